@@ -0,0 +1,169 @@
+// Package bencode encodes and decodes the bencode format used by torrent files
+// and trackers.
+package bencode
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Limits on decoded values, so that hostile input cannot exhaust the stack or
+// make a single string claim more memory than the input holds
+var (
+	MaxDepth        = 64
+	MaxStringLength = 64 << 20
+)
+
+// Whether digits is a decimal number in canonical form: "0", or digits
+// without a leading zero
+func canonicalDigits(digits string) bool {
+	if digits == "" || (digits[0] == '0' && len(digits) > 1) {
+		return false
+	}
+	for i := 0; i < len(digits); i++ {
+		if digits[i] < '0' || digits[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func DecodeString(bencodedString string) (interface{}, int, error) {
+	firstColonIdx := strings.IndexByte(bencodedString, ':')
+	if firstColonIdx <= 0 {
+		return "", 0, errors.New("invalid bencoded string: missing length")
+	}
+	lengthStr := bencodedString[:firstColonIdx]
+	if !canonicalDigits(lengthStr) {
+		return "", 0, fmt.Errorf("invalid bencoded string length %q", lengthStr)
+	}
+	length, err := strconv.Atoi(lengthStr)
+	if err != nil || length > MaxStringLength {
+		return "", 0, fmt.Errorf("invalid bencoded string length %q", lengthStr)
+	}
+	start := firstColonIdx + 1
+	if length > len(bencodedString)-start {
+		return "", 0, fmt.Errorf("bencoded string of %d bytes is truncated", length)
+	}
+	end := start + length
+	return bencodedString[start:end], end, nil
+}
+
+func DecodeInt(bencodedString string) (interface{}, int, error) {
+	if len(bencodedString) == 0 || bencodedString[0] != 'i' {
+		return nil, 0, errors.New("invalid bencoded integer: missing 'i'")
+	}
+	EIdx := strings.IndexByte(bencodedString, 'e')
+	if EIdx < 0 {
+		return nil, 0, errors.New("invalid bencoded integer: missing 'e'")
+	}
+	if EIdx == 1 {
+		return nil, 0, errors.New("invalid bencoded integer: no digits")
+	}
+	numberStr := bencodedString[1:EIdx]
+	// Only one spelling of each number is valid, so "-0", "03" and "+5" are not
+	if !canonicalDigits(strings.TrimPrefix(numberStr, "-")) || numberStr == "-0" {
+		return nil, 0, fmt.Errorf("invalid bencoded integer %q", numberStr)
+	}
+	number, err := strconv.Atoi(numberStr)
+	if err != nil {
+		return nil, 0, err
+	}
+	return number, EIdx + 1, nil
+}
+
+func DecodeList(bencodedString string) (interface{}, int, error) {
+	return decodeList(bencodedString, 0)
+}
+
+func decodeList(bencodedString string, depth int) (interface{}, int, error) {
+	retList := make([]interface{}, 0)
+	index := 1
+	for index < len(bencodedString) {
+		if bencodedString[index] == 'e' {
+			return retList, index + 1, nil
+		}
+		decoded, offset, err := decode(bencodedString[index:], depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		retList = append(retList, decoded)
+		index += offset
+	}
+	return nil, 0, errors.New("invalid bencoded list: missing 'e'")
+}
+
+func DecodeDictionary(bencodedString string) (interface{}, int, error) {
+	return decodeDictionary(bencodedString, 0)
+}
+
+func decodeDictionary(bencodedString string, depth int) (interface{}, int, error) {
+	dict := make(map[string]interface{})
+	index := 1
+	previous := ""
+	for index < len(bencodedString) {
+		if bencodedString[index] == 'e' {
+			return dict, index + 1, nil
+		}
+		key, keyLen, err := DecodeString(bencodedString[index:])
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid bencoded dictionary key: %v", err)
+		}
+		// Keys are sorted and unique, so every dictionary encodes one way
+		if len(dict) > 0 && key.(string) <= previous {
+			return nil, 0, fmt.Errorf("bencoded dictionary key %q is out of order", key)
+		}
+		previous = key.(string)
+		value, valueLen, err := decode(bencodedString[index+keyLen:], depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		dict[key.(string)] = value
+		index += keyLen + valueLen
+	}
+	return nil, 0, errors.New("invalid bencoded dictionary: missing 'e'")
+}
+
+func Decode(bencodedString string) (interface{}, int, error) {
+	return decode(bencodedString, 0)
+}
+
+func decode(bencodedString string, depth int) (interface{}, int, error) {
+	if len(bencodedString) == 0 {
+		return nil, 0, errors.New("empty bencoded string")
+	}
+	if depth > MaxDepth {
+		return nil, 0, fmt.Errorf("bencoded value nested deeper than %d levels", MaxDepth)
+	}
+	switch bencodedString[0] {
+	case 'i':
+		return DecodeInt(bencodedString)
+	case 'l':
+		return decodeList(bencodedString, depth)
+	case 'd':
+		return decodeDictionary(bencodedString, depth)
+	default:
+		if bencodedString[0] >= '0' && bencodedString[0] <= '9' {
+			return DecodeString(bencodedString)
+		}
+		return nil, 0, errors.New("invalid bencoded string")
+	}
+}
+
+func DecodeResponse(body io.Reader) (map[string]interface{}, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	decoded, _, err := Decode(string(data))
+	if err != nil {
+		return nil, err
+	}
+	if dict, ok := decoded.(map[string]interface{}); ok {
+		return dict, nil
+	}
+	return nil, fmt.Errorf("decoded response is not a dictionary")
+}
@@ -0,0 +1,98 @@
+package bencode
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	for _, c := range []struct {
+		input string
+		want  interface{}
+	}{
+		{"5:hello", "hello"},
+		{"0:", ""},
+		{"i52e", 52},
+		{"i-52e", -52},
+		{"l5:helloi52ee", []interface{}{"hello", 52}},
+		{"le", []interface{}{}},
+		{"d3:foo3:bar5:helloi52ee", map[string]interface{}{"foo": "bar", "hello": 52}},
+		{"d4:listl1:aee", map[string]interface{}{"list": []interface{}{"a"}}},
+	} {
+		got, n, err := Decode(c.input)
+		if err != nil {
+			t.Errorf("Decode(%q): %v", c.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) || n != len(c.input) {
+			t.Errorf("Decode(%q) = %#v, %d, want %#v, %d", c.input, got, n, c.want, len(c.input))
+		}
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	for _, input := range []string{
+		"", "e", "i", "ie", "i52", "iabce", "5:abc", "-1:a", "1a:b", ":", "l", "li1e", "d", "d1:a", "di1ei2ee", "x",
+		"i-0e", "i03e", "i+5e", "i-e", "i--1e", "03:abc", "00:", "+3:abc",
+		"d1:bi1e1:ai2ee", "d1:ai1e1:ai2ee",
+		strings.Repeat("l", MaxDepth+2) + strings.Repeat("e", MaxDepth+2),
+	} {
+		if _, _, err := Decode(input); err == nil {
+			t.Errorf("Decode(%q) succeeded", input)
+		}
+	}
+}
+
+func TestDecodeIntMalformed(t *testing.T) {
+	for _, input := range []string{"", "e", "ie", "i", "x5e", "iee"} {
+		if _, _, err := DecodeInt(input); err == nil {
+			t.Errorf("DecodeInt(%q) succeeded", input)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	value := map[string]interface{}{"b": []interface{}{"x", 1}, "a": "hello"}
+	encoded, n, err := Encode(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "d1:a5:hello1:bl1:xi1eee"; encoded != want || n != len(want) {
+		t.Errorf("Encode = %q, %d, want %q, %d", encoded, n, want, len(want))
+	}
+	if _, _, err := Encode(1.5); err == nil {
+		t.Error("Encode accepted a float")
+	}
+}
+
+// Only canonical input decodes, so whatever decodes encodes back to the bytes
+// it was decoded from
+func FuzzDecode(f *testing.F) {
+	for _, seed := range []string{"i52e", "5:hello", "l5:helloi52ee", "d3:foo3:bar5:helloi52ee", "d1:bi1e1:ai2ee", "i-0e", "i03e"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, input string) {
+		value, n, err := Decode(input)
+		if err != nil {
+			return
+		}
+		if n <= 0 || n > len(input) {
+			t.Fatalf("Decode(%q) consumed %d bytes", input, n)
+		}
+		encoded, length, err := Encode(value)
+		if err != nil {
+			t.Fatalf("Encode(%#v): %v", value, err)
+		}
+		if length != len(encoded) {
+			t.Fatalf("Encode(%#v) reported length %d for %d bytes", value, length, len(encoded))
+		}
+		if encoded != input[:n] {
+			t.Fatalf("Decode(%q) accepted non-canonical input that encodes as %q", input[:n], encoded)
+		}
+		again, _, err := Decode(encoded)
+		if err != nil || !reflect.DeepEqual(again, value) {
+			t.Fatalf("round trip of %q changed %#v to %#v (%v)", input, value, again, err)
+		}
+	})
+}
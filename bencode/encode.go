@@ -1,27 +1,28 @@
-package main
+package bencode
 
 import (
 	"errors"
 	"fmt"
 	"sort"
+	"strconv"
 )
 
 // Function to bencode the data (similar to decode but for encoding)
-func EncodeBencode(data interface{}) (string, int, error) {
+func Encode(data interface{}) (string, int, error) {
 	switch v := data.(type) {
 	case string:
-		return fmt.Sprintf("%d:%s", len(v), v), len(v) + 2, nil
+		encoded := strconv.Itoa(len(v)) + ":" + v
+		return encoded, len(encoded), nil
 	case int:
 		return fmt.Sprintf("i%de", v), len(fmt.Sprintf("i%de", v)), nil
 	case []interface{}:
 		result := "l"
 		for _, item := range v {
-			encoded, length, err := EncodeBencode(item)
+			encoded, _, err := Encode(item)
 			if err != nil {
 				return "", 0, err
 			}
 			result += encoded
-			result = result + encoded[length:]
 		}
 		return result + "e", len(result) + 1, nil
 	case map[string]interface{}:
@@ -34,11 +35,11 @@ func EncodeBencode(data interface{}) (string, int, error) {
 		sort.Strings(sortedKeys)
 		// Encode each key-value pair
 		for _, key := range sortedKeys {
-			encodedKey, _, err := EncodeBencode(key)
+			encodedKey, _, err := Encode(key)
 			if err != nil {
 				return "", 0, err
 			}
-			encodedValue, _, err := EncodeBencode(v[key])
+			encodedValue, _, err := Encode(v[key])
 			if err != nil {
 				return "", 0, err
 			}
@@ -0,0 +1,44 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/metainfo"
+	"github.com/codecrafters-io/bittorrent-starter-go/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/tracker"
+)
+
+// Fetch the metainfo behind a magnet link from the peers its trackers know
+// about. The first tracker becomes the torrent's announce URL.
+func (s *Session) ResolveMagnet(ctx context.Context, uri string) (*metainfo.Metainfo, error) {
+	magnet, err := metainfo.ParseMagnet(uri)
+	if err != nil {
+		return nil, err
+	}
+	if len(magnet.Trackers) == 0 {
+		return nil, errors.New("magnet link names no trackers")
+	}
+	lastErr := errors.New("no peers")
+	for _, trackerURL := range magnet.Trackers {
+		// The size is unknown until the metadata arrives; any non-zero left
+		// marks us as a leecher
+		peers, err := tracker.Announce(ctx, trackerURL, tracker.Request{InfoHash: magnet.InfoHash, PeerID: s.PeerID, Port: s.Port(), Left: 1})
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, address := range peers {
+			info, err := peer.FetchMetadata(ctx, address, magnet.InfoHash, s.config.OutboundEncryption)
+			if err == nil {
+				return metainfo.FromInfo(magnet.Trackers[0], info)
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = fmt.Errorf("%s: %v", address, err)
+		}
+	}
+	return nil, fmt.Errorf("could not fetch metadata: %v", lastErr)
+}
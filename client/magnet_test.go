@@ -0,0 +1,83 @@
+package client
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/mse"
+	"github.com/codecrafters-io/bittorrent-starter-go/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/testutil"
+)
+
+// Small pieces make for an info dictionary spanning two metadata pieces
+func magnetTorrent() *testutil.Torrent {
+	return testutil.NewTorrent("magnet.bin", 1<<10, 1000<<10)
+}
+
+func TestFetchMetadataAcrossPieces(t *testing.T) {
+	peer.Transports = []string{"tcp"}
+	tor := magnetTorrent()
+	if pieces := (len(tor.Metadata()) + peer.MetadataPieceSize - 1) / peer.MetadataPieceSize; pieces < 2 {
+		t.Fatalf("metadata fits in %d piece", pieces)
+	}
+	seeder := startPeer(t, tor, testutil.Behavior{ServeMetadata: true})
+	want := metainfoFor(t, tor)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	info, err := peer.FetchMetadata(ctx, seeder.Addr(), want.InfoHash, mse.EncryptionDisabled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(info, want.Info) {
+		t.Error("fetched info dictionary differs from the torrent's")
+	}
+}
+
+func TestFetchMetadataRejectsMismatchedHash(t *testing.T) {
+	peer.Transports = []string{"tcp"}
+	tor := magnetTorrent()
+	corrupt := startPeer(t, tor, testutil.Behavior{ServeMetadata: true, CorruptMetadata: true})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := peer.FetchMetadata(ctx, corrupt.Addr(), metainfoFor(t, tor).InfoHash, mse.EncryptionDisabled); err == nil || !strings.Contains(err.Error(), "does not match the info hash") {
+		t.Errorf("error %v, want a hash mismatch", err)
+	}
+}
+
+func TestResolveMagnetSkipsCorruptMetadata(t *testing.T) {
+	peer.Transports = []string{"tcp"}
+	tor := magnetTorrent()
+	corrupt := startPeer(t, tor, testutil.Behavior{ServeMetadata: true, CorruptMetadata: true})
+	noMetadata := startPeer(t, tor, testutil.Behavior{})
+	seeder := startPeer(t, tor, testutil.Behavior{ServeMetadata: true})
+	tracker := testutil.NewTracker(corrupt.Addr(), noMetadata.Addr(), seeder.Addr())
+	defer tracker.Close()
+	session, err := NewSession(SessionConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	info, err := session.ResolveMagnet(ctx, tor.Magnet(tracker.AnnounceURL()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := tor.Metainfo(tracker.AnnounceURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.InfoHash != want.InfoHash || info.Announce != want.Announce || info.Length != want.Length {
+		t.Errorf("resolved %s (%d bytes, announce %s), want %s (%d bytes, announce %s)", info.InfoHash, info.Length, info.Announce, want.InfoHash, want.Length, want.Announce)
+	}
+
+	// Without an honest peer the hash mismatch is what gets reported
+	tracker.SetPeers(corrupt.Addr())
+	if _, err := session.ResolveMagnet(ctx, tor.Magnet(tracker.AnnounceURL())); err == nil || !strings.Contains(err.Error(), "does not match the info hash") {
+		t.Errorf("error %v, want a hash mismatch", err)
+	}
+}
@@ -0,0 +1,293 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/metainfo"
+	"github.com/codecrafters-io/bittorrent-starter-go/mse"
+	"github.com/codecrafters-io/bittorrent-starter-go/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/ratelimit"
+	"github.com/codecrafters-io/bittorrent-starter-go/storage"
+)
+
+const BlockSize = 16 * 1024
+
+var ResumeSaveInterval = 5 * time.Second
+
+var ErrHashCheck = errors.New("failed hash check")
+
+// Default read-ahead of a streaming reader in sequential mode, in bytes
+var StreamWindow = 8 << 20
+
+// Fetch the missing blocks of one piece, keeping several requests in flight
+// and writing each block to storage as it arrives, and verify the piece hash
+// once all blocks are in
+func FetchPiece(conn *peer.Conn, store storage.Storage, info *metainfo.Metainfo, index int, progress *Progress) error {
+	pieceSize := info.PieceSize(index)
+	next := 0
+	var storeErr error
+	_, err := conn.RequestBlocks(func(int) (peer.BlockRequest, bool) {
+		for next < BlockCount(pieceSize) && progress.HasBlock(index, next) {
+			next++
+		}
+		if next == BlockCount(pieceSize) {
+			return peer.BlockRequest{}, false
+		}
+		next++
+		return blockRequest(index, next-1, pieceSize), true
+	}, func(request peer.BlockRequest, data []byte) error {
+		if _, storeErr = store.WriteAt(data, index, request.Begin); storeErr != nil {
+			return storeErr
+		}
+		progress.SetBlock(info, index, request.Begin/BlockSize)
+		return nil
+	})
+	if storeErr != nil {
+		return fmt.Errorf("failed to store block: %v", storeErr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read block: %v", err)
+	}
+	ok, err := VerifyPiece(store, info, index)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		progress.ResetPiece(index)
+		return fmt.Errorf("piece %d %w", index, ErrHashCheck)
+	}
+	progress.SetPiece(index)
+	return nil
+}
+
+func blockRequest(index int, block int, pieceSize int) peer.BlockRequest {
+	begin := block * BlockSize
+	return peer.BlockRequest{Piece: index, Begin: begin, Length: min(BlockSize, pieceSize-begin)}
+}
+
+// Hash a piece as stored and compare it with the metainfo
+func VerifyPiece(store storage.Storage, info *metainfo.Metainfo, index int) (bool, error) {
+	data := make([]byte, info.PieceSize(index))
+	if _, err := store.ReadAt(data, index, 0); err != nil {
+		return false, fmt.Errorf("failed to read piece %d: %v", index, err)
+	}
+	hash := sha1.Sum(data)
+	return bytes.Equal(hash[:], info.PieceHash(index)), nil
+}
+
+// Number of peers blocks of a single piece are requested from in parallel
+var PiecePeers = 4
+
+// A peer that served blocks of a piece
+type PieceSource struct {
+	Address string
+	Client  string
+	Blocks  int
+}
+
+// Shared state of a piece fetched from several peers at once
+type pieceFetch struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	data     []byte
+	pending  []int // blocks nobody is fetching
+	inFlight int
+	sources  []PieceSource
+	idle     []string // peers that were done before serving any block
+	share    int      // blocks one peer may have requested at once
+}
+
+// Take a block to fetch. With wait set, wait while other peers hold blocks
+// that may still be handed back, and return false once there is nothing left
+// to fetch; otherwise return false as soon as no block is pending.
+func (f *pieceFetch) take(wait bool) (int, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for wait && len(f.pending) == 0 && f.inFlight > 0 {
+		f.cond.Wait()
+	}
+	if len(f.pending) == 0 {
+		return 0, false
+	}
+	block := f.pending[0]
+	f.pending = f.pending[1:]
+	f.inFlight++
+	return block, true
+}
+
+func (f *pieceFetch) finish(block int, data []byte, conn *peer.Conn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	copy(f.data[block*BlockSize:], data)
+	f.inFlight--
+	found := false
+	for i := range f.sources {
+		if f.sources[i].Address == conn.Address {
+			f.sources[i].Blocks++
+			found = true
+		}
+	}
+	if !found {
+		f.sources = append(f.sources, PieceSource{Address: conn.Address, Client: conn.Client, Blocks: 1})
+	}
+	f.cond.Broadcast()
+}
+
+// Record a peer that ran out of blocks to fetch
+func (f *pieceFetch) done(address string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !slices.ContainsFunc(f.sources, func(source PieceSource) bool { return source.Address == address }) {
+		f.idle = append(f.idle, address)
+	}
+}
+
+func (f *pieceFetch) giveBack(block int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pending = append(f.pending, block)
+	f.inFlight--
+	f.cond.Broadcast()
+}
+
+// Download a single piece, spreading its blocks over up to PiecePeers peers
+// that have it. Peers that lack the piece, choke us or time out are replaced
+// by the next address in the list. The piece is verified before returning;
+// when the hash check fails, the peers that served it are dropped and the
+// piece is fetched again from the addresses not tried yet and the peers that
+// served none of it. Once those run out, peers that served a bad piece together with others get a chance to
+// serve it on their own, as only some of them may have sent bad blocks.
+func FetchPieceFromPeers(ctx context.Context, info *metainfo.Metainfo, addresses []string, index int, limits *ratelimit.TorrentLimits, encryption mse.EncryptionPolicy) ([]byte, []PieceSource, error) {
+	if len(addresses) == 0 {
+		return nil, nil, fmt.Errorf("no peer could provide piece %d, last error: no peers", index)
+	}
+	queue := addressQueue(addresses...)
+	var suspects []string
+	for {
+		data, sources, idle, err := fetchPieceOnce(ctx, info, queue, index, limits, encryption)
+		if err == nil || !errors.Is(err, ErrHashCheck) {
+			return data, sources, err
+		}
+		for _, source := range sources {
+			sessionLogger.Warn("piece failed hash check", "peer", source.Address, "client", source.Client, "piece", index, "blocks", source.Blocks, "sources", len(sources))
+			if len(sources) > 1 {
+				suspects = append(suspects, source.Address)
+			}
+		}
+		for address := range queue {
+			idle = append(idle, address)
+		}
+		queue = addressQueue(idle...)
+		if len(queue) == 0 {
+			if len(suspects) == 0 {
+				return nil, sources, err
+			}
+			queue, suspects = addressQueue(suspects[0]), suspects[1:]
+		}
+	}
+}
+
+func addressQueue(addresses ...string) chan string {
+	queue := make(chan string, len(addresses))
+	for _, address := range addresses {
+		queue <- address
+	}
+	close(queue)
+	return queue
+}
+
+// One attempt at a piece, taking peers from queue until every block is in.
+// When the hash check fails, the peers that served nothing are returned too.
+func fetchPieceOnce(ctx context.Context, info *metainfo.Metainfo, queue chan string, index int, limits *ratelimit.TorrentLimits, encryption mse.EncryptionPolicy) ([]byte, []PieceSource, []string, error) {
+	pieceSize := info.PieceSize(index)
+	fetch := &pieceFetch{data: make([]byte, pieceSize)}
+	fetch.cond = sync.NewCond(&fetch.mu)
+	for block := 0; block < BlockCount(pieceSize); block++ {
+		fetch.pending = append(fetch.pending, block)
+	}
+
+	var wg sync.WaitGroup
+	var errMu sync.Mutex
+	var lastErr error
+	workers := min(PiecePeers, len(queue))
+	// Leave blocks for the other peers rather than pipeline the whole piece
+	// from whichever connects first
+	fetch.share = (BlockCount(pieceSize) + max(workers, 1) - 1) / max(workers, 1)
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for address := range queue {
+				if ctx.Err() != nil {
+					return
+				}
+				err := fetchFromPeer(ctx, fetch, info, address, index, limits, encryption)
+				if err == nil {
+					fetch.done(address)
+					return
+				}
+				errMu.Lock()
+				lastErr = fmt.Errorf("%s: %v", address, err)
+				errMu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return nil, nil, nil, ctx.Err()
+	}
+	if len(fetch.pending) > 0 {
+		if lastErr == nil {
+			lastErr = errors.New("no peers")
+		}
+		return nil, nil, nil, fmt.Errorf("no peer could provide piece %d, last error: %v", index, lastErr)
+	}
+	hash := sha1.Sum(fetch.data)
+	if !bytes.Equal(hash[:], info.PieceHash(index)) {
+		return nil, fetch.sources, fetch.idle, fmt.Errorf("piece %d %w", index, ErrHashCheck)
+	}
+	return fetch.data, fetch.sources, nil, nil
+}
+
+// Fetch blocks from one peer until none are left. A nil error means the
+// peer is done; otherwise the caller moves on to another peer.
+func fetchFromPeer(ctx context.Context, fetch *pieceFetch, info *metainfo.Metainfo, address string, index int, limits *ratelimit.TorrentLimits, encryption mse.EncryptionPolicy) error {
+	conn, err := peer.ConnectForPiece(ctx, address, info, limits, encryption, index)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// Abort the blocks in flight when ctx is done
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	pieceSize := info.PieceSize(index)
+	outstanding, err := conn.RequestBlocks(func(outstanding int) (peer.BlockRequest, bool) {
+		if outstanding >= fetch.share {
+			return peer.BlockRequest{}, false
+		}
+		// Only wait on other peers once this one has nothing in flight
+		block, ok := fetch.take(outstanding == 0)
+		if !ok {
+			return peer.BlockRequest{}, false
+		}
+		return blockRequest(index, block, pieceSize), true
+	}, func(request peer.BlockRequest, data []byte) error {
+		fetch.finish(request.Begin/BlockSize, data, conn)
+		return nil
+	})
+	for _, request := range outstanding {
+		fetch.giveBack(request.Begin / BlockSize)
+	}
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,111 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/mse"
+	"github.com/codecrafters-io/bittorrent-starter-go/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/ratelimit"
+	"github.com/codecrafters-io/bittorrent-starter-go/testutil"
+)
+
+func startPeer(t *testing.T, tor *testutil.Torrent, behavior testutil.Behavior) *testutil.Peer {
+	t.Helper()
+	p, err := testutil.NewPeer(tor, behavior)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func TestFetchPieceSkipsPeersWithoutThePiece(t *testing.T) {
+	peer.Transports = []string{"tcp"}
+	tor := testutil.NewTorrent("sample.bin", 64<<10, 200<<10)
+	info, err := tor.Metainfo("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Would hold a worker for the whole unchoke timeout if its bitfield were ignored
+	lacking := startPeer(t, tor, testutil.Behavior{Missing: []int{1}, NoUnchoke: true})
+	seeder := startPeer(t, tor, testutil.Behavior{})
+
+	previous := PiecePeers
+	PiecePeers = 1
+	defer func() { PiecePeers = previous }()
+	start := time.Now()
+	data, sources, err := FetchPieceFromPeers(context.Background(), info, []string{lacking.Addr(), seeder.Addr()}, 1, ratelimit.NewTorrentLimits(), mse.EncryptionDisabled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("fetch took %v, want the lacking peer dropped at once", elapsed)
+	}
+	if !bytes.Equal(data, tor.Piece(1)) {
+		t.Error("piece data does not match")
+	}
+	if len(sources) != 1 || sources[0].Address != seeder.Addr() {
+		t.Errorf("sources = %+v, want only %s", sources, seeder.Addr())
+	}
+}
+
+func TestFetchPieceRetriesAfterHashFailure(t *testing.T) {
+	peer.Transports = []string{"tcp"}
+	tor := testutil.NewTorrent("sample.bin", 64<<10, 200<<10)
+	info, err := tor.Metainfo("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := startPeer(t, tor, testutil.Behavior{CorruptPieces: []int{0}})
+	seeder := startPeer(t, tor, testutil.Behavior{})
+
+	previous := PiecePeers
+	PiecePeers = 1
+	defer func() { PiecePeers = previous }()
+	data, sources, err := FetchPieceFromPeers(context.Background(), info, []string{corrupt.Addr(), seeder.Addr()}, 0, ratelimit.NewTorrentLimits(), mse.EncryptionDisabled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, tor.Piece(0)) {
+		t.Error("piece data does not match")
+	}
+	if len(sources) != 1 || sources[0].Address != seeder.Addr() {
+		t.Errorf("sources = %+v, want only %s", sources, seeder.Addr())
+	}
+
+	// With nobody left to ask, the hash failure is reported with its sources
+	_, sources, err = FetchPieceFromPeers(context.Background(), info, []string{corrupt.Addr()}, 0, ratelimit.NewTorrentLimits(), mse.EncryptionDisabled)
+	if !errors.Is(err, ErrHashCheck) {
+		t.Fatalf("err = %v, want ErrHashCheck", err)
+	}
+	if len(sources) != 1 || sources[0].Address != corrupt.Addr() {
+		t.Errorf("sources = %+v, want only %s", sources, corrupt.Addr())
+	}
+}
+
+func TestFetchPieceTellsCorruptPeersFromHonestOnes(t *testing.T) {
+	peer.Transports = []string{"tcp"}
+	tor := testutil.NewTorrent("sample.bin", 64<<10, 200<<10)
+	info, err := tor.Metainfo("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both serve blocks of the first attempt, which fails its hash check
+	corrupt := startPeer(t, tor, testutil.Behavior{CorruptPieces: []int{2}, Delay: 5 * time.Millisecond})
+	seeder := startPeer(t, tor, testutil.Behavior{Delay: 5 * time.Millisecond})
+
+	data, sources, err := FetchPieceFromPeers(context.Background(), info, []string{corrupt.Addr(), seeder.Addr()}, 2, ratelimit.NewTorrentLimits(), mse.EncryptionDisabled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, tor.Piece(2)) {
+		t.Error("piece data does not match")
+	}
+	if len(sources) != 1 || sources[0].Address != seeder.Addr() {
+		t.Errorf("sources = %+v, want only %s", sources, seeder.Addr())
+	}
+}
@@ -0,0 +1,316 @@
+package client
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/metainfo"
+	"github.com/codecrafters-io/bittorrent-starter-go/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/storage"
+)
+
+type Priority int
+
+const (
+	PrioritySkip Priority = iota
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+)
+
+func ParsePriority(value string) (Priority, error) {
+	switch strings.ToLower(value) {
+	case "skip", "off", "0":
+		return PrioritySkip, nil
+	case "low", "1":
+		return PriorityLow, nil
+	case "normal", "2":
+		return PriorityNormal, nil
+	case "high", "3":
+		return PriorityHigh, nil
+	}
+	return PrioritySkip, fmt.Errorf("unknown priority: %s", value)
+}
+
+func (p Priority) String() string {
+	switch p {
+	case PrioritySkip:
+		return "skip"
+	case PriorityLow:
+		return "low"
+	case PriorityHigh:
+		return "high"
+	}
+	return "normal"
+}
+
+func (p Priority) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *Priority) UnmarshalText(text []byte) error {
+	priority, err := ParsePriority(string(text))
+	*p = priority
+	return err
+}
+
+// FilePriorities holds the download priority of every file in a torrent. It
+// may be changed while a download runs; the picker reads it on every pick.
+type FilePriorities struct {
+	info       *metainfo.Metainfo
+	mu         sync.RWMutex
+	priorities []Priority
+	onChange   []func(file int, priority Priority) error
+}
+
+func NewFilePriorities(info *metainfo.Metainfo) *FilePriorities {
+	priorities := make([]Priority, len(info.Files))
+	for i := range priorities {
+		priorities[i] = PriorityNormal
+	}
+	return &FilePriorities{info: info, priorities: priorities}
+}
+
+// Register a callback run whenever a file's priority changes. A callback that
+// fails vetoes the change.
+func (fp *FilePriorities) OnChange(callback func(file int, priority Priority) error) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	fp.onChange = append(fp.onChange, callback)
+}
+
+// Change a file's priority. When a callback fails the previous priority is
+// restored and the error returned.
+func (fp *FilePriorities) Set(file int, priority Priority) error {
+	fp.mu.Lock()
+	if file < 0 || file >= len(fp.priorities) || fp.priorities[file] == priority {
+		fp.mu.Unlock()
+		return nil
+	}
+	previous := fp.priorities[file]
+	fp.priorities[file] = priority
+	callbacks := fp.onChange
+	fp.mu.Unlock()
+	for _, callback := range callbacks {
+		if err := callback(file, priority); err != nil {
+			fp.mu.Lock()
+			if fp.priorities[file] == priority {
+				fp.priorities[file] = previous
+			}
+			fp.mu.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+func (fp *FilePriorities) Get(file int) Priority {
+	fp.mu.RLock()
+	defer fp.mu.RUnlock()
+	return fp.priorities[file]
+}
+
+// A piece is as important as the most important file it overlaps
+func (fp *FilePriorities) PiecePriority(piece int) Priority {
+	fp.mu.RLock()
+	defer fp.mu.RUnlock()
+	offset := int64(piece) * int64(fp.info.PieceLength)
+	priority := PrioritySkip
+	for _, span := range storage.MapSpan(fp.info.Files, offset, fp.info.PieceSize(piece)) {
+		priority = max(priority, fp.priorities[span.File])
+	}
+	return priority
+}
+
+func matchFile(pattern string, filePath string) bool {
+	slashed := filepath.ToSlash(filePath)
+	if ok, _ := path.Match(pattern, slashed); ok {
+		return true
+	}
+	ok, _ := path.Match(pattern, path.Base(slashed))
+	return ok
+}
+
+// Apply --only and --exclude globs and --priority=<glob>:<level> rules, in that order
+func ApplyFileSelection(fp *FilePriorities, only []string, exclude []string, rules []string) error {
+	for _, pattern := range append(append([]string{}, only...), exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+	for i, file := range fp.info.Files {
+		selected := len(only) == 0
+		for _, pattern := range only {
+			selected = selected || matchFile(pattern, file.Path)
+		}
+		for _, pattern := range exclude {
+			selected = selected && !matchFile(pattern, file.Path)
+		}
+		if !selected {
+			if err := fp.Set(i, PrioritySkip); err != nil {
+				return err
+			}
+		}
+	}
+	for _, rule := range rules {
+		separator := strings.LastIndex(rule, ":")
+		if separator < 0 {
+			return fmt.Errorf("priority rule must look like <glob>:<level>: %s", rule)
+		}
+		priority, err := ParsePriority(rule[separator+1:])
+		if err != nil {
+			return err
+		}
+		pattern := rule[:separator]
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+		for i, file := range fp.info.Files {
+			if !matchFile(pattern, file.Path) {
+				continue
+			}
+			if err := fp.Set(i, priority); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// PiecePicker chooses the next piece to request. Pieces with a deadline come
+// first, earliest deadline first; deadlines are set for pieces a streaming
+// reader is blocked on and for a sliding window ahead of every read cursor,
+// and last until the piece is verified. After that, the most important
+// missing piece is picked, or in sequential mode simply the first wanted one.
+// Pieces only covering skipped files are never picked.
+type PiecePicker struct {
+	info       *metainfo.Metainfo
+	priorities *FilePriorities
+	progress   *Progress
+
+	mu         sync.Mutex
+	sequential bool
+	window     int
+	cursors    map[int]int
+	nextCursor int
+	urgent     map[int]time.Time
+}
+
+// Interval between the deadlines of consecutive pieces in a cursor's window
+var StreamPieceInterval = time.Second
+
+func NewPiecePicker(info *metainfo.Metainfo, priorities *FilePriorities, progress *Progress) *PiecePicker {
+	return &PiecePicker{
+		info:       info,
+		priorities: priorities,
+		progress:   progress,
+		window:     1,
+		cursors:    make(map[int]int),
+		urgent:     make(map[int]time.Time),
+	}
+}
+
+// Switch to sequential order with a read-ahead window of the given number of bytes
+func (p *PiecePicker) SetSequential(sequential bool, windowBytes int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sequential = sequential
+	p.window = max(1, (windowBytes+p.info.PieceLength-1)/p.info.PieceLength)
+}
+
+// Register a read cursor and return its id
+func (p *PiecePicker) AddCursor(piece int) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nextCursor++
+	p.cursors[p.nextCursor] = piece
+	return p.nextCursor
+}
+
+func (p *PiecePicker) MoveCursor(id int, piece int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.cursors[id]; ok {
+		p.cursors[id] = piece
+	}
+}
+
+func (p *PiecePicker) RemoveCursor(id int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.cursors, id)
+}
+
+// Ask for a piece to be fetched by the given time, moving it ahead of the queue
+func (p *PiecePicker) SetDeadline(piece int, deadline time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if current, ok := p.urgent[piece]; !ok || deadline.Before(current) {
+		p.urgent[piece] = deadline
+	}
+}
+
+func (p *PiecePicker) Wanted(piece int) bool {
+	return p.priorities.PiecePriority(piece) != PrioritySkip
+}
+
+// Return the next piece to download, or -1 when every wanted piece is present.
+// Pieces set in have are passed over; callers also set pieces that are in
+// flight or that the peer lacks, so have is not necessarily what is verified.
+func (p *PiecePicker) Next(have peer.Bitfield) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	best, bestDeadline := -1, time.Time{}
+	consider := func(piece int, deadline time.Time) {
+		if piece < 0 || piece >= p.info.PieceCount() || have.Has(piece) {
+			return
+		}
+		if best < 0 || deadline.Before(bestDeadline) {
+			best, bestDeadline = piece, deadline
+		}
+	}
+	for piece, deadline := range p.urgent {
+		if p.progress.HasPiece(piece) {
+			delete(p.urgent, piece)
+			continue
+		}
+		if p.Wanted(piece) {
+			consider(piece, deadline)
+		}
+	}
+	for _, cursor := range p.cursors {
+		for k := 0; k < p.window; k++ {
+			if p.Wanted(cursor + k) {
+				consider(cursor+k, now.Add(time.Duration(k)*StreamPieceInterval))
+			}
+		}
+	}
+	if best >= 0 {
+		return best
+	}
+
+	bestPriority := PrioritySkip
+	for piece := 0; piece < p.info.PieceCount(); piece++ {
+		if have.Has(piece) {
+			continue
+		}
+		priority := p.priorities.PiecePriority(piece)
+		if p.sequential && priority != PrioritySkip {
+			return piece
+		}
+		if priority > bestPriority {
+			best, bestPriority = piece, priority
+		}
+	}
+	return best
+}
+
+func (p *PiecePicker) Done(have peer.Bitfield) bool {
+	return p.Next(have) < 0
+}
@@ -0,0 +1,96 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/metainfo"
+	"github.com/codecrafters-io/bittorrent-starter-go/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/testutil"
+)
+
+// A picker over a torrent of eight 16 KiB pieces split into two files of four
+func newTestPicker(t *testing.T) (*PiecePicker, *Progress, *metainfo.Metainfo) {
+	t.Helper()
+	tor := testutil.NewTorrent("sample", 16<<10, 64<<10, 64<<10)
+	info, err := tor.Metainfo("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	progress := NewProgress(info)
+	return NewPiecePicker(info, NewFilePriorities(info), progress), progress, info
+}
+
+func TestPickerPrefersEarliestDeadline(t *testing.T) {
+	picker, progress, info := newTestPicker(t)
+	now := time.Now()
+	picker.SetDeadline(6, now.Add(2*time.Second))
+	picker.SetDeadline(4, now.Add(time.Second))
+	picker.SetDeadline(6, now.Add(time.Hour)) // a later deadline does not postpone
+	none := peer.NewBitfield(info.PieceCount())
+
+	if piece := picker.Next(none); piece != 4 {
+		t.Fatalf("picked %d, want the earliest deadline 4", piece)
+	}
+	progress.SetPiece(4)
+	if piece := picker.Next(progress.Snapshot()); piece != 6 {
+		t.Fatalf("picked %d after 4 was verified, want 6", piece)
+	}
+	progress.SetPiece(6)
+	if piece := picker.Next(progress.Snapshot()); piece != 0 {
+		t.Fatalf("picked %d with no deadlines left, want 0", piece)
+	}
+}
+
+func TestPickerKeepsDeadlineOfMaskedPiece(t *testing.T) {
+	picker, progress, info := newTestPicker(t)
+	picker.SetDeadline(5, time.Now())
+
+	// A peer lacking piece 5, or asking while it is in flight, masks it
+	mask := progress.Snapshot()
+	mask.Set(5)
+	if piece := picker.Next(mask); piece == 5 {
+		t.Fatal("picked a masked piece")
+	}
+	if piece := picker.Next(peer.NewBitfield(info.PieceCount())); piece != 5 {
+		t.Fatalf("picked %d for the next peer, want the urgent piece 5", piece)
+	}
+}
+
+func TestPickerReadsAheadOfCursors(t *testing.T) {
+	picker, progress, _ := newTestPicker(t)
+	picker.SetSequential(true, 32<<10)
+	cursor := picker.AddCursor(3)
+
+	have := progress.Snapshot()
+	if piece := picker.Next(have); piece != 3 {
+		t.Fatalf("picked %d, want the cursor's piece 3", piece)
+	}
+	have.Set(3)
+	if piece := picker.Next(have); piece != 4 {
+		t.Fatalf("picked %d, want 4 within the read-ahead window", piece)
+	}
+	have.Set(4)
+	if piece := picker.Next(have); piece != 0 {
+		t.Fatalf("picked %d past the window, want sequential order from 0", piece)
+	}
+	picker.RemoveCursor(cursor)
+}
+
+func TestPickerSkipsUnwantedFiles(t *testing.T) {
+	picker, progress, info := newTestPicker(t)
+	picker.priorities.Set(0, PrioritySkip)
+	picker.priorities.Set(1, PriorityHigh)
+	picker.SetDeadline(1, time.Now()) // a deadline does not pull in skipped data
+
+	if piece := picker.Next(progress.Snapshot()); piece != 4 {
+		t.Fatalf("picked %d, want 4, the first piece of the wanted file", piece)
+	}
+	for piece := 4; piece < info.PieceCount(); piece++ {
+		progress.SetPiece(piece)
+	}
+	picker.priorities.Set(1, PriorityNormal)
+	if !picker.Done(progress.Snapshot()) {
+		t.Errorf("picker not done with every wanted piece verified, next %d", picker.Next(progress.Snapshot()))
+	}
+}
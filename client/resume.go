@@ -0,0 +1,251 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/metainfo"
+	"github.com/codecrafters-io/bittorrent-starter-go/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/storage"
+)
+
+// Directory for fast-resume files; when empty they are stored next to the output
+var StateDir = ""
+
+// Progress records which pieces are verified and which blocks of unfinished
+// pieces have already been written to storage. It is safe for concurrent use.
+type Progress struct {
+	mu      sync.Mutex
+	Have    peer.Bitfield
+	Blocks  map[int]peer.Bitfield
+	changed chan struct{} // closed and replaced whenever a piece is verified
+}
+
+func NewProgress(info *metainfo.Metainfo) *Progress {
+	return &Progress{
+		Have:    peer.NewBitfield(info.PieceCount()),
+		Blocks:  make(map[int]peer.Bitfield),
+		changed: make(chan struct{}),
+	}
+}
+
+func BlockCount(pieceSize int) int {
+	return (pieceSize + BlockSize - 1) / BlockSize
+}
+
+func (p *Progress) Complete(info *metainfo.Metainfo) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.Have.Count() == info.PieceCount()
+}
+
+func (p *Progress) HasPiece(piece int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.Have.Has(piece)
+}
+
+// Copy of the verified-piece bitfield
+func (p *Progress) Snapshot() peer.Bitfield {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append(peer.Bitfield(nil), p.Have...)
+}
+
+// Block until the piece is verified or done is closed
+func (p *Progress) WaitPiece(piece int, done <-chan struct{}) error {
+	for {
+		p.mu.Lock()
+		have, changed := p.Have.Has(piece), p.changed
+		p.mu.Unlock()
+		if have {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-done:
+			return errors.New("stopped waiting for piece")
+		}
+	}
+}
+
+func (p *Progress) HasBlock(piece int, block int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.Have.Has(piece) || p.Blocks[piece].Has(block)
+}
+
+func (p *Progress) SetBlock(info *metainfo.Metainfo, piece int, block int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	blocks, ok := p.Blocks[piece]
+	if !ok {
+		blocks = peer.NewBitfield(BlockCount(info.PieceSize(piece)))
+		p.Blocks[piece] = blocks
+	}
+	blocks.Set(block)
+}
+
+func (p *Progress) SetPiece(piece int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Have.Set(piece)
+	delete(p.Blocks, piece)
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+func (p *Progress) ResetPiece(piece int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Have.Clear(piece)
+	delete(p.Blocks, piece)
+}
+
+func ResumePath(info *metainfo.Metainfo, outputPath string) string {
+	if StateDir != "" {
+		return filepath.Join(StateDir, info.InfoHash+".resume")
+	}
+	return outputPath + ".resume"
+}
+
+// Write the progress as a bencoded fast-resume file, together with the size and
+// modification time of every file so later runs can tell whether they changed
+func SaveProgress(path string, info *metainfo.Metainfo, paths []string, progress *Progress) error {
+	files := make([]interface{}, len(paths))
+	for i, filePath := range paths {
+		entry := map[string]interface{}{"length": -1, "mtime": 0}
+		if stat, err := os.Stat(filePath); err == nil {
+			entry["length"] = int(stat.Size())
+			entry["mtime"] = int(stat.ModTime().UnixNano())
+		}
+		files[i] = entry
+	}
+	progress.mu.Lock()
+	partial := make(map[string]interface{}, len(progress.Blocks))
+	for piece, blocks := range progress.Blocks {
+		partial[strconv.Itoa(piece)] = string(blocks)
+	}
+	encoded, _, err := bencode.Encode(map[string]interface{}{
+		"info-hash": info.InfoHash,
+		"pieces":    string(progress.Have),
+		"partial":   partial,
+		"files":     files,
+	})
+	progress.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(encoded), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Load fast-resume data and validate it against the files on disk. Pieces that
+// touch files whose size or modification time changed are rehashed; a missing
+// resume file means starting from scratch.
+func LoadProgress(path string, info *metainfo.Metainfo, paths []string, store storage.Storage) (*Progress, error) {
+	fileData, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return NewProgress(info), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	progress, recorded, err := parseResumeData(fileData, info)
+	if err != nil {
+		// Unusable resume data: trust nothing and recheck everything on disk
+		progress = NewProgress(info)
+		for i := 0; i < info.PieceCount(); i++ {
+			progress.Have.Set(i)
+		}
+		recorded = nil
+	}
+
+	changed := make([]bool, len(paths))
+	for i, filePath := range paths {
+		changed[i] = true
+		if i >= len(recorded) {
+			continue
+		}
+		stat, err := os.Stat(filePath)
+		if err != nil {
+			// Skipped files are never created
+			changed[i] = recorded[i][0] != -1
+			continue
+		}
+		changed[i] = int(stat.Size()) != recorded[i][0] || int(stat.ModTime().UnixNano()) != recorded[i][1]
+	}
+	for piece := 0; piece < info.PieceCount(); piece++ {
+		offset := int64(piece) * int64(info.PieceLength)
+		touched := false
+		for _, span := range storage.MapSpan(info.Files, offset, info.PieceSize(piece)) {
+			touched = touched || changed[span.File]
+		}
+		if !touched {
+			continue
+		}
+		delete(progress.Blocks, piece)
+		if progress.Have.Has(piece) {
+			ok, err := VerifyPiece(store, info, piece)
+			if err != nil || !ok {
+				progress.Have.Clear(piece)
+			}
+		}
+	}
+	return progress, nil
+}
+
+func parseResumeData(fileData []byte, info *metainfo.Metainfo) (*Progress, [][2]int, error) {
+	decoded, _, err := bencode.Decode(string(fileData))
+	if err != nil {
+		return nil, nil, err
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, nil, errors.New("resume data is not a dictionary")
+	}
+	if infoHash, _ := dict["info-hash"].(string); infoHash != info.InfoHash {
+		return nil, nil, errors.New("resume data belongs to a different torrent")
+	}
+	progress := NewProgress(info)
+	pieces, _ := dict["pieces"].(string)
+	if len(pieces) != len(progress.Have) {
+		return nil, nil, errors.New("resume data has a bitfield of the wrong size")
+	}
+	copy(progress.Have, pieces)
+	if partial, ok := dict["partial"].(map[string]interface{}); ok {
+		for key, value := range partial {
+			piece, err := strconv.Atoi(key)
+			blocks, ok := value.(string)
+			if err != nil || !ok || piece < 0 || piece >= info.PieceCount() {
+				continue
+			}
+			if len(blocks) == len(peer.NewBitfield(BlockCount(info.PieceSize(piece)))) {
+				progress.Blocks[piece] = peer.Bitfield(blocks)
+			}
+		}
+	}
+	list, _ := dict["files"].([]interface{})
+	if len(list) != len(info.Files) {
+		return nil, nil, fmt.Errorf("resume data lists %d files, torrent has %d", len(list), len(info.Files))
+	}
+	recorded := make([][2]int, len(list))
+	for i, item := range list {
+		entry, _ := item.(map[string]interface{})
+		length, _ := entry["length"].(int)
+		mtime, _ := entry["mtime"].(int)
+		recorded[i] = [2]int{length, mtime}
+	}
+	return progress, recorded, nil
+}
@@ -0,0 +1,197 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/metainfo"
+	"github.com/codecrafters-io/bittorrent-starter-go/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/storage"
+	"github.com/codecrafters-io/bittorrent-starter-go/testutil"
+)
+
+// readCounter records the pieces read through it, which is how LoadProgress
+// rehashes them
+type readCounter struct {
+	storage.Storage
+	mu     sync.Mutex
+	pieces map[int]bool
+}
+
+func (s *readCounter) ReadAt(p []byte, piece int, begin int) (int, error) {
+	s.mu.Lock()
+	s.pieces[piece] = true
+	s.mu.Unlock()
+	return s.Storage.ReadAt(p, piece, begin)
+}
+
+func (s *readCounter) read() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var pieces []int
+	for piece := range s.pieces {
+		pieces = append(pieces, piece)
+	}
+	sort.Ints(pieces)
+	return pieces
+}
+
+type resumeFixture struct {
+	tor        *testutil.Torrent
+	info       *metainfo.Metainfo
+	output     string
+	paths      []string
+	resumePath string
+	saved      *Progress
+}
+
+// Two files over three pieces: piece 0 lies in the first file, piece 1 spans
+// both and piece 2 lies in the second. Pieces 0 and 1 are on disk and
+// verified; piece 2 has its first block written.
+func newResumeFixture(t *testing.T) *resumeFixture {
+	t.Helper()
+	tor := testutil.NewTorrent("sample", 32<<10, 40<<10, 50<<10)
+	info := metainfoFor(t, tor)
+	output := filepath.Join(t.TempDir(), tor.Name)
+	store := storage.NewFileStorage(info, output)
+	defer store.Close()
+	progress := NewProgress(info)
+	for piece := 0; piece < 2; piece++ {
+		if _, err := store.WriteAt(tor.Piece(piece), piece, 0); err != nil {
+			t.Fatal(err)
+		}
+		progress.SetPiece(piece)
+	}
+	if _, err := store.WriteAt(tor.Piece(2)[:BlockSize], 2, 0); err != nil {
+		t.Fatal(err)
+	}
+	progress.SetBlock(info, 2, 0)
+	f := &resumeFixture{tor: tor, info: info, output: output, paths: storage.Paths(info, output), resumePath: ResumePath(info, output), saved: progress}
+	if err := SaveProgress(f.resumePath, info, f.paths, progress); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// Load the resume data, returning the progress and the pieces rehashed
+func (f *resumeFixture) load(t *testing.T) (*Progress, []int) {
+	t.Helper()
+	store := &readCounter{Storage: storage.NewFileStorage(f.info, f.output), pieces: make(map[int]bool)}
+	defer store.Close()
+	progress, err := LoadProgress(f.resumePath, f.info, f.paths, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return progress, store.read()
+}
+
+// Give a file a modification time other than the one recorded
+func touch(t *testing.T, path string) {
+	t.Helper()
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResumeDataIsTrustedWhenFilesAreUnchanged(t *testing.T) {
+	f := newResumeFixture(t)
+	progress, rehashed := f.load(t)
+	if len(rehashed) != 0 {
+		t.Errorf("rehashed pieces %v of untouched files", rehashed)
+	}
+	if !reflect.DeepEqual(progress.Have, f.saved.Have) {
+		t.Errorf("have %08b, want %08b", progress.Have, f.saved.Have)
+	}
+	if !reflect.DeepEqual(progress.Blocks, f.saved.Blocks) {
+		t.Errorf("partial blocks %v, want %v", progress.Blocks, f.saved.Blocks)
+	}
+}
+
+func TestTouchedFileRehashesOnlyItsPieces(t *testing.T) {
+	f := newResumeFixture(t)
+	touch(t, f.paths[0])
+	progress, rehashed := f.load(t)
+	if want := []int{0, 1}; !reflect.DeepEqual(rehashed, want) {
+		t.Errorf("rehashed pieces %v, want %v", rehashed, want)
+	}
+	if !reflect.DeepEqual(progress.Have, f.saved.Have) {
+		t.Errorf("have %08b after rehashing intact pieces, want %08b", progress.Have, f.saved.Have)
+	}
+	if !progress.HasBlock(2, 0) {
+		t.Error("partial piece in the untouched file was forgotten")
+	}
+}
+
+func TestChangedFileLosesDamagedPieces(t *testing.T) {
+	f := newResumeFixture(t)
+	// Flip the last byte of piece 1, which lies in the second file
+	file, err := os.OpenFile(f.paths[1], os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := f.tor.Piece(1)[f.info.PieceLength-1]
+	_, err = file.WriteAt([]byte{^last}, int64(2*f.info.PieceLength-f.info.Files[0].Length-1))
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	touch(t, f.paths[1])
+
+	// Piece 2 was never verified, so only piece 1 is rehashed
+	progress, rehashed := f.load(t)
+	if want := []int{1}; !reflect.DeepEqual(rehashed, want) {
+		t.Errorf("rehashed pieces %v, want %v", rehashed, want)
+	}
+	if !progress.HasPiece(0) || progress.HasPiece(1) {
+		t.Errorf("have %08b, want only piece 0", progress.Have)
+	}
+	if progress.HasBlock(2, 0) {
+		t.Error("partial block kept although its file changed")
+	}
+}
+
+func TestCorruptResumeDataRechecksEverything(t *testing.T) {
+	for name, data := range map[string]func(infoHash string) string{
+		"truncated":        func(string) string { return "d6:pieces" },
+		"not a dictionary": func(string) string { return "li1ee" },
+		"other torrent":    func(string) string { return "d9:info-hash40:" + strings.Repeat("0", 40) + "e" },
+		"wrong bitfield":   func(infoHash string) string { return "d9:info-hash40:" + infoHash + "6:pieces3:abce" },
+		"no files":         func(infoHash string) string { return "d9:info-hash40:" + infoHash + "6:pieces1:\xffe" },
+	} {
+		t.Run(name, func(t *testing.T) {
+			f := newResumeFixture(t)
+			if err := os.WriteFile(f.resumePath, []byte(data(f.info.InfoHash)), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			progress, rehashed := f.load(t)
+			if want := []int{0, 1, 2}; !reflect.DeepEqual(rehashed, want) {
+				t.Errorf("rehashed pieces %v, want every piece", rehashed)
+			}
+			// Piece 2 is only partly on disk and fails the check
+			if want := (peer.Bitfield{0b11000000}); !reflect.DeepEqual(progress.Have, want) {
+				t.Errorf("have %08b, want %08b", progress.Have, want)
+			}
+			if len(progress.Blocks) != 0 {
+				t.Errorf("partial blocks %v kept from unusable resume data", progress.Blocks)
+			}
+		})
+	}
+}
+
+func TestMissingResumeDataStartsFromScratch(t *testing.T) {
+	f := newResumeFixture(t)
+	if err := os.Remove(f.resumePath); err != nil {
+		t.Fatal(err)
+	}
+	progress, rehashed := f.load(t)
+	if len(rehashed) != 0 || progress.Have.Count() != 0 {
+		t.Errorf("rehashed %v and have %08b without resume data", rehashed, progress.Have)
+	}
+}
@@ -0,0 +1,349 @@
+// Package client downloads and seeds torrents. A Session runs any number of
+// torrents side by side, sharing one listening port and rate limits.
+package client
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/metainfo"
+	"github.com/codecrafters-io/bittorrent-starter-go/mse"
+	"github.com/codecrafters-io/bittorrent-starter-go/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/ratelimit"
+	"github.com/codecrafters-io/bittorrent-starter-go/storage"
+	"github.com/codecrafters-io/bittorrent-starter-go/utp"
+)
+
+type SessionConfig struct {
+	// Address to accept peer connections on, over TCP and uTP; empty to
+	// accept none
+	ListenAddress string
+	// Limits on torrents running at once, 0 for no limit. Torrents beyond
+	// them wait in the queue in the order they were added.
+	MaxActiveDownloads int
+	MaxActiveSeeds     int
+	// Peers each torrent downloads from at once
+	MaxPeersPerTorrent int
+	// Where torrents keep their data, storage.OpenFile when nil
+	Storage storage.Backend
+	// Stream encryption of connections made to peers and accepted from
+	// them; the zero value is plaintext only
+	OutboundEncryption mse.EncryptionPolicy
+	InboundEncryption  mse.EncryptionPolicy
+	// Limits on the traffic of all torrents together, fresh unlimited
+	// limiters when nil. Sessions only share limits when given the same
+	// limiters, such as ratelimit.GlobalDownloadLimit.
+	Download *ratelimit.Limiter
+	Upload   *ratelimit.Limiter
+}
+
+var ErrSessionClosed = errors.New("session closed")
+
+// Session runs any number of torrents side by side. It owns the listener for
+// inbound peers, the peer ID shown to trackers and peers, and the bandwidth
+// limits of all its torrents together, and decides which torrents may run.
+type Session struct {
+	PeerID   [20]byte           // see peer.SessionPeerID
+	Download *ratelimit.Limiter // limits of all torrents together, see
+	Upload   *ratelimit.Limiter // SessionConfig.Download
+
+	config   SessionConfig
+	listener net.Listener
+	utp      *utp.Socket
+
+	mu       sync.Mutex
+	torrents []*Torrent // in queue order
+	closed   bool
+	halfOpen int // inbound connections still handshaking
+}
+
+func NewSession(config SessionConfig) (*Session, error) {
+	if config.MaxPeersPerTorrent <= 0 {
+		config.MaxPeersPerTorrent = 8
+	}
+	if config.Storage == nil {
+		config.Storage = storage.OpenFile
+	}
+	if config.Download == nil {
+		config.Download = ratelimit.NewLimiter(0)
+	}
+	if config.Upload == nil {
+		config.Upload = ratelimit.NewLimiter(0)
+	}
+	s := &Session{
+		PeerID:   peer.SessionPeerID(),
+		Download: config.Download,
+		Upload:   config.Upload,
+		config:   config,
+	}
+	if config.ListenAddress == "" {
+		return s, nil
+	}
+	listener, err := net.Listen("tcp", config.ListenAddress)
+	if err != nil {
+		return nil, err
+	}
+	s.listener = listener
+	go s.acceptLoop(listener)
+	if slices.Contains(peer.Transports, "utp") {
+		// uTP shares the port number of the TCP listener
+		utp, err := utp.Listen(listener.Addr().String())
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		s.utp = utp
+		go s.acceptLoop(utp)
+	}
+	return s, nil
+}
+
+// Port announced to trackers
+func (s *Session) Port() int {
+	if s.listener == nil {
+		return 6881
+	}
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *Session) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Add a torrent whose data lives at outputPath. Resume data is loaded before
+// returning; the download starts as soon as the queue allows.
+func (s *Session) Add(info *metainfo.Metainfo, outputPath string, options *TorrentOptions) (*Torrent, error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, ErrSessionClosed
+	}
+	for _, t := range s.torrents {
+		if t.Info.InfoHash == info.InfoHash {
+			s.mu.Unlock()
+			return nil, fmt.Errorf("torrent %s already added", info.InfoHash)
+		}
+	}
+	s.mu.Unlock()
+	t, err := newTorrent(s, info, outputPath, options)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		t.close(false)
+		return nil, ErrSessionClosed
+	}
+	s.torrents = append(s.torrents, t)
+	s.mu.Unlock()
+	s.schedule()
+	return t, nil
+}
+
+func (s *Session) Get(infoHash string) *Torrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.torrents {
+		if t.Info.InfoHash == infoHash {
+			return t
+		}
+	}
+	return nil
+}
+
+func (s *Session) Torrents() []*Torrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Torrent(nil), s.torrents...)
+}
+
+// Stop a torrent and drop it from the session, deleting its files and resume
+// data if asked to
+func (s *Session) Remove(infoHash string, deleteData bool) error {
+	s.mu.Lock()
+	index := slices.IndexFunc(s.torrents, func(t *Torrent) bool { return t.Info.InfoHash == infoHash })
+	if index < 0 {
+		s.mu.Unlock()
+		return fmt.Errorf("unknown torrent: %s", infoHash)
+	}
+	t := s.torrents[index]
+	s.torrents = slices.Delete(s.torrents, index, index+1)
+	s.mu.Unlock()
+	err := t.close(deleteData)
+	s.schedule()
+	return err
+}
+
+func (s *Session) Pause(infoHash string) error {
+	t := s.Get(infoHash)
+	if t == nil {
+		return fmt.Errorf("unknown torrent: %s", infoHash)
+	}
+	t.Pause()
+	return nil
+}
+
+func (s *Session) Resume(infoHash string) error {
+	t := s.Get(infoHash)
+	if t == nil {
+		return fmt.Errorf("unknown torrent: %s", infoHash)
+	}
+	t.Resume()
+	return nil
+}
+
+func (s *Session) Status() []TorrentStatus {
+	torrents := s.Torrents()
+	statuses := make([]TorrentStatus, len(torrents))
+	for i, t := range torrents {
+		statuses[i] = t.Status()
+	}
+	return statuses
+}
+
+// Start and stop torrents so that, in queue order, as many run as the
+// download and seed limits allow
+func (s *Session) schedule() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	downloads, seeds := 0, 0
+	for _, t := range s.torrents {
+		complete := t.Complete()
+		t.mu.Lock()
+		state := TorrentQueued
+		switch {
+		case t.paused:
+			state = TorrentPaused
+		case t.err != nil:
+			state = TorrentFailed
+		case complete && (s.config.MaxActiveSeeds == 0 || seeds < s.config.MaxActiveSeeds):
+			seeds++
+			state = TorrentSeeding
+		case !complete && (s.config.MaxActiveDownloads == 0 || downloads < s.config.MaxActiveDownloads):
+			downloads++
+			state = TorrentDownloading
+		}
+		if state == TorrentDownloading || state == TorrentSeeding {
+			t.start()
+		} else {
+			t.halt()
+		}
+		if state != t.state {
+			t.setState(state)
+		}
+		t.mu.Unlock()
+	}
+}
+
+func (s *Session) acceptLoop(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			if err := s.handleInbound(conn); err != nil {
+				sessionLogger.Debug("inbound peer dropped", "peer", conn.RemoteAddr().String(), "error", err)
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// Complete the handshake with an inbound peer and hand it to its torrent
+func (s *Session) handleInbound(conn net.Conn) error {
+	s.addHalfOpen(1)
+	t, conn, remote, err := s.acceptHandshake(conn)
+	s.addHalfOpen(-1)
+	if err != nil {
+		return err
+	}
+	return t.serve(peer.NewConn(conn.RemoteAddr().String(), t.Limits.Wrap(conn), remote, t.Info.PieceCount()))
+}
+
+func (s *Session) acceptHandshake(conn net.Conn) (*Torrent, net.Conn, *peer.Handshake, error) {
+	torrents := s.Torrents()
+	infoHashes := make([][]byte, 0, len(torrents))
+	for _, t := range torrents {
+		infoHash, _ := hex.DecodeString(t.Info.InfoHash)
+		infoHashes = append(infoHashes, infoHash)
+	}
+	// A peer that stalls before finishing the handshake is dropped
+	conn.SetDeadline(time.Now().Add(peer.HandshakeTimeout))
+	conn, matched, err := mse.AcceptInbound(conn, infoHashes, s.config.InboundEncryption)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	conn = peer.Trace(conn, conn.RemoteAddr().String())
+	remote, err := peer.ReadHandshake(conn)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// An encrypted peer already named its torrent; the handshake must agree
+	if matched != nil && !bytes.Equal(matched, remote.InfoHash[:]) {
+		return nil, nil, nil, peer.ErrInfoHashMismatch
+	}
+	if remote.PeerID == s.PeerID {
+		return nil, nil, nil, peer.ErrSelfConnection
+	}
+	t := s.Get(hex.EncodeToString(remote.InfoHash[:]))
+	if t == nil {
+		return nil, nil, nil, peer.ErrInfoHashMismatch
+	}
+	local := peer.NewHandshake(remote.InfoHash, s.PeerID)
+	if err := peer.WriteHandshake(conn, local); err != nil {
+		return nil, nil, nil, err
+	}
+	return t, conn, remote, nil
+}
+
+func (s *Session) addHalfOpen(delta int) {
+	s.mu.Lock()
+	s.halfOpen += delta
+	s.mu.Unlock()
+}
+
+// Inbound connections that have not finished the handshake yet
+func (s *Session) HalfOpen() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.halfOpen
+}
+
+// Stop every torrent, saving their resume data, and close the listeners
+func (s *Session) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	torrents := s.torrents
+	s.mu.Unlock()
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	if s.utp != nil {
+		s.utp.Close()
+	}
+	var firstErr error
+	for _, t := range torrents {
+		if err := t.close(false); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,184 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/metainfo"
+	"github.com/codecrafters-io/bittorrent-starter-go/mse"
+	"github.com/codecrafters-io/bittorrent-starter-go/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/ratelimit"
+	"github.com/codecrafters-io/bittorrent-starter-go/testutil"
+)
+
+// Seed tor from a session listening on loopback. The data is written out with
+// unusable resume data next to it, so adding the torrent rechecks every piece.
+func seedingSession(t *testing.T, tor *testutil.Torrent, info *metainfo.Metainfo, config SessionConfig) *Session {
+	t.Helper()
+	config.ListenAddress = "127.0.0.1:0"
+	session, err := NewSession(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { session.Close() })
+	// Sessions in one process share a peer ID; tell this one apart so
+	// connections from the others are not taken for its own
+	session.PeerID[0] ^= 0xff
+	output := filepath.Join(t.TempDir(), tor.Name)
+	if err := os.WriteFile(output, tor.Data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(ResumePath(info, output), []byte("not resume data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	torrent, err := session.Add(info, output, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !torrent.Complete() {
+		t.Fatal("seeding torrent is not complete after the recheck")
+	}
+	return session
+}
+
+func TestSessionsNegotiateTheirOwnEncryption(t *testing.T) {
+	previous := peer.Transports
+	peer.Transports = []string{"tcp"}
+	t.Cleanup(func() { peer.Transports = previous })
+	tor := testutil.NewTorrent("sample.bin", 32<<10, 100<<10)
+	info, err := tor.Metainfo("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeder := seedingSession(t, tor, info, SessionConfig{InboundEncryption: mse.EncryptionRequired})
+	tracker := testutil.NewTracker(seeder.Addr().String())
+	defer tracker.Close()
+
+	// A plaintext connection is turned away by the seeder's policy alone
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := peer.Dial(ctx, seeder.Addr().String(), info.InfoHash, mse.EncryptionDisabled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := peer.PerformHandshake(conn, info.InfoHash); err == nil {
+		t.Error("seeder requiring encryption completed a plaintext handshake")
+	}
+	conn.Close()
+
+	// A leecher requiring encryption gets the whole torrent over RC4
+	leecher, err := NewSession(SessionConfig{OutboundEncryption: mse.EncryptionRequired})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leecher.Close()
+	announced, err := tor.Metainfo(tracker.AnnounceURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(t.TempDir(), tor.Name)
+	torrent, err := leecher.Add(announced, output, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := torrent.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := tor.Check(output); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionsHaveTheirOwnLimits(t *testing.T) {
+	first, err := NewSession(SessionConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := NewSession(SessionConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	first.Download.SetRate(64 << 10)
+	first.Upload.SetRate(32 << 10)
+	if second.Download.Rate() != 0 || second.Upload.Rate() != 0 {
+		t.Errorf("limiting one session limited another to %d/%d", second.Download.Rate(), second.Upload.Rate())
+	}
+	if ratelimit.GlobalDownloadLimit.Rate() != 0 || ratelimit.GlobalUploadLimit.Rate() != 0 {
+		t.Error("limiting a session changed the global limits")
+	}
+
+	// Sessions handed the same limiters share them
+	shared := ratelimit.NewLimiter(0)
+	third, err := NewSession(SessionConfig{Download: shared, Upload: shared})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer third.Close()
+	if third.Download != shared || third.Upload != shared {
+		t.Error("session ignored the limiters it was given")
+	}
+}
+
+func TestInboundPeersHearOfNewPieces(t *testing.T) {
+	previous := peer.Transports
+	peer.Transports = []string{"tcp"}
+	t.Cleanup(func() { peer.Transports = previous })
+	tor := testutil.NewTorrent("sample.bin", 32<<10, 160<<10)
+	// Slow enough that the inbound peer connects while pieces are missing
+	seeder := startPeer(t, tor, testutil.Behavior{Delay: 50 * time.Millisecond})
+	tracker := testutil.NewTracker(seeder.Addr())
+	defer tracker.Close()
+	leecher, err := NewSession(SessionConfig{ListenAddress: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leecher.Close()
+	leecher.PeerID[0] ^= 0xff
+	info, err := tor.Metainfo(tracker.AnnounceURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := leecher.Add(info, filepath.Join(t.TempDir(), tor.Name), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := peer.Dial(ctx, leecher.Addr().String(), info.InfoHash, mse.EncryptionDisabled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := peer.PerformHandshake(conn, info.InfoHash); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	var have peer.Bitfield
+	haves := 0
+	for have == nil || have.Count() < info.PieceCount() {
+		message, err := peer.ReadMessage(conn)
+		if err != nil {
+			t.Fatalf("with pieces %08b after %d have messages: %v", have, haves, err)
+		}
+		switch {
+		case message == nil:
+		case have == nil && message.ID != peer.MsgBitfield:
+			t.Fatalf("first message %d, want the bitfield", message.ID)
+		case message.ID == peer.MsgBitfield:
+			have = peer.Bitfield(message.Payload)
+		case message.ID == peer.MsgHave:
+			have.Set(int(binary.BigEndian.Uint32(message.Payload)))
+			haves++
+		}
+	}
+	if haves == 0 {
+		t.Error("the download finished before the peer connected; no have message was tested")
+	}
+}
@@ -0,0 +1,138 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/storage"
+	"github.com/codecrafters-io/bittorrent-starter-go/testutil"
+)
+
+func TestStreamServerWaitsForPiecesAndSetsDeadlines(t *testing.T) {
+	tor := testutil.NewTorrent("sample", 16<<10, 40<<10, 24<<10)
+	info, err := tor.Metainfo("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := storage.NewMemoryStorage(info)
+	progress := NewProgress(info)
+	priorities := NewFilePriorities(info)
+	priorities.Set(1, PrioritySkip)
+	picker := NewPiecePicker(info, priorities, progress)
+	server := httptest.NewServer(NewStreamServer(info, store, progress, picker, priorities))
+	defer server.Close()
+
+	// Bytes 36864-45055 of the torrent: the end of file0 is in piece 2
+	request, err := http.NewRequest(http.MethodGet, server.URL+"/files/data/file0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Range", "bytes=36864-")
+	type result struct {
+		body   []byte
+		status int
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer response.Body.Close()
+		body, err := io.ReadAll(response.Body)
+		done <- result{body, response.StatusCode, err}
+	}()
+
+	// The reader blocks on piece 2 and asks for it ahead of everything else
+	deadline := time.Now().Add(5 * time.Second)
+	for picker.Next(progress.Snapshot()) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("stream never made piece 2 urgent, picker chose %d", picker.Next(progress.Snapshot()))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	select {
+	case r := <-done:
+		t.Fatalf("stream answered before its piece was verified: %d %v", r.status, r.err)
+	default:
+	}
+	store.WriteAt(tor.Piece(2), 2, 0)
+	progress.SetPiece(2)
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		if r.status != http.StatusPartialContent {
+			t.Errorf("status %d, want %d", r.status, http.StatusPartialContent)
+		}
+		if want := tor.Data[36864 : 40<<10]; !bytes.Equal(r.body, want) {
+			t.Errorf("got %d bytes, want the last %d bytes of file0", len(r.body), len(want))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream did not finish once the piece was verified")
+	}
+	if piece := picker.Next(progress.Snapshot()); piece == 2 {
+		t.Error("verified piece still picked")
+	}
+}
+
+func TestStreamServerUnskipsStreamedFile(t *testing.T) {
+	tor := testutil.NewTorrent("sample", 16<<10, 16<<10, 16<<10)
+	info, err := tor.Metainfo("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := storage.NewMemoryStorage(info)
+	progress := NewProgress(info)
+	for piece := 0; piece < info.PieceCount(); piece++ {
+		store.WriteAt(tor.Piece(piece), piece, 0)
+		progress.SetPiece(piece)
+	}
+	priorities := NewFilePriorities(info)
+	priorities.Set(1, PrioritySkip)
+	server := httptest.NewServer(NewStreamServer(info, store, progress, NewPiecePicker(info, priorities, progress), priorities))
+	defer server.Close()
+
+	response, err := http.Get(server.URL + "/files/data/file1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, tor.Data[16<<10:]) {
+		t.Errorf("got %d bytes, want file1", len(body))
+	}
+	if priority := priorities.Get(1); priority != PriorityNormal {
+		t.Errorf("streamed file has priority %v, want normal", priority)
+	}
+
+	for path, status := range map[string]int{"/files/missing": http.StatusNotFound, "/": http.StatusOK} {
+		response, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != status {
+			t.Errorf("%s: status %d, want %d", path, response.StatusCode, status)
+		}
+	}
+	response, err = http.Post(server.URL+"/files/data/file0", "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST: status %d, want %d", response.StatusCode, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,831 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/logging"
+	"github.com/codecrafters-io/bittorrent-starter-go/metainfo"
+	"github.com/codecrafters-io/bittorrent-starter-go/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/ratelimit"
+	"github.com/codecrafters-io/bittorrent-starter-go/storage"
+	"github.com/codecrafters-io/bittorrent-starter-go/tracker"
+)
+
+type TorrentState int
+
+const (
+	TorrentQueued TorrentState = iota
+	TorrentDownloading
+	TorrentSeeding
+	TorrentPaused
+	TorrentFailed
+)
+
+func (s TorrentState) String() string {
+	switch s {
+	case TorrentDownloading:
+		return "downloading"
+	case TorrentSeeding:
+		return "seeding"
+	case TorrentPaused:
+		return "paused"
+	case TorrentFailed:
+		return "failed"
+	}
+	return "queued"
+}
+
+func (s TorrentState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *TorrentState) UnmarshalText(text []byte) error {
+	for state := TorrentQueued; state <= TorrentFailed; state++ {
+		if state.String() == string(text) {
+			*s = state
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown torrent state: %s", text)
+}
+
+// Settings applied when a torrent is added to a session
+type TorrentOptions struct {
+	Paused       bool
+	Sequential   bool
+	StreamWindow int // read-ahead in bytes for sequential mode, StreamWindow when 0
+	Only         []string
+	Exclude      []string
+	Priorities   []string // <glob>:<level> rules
+	// Where the torrent keeps its data, the session's backend when nil
+	Storage storage.Backend
+}
+
+// Snapshot of a torrent's state
+type TorrentStatus struct {
+	InfoHash   string       `json:"info_hash"`
+	Name       string       `json:"name"`
+	OutputPath string       `json:"output_path"`
+	Added      time.Time    `json:"added"`
+	State      TorrentState `json:"state"`
+	Pieces     int          `json:"pieces"`
+	Have       int          `json:"have"`
+	Size       int64        `json:"size"` // bytes of wanted pieces
+	Left       int64        `json:"left"` // bytes of wanted pieces still missing
+	Downloaded int64        `json:"downloaded"`
+	Uploaded   int64        `json:"uploaded"`
+	Wasted     int64        `json:"wasted"` // bytes of pieces that failed the hash check
+	// Bytes per second over the last few seconds, summed over the peers
+	DownloadRate int64  `json:"download_rate"`
+	UploadRate   int64  `json:"upload_rate"`
+	Peers        int    `json:"peers"`
+	HalfOpen     int    `json:"half_open"` // outbound connections still handshaking
+	HashFailures int    `json:"hash_failures"`
+	Error        string `json:"error,omitempty"`
+}
+
+type PeerStatus struct {
+	Address      string `json:"address"`
+	Client       string `json:"client"`
+	Choked       bool   `json:"choked"`
+	DownloadRate int64  `json:"download_rate"`
+	UploadRate   int64  `json:"upload_rate"`
+}
+
+type FileStatus struct {
+	Path      string   `json:"path"`
+	Length    int      `json:"length"`
+	Completed int64    `json:"completed"` // bytes of the file in verified pieces
+	Priority  Priority `json:"priority"`
+}
+
+// Outcome of the latest announce, and totals over all of them
+type TrackerStatus struct {
+	URL          string        `json:"url"`
+	LastAnnounce time.Time     `json:"last_announce"`
+	Latency      time.Duration `json:"latency"`
+	Peers        int           `json:"peers"`
+	Error        string        `json:"error,omitempty"`
+	Announces    int           `json:"announces"`
+	Failures     int           `json:"failures"`
+}
+
+var (
+	// How long to wait before asking the tracker again after a round of peers
+	// yielded nothing
+	TrackerRetryInterval = 30 * time.Second
+	// How long to wait for the tracker to take note of a stopped torrent
+	StoppedAnnounceTimeout = 5 * time.Second
+
+	ErrTorrentStopped = errors.New("torrent stopped")
+	ErrNoTracker      = errors.New("torrent has no tracker")
+
+	sessionLogger = logging.For(logging.Session)
+	pickerLogger  = logging.For(logging.Picker)
+)
+
+// Torrent is a handle on one torrent in a session. Its download runs in the
+// background while the session lets it; see Session for queueing.
+type Torrent struct {
+	Info       *metainfo.Metainfo
+	OutputPath string
+	Added      time.Time
+	Storage    storage.Storage
+	Priorities *FilePriorities
+	Picker     *PiecePicker
+	Limits     *ratelimit.TorrentLimits
+	Progress   *Progress
+
+	session    *Session
+	paths      []string
+	resumePath string
+	log        *slog.Logger
+
+	mu         sync.Mutex
+	state      TorrentState
+	paused     bool
+	err        error
+	ctx        context.Context    // done once the running torrent is told to stop
+	cancel     context.CancelFunc // stops the running torrent, nil when idle
+	stopped    chan struct{}      // closed once the running torrent has wound down
+	announced  bool               // the tracker was sent a started event
+	tracker    TrackerStatus
+	changed    chan struct{} // closed and replaced on every state change
+	peers      map[*peer.Conn]bool
+	webSeeds   map[*webSeed]bool
+	inFlight   map[int]bool
+	downloaded int64
+	uploaded   int64
+	wasted     int64
+	hashFails  int
+	halfOpen   int
+	lastSave   time.Time // last periodic save of resume data
+}
+
+func newTorrent(session *Session, info *metainfo.Metainfo, outputPath string, options *TorrentOptions) (*Torrent, error) {
+	if options == nil {
+		options = &TorrentOptions{}
+	}
+	backend := options.Storage
+	if backend == nil {
+		backend = session.config.Storage
+	}
+	store, err := backend(info, outputPath)
+	if err != nil {
+		return nil, err
+	}
+	t := &Torrent{
+		Info:       info,
+		OutputPath: outputPath,
+		Added:      time.Now(),
+		Storage:    store,
+		Priorities: NewFilePriorities(info),
+		Limits:     ratelimit.NewSharedTorrentLimits(session.Download, session.Upload),
+		session:    session,
+		paths:      storage.Paths(info, outputPath),
+		resumePath: ResumePath(info, outputPath),
+		log:        sessionLogger.With("info_hash", info.InfoHash, "name", info.Name),
+		paused:     options.Paused,
+		changed:    make(chan struct{}),
+		peers:      make(map[*peer.Conn]bool),
+		webSeeds:   make(map[*webSeed]bool),
+		inFlight:   make(map[int]bool),
+	}
+	selective, _ := store.(storage.SelectiveStorage)
+	if selective != nil {
+		t.Priorities.OnChange(func(file int, priority Priority) error {
+			// Wanting a skipped file again moves its data out of the parts file
+			if err := selective.SetSkipped(file, priority == PrioritySkip); err != nil {
+				t.log.Warn("failed to change file priority", "file", info.Files[file].Path, "priority", priority, "error", err)
+				return err
+			}
+			return nil
+		})
+	}
+	if err := ApplyFileSelection(t.Priorities, options.Only, options.Exclude, options.Priorities); err != nil {
+		store.Close()
+		return nil, err
+	}
+	if selective != nil {
+		if err := selective.CreateWantedFiles(); err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
+	// Pick up where an interrupted download stopped
+	progress, err := LoadProgress(t.resumePath, info, t.paths, t.Storage)
+	if err != nil {
+		t.Storage.Close()
+		return nil, fmt.Errorf("failed to load resume data: %v", err)
+	}
+	t.Progress = progress
+	t.Picker = NewPiecePicker(info, t.Priorities, progress)
+	if options.Sequential {
+		window := options.StreamWindow
+		if window == 0 {
+			window = StreamWindow
+		}
+		t.Picker.SetSequential(true, window)
+	}
+	return t, nil
+}
+
+func (t *Torrent) InfoHash() string {
+	return t.Info.InfoHash
+}
+
+// True once every wanted piece is verified
+func (t *Torrent) Complete() bool {
+	return t.Picker.Done(t.Progress.Snapshot())
+}
+
+// Stream the torrent's files over HTTP while it downloads
+func (t *Torrent) StreamServer() *StreamServer {
+	return NewStreamServer(t.Info, t.Storage, t.Progress, t.Picker, t.Priorities)
+}
+
+func (t *Torrent) Pause() {
+	t.setPaused(true)
+}
+
+// Resume a paused torrent; a failed torrent is retried
+func (t *Torrent) Resume() {
+	t.mu.Lock()
+	t.err = nil
+	t.mu.Unlock()
+	t.setPaused(false)
+}
+
+func (t *Torrent) setPaused(paused bool) {
+	t.mu.Lock()
+	t.paused = paused
+	t.mu.Unlock()
+	t.session.schedule()
+}
+
+func (t *Torrent) Status() TorrentStatus {
+	have := t.Progress.Snapshot()
+	size, left := t.wanted()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	status := TorrentStatus{
+		InfoHash:     t.Info.InfoHash,
+		Name:         t.Info.Name,
+		OutputPath:   t.OutputPath,
+		Added:        t.Added,
+		State:        t.state,
+		Pieces:       t.Info.PieceCount(),
+		Have:         have.Count(),
+		Size:         size,
+		Left:         left,
+		Downloaded:   t.downloaded,
+		Uploaded:     t.uploaded,
+		Wasted:       t.wasted,
+		Peers:        len(t.peers),
+		HalfOpen:     t.halfOpen,
+		HashFailures: t.hashFails,
+	}
+	for conn := range t.peers {
+		status.DownloadRate += conn.Downloaded.Rate()
+		status.UploadRate += conn.Uploaded.Rate()
+	}
+	for seed := range t.webSeeds {
+		status.DownloadRate += seed.Downloaded.Rate()
+	}
+	if t.err != nil {
+		status.Error = t.err.Error()
+	}
+	return status
+}
+
+// Connected peers, inbound and outbound, and web seeds in use
+func (t *Torrent) Peers() []PeerStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	peers := make([]PeerStatus, 0, len(t.peers)+len(t.webSeeds))
+	for conn := range t.peers {
+		peers = append(peers, PeerStatus{
+			Address:      conn.Address,
+			Client:       conn.Client,
+			Choked:       conn.Choked,
+			DownloadRate: conn.Downloaded.Rate(),
+			UploadRate:   conn.Uploaded.Rate(),
+		})
+	}
+	for seed := range t.webSeeds {
+		peers = append(peers, PeerStatus{
+			Address:      seed.URL,
+			Client:       "web seed",
+			DownloadRate: seed.Downloaded.Rate(),
+		})
+	}
+	return peers
+}
+
+// Verified pieces, as a bitfield with the first piece in the high bit
+func (t *Torrent) Pieces() peer.Bitfield {
+	return t.Progress.Snapshot()
+}
+
+func (t *Torrent) Files() []FileStatus {
+	files := make([]FileStatus, len(t.Info.Files))
+	for i, file := range t.Info.Files {
+		files[i] = FileStatus{Path: file.Path, Length: file.Length, Priority: t.Priorities.Get(i)}
+	}
+	have := t.Progress.Snapshot()
+	for piece := 0; piece < t.Info.PieceCount(); piece++ {
+		if !have.Has(piece) {
+			continue
+		}
+		offset := int64(piece) * int64(t.Info.PieceLength)
+		for _, span := range storage.MapSpan(t.Info.Files, offset, t.Info.PieceSize(piece)) {
+			files[span.File].Completed += int64(span.Length)
+		}
+	}
+	return files
+}
+
+func (t *Torrent) Trackers() []TrackerStatus {
+	if t.Info.Announce == "" {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	status := t.tracker
+	status.URL = t.Info.Announce
+	return []TrackerStatus{status}
+}
+
+// Block until every wanted piece is present, the torrent fails or ctx is done
+func (t *Torrent) Wait(ctx context.Context) error {
+	for {
+		if t.Complete() {
+			return nil
+		}
+		t.mu.Lock()
+		err, changed := t.err, t.changed
+		t.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Record a new state and wake up waiters. Callers hold t.mu.
+func (t *Torrent) setState(state TorrentState) {
+	t.log.Info("state changed", "from", t.state, "to", state)
+	t.state = state
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+func (t *Torrent) fail(err error) {
+	t.log.Warn("torrent failed", "error", err)
+	t.mu.Lock()
+	t.err = err
+	t.setState(TorrentFailed)
+	t.mu.Unlock()
+	go t.session.schedule()
+}
+
+// Start the background loop unless it already runs. Callers hold t.mu.
+func (t *Torrent) start() {
+	if t.cancel != nil {
+		return
+	}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	t.stopped = make(chan struct{})
+	go t.run(t.ctx, t.stopped)
+}
+
+// Ask the background loop to stop and return a channel closed once it has.
+// Callers hold t.mu.
+func (t *Torrent) halt() <-chan struct{} {
+	if t.cancel == nil {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	stopped := t.stopped
+	t.cancel()
+	for conn := range t.peers {
+		conn.Close()
+	}
+	t.ctx, t.cancel, t.stopped = nil, nil, nil
+	return stopped
+}
+
+// Save resume data and flush the files
+func (t *Torrent) checkpoint() error {
+	err := t.Storage.Sync()
+	if err == nil {
+		err = SaveProgress(t.resumePath, t.Info, t.paths, t.Progress)
+	}
+	if err != nil {
+		t.log.Warn("saving resume data failed", "error", err)
+	}
+	return err
+}
+
+// Save resume data once ResumeSaveInterval has passed since the last save,
+// so a crash mid-download loses little progress
+func (t *Torrent) periodicCheckpoint() {
+	t.mu.Lock()
+	due := time.Since(t.lastSave) >= ResumeSaveInterval
+	if due {
+		t.lastSave = time.Now()
+	}
+	t.mu.Unlock()
+	if due {
+		t.checkpoint()
+	}
+}
+
+// Bytes of wanted pieces still missing
+func (t *Torrent) left() int64 {
+	_, left := t.wanted()
+	return left
+}
+
+// Bytes of wanted pieces, in total and still missing
+func (t *Torrent) wanted() (int64, int64) {
+	have := t.Progress.Snapshot()
+	var size, left int64
+	for piece := 0; piece < t.Info.PieceCount(); piece++ {
+		if !t.Picker.Wanted(piece) {
+			continue
+		}
+		size += int64(t.Info.PieceSize(piece))
+		if !have.Has(piece) {
+			left += int64(t.Info.PieceSize(piece))
+		}
+	}
+	return size, left
+}
+
+// Announce to the tracker with our transfer totals
+func (t *Torrent) announce(ctx context.Context, event string) ([]string, error) {
+	if t.Info.Announce == "" {
+		return nil, ErrNoTracker
+	}
+	left := t.left()
+	t.mu.Lock()
+	request := tracker.Request{
+		InfoHash:   t.Info.InfoHash,
+		PeerID:     t.session.PeerID,
+		Port:       t.session.Port(),
+		Uploaded:   t.uploaded,
+		Downloaded: t.downloaded,
+		Left:       left,
+		Event:      event,
+	}
+	t.mu.Unlock()
+	start := time.Now()
+	peers, err := tracker.Announce(ctx, t.Info.Announce, request)
+	t.mu.Lock()
+	t.tracker.URL = t.Info.Announce
+	t.tracker.LastAnnounce = time.Now()
+	t.tracker.Latency = time.Since(start)
+	t.tracker.Peers = len(peers)
+	t.tracker.Error = ""
+	t.tracker.Announces++
+	if err != nil {
+		t.tracker.Error = err.Error()
+		t.tracker.Failures++
+	}
+	t.mu.Unlock()
+	if err != nil && event != tracker.EventStopped {
+		t.log.Warn("announce failed", "tracker", t.Info.Announce, "event", event, "error", err)
+	}
+	return peers, err
+}
+
+// Tell the tracker we are leaving the swarm. The torrent's own context is
+// already done, so this gets a short one of its own.
+func (t *Torrent) announceStopped() {
+	t.mu.Lock()
+	announced := t.announced
+	t.announced = false
+	t.mu.Unlock()
+	if !announced {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), StoppedAnnounceTimeout)
+	defer cancel()
+	t.announce(ctx, tracker.EventStopped)
+}
+
+func (t *Torrent) run(ctx context.Context, stopped chan<- struct{}) {
+	defer close(stopped)
+	defer t.checkpoint()
+	defer t.announceStopped()
+	wasComplete := t.Complete()
+	for !t.Complete() {
+		progressed, err := t.downloadRound(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil && !progressed {
+			t.fail(err)
+			return
+		}
+		if !progressed && !t.Complete() {
+			select {
+			case <-time.After(TrackerRetryInterval):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+	t.checkpoint()
+	if !wasComplete {
+		t.log.Info("download complete")
+		t.announce(ctx, tracker.EventCompleted)
+	}
+	// Downloading is over; the session now decides whether we may seed
+	go t.session.schedule()
+	<-ctx.Done()
+}
+
+// Ask the tracker for peers and download from them and the web seeds until
+// they have nothing more to give. Reports whether any piece was completed.
+func (t *Torrent) downloadRound(ctx context.Context) (bool, error) {
+	t.mu.Lock()
+	event := ""
+	if !t.announced {
+		event = tracker.EventStarted
+	}
+	t.lastSave = time.Now()
+	t.mu.Unlock()
+	// Web seeds keep the download going when the tracker fails
+	peers, err := t.announce(ctx, event)
+	if err != nil && len(t.Info.WebSeeds) == 0 {
+		return false, err
+	}
+	if err == nil {
+		t.mu.Lock()
+		t.announced = true
+		t.mu.Unlock()
+	}
+	if len(peers) == 0 && len(t.Info.WebSeeds) == 0 {
+		return false, errors.New("tracker returned no peers")
+	}
+	before := t.Progress.Snapshot().Count()
+	queue := make(chan string, len(peers))
+	for _, address := range peers {
+		queue <- address
+	}
+	close(queue)
+
+	var wg sync.WaitGroup
+	var errMu sync.Mutex
+	var lastErr error
+	for _, seedURL := range t.Info.WebSeeds {
+		wg.Add(1)
+		go func(seed *webSeed) {
+			defer wg.Done()
+			if err := t.downloadFromWebSeed(ctx, seed); err != nil && ctx.Err() == nil {
+				t.log.Debug("web seed failed", "web_seed", seed.URL, "error", err)
+				errMu.Lock()
+				lastErr = fmt.Errorf("%s: %v", seed.URL, err)
+				errMu.Unlock()
+			}
+		}(newWebSeed(seedURL, t.Info, t.Limits))
+	}
+	for worker := 0; worker < min(t.session.config.MaxPeersPerTorrent, len(peers)); worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for address := range queue {
+				if ctx.Err() != nil {
+					return
+				}
+				err := t.downloadFrom(ctx, address)
+				if err == nil {
+					continue
+				}
+				t.log.Debug("peer failed", "peer", address, "error", err)
+				errMu.Lock()
+				lastErr = fmt.Errorf("%s: %v", address, err)
+				errMu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return t.Progress.Snapshot().Count() > before, lastErr
+}
+
+// Download pieces from one peer until it has nothing left that we want. A
+// nil error means the peer was used up rather than failing.
+func (t *Torrent) downloadFrom(ctx context.Context, address string) error {
+	t.mu.Lock()
+	t.halfOpen++
+	t.mu.Unlock()
+	conn, err := peer.Connect(ctx, address, t.Info, t.Limits, t.session.config.OutboundEncryption)
+	t.mu.Lock()
+	t.halfOpen--
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if !t.addPeer(ctx, conn) {
+		conn.Close()
+		return ErrTorrentStopped
+	}
+	defer t.removePeer(conn)
+	for {
+		piece, waiting := t.pickFor(conn.Address, conn.Has)
+		if piece < 0 && !waiting {
+			return nil
+		}
+		if piece < 0 {
+			// Another peer holds the only pieces left; it may still fail
+			select {
+			case <-time.After(time.Second):
+				continue
+			case <-ctx.Done():
+				return ErrTorrentStopped
+			}
+		}
+		err := FetchPiece(conn, t.Storage, t.Info, piece, t.Progress)
+		t.mu.Lock()
+		delete(t.inFlight, piece)
+		if err == nil {
+			t.downloaded += int64(t.Info.PieceSize(piece))
+		} else if errors.Is(err, ErrHashCheck) {
+			conn.Log.Warn("piece failed hash check", "info_hash", t.Info.InfoHash, "piece", piece)
+			t.wasted += int64(t.Info.PieceSize(piece))
+			t.hashFails++
+		}
+		t.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		t.broadcastHave(piece)
+		t.periodicCheckpoint()
+	}
+}
+
+// Choose a piece for a peer or web seed, skipping pieces it lacks and pieces
+// others are fetching. The second result reports whether pieces are in flight
+// elsewhere, so the peer may have work later.
+func (t *Torrent) pickFor(address string, has func(piece int) bool) (int, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	mask := t.Progress.Snapshot()
+	for piece := 0; piece < t.Info.PieceCount(); piece++ {
+		if !has(piece) || t.inFlight[piece] {
+			mask.Set(piece)
+		}
+	}
+	piece := t.Picker.Next(mask)
+	if piece >= 0 {
+		t.inFlight[piece] = true
+		pickerLogger.Debug("picked piece", "info_hash", t.Info.InfoHash, "piece", piece, "peer", address)
+	}
+	return piece, len(t.inFlight) > 0
+}
+
+// Register a connected peer, unless the torrent stopped meanwhile
+func (t *Torrent) addPeer(ctx context.Context, conn *peer.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if ctx.Err() != nil {
+		return false
+	}
+	t.peers[conn] = true
+	return true
+}
+
+func (t *Torrent) removePeer(conn *peer.Conn) {
+	t.mu.Lock()
+	delete(t.peers, conn)
+	t.mu.Unlock()
+	conn.Close()
+}
+
+// Tell every connected peer that we have a newly verified piece, so those we
+// serve can request it
+func (t *Torrent) broadcastHave(piece int) {
+	t.mu.Lock()
+	conns := make([]*peer.Conn, 0, len(t.peers))
+	for conn := range t.peers {
+		conns = append(conns, conn)
+	}
+	t.mu.Unlock()
+	payload := binary.BigEndian.AppendUint32(nil, uint32(piece))
+	for _, conn := range conns {
+		if err := conn.Send(peer.MsgHave, payload); err != nil {
+			// The goroutine reading from the peer notices the failure too
+			conn.Log.Debug("failed to send have", "piece", piece, "error", err)
+		}
+	}
+}
+
+// Serve an inbound peer: announce our pieces, unchoke it once interested and
+// answer its block requests until it disconnects or the torrent stops
+func (t *Torrent) serve(conn *peer.Conn) error {
+	t.mu.Lock()
+	if t.cancel == nil {
+		t.mu.Unlock()
+		return ErrTorrentStopped
+	}
+	ctx := t.ctx
+	t.mu.Unlock()
+	// The bitfield goes first, before the peer can be sent any have message;
+	// pieces verified before the peer was registered are caught up on after
+	have := t.Progress.Snapshot()
+	if err := conn.Send(peer.MsgBitfield, have); err != nil {
+		return err
+	}
+	if !t.addPeer(ctx, conn) {
+		return ErrTorrentStopped
+	}
+	defer t.removePeer(conn)
+	for piece := 0; piece < t.Info.PieceCount(); piece++ {
+		if !have.Has(piece) && t.Progress.HasPiece(piece) {
+			if err := conn.Send(peer.MsgHave, binary.BigEndian.AppendUint32(nil, uint32(piece))); err != nil {
+				return err
+			}
+		}
+	}
+	for {
+		conn.SetReadDeadline(time.Now().Add(peer.IdleTimeout))
+		message, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if message == nil {
+			continue
+		}
+		switch message.ID {
+		case peer.MsgInterested:
+			if err := conn.Send(peer.MsgUnchoke, nil); err != nil {
+				return err
+			}
+		case peer.MsgRequest:
+			if err := t.serveRequest(conn, message.Payload); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Largest block a peer may request
+const maxRequestLength = 128 * 1024
+
+func (t *Torrent) serveRequest(conn *peer.Conn, payload []byte) error {
+	piece, begin, length, err := peer.ParseRequest(payload)
+	if err != nil {
+		return fmt.Errorf("%v from %s", err, conn.Address)
+	}
+	if length > maxRequestLength || !t.Progress.HasPiece(piece) {
+		return fmt.Errorf("peer %s requested a block we cannot serve", conn.Address)
+	}
+	block := make([]byte, 8+length)
+	copy(block, payload[:8])
+	if _, err := t.Storage.ReadAt(block[8:], piece, begin); err != nil {
+		return err
+	}
+	if err := conn.Send(peer.MsgPiece, block); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.uploaded += int64(length)
+	t.mu.Unlock()
+	return nil
+}
+
+// Stop the torrent, close its files and optionally delete its data
+func (t *Torrent) close(deleteData bool) error {
+	t.mu.Lock()
+	stopped := t.halt()
+	t.mu.Unlock()
+	<-stopped
+	err := t.Storage.Close()
+	if !deleteData {
+		return err
+	}
+	paths := append(append([]string{}, t.paths...), t.resumePath)
+	if selective, ok := t.Storage.(storage.SelectiveStorage); ok {
+		paths = append(paths, selective.PartsPath())
+	}
+	for _, path := range paths {
+		if removeErr := os.Remove(path); removeErr != nil && !errors.Is(removeErr, os.ErrNotExist) && err == nil {
+			err = removeErr
+		}
+	}
+	return err
+}
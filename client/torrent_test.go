@@ -0,0 +1,130 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/storage"
+	"github.com/codecrafters-io/bittorrent-starter-go/testutil"
+)
+
+// Add a torrent announced by tracker to a fresh session downloading from
+// maxPeers peers at once
+func addTorrent(t *testing.T, tor *testutil.Torrent, tracker *testutil.Tracker, maxPeers int) (*Torrent, string) {
+	t.Helper()
+	peer.Transports = []string{"tcp"}
+	session, err := NewSession(SessionConfig{MaxPeersPerTorrent: maxPeers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { session.Close() })
+	info, err := tor.Metainfo(tracker.AnnounceURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(t.TempDir(), tor.Name)
+	torrent, err := session.Add(info, output, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return torrent, output
+}
+
+func TestDownloadMovesOnToQueuedPeers(t *testing.T) {
+	tor := testutil.NewTorrent("sample.bin", 32<<10, 160<<10)
+	// Used up after one piece; the only worker must go on to the seeder
+	partial := startPeer(t, tor, testutil.Behavior{Missing: []int{1, 2, 3, 4}})
+	seeder := startPeer(t, tor, testutil.Behavior{})
+	tracker := testutil.NewTracker(partial.Addr(), seeder.Addr())
+	defer tracker.Close()
+
+	torrent, output := addTorrent(t, tor, tracker, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := torrent.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := tor.Check(output); err != nil {
+		t.Fatal(err)
+	}
+	if seeder.BlocksServed() == 0 {
+		t.Error("the queued seeder was never used")
+	}
+	if announces := len(tracker.Requests()); announces > 2 {
+		t.Errorf("needed %d announces, want the download done in the first round", announces)
+	}
+}
+
+func TestDownloadSavesResumeDataWhilePeersAreHealthy(t *testing.T) {
+	previous := ResumeSaveInterval
+	ResumeSaveInterval = 0
+	defer func() { ResumeSaveInterval = previous }()
+	tor := testutil.NewTorrent("sample.bin", 32<<10, 160<<10)
+	// Serves three pieces, then holds the connection open without answering
+	stalling := startPeer(t, tor, testutil.Behavior{StallAfter: 6})
+	tracker := testutil.NewTracker(stalling.Addr())
+	defer tracker.Close()
+
+	torrent, output := addTorrent(t, tor, tracker, 1)
+	info, err := tor.Metainfo(tracker.AnnounceURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumePath := ResumePath(info, output)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if data, err := os.ReadFile(resumePath); err == nil {
+			progress, _, err := parseResumeData(data, info)
+			if err == nil && progress.Have.Count() == 3 {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("resume data never recorded the pieces fetched before the peer stalled; status %+v", torrent.Status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDownloadIntoSessionStorageBackend(t *testing.T) {
+	peer.Transports = []string{"tcp"}
+	tor := testutil.NewTorrent("sample", 32<<10, 40<<10, 50<<10)
+	seeder := startPeer(t, tor, testutil.Behavior{})
+	tracker := testutil.NewTracker(seeder.Addr())
+	defer tracker.Close()
+	session, err := NewSession(SessionConfig{Storage: storage.OpenMemory})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	info, err := tor.Metainfo(tracker.AnnounceURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(t.TempDir(), tor.Name)
+	torrent, err := session.Add(info, output, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := torrent.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	memory, ok := torrent.Storage.(*storage.MemoryStorage)
+	if !ok {
+		t.Fatalf("torrent storage is %T, want the session's memory backend", torrent.Storage)
+	}
+	if !bytes.Equal(memory.Bytes(), tor.Data) {
+		t.Error("downloaded data differs from the torrent")
+	}
+	if _, err := os.Stat(filepath.Join(output, "data")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("memory backend touched the output path: %v", err)
+	}
+}
@@ -0,0 +1,214 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/metainfo"
+	"github.com/codecrafters-io/bittorrent-starter-go/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/ratelimit"
+	"github.com/codecrafters-io/bittorrent-starter-go/storage"
+)
+
+var (
+	// How long a web seed may take to deliver one piece
+	WebSeedTimeout = 30 * time.Second
+	// Wait after a web seed's first failure, doubled on each further one
+	WebSeedBackoff = 5 * time.Second
+	// Consecutive failures after which a web seed is left alone for the round
+	WebSeedMaxFailures = 5
+)
+
+// A web seed is an HTTP server holding the torrent's files, from which pieces
+// are fetched with range requests (BEP 19). It has every piece.
+type webSeed struct {
+	URL        string
+	info       *metainfo.Metainfo
+	client     *http.Client
+	Downloaded *ratelimit.Meter
+}
+
+func newWebSeed(seedURL string, info *metainfo.Metainfo, limits *ratelimit.TorrentLimits) *webSeed {
+	dialer := &net.Dialer{Timeout: peer.DialTimeout}
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		// Web seed traffic counts against the same limits as peers
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			return limits.Wrap(conn), nil
+		},
+		MaxIdleConnsPerHost: 2,
+	}
+	return &webSeed{
+		URL:        seedURL,
+		info:       info,
+		client:     &http.Client{Transport: transport},
+		Downloaded: &ratelimit.Meter{},
+	}
+}
+
+func (w *webSeed) Has(piece int) bool {
+	return true
+}
+
+// URL of one of the torrent's files. For a single-file torrent a URL ending
+// in a slash names a directory holding the file; otherwise it is the file.
+// For a multi-file torrent the URL names the directory above the torrent's.
+func (w *webSeed) fileURL(file int) string {
+	if len(w.info.Files) == 1 && w.info.Info["files"] == nil {
+		if !strings.HasSuffix(w.URL, "/") {
+			return w.URL
+		}
+		return w.URL + url.PathEscape(w.info.Name)
+	}
+	parts := []string{url.PathEscape(w.info.Name)}
+	for _, part := range strings.Split(w.info.Files[file].Path, string(filepath.Separator)) {
+		parts = append(parts, url.PathEscape(part))
+	}
+	return strings.TrimSuffix(w.URL, "/") + "/" + strings.Join(parts, "/")
+}
+
+// Download one piece, with one range request per file it covers
+func (w *webSeed) fetch(ctx context.Context, index int) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, WebSeedTimeout)
+	defer cancel()
+	data := make([]byte, w.info.PieceSize(index))
+	offset := int64(index) * int64(w.info.PieceLength)
+	for _, span := range storage.MapSpan(w.info.Files, offset, len(data)) {
+		if err := w.fetchRange(ctx, w.fileURL(span.File), span.Offset, data[span.Start:span.Start+span.Length]); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+func (w *webSeed) fetchRange(ctx context.Context, fileURL string, offset int64, buffer []byte) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+int64(len(buffer))-1))
+	request.Header.Set("User-Agent", peer.ClientDescription())
+	response, err := w.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	switch response.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server ignored the range and sends the whole file
+		if _, err := io.CopyN(io.Discard, response.Body, offset); err != nil {
+			return fmt.Errorf("short response from %s: %v", fileURL, err)
+		}
+	default:
+		return fmt.Errorf("%s: %s", fileURL, response.Status)
+	}
+	n, err := io.ReadFull(response.Body, buffer)
+	w.Downloaded.Add(n)
+	if err != nil {
+		return fmt.Errorf("short response from %s: %v", fileURL, err)
+	}
+	return nil
+}
+
+// Download pieces from a web seed until nothing is left that we want. Failed
+// requests are retried after a growing pause; a nil error means the seed was
+// used up rather than failing. The files behind a web seed do not change
+// between requests, so a piece that fails its hash check is not asked for
+// again in this round.
+func (t *Torrent) downloadFromWebSeed(ctx context.Context, seed *webSeed) error {
+	t.mu.Lock()
+	t.webSeeds[seed] = true
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.webSeeds, seed)
+		t.mu.Unlock()
+		seed.client.CloseIdleConnections()
+	}()
+	log := t.log.With("web_seed", seed.URL)
+	failures := 0
+	corrupt := make(map[int]bool)
+	has := func(piece int) bool {
+		return seed.Has(piece) && !corrupt[piece]
+	}
+	for {
+		piece, waiting := t.pickFor(seed.URL, has)
+		if piece < 0 && !waiting {
+			return nil
+		}
+		if piece < 0 {
+			select {
+			case <-time.After(time.Second):
+				continue
+			case <-ctx.Done():
+				return ErrTorrentStopped
+			}
+		}
+		err := t.fetchFromWebSeed(ctx, seed, piece)
+		t.mu.Lock()
+		delete(t.inFlight, piece)
+		if err == nil {
+			t.downloaded += int64(t.Info.PieceSize(piece))
+		} else if errors.Is(err, ErrHashCheck) {
+			log.Warn("piece failed hash check", "piece", piece)
+			corrupt[piece] = true
+			t.wasted += int64(t.Info.PieceSize(piece))
+			t.hashFails++
+		}
+		t.mu.Unlock()
+		if err == nil {
+			failures = 0
+			continue
+		}
+		if ctx.Err() != nil {
+			return ErrTorrentStopped
+		}
+		failures++
+		if failures >= WebSeedMaxFailures {
+			return err
+		}
+		backoff := WebSeedBackoff << (failures - 1)
+		log.Debug("web seed request failed", "error", err, "retry_in", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ErrTorrentStopped
+		}
+	}
+}
+
+// Fetch a piece from a web seed, store it and verify it like peer data
+func (t *Torrent) fetchFromWebSeed(ctx context.Context, seed *webSeed, index int) error {
+	data, err := seed.fetch(ctx, index)
+	if err != nil {
+		return err
+	}
+	if _, err := t.Storage.WriteAt(data, index, 0); err != nil {
+		return fmt.Errorf("failed to store piece: %v", err)
+	}
+	ok, err := VerifyPiece(t.Storage, t.Info, index)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		t.Progress.ResetPiece(index)
+		return fmt.Errorf("piece %d %w", index, ErrHashCheck)
+	}
+	t.Progress.SetPiece(index)
+	t.broadcastHave(index)
+	t.periodicCheckpoint()
+	return nil
+}
@@ -0,0 +1,232 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/metainfo"
+	"github.com/codecrafters-io/bittorrent-starter-go/ratelimit"
+	"github.com/codecrafters-io/bittorrent-starter-go/testutil"
+)
+
+func metainfoFor(t *testing.T, tor *testutil.Torrent) *metainfo.Metainfo {
+	t.Helper()
+	info, err := tor.Metainfo("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+// A paused torrent without tracker, for driving a web seed by hand
+func pausedTorrent(t *testing.T, tor *testutil.Torrent) *Torrent {
+	t.Helper()
+	session, err := NewSession(SessionConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { session.Close() })
+	torrent, err := session.Add(metainfoFor(t, tor), filepath.Join(t.TempDir(), tor.Name), &TorrentOptions{Paused: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return torrent
+}
+
+// Shorten the pauses between failed web seed requests
+func fastBackoff(t *testing.T, backoff time.Duration, maxFailures int) {
+	previousBackoff, previousMax := WebSeedBackoff, WebSeedMaxFailures
+	WebSeedBackoff, WebSeedMaxFailures = backoff, maxFailures
+	t.Cleanup(func() { WebSeedBackoff, WebSeedMaxFailures = previousBackoff, previousMax })
+}
+
+func TestWebSeedSingleFileURLs(t *testing.T) {
+	tor := testutil.NewTorrent("sample.bin", 32<<10, 100<<10)
+	server := testutil.NewWebSeed(tor)
+	defer server.Close()
+	info := metainfoFor(t, tor)
+	// With a trailing slash the URL names the directory, without one the file
+	for _, seedURL := range []string{server.SeedURL(), server.URL + "/" + tor.Name} {
+		seed := newWebSeed(seedURL, info, ratelimit.NewTorrentLimits())
+		if got := seed.fileURL(0); got != server.URL+"/"+tor.Name {
+			t.Errorf("file URL for %s = %s", seedURL, got)
+		}
+		for _, piece := range []int{0, 3} {
+			data, err := seed.fetch(context.Background(), piece)
+			if err != nil {
+				t.Fatalf("%s piece %d: %v", seedURL, piece, err)
+			}
+			if !bytes.Equal(data, tor.Piece(piece)) {
+				t.Errorf("%s piece %d differs from the torrent", seedURL, piece)
+			}
+		}
+	}
+}
+
+func TestWebSeedPieceSpanningFiles(t *testing.T) {
+	// Piece 0 covers all of file 0 and file 1 and the start of file 2
+	tor := testutil.NewTorrent("album", 32<<10, 10<<10, 5, 40<<10)
+	server := testutil.NewWebSeed(tor)
+	defer server.Close()
+	info := metainfoFor(t, tor)
+	for _, seedURL := range []string{server.SeedURL(), server.URL} {
+		seed := newWebSeed(seedURL, info, ratelimit.NewTorrentLimits())
+		if got, want := seed.fileURL(2), server.URL+"/album/data/file2"; got != want {
+			t.Errorf("file URL for %s = %s, want %s", seedURL, got, want)
+		}
+		before := server.Requests()
+		data, err := seed.fetch(context.Background(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, tor.Piece(0)) {
+			t.Error("piece 0 differs from the torrent")
+		}
+		if requests := server.Requests() - before; requests != 3 {
+			t.Errorf("piece 0 took %d requests, want one per file", requests)
+		}
+		// The last piece starts inside file 2
+		last := tor.PieceCount() - 1
+		if data, err := seed.fetch(context.Background(), last); err != nil || !bytes.Equal(data, tor.Piece(last)) {
+			t.Errorf("last piece: %v", err)
+		}
+	}
+}
+
+func TestWebSeedServerIgnoringRanges(t *testing.T) {
+	tor := testutil.NewTorrent("album", 32<<10, 10<<10, 5, 70<<10)
+	server := testutil.NewWebSeed(tor)
+	defer server.Close()
+	server.SetIgnoreRange(true)
+	seed := newWebSeed(server.SeedURL(), metainfoFor(t, tor), ratelimit.NewTorrentLimits())
+	for piece := 0; piece < tor.PieceCount(); piece++ {
+		data, err := seed.fetch(context.Background(), piece)
+		if err != nil {
+			t.Fatalf("piece %d: %v", piece, err)
+		}
+		if !bytes.Equal(data, tor.Piece(piece)) {
+			t.Errorf("piece %d differs from the torrent", piece)
+		}
+	}
+}
+
+func TestWebSeedDownload(t *testing.T) {
+	tor := testutil.NewTorrent("album", 32<<10, 10<<10, 5, 70<<10)
+	server := testutil.NewWebSeed(tor)
+	defer server.Close()
+	torrent := pausedTorrent(t, tor)
+	seed := newWebSeed(server.SeedURL(), torrent.Info, torrent.Limits)
+	if err := torrent.downloadFromWebSeed(context.Background(), seed); err != nil {
+		t.Fatal(err)
+	}
+	if !torrent.Complete() {
+		t.Fatal("download incomplete")
+	}
+	if err := torrent.Storage.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tor.Check(torrent.OutputPath); err != nil {
+		t.Error(err)
+	}
+	status := torrent.Status()
+	if status.Downloaded != int64(len(tor.Data)) || status.Wasted != 0 || status.HashFailures != 0 {
+		t.Errorf("status = %+v", status)
+	}
+	if seed.Downloaded.Total() != int64(len(tor.Data)) {
+		t.Errorf("seed meter = %d bytes, want %d", seed.Downloaded.Total(), len(tor.Data))
+	}
+}
+
+func TestWebSeedHashFailures(t *testing.T) {
+	fastBackoff(t, time.Millisecond, 3)
+	// Piece 0 starts file 0 and piece 1 starts file 1
+	tor := testutil.NewTorrent("album", 32<<10, 32<<10, 70<<10)
+	server := testutil.NewWebSeed(tor)
+	defer server.Close()
+	// The first byte of every file is flipped
+	server.SetCorrupt(true)
+	torrent := pausedTorrent(t, tor)
+	seed := newWebSeed(server.SeedURL(), torrent.Info, torrent.Limits)
+	// Each bad piece is tried once, and the good ones still come through
+	if err := torrent.downloadFromWebSeed(context.Background(), seed); err != nil {
+		t.Fatal(err)
+	}
+	status := torrent.Status()
+	if status.HashFailures != 2 || status.Wasted != int64(2*tor.PieceLength) {
+		t.Errorf("hash failures = %d, wasted = %d, want 2 failed pieces", status.HashFailures, status.Wasted)
+	}
+	have := torrent.Progress.Snapshot()
+	if status.Have != tor.PieceCount()-2 || have.Has(0) || have.Has(1) {
+		t.Errorf("have %d pieces, want all but the corrupt ones", status.Have)
+	}
+	if status.Downloaded != int64(len(tor.Data)-2*tor.PieceLength) {
+		t.Errorf("downloaded = %d, want only the verified pieces counted", status.Downloaded)
+	}
+
+	server.SetCorrupt(false)
+	if err := torrent.downloadFromWebSeed(context.Background(), seed); err != nil || !torrent.Complete() {
+		t.Errorf("download after the seed recovered: %v", err)
+	}
+}
+
+func TestWebSeedBackoff(t *testing.T) {
+	backoff := 20 * time.Millisecond
+	fastBackoff(t, backoff, 4)
+	tor := testutil.NewTorrent("sample.bin", 32<<10, 100<<10)
+	server := testutil.NewWebSeed(tor)
+	defer server.Close()
+	torrent := pausedTorrent(t, tor)
+	seed := newWebSeed(server.SeedURL(), torrent.Info, torrent.Limits)
+
+	// Two failures are retried and then forgotten
+	server.FailNext(2)
+	start := time.Now()
+	if err := torrent.downloadFromWebSeed(context.Background(), seed); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < backoff+2*backoff {
+		t.Errorf("retries took %v, want at least %v", elapsed, 3*backoff)
+	}
+	if !torrent.Complete() || server.Requests() != 2+tor.PieceCount() {
+		t.Errorf("complete = %v after %d requests", torrent.Complete(), server.Requests())
+	}
+}
+
+func TestWebSeedGivesUp(t *testing.T) {
+	backoff := 20 * time.Millisecond
+	fastBackoff(t, backoff, 4)
+	tor := testutil.NewTorrent("sample.bin", 32<<10, 100<<10)
+	server := testutil.NewWebSeed(tor)
+	defer server.Close()
+	server.FailNext(100)
+	torrent := pausedTorrent(t, tor)
+	seed := newWebSeed(server.SeedURL(), torrent.Info, torrent.Limits)
+
+	start := time.Now()
+	err := torrent.downloadFromWebSeed(context.Background(), seed)
+	if err == nil {
+		t.Fatal("a seed failing every request was not given up on")
+	}
+	// Waits of 1, 2 and 4 times the backoff between the four attempts
+	if elapsed := time.Since(start); elapsed < 7*backoff {
+		t.Errorf("gave up after %v, want at least %v", elapsed, 7*backoff)
+	}
+	if server.Requests() != WebSeedMaxFailures {
+		t.Errorf("%d requests, want %d", server.Requests(), WebSeedMaxFailures)
+	}
+	if status := torrent.Status(); status.Have != 0 || status.HashFailures != 0 {
+		t.Errorf("status = %+v", status)
+	}
+
+	// Being stopped ends the wait without counting as a failure
+	server.FailNext(100)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(backoff/2, cancel)
+	if err := torrent.downloadFromWebSeed(ctx, seed); !errors.Is(err, ErrTorrentStopped) {
+		t.Errorf("err = %v after stopping, want ErrTorrentStopped", err)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/client"
+	"github.com/codecrafters-io/bittorrent-starter-go/daemon"
+	"github.com/codecrafters-io/bittorrent-starter-go/ratelimit"
+)
+
+const (
+	DefaultRPCAddress = "127.0.0.1:9080"
+	// Environment variable holding the RPC token for daemon and ctl
+	TokenEnv = "MYBITTORRENT_RPC_TOKEN"
+)
+
+func rpcToken() string {
+	return FlagValue("token", os.Getenv(TokenEnv))
+}
+
+// Run a session until interrupted, controlled over JSON-RPC
+func Daemon(ctx context.Context, args []string) error {
+	token := rpcToken()
+	if token == "" {
+		random := make([]byte, 16)
+		if _, err := rand.Read(random); err != nil {
+			return err
+		}
+		token = hex.EncodeToString(random)
+		fmt.Printf("RPC token: %s\n", token)
+	}
+	backend, err := storageBackend()
+	if err != nil {
+		return err
+	}
+	config := client.SessionConfig{
+		ListenAddress:      FlagValue("listen", ":6881"),
+		Storage:            backend,
+		OutboundEncryption: OutboundEncryption,
+		InboundEncryption:  InboundEncryption,
+		// The --*-limit flags and --alt-schedule set the global limits
+		Download: ratelimit.GlobalDownloadLimit,
+		Upload:   ratelimit.GlobalUploadLimit,
+	}
+	for name, target := range map[string]*int{
+		"max-active-downloads": &config.MaxActiveDownloads,
+		"max-active-seeds":     &config.MaxActiveSeeds,
+		"max-peers":            &config.MaxPeersPerTorrent,
+	} {
+		value, err := strconv.Atoi(FlagValue(name, "0"))
+		if err != nil {
+			return fmt.Errorf("--%s: %v", name, err)
+		}
+		*target = value
+	}
+	session, err := client.NewSession(config)
+	if err != nil {
+		return fmt.Errorf("starting session: %v", err)
+	}
+	defer session.Close()
+	if err := serveMetrics(ctx, session); err != nil {
+		return err
+	}
+	server := daemon.NewServer(session, token, FlagValue("download-dir", "."))
+	listener, err := net.Listen("tcp", FlagValue("rpc", DefaultRPCAddress))
+	if err != nil {
+		return err
+	}
+	httpServer := &http.Server{Handler: server.Handler(), ReadHeaderTimeout: 10 * time.Second}
+	httpServer.RegisterOnShutdown(server.Close)
+	go httpServer.Serve(listener)
+	fmt.Printf("Listening for peers on port %d, RPC on http://%s/rpc and http://%[2]s/transmission/rpc\n", session.Port(), listener.Addr())
+	fmt.Printf("Web UI on http://%s/ (log in with any user name and the RPC token)\n", listener.Addr())
+	<-ctx.Done()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	httpServer.Shutdown(shutdownCtx)
+	return session.Close()
+}
+
+// Talk to a running daemon: ctl <command> [arguments]
+func Ctl(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: ctl <add|list|status|pause|resume|remove|files|peers|trackers|priority|limit|session> [arguments]")
+	}
+	rpc := daemon.NewClient("http://"+FlagValue("rpc", DefaultRPCAddress)+"/rpc", rpcToken())
+	command, args := args[0], args[1:]
+	var method string
+	var params interface{}
+	switch command {
+	case "add":
+		if len(args) != 1 {
+			return errors.New("usage: ctl add <torrent file|URL|magnet link>")
+		}
+		add := daemon.AddParams{
+			Output:     FlagValue("output", ""),
+			Paused:     FlagValue("paused", "false") == "true",
+			Sequential: FlagValue("sequential", "false") == "true",
+			Only:       CommandFlags["only"],
+			Exclude:    CommandFlags["exclude"],
+			Priority:   CommandFlags["priority"],
+		}
+		if strings.Contains(args[0], "://") || strings.HasPrefix(args[0], "magnet:") {
+			add.URL = args[0]
+		} else {
+			// Send the file itself so a remote daemon can add it
+			data, err := os.ReadFile(args[0])
+			if err != nil {
+				return err
+			}
+			add.Metainfo = data
+		}
+		method, params = "torrent.add", add
+	case "list":
+		var statuses []client.TorrentStatus
+		if err := rpc.Call(ctx, "torrent.list", nil, &statuses); err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			fmt.Printf("%s  %-11s  %5.1f%%  %s\n", status.InfoHash, status.State, 100*float64(status.Have)/float64(max(status.Pieces, 1)), status.Name)
+		}
+		return nil
+	case "status", "pause", "resume", "files", "peers", "trackers":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: ctl %s <info hash>", command)
+		}
+		method = "torrent." + command
+		if command == "status" {
+			method = "torrent.get"
+		}
+		params = map[string]string{"hash": args[0]}
+	case "remove":
+		if len(args) != 1 {
+			return errors.New("usage: ctl remove <info hash> [--delete-data]")
+		}
+		method, params = "torrent.remove", daemon.RemoveParams{Hash: args[0], DeleteData: FlagValue("delete-data", "false") == "true"}
+	case "priority":
+		if len(args) < 3 {
+			return errors.New("usage: ctl priority <info hash> <skip|low|normal|high> <file index>...")
+		}
+		priority, err := client.ParsePriority(args[1])
+		if err != nil {
+			return err
+		}
+		p := daemon.PriorityParams{Hash: args[0], Priority: priority}
+		for _, arg := range args[2:] {
+			file, err := strconv.Atoi(arg)
+			if err != nil {
+				return fmt.Errorf("invalid file index: %s", arg)
+			}
+			p.Files = append(p.Files, file)
+		}
+		method, params = "torrent.set_priority", p
+	case "limit":
+		// ctl limit [<info hash>] [--down=<rate>] [--up=<rate>] [--peer-down=<rate>] [--peer-up=<rate>]
+		p := daemon.LimitParams{}
+		method = "session.set_limits"
+		if len(args) > 0 {
+			p.Hash, method = args[0], "torrent.set_limits"
+		}
+		for name, target := range map[string]**int{"down": &p.Download, "up": &p.Upload, "peer-down": &p.PeerDownload, "peer-up": &p.PeerUpload} {
+			if value := FlagValue(name, ""); value != "" {
+				rate, err := ratelimit.ParseRate(value)
+				if err != nil {
+					return fmt.Errorf("--%s: %v", name, err)
+				}
+				*target = &rate
+			}
+		}
+		params = p
+	case "session":
+		method = "session.get"
+	default:
+		return fmt.Errorf("unknown ctl command: %s", command)
+	}
+	var result json.RawMessage
+	if err := rpc.Call(ctx, method, params, &result); err != nil {
+		return err
+	}
+	output, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(output))
+	return nil
+}
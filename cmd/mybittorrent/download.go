@@ -1,222 +1,147 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"math"
-	"net"
 	"os"
 	"strconv"
-)
-
-func DownloadPiece() {
-	var filePath, outputPath, pieceIndex string
-
-	if os.Args[2] == "-o" {
-		outputPath = os.Args[3]
-		filePath = os.Args[4]
-		pieceIndex = os.Args[5]
-	} else {
-		outputPath = os.Args[2]
-		filePath = os.Args[3]
-		pieceIndex = os.Args[4]
-	}
-	// Read the torrent file
-	decoded := ReadFileAndDecode(&filePath)
 
-	if dict, ok := decoded.(map[string]interface{}); ok {
-		// Extract the metadata to get the announce and infoHash
-		announce, length, infoDict, pieceLength, _, err := ExtractMetadata(dict)
-		if err != nil {
-			fmt.Println("Error extracting metadata:", err)
-			return
-		}
-		infoHash, err := ComputeInfoHash(infoDict)
-		if err != nil {
-			fmt.Println("Error computing info hash:", err)
-			return
-		}
-		myPeerID := GeneratePeerID()
-		fileLength, ok := dict["info"].(map[string]interface{})["length"].(int)
-		if !ok {
-			fmt.Println("Error: missing file length in torrent metadata")
-			return
-		}
-		// Query the tracker for a list of peers
-		peers, err := QueryTracker(announce, ConvertToPercentEncoded(infoHash), string(myPeerID[:]), 6881, fileLength)
-		if err != nil {
-			fmt.Println("Error querying tracker:", err)
-			return
-		}
-		peerAddress := peers[0]
-		conn, err := net.Dial("tcp", peerAddress)
-		if err != nil {
-			fmt.Println("Error connecting to Peer:", err)
-			return
-		}
-		defer conn.Close() // Perform handshake
-		_, _, err = PerformHandshake(conn, infoHash)
-		if err != nil {
-			fmt.Println("Error performing handshake:", err)
-			return
-		}
-		// check bitfield
-		if err := CheckRecievedMessage(conn, 5); err != nil {
-			fmt.Println("Error checking bitfield:", err)
-			return
-		}
-		// send interested message
-		interestedMessage := CreatePeerMessage(2, []byte{})
-		_, err = conn.Write(interestedMessage)
-		if err != nil {
-			fmt.Println("Error sending interested message:", err)
-			return
-		}
-		// wait until unchoke message is recieved
-		if err := CheckRecievedMessage(conn, 1); err != nil {
-			fmt.Println("Error checking unchoke message:", err)
-			return
-		}
-		pieceSize := pieceLength
-		pieceCnt := int(math.Ceil(float64(length) / float64(pieceSize)))
-		pieceIndexInt, err := strconv.Atoi(pieceIndex)
-		if err != nil {
-			fmt.Println("Error converting piece index to int:", err)
-			return
-		}
-		if pieceIndexInt == pieceCnt-1 {
-			pieceSize = length % pieceLength
-		}
-		blockSize := 16 * 1024
-		blockCnt := int(math.Ceil(float64(pieceSize) / float64(blockSize)))
-		var data []byte
-		for i := 0; i < blockCnt; i++ {
-			blockData, err := ReadBlock(conn, i, blockSize, pieceSize, pieceIndexInt)
-			if err != nil {
-				fmt.Println("Error reading block:", err)
-				return
-			}
-			data = append(data, blockData...)
-		}
-		file, err := os.Create(outputPath)
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
-		defer file.Close()
-		_, err = file.Write(data)
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
-		fmt.Printf("Piece downloaded to %s.\n", outputPath)
+	"github.com/codecrafters-io/bittorrent-starter-go/client"
+	"github.com/codecrafters-io/bittorrent-starter-go/metainfo"
+	"github.com/codecrafters-io/bittorrent-starter-go/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/ratelimit"
+	"github.com/codecrafters-io/bittorrent-starter-go/storage"
+	"github.com/codecrafters-io/bittorrent-starter-go/tracker"
+)
 
-	} else {
-		fmt.Println("Decoded data is not a dictionary")
+// Split an optional leading "-o <path>" off args, returning the output path
+// and the remaining arguments
+func outputArgs(args []string) (string, []string) {
+	if len(args) > 0 && args[0] == "-o" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return "", nil
 	}
+	return args[0], args[1:]
 }
 
-func Download() {
-	var filePath, outputPath string
+// The storage backend named by --storage, file by default
+func storageBackend() (storage.Backend, error) {
+	name := FlagValue("storage", "file")
+	backend, ok := storage.Backends[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown storage backend: %s", name)
+	}
+	return backend, nil
+}
 
-	if os.Args[2] == "-o" {
-		outputPath = os.Args[3]
-		filePath = os.Args[4]
-	} else {
-		outputPath = os.Args[2]
-		filePath = os.Args[3]
-	}
-	// Read the torrent file
-	decoded := ReadFileAndDecode(&filePath)
+func DownloadPiece(ctx context.Context, args []string) error {
+	outputPath, args := outputArgs(args)
+	if len(args) < 2 {
+		return errors.New("usage: download_piece -o <output> <torrent> <piece>")
+	}
+	info, err := metainfo.Load(args[0])
+	if err != nil {
+		return err
+	}
+	pieceIndex, err := strconv.Atoi(args[1])
+	if err != nil {
+		return fmt.Errorf("invalid piece index: %v", err)
+	}
+	if pieceIndex < 0 || pieceIndex >= info.PieceCount() {
+		return fmt.Errorf("piece index %d out of range, torrent has %d pieces", pieceIndex, info.PieceCount())
+	}
+	// Query the tracker for a list of peers
+	peers, err := tracker.Query(ctx, info.Announce, info.InfoHash, peer.SessionPeerID(), 6881, info.Length)
+	if err != nil {
+		return err
+	}
+	data, sources, err := client.FetchPieceFromPeers(ctx, info, peers, pieceIndex, ratelimit.NewTorrentLimits(), OutboundEncryption)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(outputPath, data, 0o644); err != nil {
+		return err
+	}
+	fmt.Printf("Piece downloaded to %s.\n", outputPath)
+	for _, source := range sources {
+		fmt.Printf("Served by %s (%s): %d/%d blocks\n", source.Address, source.Client, source.Blocks, client.BlockCount(len(data)))
+	}
+	return nil
+}
 
-	if dict, ok := decoded.(map[string]interface{}); ok {
-		// Extract the metadata to get the announce and infoHash
-		announce, length, infoDict, pieceLength, _, err := ExtractMetadata(dict)
-		if err != nil {
-			fmt.Println("Error extracting metadata:", err)
-			return
-		}
-		infoHash, err := ComputeInfoHash(infoDict)
-		if err != nil {
-			fmt.Println("Error computing info hash:", err)
-			return
-		}
-		myPeerID := GeneratePeerID()
-		fileLength, ok := dict["info"].(map[string]interface{})["length"].(int)
-		if !ok {
-			fmt.Println("Error: missing file length in torrent metadata")
-			return
-		}
-		// Query the tracker for a list of peers
-		peers, err := QueryTracker(announce, ConvertToPercentEncoded(infoHash), string(myPeerID[:]), 6881, fileLength)
-		if err != nil {
-			fmt.Println("Error querying tracker:", err)
-			return
-		}
-		peerAddress := peers[0]
-		conn, err := net.Dial("tcp", peerAddress)
-		if err != nil {
-			fmt.Println("Error connecting to Peer:", err)
-			return
-		}
-		defer conn.Close() // Perform handshake
-		_, _, err = PerformHandshake(conn, infoHash)
-		if err != nil {
-			fmt.Println("Error performing handshake:", err)
-			return
-		}
-		// check bitfield
-		if err := CheckRecievedMessage(conn, 5); err != nil {
-			fmt.Println("Error checking bitfield:", err)
-			return
-		}
-		// send interested message
-		interestedMessage := CreatePeerMessage(2, []byte{})
-		_, err = conn.Write(interestedMessage)
+func Download(ctx context.Context, args []string) error {
+	outputPath, args := outputArgs(args)
+	if len(args) < 1 {
+		return errors.New("usage: download -o <output> <torrent>")
+	}
+	info, err := metainfo.Load(args[0])
+	if err != nil {
+		return err
+	}
+	options := &client.TorrentOptions{
+		Sequential: FlagValue("sequential", "false") == "true",
+		Only:       CommandFlags["only"],
+		Exclude:    CommandFlags["exclude"],
+		Priorities: CommandFlags["priority"],
+	}
+	if options.StreamWindow, err = strconv.Atoi(FlagValue("stream-window", strconv.Itoa(client.StreamWindow))); err != nil {
+		return fmt.Errorf("invalid stream window: %v", err)
+	}
+	backend, err := storageBackend()
+	if err != nil {
+		return err
+	}
+	session, err := client.NewSession(client.SessionConfig{
+		ListenAddress:      FlagValue("listen", ""),
+		Storage:            backend,
+		OutboundEncryption: OutboundEncryption,
+		InboundEncryption:  InboundEncryption,
+		// The --*-limit flags and --alt-schedule set the global limits
+		Download: ratelimit.GlobalDownloadLimit,
+		Upload:   ratelimit.GlobalUploadLimit,
+	})
+	if err != nil {
+		return fmt.Errorf("starting session: %v", err)
+	}
+	defer session.Close()
+	if err := serveMetrics(ctx, session); err != nil {
+		return err
+	}
+	torrent, err := session.Add(info, outputPath, options)
+	if err != nil {
+		return err
+	}
+	if address := FlagValue("serve", ""); address != "" {
+		bound, err := torrent.StreamServer().ListenAndServe(address)
 		if err != nil {
-			fmt.Println("Error sending interested message:", err)
-			return
-		}
-		// wait until unchoke message is recieved
-		if err := CheckRecievedMessage(conn, 1); err != nil {
-			fmt.Println("Error checking unchoke message:", err)
-			return
+			return fmt.Errorf("starting stream server: %v", err)
 		}
-		pieceSize := pieceLength
-		pieceCnt := int(math.Ceil(float64(length) / float64(pieceSize)))
-		var data []byte
-		for i := 0; i < pieceCnt; i++ {
-			if i == pieceCnt-1 {
-				pieceSize = length % pieceLength
-			}
-			blockSize := 16 * 1024
-			blockCnt := int(math.Ceil(float64(pieceSize) / float64(blockSize)))
-			var blockDataByte []byte
-			for j := 0; j < blockCnt; j++ {
-				blockData, err := ReadBlock(conn, j, blockSize, pieceSize, i)
-				if err != nil {
-					if err.Error() == "EOF" {
-						break
-					}
-					fmt.Println("Error reading block:", err)
-					return
-				}
-				blockDataByte = append(blockDataByte, blockData...)
+		fmt.Printf("Streaming on http://%s/\n", bound)
+		// Keep serving the finished files until interrupted
+		defer func() { <-ctx.Done() }()
+	}
+	// --quiet keeps the output to the final message
+	var display *progressDisplay
+	if FlagValue("quiet", "false") != "true" {
+		display = startProgress(torrent)
+	}
+	err = torrent.Wait(ctx)
+	if display != nil {
+		display.Stop()
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			// Stop the peers, tell the tracker and save the resume data
+			if err := session.Close(); err != nil {
+				return err
 			}
-			data = append(data, blockDataByte...)
-		}
-		file, err := os.Create(outputPath)
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
-		defer file.Close()
-		_, err = file.Write(data)
-		if err != nil {
-			fmt.Println(err)
-			return
+			return errors.New("download interrupted, progress saved")
 		}
-		fmt.Printf("File downloaded to %s.\n", outputPath)
-	} else {
-		fmt.Println("Decoded data is not a dictionary")
+		return err
 	}
+	fmt.Printf("File downloaded to %s.\n", outputPath)
+	return nil
 }
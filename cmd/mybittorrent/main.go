@@ -1,36 +1,235 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
-	// bencode "github.com/jackpal/bencode-go" // Available if you need it!
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/client"
+	"github.com/codecrafters-io/bittorrent-starter-go/logging"
+	"github.com/codecrafters-io/bittorrent-starter-go/mse"
+	"github.com/codecrafters-io/bittorrent-starter-go/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/ratelimit"
+	"github.com/codecrafters-io/bittorrent-starter-go/trace"
+)
+
+// Flags given as --name or --name=value anywhere on the command line
+var CommandFlags = map[string][]string{}
+
+// Stream encryption of outbound and inbound peer connections, from
+// --encryption and --encryption-in
+var (
+	OutboundEncryption = mse.EncryptionDisabled
+	InboundEncryption  = mse.EncryptionPreferred
 )
 
+// Split --name[=value] flags out of args, leaving the positional arguments in place
+func SplitFlags(args []string) ([]string, map[string][]string) {
+	positional := make([]string, 0, len(args))
+	flags := make(map[string][]string)
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "--") || len(arg) == 2 {
+			positional = append(positional, arg)
+			continue
+		}
+		name, value, found := strings.Cut(arg[2:], "=")
+		if !found {
+			value = "true"
+		}
+		flags[name] = append(flags[name], value)
+	}
+	return positional, flags
+}
+
+// Return the last value given for a flag, or fallback when it is absent
+func FlagValue(name string, fallback string) string {
+	values := CommandFlags[name]
+	if len(values) == 0 {
+		return fallback
+	}
+	return values[len(values)-1]
+}
+
+func ApplyGlobalFlags() error {
+	if value := FlagValue("encryption", ""); value != "" {
+		policy, err := mse.ParseEncryptionPolicy(value)
+		if err != nil {
+			return err
+		}
+		OutboundEncryption = policy
+	}
+	if value := FlagValue("encryption-in", ""); value != "" {
+		policy, err := mse.ParseEncryptionPolicy(value)
+		if err != nil {
+			return err
+		}
+		InboundEncryption = policy
+	}
+	if value := FlagValue("transport", ""); value != "" {
+		transports, err := peer.ParseTransports(value)
+		if err != nil {
+			return err
+		}
+		peer.Transports = transports
+	}
+	if value := FlagValue("pipeline", ""); value != "" {
+		depth, err := strconv.Atoi(value)
+		if err != nil || depth < 1 {
+			return fmt.Errorf("--pipeline: invalid request queue depth %q", value)
+		}
+		peer.PipelineDepth = depth
+	}
+	if code, version := FlagValue("client-code", ""), FlagValue("client-version", ""); code != "" || version != "" {
+		if err := peer.SetClientIdentity(FlagValue("client-code", peer.ClientCode), FlagValue("client-version", peer.ClientVersion)); err != nil {
+			return err
+		}
+	}
+	client.StateDir = FlagValue("state-dir", client.StateDir)
+	// Record wire traffic to a JSONL file for the replay command
+	if path := FlagValue("trace", ""); path != "" {
+		recorder, err := trace.Create(path)
+		if err != nil {
+			return err
+		}
+		trace.Enable(recorder)
+	}
+	if err := ApplyLogFlags(); err != nil {
+		return err
+	}
+	return ApplyRateFlags()
+}
+
+// Environment variables read when the matching --log-* flag is absent
+const (
+	LogLevelEnv  = "MYBITTORRENT_LOG"
+	LogFormatEnv = "MYBITTORRENT_LOG_FORMAT"
+)
+
+// Configure logging from --log-level, --log-format and --log-file. Logs go to
+// stderr unless a file is given, which is rotated at --log-max-size keeping
+// --log-backups old files.
+func ApplyLogFlags() error {
+	config := logging.Config{
+		Level:  FlagValue("log-level", os.Getenv(LogLevelEnv)),
+		Format: FlagValue("log-format", os.Getenv(LogFormatEnv)),
+	}
+	if path := FlagValue("log-file", ""); path != "" {
+		maxSize, err := ratelimit.ParseRate(FlagValue("log-max-size", "10m"))
+		if err != nil {
+			return fmt.Errorf("--log-max-size: %v", err)
+		}
+		backups, err := strconv.Atoi(FlagValue("log-backups", "3"))
+		if err != nil {
+			return fmt.Errorf("--log-backups: %v", err)
+		}
+		file, err := logging.OpenRotatingFile(path, int64(maxSize), backups)
+		if err != nil {
+			return err
+		}
+		config.Output = file
+	}
+	return logging.Configure(config)
+}
+
+// Configure the limiters from the --*-limit and --alt-* flags
+func ApplyRateFlags() error {
+	var download, upload, altDownload, altUpload int
+	for name, target := range map[string]*int{
+		"download-limit":         &download,
+		"upload-limit":           &upload,
+		"torrent-download-limit": &ratelimit.TorrentDownloadRate,
+		"torrent-upload-limit":   &ratelimit.TorrentUploadRate,
+		"peer-download-limit":    &ratelimit.PeerDownloadRate,
+		"peer-upload-limit":      &ratelimit.PeerUploadRate,
+		"alt-download-limit":     &altDownload,
+		"alt-upload-limit":       &altUpload,
+	} {
+		value := FlagValue(name, "")
+		if value == "" {
+			continue
+		}
+		rate, err := ratelimit.ParseRate(value)
+		if err != nil {
+			return fmt.Errorf("--%s: %v", name, err)
+		}
+		*target = rate
+	}
+	ratelimit.GlobalDownloadLimit.SetRate(download)
+	ratelimit.GlobalUploadLimit.SetRate(upload)
+	if len(CommandFlags["alt-schedule"]) == 0 {
+		return nil
+	}
+	schedule := &ratelimit.Schedule{Download: download, Upload: upload, AltDownload: altDownload, AltUpload: altUpload}
+	for _, value := range CommandFlags["alt-schedule"] {
+		window, err := ratelimit.ParseScheduleWindow(value)
+		if err != nil {
+			return fmt.Errorf("--alt-schedule: %v", err)
+		}
+		schedule.Windows = append(schedule.Windows, window)
+	}
+	go schedule.Run(nil)
+	return nil
+}
+
+// A command gets the positional arguments that follow its name
+type Command func(ctx context.Context, args []string) error
+
+var commands = map[string]Command{
+	"decode":         Decode,
+	"info":           ProcessInfo,
+	"peers":          ProcessPeersInfo,
+	"handshake":      ProcessHandshake,
+	"download_piece": DownloadPiece,
+	"download":       Download,
+	"daemon":         Daemon,
+	"ctl":            Ctl,
+	"tracker":        Tracker,
+	"simulate":       Simulate,
+	"replay":         Replay,
+}
+
+func Decode(ctx context.Context, args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: decode <bencoded value>")
+	}
+	decoded, _, err := bencode.Decode(args[0])
+	if err != nil {
+		return err
+	}
+	jsonOutput, _ := json.Marshal(decoded)
+	fmt.Println(string(jsonOutput))
+	return nil
+}
+
 func main() {
-	command := os.Args[1]
-
-	switch command {
-	case "decode":
-		bencodedValue := os.Args[2]
-		decoded, _, err := DecodeBencode(bencodedValue)
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
-		jsonOutput, _ := json.Marshal(decoded)
-		fmt.Println(string(jsonOutput))
-	case "info":
-		ProcessInfo()
-	case "peers":
-		ProcessPeersInfo()
-	case "handshake":
-		ProcessHandshake()
-	case "download_piece":
-		DownloadPiece()
-	case "download":
-		Download()
-	default:
+	var args []string
+	args, CommandFlags = SplitFlags(os.Args[1:])
+	if err := ApplyGlobalFlags(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if len(args) == 0 {
+		fmt.Println("Usage: mybittorrent <command> [arguments]")
+		os.Exit(1)
+	}
+	command, ok := commands[args[0]]
+	if !ok {
 		fmt.Println("Unknown command specified")
+		os.Exit(1)
+	}
+	// The first Ctrl-C stops the command gracefully; a second one kills it
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	context.AfterFunc(ctx, stop)
+	err := command(ctx, args[1:])
+	stop()
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
 	}
 }
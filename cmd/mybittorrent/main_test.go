@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/client"
+	"github.com/codecrafters-io/bittorrent-starter-go/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/testutil"
+)
+
+func TestMain(m *testing.M) {
+	// The fake peers speak TCP only, and misbehaving ones should not hold a
+	// test up for the full timeouts
+	peer.Transports = []string{"tcp"}
+	peer.Timeout = time.Second
+	client.TrackerRetryInterval = 200 * time.Millisecond
+	os.Exit(m.Run())
+}
+
+// Run a command with the given flags, returning what it printed
+func run(t *testing.T, command Command, flags map[string][]string, args ...string) (string, error) {
+	t.Helper()
+	CommandFlags = flags
+	if CommandFlags == nil {
+		CommandFlags = map[string][]string{}
+	}
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	output := make(chan string)
+	go func() {
+		var buffer bytes.Buffer
+		io.Copy(&buffer, reader)
+		output <- buffer.String()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	err = command(ctx, args)
+	os.Stdout = stdout
+	writer.Close()
+	return <-output, err
+}
+
+// Start fake peers seeding tor, one per behavior, and a tracker handing them
+// out in that order. Returns the path of a .torrent file announcing to it.
+func startSwarm(t *testing.T, tor *testutil.Torrent, behaviors ...testutil.Behavior) (string, []*testutil.Peer, *testutil.Tracker) {
+	t.Helper()
+	var peers []*testutil.Peer
+	var addresses []string
+	for _, behavior := range behaviors {
+		p, err := testutil.NewPeer(tor, behavior)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { p.Close() })
+		peers = append(peers, p)
+		addresses = append(addresses, p.Addr())
+	}
+	tracker := testutil.NewTracker(addresses...)
+	t.Cleanup(tracker.Close)
+	torrentPath := filepath.Join(t.TempDir(), tor.Name+".torrent")
+	if err := tor.WriteFile(torrentPath, tracker.AnnounceURL()); err != nil {
+		t.Fatal(err)
+	}
+	return torrentPath, peers, tracker
+}
+
+func TestHandshake(t *testing.T) {
+	tor := testutil.NewTorrent("sample.bin", 32<<10, 100<<10)
+	torrentPath, peers, _ := startSwarm(t, tor, testutil.Behavior{})
+
+	output, err := run(t, ProcessHandshake, nil, torrentPath, peers[0].Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Peer ID: " + hex.EncodeToString(peers[0].PeerID[:]) + "\n"
+	if output != want {
+		t.Errorf("output = %q, want %q", output, want)
+	}
+
+	output, err = run(t, ProcessHandshake, map[string][]string{"identify": {"true"}}, torrentPath, peers[0].Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(output, want) || !strings.Contains(output, "\nClient: ") {
+		t.Errorf("identified handshake output = %q", output)
+	}
+}
+
+func TestHandshakeWrongTorrent(t *testing.T) {
+	tor := testutil.NewTorrent("sample.bin", 32<<10, 100<<10)
+	other := testutil.NewTorrent("other.bin", 32<<10, 90<<10)
+	_, peers, _ := startSwarm(t, tor, testutil.Behavior{})
+	otherPath := filepath.Join(t.TempDir(), "other.torrent")
+	if err := other.WriteFile(otherPath, "http://127.0.0.1:1/announce"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The fake peer hangs up on an info hash it does not seed
+	if _, err := run(t, ProcessHandshake, nil, otherPath, peers[0].Addr()); err == nil {
+		t.Error("handshake for a torrent the peer does not seed succeeded")
+	}
+}
+
+func TestPeers(t *testing.T) {
+	tor := testutil.NewTorrent("sample.bin", 32<<10, 100<<10)
+	torrentPath, peers, tracker := startSwarm(t, tor, testutil.Behavior{}, testutil.Behavior{NoUnchoke: true})
+
+	output, err := run(t, ProcessPeersInfo, nil, torrentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := peers[0].Addr() + "\n" + peers[1].Addr() + "\n"; output != want {
+		t.Errorf("output = %q, want %q", output, want)
+	}
+	requests, infoHash := tracker.Requests(), tor.InfoHashBytes()
+	if len(requests) != 1 || requests[0].Get("info_hash") != string(infoHash[:]) {
+		t.Errorf("tracker got %v, want one announce for the torrent", requests)
+	}
+
+	output, err = run(t, ProcessPeersInfo, map[string][]string{"identify": {"true"}}, torrentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(output), "\n"); len(lines) != 2 || !strings.HasPrefix(lines[0], peers[0].Addr()+"\t") {
+		t.Errorf("identified peers = %q", output)
+	}
+}
+
+func TestPeersTrackerFailure(t *testing.T) {
+	tor := testutil.NewTorrent("sample.bin", 32<<10, 100<<10)
+	torrentPath, _, tracker := startSwarm(t, tor, testutil.Behavior{})
+	tracker.SetFailure("torrent not registered")
+
+	if _, err := run(t, ProcessPeersInfo, nil, torrentPath); err == nil || !strings.Contains(err.Error(), "torrent not registered") {
+		t.Errorf("err = %v, want the tracker's failure reason", err)
+	}
+}
+
+func TestDownloadPiece(t *testing.T) {
+	tor := testutil.NewTorrent("sample.bin", 64<<10, 200<<10)
+	torrentPath, peers, _ := startSwarm(t, tor, testutil.Behavior{}, testutil.Behavior{})
+	for _, piece := range []int{0, 3} {
+		output := filepath.Join(t.TempDir(), "piece")
+		printed, err := run(t, DownloadPiece, nil, "-o", output, torrentPath, strconv.Itoa(piece))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, tor.Piece(piece)) {
+			t.Errorf("piece %d differs from the torrent", piece)
+		}
+		if !strings.HasPrefix(printed, "Piece downloaded to "+output+".\n") || !strings.Contains(printed, "Served by ") {
+			t.Errorf("output = %q", printed)
+		}
+	}
+	if peers[0].BlocksServed() == 0 || peers[1].BlocksServed() == 0 {
+		t.Errorf("blocks were not spread over both peers: %d and %d", peers[0].BlocksServed(), peers[1].BlocksServed())
+	}
+}
+
+func TestDownloadPieceOutOfRange(t *testing.T) {
+	tor := testutil.NewTorrent("sample.bin", 64<<10, 200<<10)
+	torrentPath, _, _ := startSwarm(t, tor, testutil.Behavior{})
+	if _, err := run(t, DownloadPiece, nil, "-o", filepath.Join(t.TempDir(), "piece"), torrentPath, "4"); err == nil {
+		t.Error("downloading a piece past the end succeeded")
+	}
+}
+
+// One misbehaving peer ahead of a well-behaved one
+var misbehaviors = map[string]testutil.Behavior{
+	"missing piece":  {Missing: []int{0, 1, 2, 3}},
+	"corrupt":        {CorruptPieces: []int{0, 1, 2, 3}},
+	"never unchokes": {NoUnchoke: true},
+	"chokes":         {ChokeAfter: 1},
+	"stalls":         {StallAfter: 1},
+	"disconnects":    {DisconnectAfter: 1},
+}
+
+func TestDownloadPieceMisbehavingPeer(t *testing.T) {
+	for name, behavior := range misbehaviors {
+		t.Run(name, func(t *testing.T) {
+			tor := testutil.NewTorrent("sample.bin", 64<<10, 200<<10)
+			torrentPath, peers, _ := startSwarm(t, tor, behavior, testutil.Behavior{})
+			output := filepath.Join(t.TempDir(), "piece")
+			printed, err := run(t, DownloadPiece, nil, "-o", output, torrentPath, "1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, tor.Piece(1)) {
+				t.Error("piece differs from the torrent")
+			}
+			if !strings.Contains(printed, "Served by "+peers[1].Addr()) {
+				t.Errorf("the well-behaved peer is not among the sources: %q", printed)
+			}
+			if behavior.CorruptPieces != nil && strings.Contains(printed, "Served by "+peers[0].Addr()) {
+				t.Errorf("the corrupt peer is credited with the piece: %q", printed)
+			}
+		})
+	}
+}
+
+func TestDownloadPieceOnlyCorruptPeers(t *testing.T) {
+	tor := testutil.NewTorrent("sample.bin", 64<<10, 200<<10)
+	torrentPath, _, _ := startSwarm(t, tor, testutil.Behavior{CorruptPieces: []int{2}}, testutil.Behavior{CorruptPieces: []int{2}})
+	output := filepath.Join(t.TempDir(), "piece")
+	if _, err := run(t, DownloadPiece, nil, "-o", output, torrentPath, "2"); !errors.Is(err, client.ErrHashCheck) {
+		t.Errorf("err = %v, want ErrHashCheck", err)
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Error("a piece failing its hash check was written")
+	}
+}
+
+func TestDownload(t *testing.T) {
+	for name, files := range map[string][]int{"single file": {300 << 10}, "multiple files": {100 << 10, 5, 150 << 10}} {
+		t.Run(name, func(t *testing.T) {
+			tor := testutil.NewTorrent("sample", 64<<10, files...)
+			torrentPath, _, tracker := startSwarm(t, tor, testutil.Behavior{}, testutil.Behavior{Missing: []int{0, 1}})
+			output := filepath.Join(t.TempDir(), "sample")
+			printed, err := run(t, Download, map[string][]string{"quiet": {"true"}}, "-o", output, torrentPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if printed != "File downloaded to "+output+".\n" {
+				t.Errorf("output = %q", printed)
+			}
+			if err := tor.Check(output); err != nil {
+				t.Fatal(err)
+			}
+			if events := tracker.Events(); !slices.Contains(events, "started") || !slices.Contains(events, "completed") {
+				t.Errorf("tracker events = %q, want started and completed", events)
+			}
+		})
+	}
+}
+
+func TestDownloadMisbehavingPeers(t *testing.T) {
+	tor := testutil.NewTorrent("sample", 32<<10, 100<<10, 3, 90<<10)
+	var behaviors []testutil.Behavior
+	for _, behavior := range misbehaviors {
+		behaviors = append(behaviors, behavior)
+	}
+	torrentPath, _, _ := startSwarm(t, tor, append(behaviors, testutil.Behavior{Missing: []int{0}})...)
+	output := filepath.Join(t.TempDir(), "sample")
+	if _, err := run(t, Download, map[string][]string{"quiet": {"true"}}, "-o", output, torrentPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := tor.Check(output); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/client"
+	"github.com/codecrafters-io/bittorrent-starter-go/metrics"
+)
+
+// Serve Prometheus metrics at /metrics on the address given with --metrics,
+// if any, until ctx is done
+func serveMetrics(ctx context.Context, session *client.Session) error {
+	address := FlagValue("metrics", "")
+	if address == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("starting metrics server: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler(session))
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go server.Serve(listener)
+	context.AfterFunc(ctx, func() { server.Close() })
+	fmt.Printf("Metrics on http://%s/metrics\n", listener.Addr())
+	return nil
+}
@@ -1,98 +1,103 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"net"
-	"os"
+	"sync"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/metainfo"
+	"github.com/codecrafters-io/bittorrent-starter-go/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/tracker"
 )
 
-func ProcessInfo() {
-	decoded := ReadFileAndDecode(nil)
-	if dict, ok := decoded.(map[string]interface{}); ok {
-		announce, length, infoDict, pieceLength, pieces, err := ExtractMetadata(dict)
-		if err != nil {
-			fmt.Println("Error extracting metadata:", err)
-			return
-		}
-		infoHash, err := ComputeInfoHash(infoDict)
-		if err != nil {
-			fmt.Println("Error computing info hash:", err)
-			return
-		}
-		// Print the tracker URL, file length, and info hash
-		fmt.Printf("Tracker URL: %s\nLength: %d\nInfo Hash: %s\n", announce, length, infoHash)
-		// Print the piece length and piece hashes
-		fmt.Printf("Piece Length: %d\nPiece Hashes:\n", pieceLength)
-		PrintPieceHashes(pieces)
-	} else {
-		fmt.Println("Decoded data is not a dictionary")
+func ProcessInfo(ctx context.Context, args []string) error {
+	if len(args) < 1 {
+		return errors.New("usage: info <torrent>")
+	}
+	info, err := metainfo.Load(args[0])
+	if err != nil {
+		return err
 	}
+	// Print the tracker URL, file length, and info hash
+	fmt.Printf("Tracker URL: %s\nLength: %d\nInfo Hash: %s\n", info.Announce, info.Length, info.InfoHash)
+	// Print the piece length and piece hashes
+	fmt.Printf("Piece Length: %d\nPiece Hashes:\n", info.PieceLength)
+	PrintPieceHashes(info.Pieces)
+	return nil
 }
 
-func ProcessPeersInfo() {
-	decoded := ReadFileAndDecode(nil)
-	if dict, ok := decoded.(map[string]interface{}); ok {
-		announce, _, infoDict, _, _, err := ExtractMetadata(dict)
-		if err != nil {
-			fmt.Println("Error extracting metadata:", err)
-			return
-		}
-		infoHash, err := ComputeInfoHash(infoDict)
-		if err != nil {
-			fmt.Println("Error computing info hash:", err)
-			return
-		}
-		peerID := GeneratePeerID()
-		fileLength, ok := dict["info"].(map[string]interface{})["length"].(int)
-		if !ok {
-			fmt.Println("Error: missing file length in torrent metadata")
-			return
-		}
-		stringPeerID := string(peerID[:])
-		peers, err := QueryTracker(announce, ConvertToPercentEncoded(infoHash), stringPeerID, 6881, fileLength)
-		if err != nil {
-			fmt.Println("Error querying tracker:", err)
-			return
-		}
-		for _, peer := range peers {
-			fmt.Println(peer)
+func ProcessPeersInfo(ctx context.Context, args []string) error {
+	if len(args) < 1 {
+		return errors.New("usage: peers <torrent>")
+	}
+	info, err := metainfo.Load(args[0])
+	if err != nil {
+		return err
+	}
+	peers, err := tracker.Query(ctx, info.Announce, info.InfoHash, peer.SessionPeerID(), 6881, info.Length)
+	if err != nil {
+		return err
+	}
+	if FlagValue("identify", "false") != "true" {
+		for _, address := range peers {
+			fmt.Println(address)
 		}
-	} else {
-		fmt.Println("Decoded data is not a dictionary")
+		return nil
+	}
+	// Handshake with every peer concurrently to find out which client it runs
+	clients := make([]string, len(peers))
+	var wg sync.WaitGroup
+	for i, address := range peers {
+		wg.Add(1)
+		go func(i int, address string) {
+			defer wg.Done()
+			clients[i] = IdentifyPeer(ctx, address, info.InfoHash)
+		}(i, address)
+	}
+	wg.Wait()
+	for i, address := range peers {
+		fmt.Printf("%s\t%s\n", address, clients[i])
 	}
+	return nil
 }
 
-func ProcessHandshake() {
-	peerAddress := os.Args[3]
-	decoded := ReadFileAndDecode(nil)
-	if dict, ok := decoded.(map[string]interface{}); ok {
-		// Extract the metadata to get the announce and infoHash
-		_, _, infoDict, _, _, err := ExtractMetadata(dict)
-		if err != nil {
-			fmt.Println("Error extracting metadata:", err)
-			return
-		}
-		infoHash, err := ComputeInfoHash(infoDict)
-		if err != nil {
-			fmt.Println("Error computing info hash:", err)
-			return
-		}
-		conn, err := net.Dial("tcp", peerAddress)
-		if err != nil {
-			fmt.Println("Error connecting to Peer:", err)
-			return
-		}
-		defer conn.Close()
-		// Perform handshake
-		_, response, err := PerformHandshake(conn, infoHash)
-		peerID := ExtractPeerId(response)
-		if err != nil {
-			fmt.Println("Error performing handshake:", err)
-			return
-		}
-		// Print the received peer ID
-		fmt.Printf("Peer ID: %s\n", peerID)
-	} else {
-		fmt.Println("Decoded data is not a dictionary")
+func ProcessHandshake(ctx context.Context, args []string) error {
+	if len(args) < 2 {
+		return errors.New("usage: handshake <torrent> <peer address>")
+	}
+	info, err := metainfo.Load(args[0])
+	if err != nil {
+		return err
+	}
+	conn, err := peer.Dial(ctx, args[1], info.InfoHash, OutboundEncryption)
+	if err != nil {
+		return fmt.Errorf("connecting to peer: %v", err)
+	}
+	defer conn.Close()
+	handshake, err := peer.PerformHandshake(conn, info.InfoHash)
+	if err != nil {
+		return fmt.Errorf("performing handshake: %v", err)
+	}
+	// Print the received peer ID
+	fmt.Printf("Peer ID: %s\n", hex.EncodeToString(handshake.PeerID[:]))
+	// Naming the client may wait for the extended handshake, so only on request
+	if FlagValue("identify", "false") == "true" {
+		fmt.Printf("Client: %s\n", peer.IdentifyConnected(conn, handshake))
+	}
+	return nil
+}
+
+func IdentifyPeer(ctx context.Context, peerAddress string, infoHash string) string {
+	conn, err := peer.Dial(ctx, peerAddress, infoHash, OutboundEncryption)
+	if err != nil {
+		return "unreachable"
+	}
+	defer conn.Close()
+	handshake, err := peer.PerformHandshake(conn, infoHash)
+	if err != nil {
+		return "handshake failed"
 	}
+	return peer.IdentifyConnected(conn, handshake)
 }
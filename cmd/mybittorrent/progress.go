@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/client"
+	"github.com/codecrafters-io/bittorrent-starter-go/peer"
+)
+
+var (
+	// How often the progress display is redrawn on a terminal, and how often
+	// a progress line is printed otherwise
+	ProgressInterval     = 500 * time.Millisecond
+	ProgressLineInterval = 5 * time.Second
+	// Files listed under the progress bar of a multi-file torrent
+	ProgressMaxFiles = 10
+)
+
+// Live progress of a download. On a terminal the display is redrawn in place;
+// when output is redirected a plain line is printed now and then instead.
+type progressDisplay struct {
+	torrent *client.Torrent
+	out     io.Writer
+	tty     bool
+	width   int
+	drawn   int // lines of the previous frame, erased before the next
+	stop    chan struct{}
+	done    sync.WaitGroup
+}
+
+func isTerminal(file *os.File) bool {
+	stat, err := file.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
+
+// Terminal width from $COLUMNS, 80 when unknown
+func terminalWidth() int {
+	if columns, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && columns > 20 {
+		return columns
+	}
+	return 80
+}
+
+func startProgress(torrent *client.Torrent) *progressDisplay {
+	d := &progressDisplay{
+		torrent: torrent,
+		out:     os.Stdout,
+		tty:     isTerminal(os.Stdout),
+		width:   terminalWidth(),
+		stop:    make(chan struct{}),
+	}
+	interval := ProgressLineInterval
+	if d.tty {
+		interval = ProgressInterval
+	}
+	d.done.Add(1)
+	go func() {
+		defer d.done.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				d.render()
+			case <-d.stop:
+				return
+			}
+		}
+	}()
+	return d
+}
+
+// Stop updating, drawing the final state once more on a terminal
+func (d *progressDisplay) Stop() {
+	close(d.stop)
+	d.done.Wait()
+	if d.tty {
+		d.render()
+	}
+}
+
+func (d *progressDisplay) render() {
+	status := d.torrent.Status()
+	available := 0
+	for _, tracker := range d.torrent.Trackers() {
+		available += tracker.Peers
+	}
+	percent := 100.0
+	if status.Size > 0 {
+		percent = 100 * float64(status.Size-status.Left) / float64(status.Size)
+	}
+	summary := fmt.Sprintf("%5.1f%%  down %s  up %s  peers %d/%d  ETA %s",
+		percent, formatRate(status.DownloadRate), formatRate(status.UploadRate), status.Peers, available, formatETA(status.Left, status.DownloadRate))
+	if !d.tty {
+		fmt.Fprintf(d.out, "Progress: %s\n", summary)
+		return
+	}
+
+	lines := []string{
+		truncate(status.Name, d.width),
+		piecesBar(d.torrent.Pieces(), status.Pieces, d.width-2),
+		truncate(summary, d.width),
+	}
+	if files := d.torrent.Files(); len(files) > 1 {
+		for i, file := range files {
+			if i == ProgressMaxFiles {
+				lines = append(lines, fmt.Sprintf("  … and %d more files", len(files)-i))
+				break
+			}
+			filePercent := 100.0
+			if file.Length > 0 {
+				filePercent = 100 * float64(file.Completed) / float64(file.Length)
+			}
+			line := fmt.Sprintf("  %5.1f%%  %-6s  %s", filePercent, file.Priority, file.Path)
+			lines = append(lines, truncate(line, d.width))
+		}
+	}
+	var frame strings.Builder
+	if d.drawn > 0 {
+		// Back to the start of the previous frame, clearing it
+		fmt.Fprintf(&frame, "\x1b[%dA\r\x1b[J", d.drawn)
+	}
+	for _, line := range lines {
+		frame.WriteString(line)
+		frame.WriteByte('\n')
+	}
+	io.WriteString(d.out, frame.String())
+	d.drawn = len(lines)
+}
+
+// Draw the piece map squeezed into width cells: '#' where every piece of
+// the cell is verified, '+' where some are and '.' where none are
+func piecesBar(have peer.Bitfield, pieces int, width int) string {
+	cells := min(max(width, 10), max(pieces, 1))
+	var bar strings.Builder
+	bar.WriteByte('[')
+	for cell := 0; cell < cells; cell++ {
+		first, last := cell*pieces/cells, (cell+1)*pieces/cells
+		count := 0
+		for piece := first; piece < last; piece++ {
+			if have.Has(piece) {
+				count++
+			}
+		}
+		switch {
+		case count > 0 && count == last-first:
+			bar.WriteByte('#')
+		case count > 0:
+			bar.WriteByte('+')
+		default:
+			bar.WriteByte('.')
+		}
+	}
+	bar.WriteByte(']')
+	return bar.String()
+}
+
+func truncate(line string, width int) string {
+	runes := []rune(line)
+	if len(runes) <= width {
+		return line
+	}
+	return string(runes[:width-1]) + "…"
+}
+
+func formatBytes(bytes int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(bytes)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+func formatRate(rate int64) string {
+	return formatBytes(rate) + "/s"
+}
+
+func formatETA(left int64, rate int64) string {
+	if left == 0 {
+		return "done"
+	}
+	if rate == 0 {
+		return "--"
+	}
+	return (time.Duration(left/rate) * time.Second).String()
+}
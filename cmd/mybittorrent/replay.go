@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/metainfo"
+	"github.com/codecrafters-io/bittorrent-starter-go/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/trace"
+)
+
+// Replay a trace recorded with --trace through the peer wire code and print
+// the state each connection ended in; --events also prints the trace itself.
+// Fails when any connection could not be replayed, so a trace of an interop
+// problem can serve as a regression test. The torrent, when given, sizes the
+// peers' bitfields.
+func Replay(ctx context.Context, args []string) error {
+	if len(args) < 1 {
+		return errors.New("usage: replay <trace> [torrent]")
+	}
+	events, err := trace.LoadFile(args[0])
+	if err != nil {
+		return err
+	}
+	pieceCount := 0
+	if len(args) > 1 {
+		info, err := metainfo.Load(args[1])
+		if err != nil {
+			return err
+		}
+		pieceCount = info.PieceCount()
+	}
+	if FlagValue("events", "false") == "true" {
+		for _, event := range events {
+			detail := event.Summary
+			if event.Error != "" {
+				detail = "error: " + event.Error
+			}
+			fmt.Printf("%s %-21s %-3s %-16s %-14s %s\n", event.Time.Format("15:04:05.000"), event.Conn, event.Dir, event.Kind, event.Name, detail)
+		}
+	}
+	failed := 0
+	for _, result := range peer.Replay(events, pieceCount) {
+		state := "unchoked"
+		if result.Choked {
+			state = "choked"
+		}
+		fmt.Printf("%s (%s): %d messages, %s, has %d pieces\n", result.Conn, result.Client, result.Messages, state, result.Pieces)
+		if result.Err != nil {
+			fmt.Printf("  error: %v\n", result.Err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d connections failed to replay", failed)
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReplay(t *testing.T) {
+	output, err := run(t, Replay, map[string][]string{"events": {"true"}}, "../../peer/testdata/fetch_piece.jsonl")
+	if err == nil || err.Error() != "1 connections failed to replay" {
+		t.Errorf("err = %v, want the malformed connection reported", err)
+	}
+	for _, want := range []string{
+		"127.0.0.1:33771 (Unknown (TU) 0.0.0.1): 4 messages, unchoked, has 3 pieces\n",
+		"127.0.0.1:36079 (Unknown (TU) 0.0.0.1): 1 messages, choked, has 1 pieces\n",
+		"  error: message 1: peer 127.0.0.1:51413 announced piece 7 out of range",
+		"piece=0 begin=16384 length=16384",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("output lacks %q:\n%s", want, output)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/ratelimit"
+	"github.com/codecrafters-io/bittorrent-starter-go/sim"
+	"github.com/codecrafters-io/bittorrent-starter-go/testutil"
+)
+
+// Simulate a swarm sharing a generated torrent on a virtual clock and print
+// how it went. Sizes and rates take k, m and g suffixes.
+func Simulate(ctx context.Context, args []string) error {
+	config := sim.Config{
+		Seeds:    1,
+		Leechers: 10,
+		Network: sim.NetworkConfig{
+			Latency:      50 * time.Millisecond,
+			UploadRate:   1 << 20,
+			DownloadRate: 4 << 20,
+		},
+		Pipeline:    sim.DefaultPipeline,
+		UploadSlots: 4,
+		Rechoke:     sim.DefaultRechoke,
+		MaxTime:     sim.DefaultMaxTime,
+	}
+	size, pieceLength := 16<<20, 256<<10
+	var seed int
+	for name, target := range map[string]*int{
+		"seeds":    &config.Seeds,
+		"leechers": &config.Leechers,
+		"corrupt":  &config.Corrupt,
+		"pipeline": &config.Pipeline,
+		"slots":    &config.UploadSlots,
+		"seed":     &seed,
+	} {
+		value := FlagValue(name, "")
+		if value == "" {
+			continue
+		}
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 0 {
+			return fmt.Errorf("--%s: invalid number %q", name, value)
+		}
+		*target = number
+	}
+	for name, target := range map[string]*int{
+		"size":         &size,
+		"piece-length": &pieceLength,
+		"upload":       &config.Network.UploadRate,
+		"download":     &config.Network.DownloadRate,
+	} {
+		value := FlagValue(name, "")
+		if value == "" {
+			continue
+		}
+		rate, err := ratelimit.ParseRate(value)
+		if err != nil {
+			return fmt.Errorf("--%s: %v", name, err)
+		}
+		*target = rate
+	}
+	for name, target := range map[string]*time.Duration{
+		"latency":  &config.Network.Latency,
+		"rechoke":  &config.Rechoke,
+		"max-time": &config.MaxTime,
+	} {
+		value := FlagValue(name, "")
+		if value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("--%s: %v", name, err)
+		}
+		*target = duration
+	}
+	if value := FlagValue("loss", ""); value != "" {
+		loss, err := strconv.ParseFloat(value, 64)
+		if err != nil || loss < 0 || loss >= 1 {
+			return fmt.Errorf("--loss: invalid probability %q", value)
+		}
+		config.Network.Loss = loss
+	}
+	if size <= 0 || pieceLength <= 0 {
+		return fmt.Errorf("--size and --piece-length must be positive")
+	}
+	config.Seed = int64(seed)
+
+	torrent := testutil.NewTorrent("simulation", pieceLength, size)
+	info, err := torrent.Metainfo("")
+	if err != nil {
+		return err
+	}
+	config.Info, config.Data = info, torrent.Data
+
+	start := time.Now()
+	report, err := sim.Run(config)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Simulated %d seeds, %d corrupt seeds and %d leechers sharing %s in %d pieces (%d events, %v real time)\n",
+		config.Seeds, config.Corrupt, config.Leechers, formatBytes(int64(size)), info.PieceCount(), report.Events, time.Since(start).Round(time.Millisecond))
+	for _, node := range report.Nodes {
+		completed := "seed"
+		if !node.Seed {
+			completed = "incomplete"
+			if node.Done {
+				completed = node.Completed.Round(time.Millisecond).String()
+			}
+		}
+		fmt.Printf("%-12s %-12s down %-10s up %-10s wasted %-10s hash failures %d\n", node.Name, completed,
+			formatBytes(node.Downloaded), formatBytes(node.Uploaded), formatBytes(node.Wasted), node.HashFailures)
+	}
+	if report.Complete {
+		fmt.Printf("Completion time: %v\n", report.Duration.Round(time.Millisecond))
+	} else {
+		fmt.Printf("Not every leecher completed within %v\n", report.Duration)
+	}
+	fmt.Printf("Fairness: %.3f\n", report.Fairness)
+	fmt.Printf("Wasted: %s\n", formatBytes(report.Wasted))
+	return nil
+}
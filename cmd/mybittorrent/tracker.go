@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/tracker"
+)
+
+// Run a tracker until interrupted. Announces are served over HTTP, and over
+// UDP when --udp is given; --allow restricts the tracker to the torrents in
+// the given .torrent files or directories.
+func Tracker(ctx context.Context, args []string) error {
+	server := tracker.NewServer()
+	for name, target := range map[string]*time.Duration{
+		"interval":     &server.Interval,
+		"min-interval": &server.MinInterval,
+		"peer-ttl":     &server.PeerTTL,
+	} {
+		value := FlagValue(name, "")
+		if value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("--%s: %v", name, err)
+		}
+		*target = duration
+	}
+	for _, path := range CommandFlags["allow"] {
+		count, err := server.AllowTorrents(path)
+		if err != nil {
+			return fmt.Errorf("--allow: %v", err)
+		}
+		fmt.Printf("Allowed %d torrents from %s\n", count, path)
+	}
+
+	listener, err := net.Listen("tcp", FlagValue("http", ":6969"))
+	if err != nil {
+		return err
+	}
+	httpServer := &http.Server{Handler: server.Handler(), ReadHeaderTimeout: 10 * time.Second}
+	go httpServer.Serve(listener)
+	fmt.Printf("Tracker announce URL: http://%s/announce\n", listener.Addr())
+	if address := FlagValue("udp", ""); address != "" {
+		conn, err := net.ListenPacket("udp", address)
+		if err != nil {
+			httpServer.Close()
+			return err
+		}
+		defer conn.Close()
+		go server.ServeUDP(conn)
+		fmt.Printf("Tracker announce URL: udp://%s/announce\n", conn.LocalAddr())
+	}
+
+	// Forget peers that stopped announcing without saying so
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			server.Sweep()
+		case <-ctx.Done():
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			return httpServer.Shutdown(shutdownCtx)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// Client calls the JSON-RPC API of a daemon
+type Client struct {
+	URL        string // e.g. http://127.0.0.1:9080/rpc
+	Token      string
+	HTTPClient *http.Client
+
+	nextID atomic.Int64
+}
+
+func NewClient(url string, token string) *Client {
+	return &Client{URL: url, Token: token, HTTPClient: http.DefaultClient}
+}
+
+// Call a method and decode its result into result, which may be nil. Errors
+// reported by the daemon are returned as *Error.
+func (c *Client) Call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	encodedParams, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	id, _ := json.Marshal(c.nextID.Add(1))
+	body, err := json.Marshal(Request{JSONRPC: "2.0", ID: id, Method: method, Params: encodedParams})
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", "Bearer "+c.Token)
+	response, err := c.HTTPClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("daemon answered %s", response.Status)
+	}
+	var decoded struct {
+		Result json.RawMessage `json:"result"`
+		Error  *Error          `json:"error"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&decoded); err != nil {
+		return fmt.Errorf("invalid response from daemon: %v", err)
+	}
+	if decoded.Error != nil {
+		return decoded.Error
+	}
+	if result == nil || decoded.Result == nil {
+		return nil
+	}
+	return json.Unmarshal(decoded.Result, result)
+}
@@ -0,0 +1,518 @@
+// Package daemon exposes a client.Session over HTTP so it can be controlled
+// remotely, through a JSON-RPC 2.0 API at /rpc guarded by a bearer token, a
+// subset of the Transmission RPC protocol at /transmission/rpc and a web UI
+// at /.
+package daemon
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/client"
+	"github.com/codecrafters-io/bittorrent-starter-go/metainfo"
+	"github.com/codecrafters-io/bittorrent-starter-go/ratelimit"
+)
+
+// JSON-RPC 2.0 error codes
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeServerError    = -32000
+)
+
+var (
+	// How long torrent.add may spend fetching a .torrent URL or the metadata
+	// behind a magnet link
+	AddTimeout = 2 * time.Minute
+	// Largest .torrent file accepted from a URL
+	MaxTorrentSize = 10 << 20
+)
+
+type Request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type Response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.Message, e.Code)
+}
+
+func invalidParams(format string, args ...interface{}) *Error {
+	return &Error{Code: CodeInvalidParams, Message: fmt.Sprintf(format, args...)}
+}
+
+type method func(ctx context.Context, params json.RawMessage) (interface{}, error)
+
+// Server answers JSON-RPC calls against a session. Requests must carry
+// "Authorization: Bearer <Token>".
+type Server struct {
+	Session *client.Session
+	Token   string
+
+	methods map[string]method
+
+	mu          sync.Mutex
+	downloadDir string // where added torrents go unless the call names an output
+	// Transmission RPC state, see transmission.go
+	sessionID       string
+	transmissionIDs map[string]int
+	nextID          int
+	speedLimits     transmissionLimits
+	closing         chan struct{} // closed by Close to end event streams
+}
+
+func NewServer(session *client.Session, token string, downloadDir string) *Server {
+	s := &Server{
+		Session:         session,
+		Token:           token,
+		downloadDir:     downloadDir,
+		sessionID:       newSessionID(),
+		transmissionIDs: make(map[string]int),
+		closing:         make(chan struct{}),
+	}
+	s.methods = map[string]method{
+		"torrent.add":          s.add,
+		"torrent.list":         s.list,
+		"torrent.get":          s.get,
+		"torrent.pause":        s.pause,
+		"torrent.resume":       s.resume,
+		"torrent.remove":       s.remove,
+		"torrent.files":        s.files,
+		"torrent.peers":        s.peers,
+		"torrent.trackers":     s.trackers,
+		"torrent.set_priority": s.setPriority,
+		"torrent.set_limits":   s.setTorrentLimits,
+		"session.get":          s.sessionGet,
+		"session.set_limits":   s.setSessionLimits,
+	}
+	return s
+}
+
+// Handler serving the JSON-RPC API at /rpc, the Transmission RPC API at
+// /transmission/rpc and the web UI with its event stream
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/rpc", s)
+	mux.HandleFunc("/transmission/rpc", s.serveTransmission)
+	mux.HandleFunc("/events", s.serveEvents)
+	mux.HandleFunc("/", s.serveWeb)
+	return mux
+}
+
+// End the event streams of connected web UIs, which would otherwise keep an
+// HTTP server shutdown waiting
+func (s *Server) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.closing:
+	default:
+		close(s.closing)
+	}
+}
+
+func (s *Server) DownloadDir() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.downloadDir
+}
+
+func (s *Server) SetDownloadDir(dir string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.downloadDir = dir
+}
+
+// Accept the token as a bearer token, or as the password of basic
+// authentication for clients that only know usernames and passwords
+func (s *Server) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		_, token, ok = r.BasicAuth()
+	}
+	return ok && s.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) == 1
+}
+
+// Browsers resend basic credentials on their own, so a page from another
+// site must not be able to make calls with them
+func crossSite(r *http.Request) bool {
+	site := r.Header.Get("Sec-Fetch-Site")
+	return site != "" && site != "same-origin" && site != "none"
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="mybittorrent"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if crossSite(r) {
+		http.Error(w, "cross-site request refused", http.StatusForbidden)
+		return
+	}
+	response := Response{JSONRPC: "2.0", ID: json.RawMessage("null")}
+	var request Request
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		response.Error = &Error{Code: CodeParseError, Message: err.Error()}
+	} else {
+		if request.ID != nil {
+			response.ID = request.ID
+		}
+		response.Result, response.Error = s.call(r.Context(), &request)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) call(ctx context.Context, request *Request) (interface{}, *Error) {
+	if request.JSONRPC != "2.0" || request.Method == "" {
+		return nil, &Error{Code: CodeInvalidRequest, Message: "invalid request"}
+	}
+	m, ok := s.methods[request.Method]
+	if !ok {
+		return nil, &Error{Code: CodeMethodNotFound, Message: "unknown method: " + request.Method}
+	}
+	result, err := m(ctx, request.Params)
+	var rpcErr *Error
+	if errors.As(err, &rpcErr) {
+		return nil, rpcErr
+	}
+	if err != nil {
+		return nil, &Error{Code: CodeServerError, Message: err.Error()}
+	}
+	return result, nil
+}
+
+func decodeParams(params json.RawMessage, target interface{}) error {
+	if len(params) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(params, target); err != nil {
+		return invalidParams("invalid params: %v", err)
+	}
+	return nil
+}
+
+type hashParams struct {
+	Hash string `json:"hash"`
+}
+
+// Decode params naming a torrent and look it up
+func (s *Server) torrent(params json.RawMessage) (*client.Torrent, error) {
+	var p hashParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	t := s.Session.Get(strings.ToLower(p.Hash))
+	if t == nil {
+		return nil, invalidParams("unknown torrent: %s", p.Hash)
+	}
+	return t, nil
+}
+
+type AddParams struct {
+	File        string   `json:"file,omitempty"` // path of a .torrent file on the daemon's host
+	URL         string   `json:"url,omitempty"`  // .torrent URL or magnet link
+	Magnet      string   `json:"magnet,omitempty"`
+	Metainfo    []byte   `json:"metainfo,omitempty"`     // contents of a .torrent file
+	Output      string   `json:"output,omitempty"`       // defaults to the torrent's name in the download directory
+	DownloadDir string   `json:"download_dir,omitempty"` // defaults to the daemon's
+	Paused      bool     `json:"paused,omitempty"`
+	Sequential  bool     `json:"sequential,omitempty"`
+	Only        []string `json:"only,omitempty"`
+	Exclude     []string `json:"exclude,omitempty"`
+	Priority    []string `json:"priority,omitempty"` // <glob>:<level> rules
+}
+
+func (s *Server) add(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p AddParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	t, err := s.addTorrent(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	return t.Status(), nil
+}
+
+func (s *Server) addTorrent(ctx context.Context, p AddParams) (*client.Torrent, error) {
+	ctx, cancel := context.WithTimeout(ctx, AddTimeout)
+	defer cancel()
+	if strings.HasPrefix(p.URL, "magnet:") {
+		p.Magnet, p.URL = p.URL, ""
+	}
+	var info *metainfo.Metainfo
+	var err error
+	switch {
+	case p.Metainfo != nil:
+		info, err = metainfo.Unmarshal(p.Metainfo)
+	case p.File != "":
+		info, err = metainfo.Load(p.File)
+	case p.Magnet != "":
+		info, err = s.Session.ResolveMagnet(ctx, p.Magnet)
+	case p.URL != "":
+		info, err = fetchTorrent(ctx, p.URL)
+	default:
+		return nil, invalidParams("one of file, url, magnet or metainfo is required")
+	}
+	if err != nil {
+		return nil, err
+	}
+	output := p.Output
+	if output == "" {
+		name := filepath.Base(filepath.Clean("/" + info.Name))
+		if name == "/" || name == "." {
+			name = info.InfoHash
+		}
+		dir := p.DownloadDir
+		if dir == "" {
+			dir = s.DownloadDir()
+		}
+		output = filepath.Join(dir, name)
+	}
+	return s.Session.Add(info, output, &client.TorrentOptions{
+		Paused:     p.Paused,
+		Sequential: p.Sequential,
+		Only:       p.Only,
+		Exclude:    p.Exclude,
+		Priorities: p.Priority,
+	})
+}
+
+func fetchTorrent(ctx context.Context, url string) (*metainfo.Metainfo, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, invalidParams("invalid URL: %v", err)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", url, response.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(response.Body, int64(MaxTorrentSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxTorrentSize {
+		return nil, fmt.Errorf("torrent file at %s is too large", url)
+	}
+	return metainfo.Unmarshal(data)
+}
+
+func (s *Server) list(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	return s.Session.Status(), nil
+}
+
+func (s *Server) get(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	t, err := s.torrent(params)
+	if err != nil {
+		return nil, err
+	}
+	return t.Status(), nil
+}
+
+func (s *Server) pause(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	t, err := s.torrent(params)
+	if err != nil {
+		return nil, err
+	}
+	t.Pause()
+	return t.Status(), nil
+}
+
+func (s *Server) resume(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	t, err := s.torrent(params)
+	if err != nil {
+		return nil, err
+	}
+	t.Resume()
+	return t.Status(), nil
+}
+
+type RemoveParams struct {
+	Hash       string `json:"hash"`
+	DeleteData bool   `json:"delete_data,omitempty"`
+}
+
+func (s *Server) remove(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p RemoveParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if s.Session.Get(strings.ToLower(p.Hash)) == nil {
+		return nil, invalidParams("unknown torrent: %s", p.Hash)
+	}
+	return true, s.Session.Remove(strings.ToLower(p.Hash), p.DeleteData)
+}
+
+func (s *Server) files(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	t, err := s.torrent(params)
+	if err != nil {
+		return nil, err
+	}
+	return t.Files(), nil
+}
+
+func (s *Server) peers(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	t, err := s.torrent(params)
+	if err != nil {
+		return nil, err
+	}
+	return t.Peers(), nil
+}
+
+func (s *Server) trackers(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	t, err := s.torrent(params)
+	if err != nil {
+		return nil, err
+	}
+	return t.Trackers(), nil
+}
+
+type PriorityParams struct {
+	Hash     string          `json:"hash"`
+	Files    []int           `json:"files"` // indices into torrent.files
+	Priority client.Priority `json:"priority"`
+}
+
+func (s *Server) setPriority(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p PriorityParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	t := s.Session.Get(strings.ToLower(p.Hash))
+	if t == nil {
+		return nil, invalidParams("unknown torrent: %s", p.Hash)
+	}
+	for _, file := range p.Files {
+		if file < 0 || file >= len(t.Info.Files) {
+			return nil, invalidParams("file index %d out of range", file)
+		}
+	}
+	for _, file := range p.Files {
+		if err := t.Priorities.Set(file, p.Priority); err != nil {
+			return nil, err
+		}
+	}
+	return t.Files(), nil
+}
+
+// Rates in bytes per second, 0 for unlimited; absent fields are left alone.
+// The per-peer rates only apply to torrents.
+type LimitParams struct {
+	Hash         string `json:"hash,omitempty"`
+	Download     *int   `json:"download,omitempty"`
+	Upload       *int   `json:"upload,omitempty"`
+	PeerDownload *int   `json:"peer_download,omitempty"`
+	PeerUpload   *int   `json:"peer_upload,omitempty"`
+}
+
+type Limits struct {
+	Download     int `json:"download"`
+	Upload       int `json:"upload"`
+	PeerDownload int `json:"peer_download,omitempty"`
+	PeerUpload   int `json:"peer_upload,omitempty"`
+}
+
+func (s *Server) setTorrentLimits(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p LimitParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	t := s.Session.Get(strings.ToLower(p.Hash))
+	if t == nil {
+		return nil, invalidParams("unknown torrent: %s", p.Hash)
+	}
+	if p.Download != nil {
+		t.Limits.Download.SetRate(max(*p.Download, 0))
+	}
+	if p.Upload != nil {
+		t.Limits.Upload.SetRate(max(*p.Upload, 0))
+	}
+	if p.PeerDownload != nil || p.PeerUpload != nil {
+		peerDownload, peerUpload := t.Limits.PeerRates()
+		if p.PeerDownload != nil {
+			peerDownload = max(*p.PeerDownload, 0)
+		}
+		if p.PeerUpload != nil {
+			peerUpload = max(*p.PeerUpload, 0)
+		}
+		t.Limits.SetPeerRates(peerDownload, peerUpload)
+	}
+	return torrentLimits(t.Limits), nil
+}
+
+func torrentLimits(limits *ratelimit.TorrentLimits) Limits {
+	peerDownload, peerUpload := limits.PeerRates()
+	return Limits{Download: limits.Download.Rate(), Upload: limits.Upload.Rate(), PeerDownload: peerDownload, PeerUpload: peerUpload}
+}
+
+func (s *Server) setSessionLimits(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p LimitParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Download != nil {
+		s.Session.Download.SetRate(max(*p.Download, 0))
+	}
+	if p.Upload != nil {
+		s.Session.Upload.SetRate(max(*p.Upload, 0))
+	}
+	return Limits{Download: s.Session.Download.Rate(), Upload: s.Session.Upload.Rate()}, nil
+}
+
+type SessionInfo struct {
+	Port        int    `json:"port"`
+	PeerID      string `json:"peer_id"`
+	DownloadDir string `json:"download_dir"`
+	Torrents    int    `json:"torrents"`
+	Limits      Limits `json:"limits"`
+}
+
+func (s *Server) sessionGet(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	return s.sessionInfo(), nil
+}
+
+func (s *Server) sessionInfo() SessionInfo {
+	return SessionInfo{
+		Port:        s.Session.Port(),
+		PeerID:      fmt.Sprintf("%x", s.Session.PeerID),
+		DownloadDir: s.DownloadDir(),
+		Torrents:    len(s.Session.Torrents()),
+		Limits:      Limits{Download: s.Session.Download.Rate(), Upload: s.Session.Upload.Rate()},
+	}
+}
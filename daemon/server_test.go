@@ -0,0 +1,208 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/client"
+	"github.com/codecrafters-io/bittorrent-starter-go/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/testutil"
+)
+
+const testToken = "secret"
+
+// A daemon for a fresh session, served over HTTP
+func startDaemon(t *testing.T) (*Server, *httptest.Server) {
+	t.Helper()
+	previous := peer.Transports
+	peer.Transports = []string{"tcp"}
+	t.Cleanup(func() { peer.Transports = previous })
+	session, err := client.NewSession(client.SessionConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { session.Close() })
+	s := NewServer(session, testToken, t.TempDir())
+	server := httptest.NewServer(s.Handler())
+	t.Cleanup(func() {
+		s.Close()
+		server.Close()
+	})
+	return s, server
+}
+
+// A torrent announced by a tracker that knows no peers, so nothing is
+// downloaded while the test looks at it
+func idleTorrent(t *testing.T) (*testutil.Torrent, []byte) {
+	t.Helper()
+	tracker := testutil.NewTracker()
+	t.Cleanup(tracker.Close)
+	tor := testutil.NewTorrent("sample.bin", 32<<10, 100<<10)
+	return tor, tor.Marshal(tracker.AnnounceURL())
+}
+
+func post(t *testing.T, url string, body string, header http.Header) *http.Response {
+	t.Helper()
+	request, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { response.Body.Close() })
+	return response
+}
+
+func TestRPCRequiresToken(t *testing.T) {
+	_, server := startDaemon(t)
+	call := `{"jsonrpc":"2.0","id":1,"method":"torrent.list"}`
+	for name, header := range map[string]http.Header{
+		"no credentials": {},
+		"wrong token":    {"Authorization": {"Bearer wrong"}},
+		"not bearer":     {"Authorization": {testToken}},
+	} {
+		response := post(t, server.URL+"/rpc", call, header)
+		if response.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s: status %s, want %d", name, response.Status, http.StatusUnauthorized)
+		}
+		if !strings.HasPrefix(response.Header.Get("WWW-Authenticate"), "Bearer ") {
+			t.Errorf("%s: no bearer challenge", name)
+		}
+	}
+
+	request, _ := http.NewRequest(http.MethodPost, server.URL+"/rpc", strings.NewReader(call))
+	request.SetBasicAuth("anyone", testToken)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("token as basic auth password: status %s", response.Status)
+	}
+
+	response, err = http.Get(server.URL + "/rpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusMethodNotAllowed || response.Header.Get("Allow") != http.MethodPost {
+		t.Errorf("GET: status %s, Allow %q", response.Status, response.Header.Get("Allow"))
+	}
+}
+
+func TestRPCRefusesCrossSiteRequests(t *testing.T) {
+	_, server := startDaemon(t)
+	call := `{"jsonrpc":"2.0","id":1,"method":"torrent.list"}`
+	for site, want := range map[string]int{
+		"cross-site":  http.StatusForbidden,
+		"same-site":   http.StatusForbidden,
+		"same-origin": http.StatusOK,
+		"none":        http.StatusOK,
+	} {
+		header := http.Header{"Authorization": {"Bearer " + testToken}, "Sec-Fetch-Site": {site}}
+		if response := post(t, server.URL+"/rpc", call, header); response.StatusCode != want {
+			t.Errorf("Sec-Fetch-Site %s: status %s, want %d", site, response.Status, want)
+		}
+	}
+}
+
+func TestRPCReportsProtocolErrors(t *testing.T) {
+	_, server := startDaemon(t)
+	header := http.Header{"Authorization": {"Bearer " + testToken}}
+	for body, want := range map[string]int{
+		`{"jsonrpc":`: CodeParseError,
+		`{"jsonrpc":"1.0","id":1,"method":"torrent.list"}`:   CodeInvalidRequest,
+		`{"jsonrpc":"2.0","id":1,"method":"torrent.frob"}`:   CodeMethodNotFound,
+		`{"jsonrpc":"2.0","id":1,"method":"torrent.add"}`:    CodeInvalidParams,
+		`{"jsonrpc":"2.0","id":1,"method":"torrent.get"}`:    CodeInvalidParams,
+		`{"jsonrpc":"2.0","id":1,"method":"torrent.pause"}`:  CodeInvalidParams,
+		`{"jsonrpc":"2.0","id":1,"method":"torrent.remove"}`: CodeInvalidParams,
+	} {
+		var response Response
+		if err := json.NewDecoder(post(t, server.URL+"/rpc", body, header).Body).Decode(&response); err != nil {
+			t.Fatalf("%s: %v", body, err)
+		}
+		if response.Error == nil || response.Error.Code != want {
+			t.Errorf("%s: error %v, want code %d", body, response.Error, want)
+		}
+	}
+}
+
+func TestRPCMethods(t *testing.T) {
+	s, server := startDaemon(t)
+	rpc := NewClient(server.URL+"/rpc", testToken)
+	ctx := context.Background()
+	tor, metainfo := idleTorrent(t)
+
+	var added client.TorrentStatus
+	if err := rpc.Call(ctx, "torrent.add", AddParams{Metainfo: metainfo, Paused: true}, &added); err != nil {
+		t.Fatal(err)
+	}
+	if added.Name != tor.Name || added.State != client.TorrentPaused {
+		t.Errorf("added %s in state %s, want %s paused", added.Name, added.State, tor.Name)
+	}
+	if want := filepath.Join(s.DownloadDir(), tor.Name); added.OutputPath != want {
+		t.Errorf("output path %s, want %s", added.OutputPath, want)
+	}
+	if err := rpc.Call(ctx, "torrent.add", AddParams{Metainfo: metainfo}, nil); err == nil {
+		t.Error("added the same torrent twice")
+	}
+
+	var list []client.TorrentStatus
+	if err := rpc.Call(ctx, "torrent.list", nil, &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].InfoHash != added.InfoHash {
+		t.Fatalf("list = %+v, want the added torrent", list)
+	}
+
+	hash := hashParams{Hash: strings.ToUpper(added.InfoHash)}
+	var status client.TorrentStatus
+	if err := rpc.Call(ctx, "torrent.resume", hash, &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.State == client.TorrentPaused {
+		t.Errorf("state %s after resume", status.State)
+	}
+	if err := rpc.Call(ctx, "torrent.pause", hash, &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.State != client.TorrentPaused {
+		t.Errorf("state %s after pause, want paused", status.State)
+	}
+	if err := rpc.Call(ctx, "torrent.get", hash, &status); err != nil || status.InfoHash != added.InfoHash {
+		t.Errorf("get = %+v, %v", status, err)
+	}
+
+	var rpcErr *Error
+	if err := rpc.Call(ctx, "torrent.get", hashParams{Hash: strings.Repeat("0", 40)}, nil); !errors.As(err, &rpcErr) || rpcErr.Code != CodeInvalidParams {
+		t.Errorf("get of an unknown torrent: %v", err)
+	}
+
+	var removed bool
+	if err := rpc.Call(ctx, "torrent.remove", RemoveParams{Hash: added.InfoHash, DeleteData: true}, &removed); err != nil || !removed {
+		t.Fatalf("remove = %v, %v", removed, err)
+	}
+	if len(s.Session.Torrents()) != 0 {
+		t.Error("torrent still in the session after remove")
+	}
+	if _, err := os.Stat(added.OutputPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("data left behind after remove with delete_data: %v", err)
+	}
+	if err := rpc.Call(ctx, "torrent.remove", RemoveParams{Hash: added.InfoHash}, nil); !errors.As(err, &rpcErr) || rpcErr.Code != CodeInvalidParams {
+		t.Errorf("second remove: %v", err)
+	}
+}
@@ -0,0 +1,656 @@
+package daemon
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/client"
+)
+
+// Transmission RPC (https://github.com/transmission/transmission/blob/main/docs/rpc-spec.md),
+// the subset that remote GUIs and scripts rely on
+
+const (
+	TransmissionSessionHeader = "X-Transmission-Session-Id"
+	TransmissionRPCVersion    = 17
+
+	// Transmission counts speeds in kB/s
+	transmissionSpeedUnit = 1000
+)
+
+// Torrent status codes
+const (
+	transmissionStopped      = 0
+	transmissionDownloadWait = 3
+	transmissionDownloading  = 4
+	transmissionSeeding      = 6
+)
+
+type transmissionRequest struct {
+	Method    string          `json:"method"`
+	Arguments json.RawMessage `json:"arguments"`
+	Tag       json.RawMessage `json:"tag,omitempty"`
+}
+
+type transmissionResponse struct {
+	Result    string          `json:"result"`
+	Arguments interface{}     `json:"arguments"`
+	Tag       json.RawMessage `json:"tag,omitempty"`
+}
+
+// Configured global speed limits in kB/s; a limit stays configured while
+// disabled
+type transmissionLimits struct {
+	Down int
+	Up   int
+}
+
+func newSessionID() string {
+	random := make([]byte, 24)
+	rand.Read(random)
+	return hex.EncodeToString(random)
+}
+
+func (s *Server) serveTransmission(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="mybittorrent"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	// CSRF protection: clients must echo the session ID from a 409 answer
+	if r.Header.Get(TransmissionSessionHeader) != s.sessionID {
+		w.Header().Set(TransmissionSessionHeader, s.sessionID)
+		http.Error(w, "invalid session id", http.StatusConflict)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var request transmissionRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	response := transmissionResponse{Result: "success", Tag: request.Tag}
+	arguments, err := s.callTransmission(r.Context(), request.Method, request.Arguments)
+	if err != nil {
+		response.Result = err.Error()
+	}
+	if arguments == nil {
+		arguments = struct{}{}
+	}
+	response.Arguments = arguments
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) callTransmission(ctx context.Context, method string, arguments json.RawMessage) (interface{}, error) {
+	if len(arguments) == 0 {
+		arguments = json.RawMessage("{}")
+	}
+	switch method {
+	case "torrent-add":
+		return s.transmissionAdd(ctx, arguments)
+	case "torrent-get":
+		return s.transmissionGet(arguments)
+	case "torrent-start", "torrent-start-now":
+		return s.transmissionEach(arguments, (*client.Torrent).Resume)
+	case "torrent-stop":
+		return s.transmissionEach(arguments, (*client.Torrent).Pause)
+	case "torrent-remove":
+		return s.transmissionRemove(arguments)
+	case "torrent-set":
+		return s.transmissionSet(arguments)
+	case "session-get":
+		return s.transmissionSessionGet(arguments)
+	case "session-set":
+		return s.transmissionSessionSet(arguments)
+	case "session-stats":
+		return s.transmissionSessionStats()
+	}
+	return nil, errors.New("method name not recognized")
+}
+
+// A torrent as seen through Transmission's field names
+type transmissionTorrent struct {
+	id     int
+	t      *client.Torrent
+	status client.TorrentStatus
+	queue  int
+}
+
+// Torrent fields for torrent-get, each computed from the torrent's status
+var transmissionFields = map[string]func(v *transmissionTorrent) interface{}{
+	"id":             func(v *transmissionTorrent) interface{} { return v.id },
+	"hashString":     func(v *transmissionTorrent) interface{} { return v.status.InfoHash },
+	"name":           func(v *transmissionTorrent) interface{} { return v.status.Name },
+	"status":         func(v *transmissionTorrent) interface{} { return transmissionStatus(v.status.State) },
+	"error":          func(v *transmissionTorrent) interface{} { return transmissionError(v.status) },
+	"errorString":    func(v *transmissionTorrent) interface{} { return v.status.Error },
+	"totalSize":      func(v *transmissionTorrent) interface{} { return v.t.Info.Length },
+	"sizeWhenDone":   func(v *transmissionTorrent) interface{} { return v.status.Size },
+	"leftUntilDone":  func(v *transmissionTorrent) interface{} { return v.status.Left },
+	"haveValid":      func(v *transmissionTorrent) interface{} { return v.status.Size - v.status.Left },
+	"haveUnchecked":  func(v *transmissionTorrent) interface{} { return 0 },
+	"percentDone":    func(v *transmissionTorrent) interface{} { return percentDone(v.status) },
+	"downloadedEver": func(v *transmissionTorrent) interface{} { return v.status.Downloaded },
+	"uploadedEver":   func(v *transmissionTorrent) interface{} { return v.status.Uploaded },
+	"corruptEver":    func(v *transmissionTorrent) interface{} { return v.status.Wasted },
+	"uploadRatio":    func(v *transmissionTorrent) interface{} { return uploadRatio(v.status) },
+	"rateDownload":   func(v *transmissionTorrent) interface{} { return v.status.DownloadRate },
+	"rateUpload":     func(v *transmissionTorrent) interface{} { return v.status.UploadRate },
+	"eta":            func(v *transmissionTorrent) interface{} { return eta(v.status) },
+	"peersConnected": func(v *transmissionTorrent) interface{} { return v.status.Peers },
+	"isFinished":     func(v *transmissionTorrent) interface{} { return v.status.Left == 0 },
+	"isPrivate":      func(v *transmissionTorrent) interface{} { return false },
+	"downloadDir":    func(v *transmissionTorrent) interface{} { return filepath.Dir(v.status.OutputPath) },
+	"addedDate":      func(v *transmissionTorrent) interface{} { return v.status.Added.Unix() },
+	"queuePosition":  func(v *transmissionTorrent) interface{} { return v.queue },
+	"pieceCount":     func(v *transmissionTorrent) interface{} { return v.status.Pieces },
+	"pieceSize":      func(v *transmissionTorrent) interface{} { return v.t.Info.PieceLength },
+	"webseeds":       func(v *transmissionTorrent) interface{} { return append([]string{}, v.t.Info.WebSeeds...) },
+	"magnetLink": func(v *transmissionTorrent) interface{} {
+		return "magnet:?xt=urn:btih:" + v.status.InfoHash + "&dn=" + url.QueryEscape(v.status.Name) + "&tr=" + url.QueryEscape(v.t.Info.Announce)
+	},
+	"files": func(v *transmissionTorrent) interface{} {
+		files := []map[string]interface{}{}
+		for _, file := range v.t.Files() {
+			files = append(files, map[string]interface{}{"name": filepath.ToSlash(file.Path), "length": file.Length, "bytesCompleted": file.Completed})
+		}
+		return files
+	},
+	"fileStats": func(v *transmissionTorrent) interface{} {
+		stats := []map[string]interface{}{}
+		for _, file := range v.t.Files() {
+			stats = append(stats, map[string]interface{}{"bytesCompleted": file.Completed, "wanted": file.Priority != client.PrioritySkip, "priority": transmissionPriority(file.Priority)})
+		}
+		return stats
+	},
+	"wanted": func(v *transmissionTorrent) interface{} {
+		wanted := []int{}
+		for _, file := range v.t.Files() {
+			wanted = append(wanted, boolInt(file.Priority != client.PrioritySkip))
+		}
+		return wanted
+	},
+	"priorities": func(v *transmissionTorrent) interface{} {
+		priorities := []int{}
+		for _, file := range v.t.Files() {
+			priorities = append(priorities, transmissionPriority(file.Priority))
+		}
+		return priorities
+	},
+	"trackers": func(v *transmissionTorrent) interface{} {
+		trackers := []map[string]interface{}{}
+		for i, tracker := range v.t.Trackers() {
+			trackers = append(trackers, map[string]interface{}{"id": i, "announce": tracker.URL, "tier": 0})
+		}
+		return trackers
+	},
+	"trackerStats": func(v *transmissionTorrent) interface{} {
+		stats := []map[string]interface{}{}
+		for i, tracker := range v.t.Trackers() {
+			var lastAnnounce int64
+			if !tracker.LastAnnounce.IsZero() {
+				lastAnnounce = tracker.LastAnnounce.Unix()
+			}
+			stats = append(stats, map[string]interface{}{
+				"id":                    i,
+				"announce":              tracker.URL,
+				"tier":                  0,
+				"lastAnnounceTime":      lastAnnounce,
+				"lastAnnounceSucceeded": tracker.Error == "" && lastAnnounce != 0,
+				"lastAnnounceResult":    tracker.Error,
+				"lastAnnouncePeerCount": tracker.Peers,
+			})
+		}
+		return stats
+	},
+	"peers": func(v *transmissionTorrent) interface{} {
+		peers := []map[string]interface{}{}
+		for _, peer := range v.t.Peers() {
+			host, port, _ := net.SplitHostPort(peer.Address)
+			portNumber, _ := strconv.Atoi(port)
+			peers = append(peers, map[string]interface{}{"address": host, "port": portNumber, "clientName": peer.Client, "peerIsChoked": peer.Choked, "rateToClient": peer.DownloadRate, "rateToPeer": peer.UploadRate})
+		}
+		return peers
+	},
+	"downloadLimit":   func(v *transmissionTorrent) interface{} { return v.t.Limits.Download.Rate() / transmissionSpeedUnit },
+	"downloadLimited": func(v *transmissionTorrent) interface{} { return v.t.Limits.Download.Rate() > 0 },
+	"uploadLimit":     func(v *transmissionTorrent) interface{} { return v.t.Limits.Upload.Rate() / transmissionSpeedUnit },
+	"uploadLimited":   func(v *transmissionTorrent) interface{} { return v.t.Limits.Upload.Rate() > 0 },
+}
+
+func transmissionStatus(state client.TorrentState) int {
+	switch state {
+	case client.TorrentQueued:
+		return transmissionDownloadWait
+	case client.TorrentDownloading:
+		return transmissionDownloading
+	case client.TorrentSeeding:
+		return transmissionSeeding
+	}
+	return transmissionStopped
+}
+
+// 3 is Transmission's "local error"
+func transmissionError(status client.TorrentStatus) int {
+	if status.Error != "" {
+		return 3
+	}
+	return 0
+}
+
+func percentDone(status client.TorrentStatus) float64 {
+	if status.Size == 0 {
+		return 1
+	}
+	return float64(status.Size-status.Left) / float64(status.Size)
+}
+
+// -1 when nothing was downloaded, as in Transmission
+func uploadRatio(status client.TorrentStatus) float64 {
+	if status.Downloaded == 0 {
+		return -1
+	}
+	return float64(status.Uploaded) / float64(status.Downloaded)
+}
+
+// Seconds until done at the current rate, -1 when not downloading
+func eta(status client.TorrentStatus) int64 {
+	if status.Left == 0 || status.DownloadRate == 0 {
+		return -1
+	}
+	return status.Left / status.DownloadRate
+}
+
+func transmissionPriority(priority client.Priority) int {
+	switch priority {
+	case client.PriorityLow:
+		return -1
+	case client.PriorityHigh:
+		return 1
+	}
+	return 0
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Number the session's torrents the way Transmission does, with small
+// integers that stay stable for the daemon's lifetime
+func (s *Server) transmissionTorrents() []*transmissionTorrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var torrents []*transmissionTorrent
+	for queue, t := range s.Session.Torrents() {
+		id, ok := s.transmissionIDs[t.InfoHash()]
+		if !ok {
+			s.nextID++
+			id = s.nextID
+			s.transmissionIDs[t.InfoHash()] = id
+		}
+		torrents = append(torrents, &transmissionTorrent{id: id, t: t, queue: queue})
+	}
+	return torrents
+}
+
+// Resolve the "ids" argument: absent for every torrent, or a number, a hash
+// or a list of them
+func (s *Server) selectTorrents(arguments json.RawMessage) ([]*transmissionTorrent, error) {
+	var args struct {
+		IDs json.RawMessage `json:"ids"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, fmt.Errorf("invalid arguments: %v", err)
+	}
+	torrents := s.transmissionTorrents()
+	if len(args.IDs) == 0 {
+		return torrents, nil
+	}
+	var ids []interface{}
+	if err := json.Unmarshal(args.IDs, &ids); err != nil {
+		var id interface{}
+		if err := json.Unmarshal(args.IDs, &id); err != nil {
+			return nil, fmt.Errorf("invalid ids: %v", err)
+		}
+		ids = []interface{}{id}
+	}
+	var selected []*transmissionTorrent
+	for _, v := range torrents {
+		for _, id := range ids {
+			switch id := id.(type) {
+			case float64:
+				if int(id) != v.id {
+					continue
+				}
+			case string:
+				// "recently-active" is treated as every torrent
+				if id != "recently-active" && !strings.EqualFold(id, v.t.InfoHash()) {
+					continue
+				}
+			default:
+				continue
+			}
+			selected = append(selected, v)
+			break
+		}
+	}
+	return selected, nil
+}
+
+func (s *Server) transmissionGet(arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		Fields []string `json:"fields"`
+		Format string   `json:"format"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, fmt.Errorf("invalid arguments: %v", err)
+	}
+	if len(args.Fields) == 0 {
+		return nil, errors.New("no fields specified")
+	}
+	torrents, err := s.selectTorrents(arguments)
+	if err != nil {
+		return nil, err
+	}
+	var fields []string
+	for _, field := range args.Fields {
+		if _, ok := transmissionFields[field]; ok {
+			fields = append(fields, field)
+		}
+	}
+	if args.Format == "table" {
+		// The first row names the columns
+		table := [][]interface{}{{}}
+		for _, field := range fields {
+			table[0] = append(table[0], field)
+		}
+		for _, v := range torrents {
+			v.status = v.t.Status()
+			row := []interface{}{}
+			for _, field := range fields {
+				row = append(row, transmissionFields[field](v))
+			}
+			table = append(table, row)
+		}
+		return map[string]interface{}{"torrents": table}, nil
+	}
+	objects := []map[string]interface{}{}
+	for _, v := range torrents {
+		v.status = v.t.Status()
+		object := make(map[string]interface{}, len(fields))
+		for _, field := range fields {
+			object[field] = transmissionFields[field](v)
+		}
+		objects = append(objects, object)
+	}
+	return map[string]interface{}{"torrents": objects}, nil
+}
+
+func (s *Server) transmissionAdd(ctx context.Context, arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		Filename    string `json:"filename"`
+		Metainfo    string `json:"metainfo"` // base64
+		DownloadDir string `json:"download-dir"`
+		Paused      bool   `json:"paused"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, fmt.Errorf("invalid arguments: %v", err)
+	}
+	p := AddParams{Paused: args.Paused}
+	switch {
+	case args.Metainfo != "":
+		data, err := base64.StdEncoding.DecodeString(args.Metainfo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metainfo: %v", err)
+		}
+		p.Metainfo = data
+	case strings.HasPrefix(args.Filename, "magnet:") || strings.Contains(args.Filename, "://"):
+		p.URL = args.Filename
+	case args.Filename != "":
+		p.File = args.Filename
+	default:
+		return nil, errors.New("no filename or metainfo specified")
+	}
+	p.DownloadDir = args.DownloadDir
+	t, err := s.addTorrent(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range s.transmissionTorrents() {
+		if v.t == t {
+			return map[string]interface{}{"torrent-added": map[string]interface{}{"id": v.id, "hashString": t.InfoHash(), "name": t.Info.Name}}, nil
+		}
+	}
+	return nil, errors.New("torrent vanished after being added")
+}
+
+func (s *Server) transmissionEach(arguments json.RawMessage, action func(*client.Torrent)) (interface{}, error) {
+	torrents, err := s.selectTorrents(arguments)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range torrents {
+		action(v.t)
+	}
+	return nil, nil
+}
+
+func (s *Server) transmissionRemove(arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		DeleteLocalData bool `json:"delete-local-data"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, fmt.Errorf("invalid arguments: %v", err)
+	}
+	torrents, err := s.selectTorrents(arguments)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range torrents {
+		if err := s.Session.Remove(v.t.InfoHash(), args.DeleteLocalData); err != nil {
+			return nil, err
+		}
+		s.mu.Lock()
+		delete(s.transmissionIDs, v.t.InfoHash())
+		s.mu.Unlock()
+	}
+	return nil, nil
+}
+
+func (s *Server) transmissionSet(arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		FilesWanted     []int `json:"files-wanted"`
+		FilesUnwanted   []int `json:"files-unwanted"`
+		PriorityHigh    []int `json:"priority-high"`
+		PriorityNormal  []int `json:"priority-normal"`
+		PriorityLow     []int `json:"priority-low"`
+		DownloadLimit   *int  `json:"downloadLimit"`
+		DownloadLimited *bool `json:"downloadLimited"`
+		UploadLimit     *int  `json:"uploadLimit"`
+		UploadLimited   *bool `json:"uploadLimited"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, fmt.Errorf("invalid arguments: %v", err)
+	}
+	torrents, err := s.selectTorrents(arguments)
+	if err != nil {
+		return nil, err
+	}
+	var setErr error
+	for _, v := range torrents {
+		set := func(files []int, priority client.Priority) {
+			for _, file := range files {
+				if file < 0 || file >= len(v.t.Info.Files) {
+					continue
+				}
+				if err := v.t.Priorities.Set(file, priority); err != nil && setErr == nil {
+					setErr = err
+				}
+			}
+		}
+		set(args.FilesUnwanted, client.PrioritySkip)
+		for _, file := range args.FilesWanted {
+			if file >= 0 && file < len(v.t.Info.Files) && v.t.Priorities.Get(file) == client.PrioritySkip {
+				set([]int{file}, client.PriorityNormal)
+			}
+		}
+		set(args.PriorityHigh, client.PriorityHigh)
+		set(args.PriorityNormal, client.PriorityNormal)
+		set(args.PriorityLow, client.PriorityLow)
+		applyTorrentLimit(v.t.Limits.Download.SetRate, v.t.Limits.Download.Rate(), args.DownloadLimit, args.DownloadLimited)
+		applyTorrentLimit(v.t.Limits.Upload.SetRate, v.t.Limits.Upload.Rate(), args.UploadLimit, args.UploadLimited)
+	}
+	return nil, setErr
+}
+
+// Apply a Transmission limit in kB/s and its enabled flag, either of which may be absent
+func applyTorrentLimit(setRate func(int), current int, limit *int, limited *bool) {
+	switch {
+	case limited != nil && !*limited:
+		setRate(0)
+	case limit != nil && (limited != nil || current > 0):
+		setRate(max(*limit, 0) * transmissionSpeedUnit)
+	}
+}
+
+func (s *Server) transmissionSessionGet(arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		Fields []string `json:"fields"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, fmt.Errorf("invalid arguments: %v", err)
+	}
+	s.mu.Lock()
+	limits := s.speedLimits
+	s.mu.Unlock()
+	down, up := s.Session.Download.Rate(), s.Session.Upload.Rate()
+	if down > 0 {
+		limits.Down = down / transmissionSpeedUnit
+	}
+	if up > 0 {
+		limits.Up = up / transmissionSpeedUnit
+	}
+	values := map[string]interface{}{
+		"version":                  "mybittorrent",
+		"rpc-version":              TransmissionRPCVersion,
+		"rpc-version-minimum":      1,
+		"session-id":               s.sessionID,
+		"download-dir":             s.DownloadDir(),
+		"peer-port":                s.Session.Port(),
+		"speed-limit-down":         limits.Down,
+		"speed-limit-down-enabled": down > 0,
+		"speed-limit-up":           limits.Up,
+		"speed-limit-up-enabled":   up > 0,
+		"units": map[string]interface{}{
+			"speed-units":  []string{"kB/s", "MB/s", "GB/s", "TB/s"},
+			"speed-bytes":  transmissionSpeedUnit,
+			"size-units":   []string{"kB", "MB", "GB", "TB"},
+			"size-bytes":   1000,
+			"memory-units": []string{"KiB", "MiB", "GiB", "TiB"},
+			"memory-bytes": 1024,
+		},
+	}
+	if len(args.Fields) == 0 {
+		return values, nil
+	}
+	selected := make(map[string]interface{})
+	for name, value := range values {
+		if slices.Contains(args.Fields, name) {
+			selected[name] = value
+		}
+	}
+	return selected, nil
+}
+
+func (s *Server) transmissionSessionSet(arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		DownloadDir          *string `json:"download-dir"`
+		SpeedLimitDown       *int    `json:"speed-limit-down"`
+		SpeedLimitDownEnable *bool   `json:"speed-limit-down-enabled"`
+		SpeedLimitUp         *int    `json:"speed-limit-up"`
+		SpeedLimitUpEnable   *bool   `json:"speed-limit-up-enabled"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, fmt.Errorf("invalid arguments: %v", err)
+	}
+	if args.DownloadDir != nil {
+		s.SetDownloadDir(*args.DownloadDir)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if args.SpeedLimitDown != nil {
+		s.speedLimits.Down = max(*args.SpeedLimitDown, 0)
+	}
+	if args.SpeedLimitUp != nil {
+		s.speedLimits.Up = max(*args.SpeedLimitUp, 0)
+	}
+	enabled := func(flag *bool, current int) bool {
+		if flag != nil {
+			return *flag
+		}
+		return current > 0
+	}
+	if args.SpeedLimitDown != nil || args.SpeedLimitDownEnable != nil {
+		rate := 0
+		if enabled(args.SpeedLimitDownEnable, s.Session.Download.Rate()) {
+			rate = s.speedLimits.Down * transmissionSpeedUnit
+		}
+		s.Session.Download.SetRate(rate)
+	}
+	if args.SpeedLimitUp != nil || args.SpeedLimitUpEnable != nil {
+		rate := 0
+		if enabled(args.SpeedLimitUpEnable, s.Session.Upload.Rate()) {
+			rate = s.speedLimits.Up * transmissionSpeedUnit
+		}
+		s.Session.Upload.SetRate(rate)
+	}
+	return nil, nil
+}
+
+func (s *Server) transmissionSessionStats() (interface{}, error) {
+	var active, paused int
+	var downloaded, uploaded, downloadSpeed, uploadSpeed int64
+	statuses := s.Session.Status()
+	for _, status := range statuses {
+		switch status.State {
+		case client.TorrentDownloading, client.TorrentSeeding:
+			active++
+		case client.TorrentPaused:
+			paused++
+		}
+		downloaded += status.Downloaded
+		uploaded += status.Uploaded
+		downloadSpeed += status.DownloadRate
+		uploadSpeed += status.UploadRate
+	}
+	totals := map[string]interface{}{"downloadedBytes": downloaded, "uploadedBytes": uploaded}
+	return map[string]interface{}{
+		"activeTorrentCount": active,
+		"pausedTorrentCount": paused,
+		"torrentCount":       len(statuses),
+		"downloadSpeed":      downloadSpeed,
+		"uploadSpeed":        uploadSpeed,
+		"current-stats":      totals,
+		"cumulative-stats":   totals,
+	}, nil
+}
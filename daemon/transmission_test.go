@@ -0,0 +1,231 @@
+package daemon
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/client"
+	"github.com/codecrafters-io/bittorrent-starter-go/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/testutil"
+)
+
+func TestTransmissionSessionStatsReportsSpeed(t *testing.T) {
+	previous := peer.Transports
+	peer.Transports = []string{"tcp"}
+	t.Cleanup(func() { peer.Transports = previous })
+	tor := testutil.NewTorrent("sample.bin", 64<<10, 1<<20)
+	// Slow enough for the download to span a few whole seconds
+	seeder, err := testutil.NewPeer(tor, testutil.Behavior{Delay: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seeder.Close()
+	tracker := testutil.NewTracker(seeder.Addr())
+	defer tracker.Close()
+	session, err := client.NewSession(client.SessionConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	s := NewServer(session, "secret", t.TempDir())
+	info, err := tor.Metainfo(tracker.AnnounceURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Add(info, filepath.Join(t.TempDir(), tor.Name), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		result, err := s.transmissionSessionStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats := result.(map[string]interface{})
+		if stats["downloadSpeed"].(int64) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("downloadSpeed stayed 0 during a download: %v", stats)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Call a Transmission method the way clients do: a first request without a
+// session ID is answered 409 with the ID, and retried carrying it
+type transmissionClient struct {
+	t         *testing.T
+	url       string
+	sessionID string
+}
+
+func (c *transmissionClient) call(method string, arguments interface{}) (string, map[string]interface{}) {
+	c.t.Helper()
+	body, err := json.Marshal(map[string]interface{}{"method": method, "arguments": arguments, "tag": 7})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	for attempt := 0; ; attempt++ {
+		request, _ := http.NewRequest(http.MethodPost, c.url, strings.NewReader(string(body)))
+		request.SetBasicAuth("admin", testToken)
+		if c.sessionID != "" {
+			request.Header.Set(TransmissionSessionHeader, c.sessionID)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		defer response.Body.Close()
+		if response.StatusCode == http.StatusConflict && attempt == 0 {
+			c.sessionID = response.Header.Get(TransmissionSessionHeader)
+			continue
+		}
+		if response.StatusCode != http.StatusOK {
+			c.t.Fatalf("%s: status %s", method, response.Status)
+		}
+		var decoded struct {
+			Result    string                 `json:"result"`
+			Arguments map[string]interface{} `json:"arguments"`
+			Tag       int                    `json:"tag"`
+		}
+		if err := json.NewDecoder(response.Body).Decode(&decoded); err != nil {
+			c.t.Fatal(err)
+		}
+		if decoded.Tag != 7 {
+			c.t.Errorf("%s: tag %d not echoed", method, decoded.Tag)
+		}
+		return decoded.Result, decoded.Arguments
+	}
+}
+
+func TestTransmissionSessionIDHandshake(t *testing.T) {
+	_, server := startDaemon(t)
+	url := server.URL + "/transmission/rpc"
+	body := `{"method":"session-get"}`
+
+	request, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	request.SetBasicAuth("admin", "wrong")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusUnauthorized || !strings.HasPrefix(response.Header.Get("WWW-Authenticate"), "Basic ") {
+		t.Errorf("wrong password: status %s, challenge %q", response.Status, response.Header.Get("WWW-Authenticate"))
+	}
+
+	sessionID := ""
+	for _, header := range []string{"", "stale"} {
+		request, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+		request.SetBasicAuth("admin", testToken)
+		if header != "" {
+			request.Header.Set(TransmissionSessionHeader, header)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusConflict {
+			t.Fatalf("session ID %q: status %s, want %d", header, response.Status, http.StatusConflict)
+		}
+		sessionID = response.Header.Get(TransmissionSessionHeader)
+		if sessionID == "" {
+			t.Fatal("409 answer carries no session ID")
+		}
+	}
+
+	c := &transmissionClient{t: t, url: url, sessionID: sessionID}
+	result, arguments := c.call("session-get", nil)
+	if result != "success" || arguments["rpc-version"] != float64(TransmissionRPCVersion) {
+		t.Errorf("session-get = %s, %v", result, arguments)
+	}
+	if result, _ := c.call("torrent-frob", nil); result != "method name not recognized" {
+		t.Errorf("unknown method: result %q", result)
+	}
+}
+
+func TestTransmissionAddGetAndRemove(t *testing.T) {
+	s, server := startDaemon(t)
+	c := &transmissionClient{t: t, url: server.URL + "/transmission/rpc"}
+	tor, metainfo := idleTorrent(t)
+	downloadDir := t.TempDir()
+
+	result, arguments := c.call("torrent-add", map[string]interface{}{
+		"metainfo":     base64.StdEncoding.EncodeToString(metainfo),
+		"download-dir": downloadDir,
+		"paused":       true,
+	})
+	if result != "success" {
+		t.Fatalf("torrent-add: %s", result)
+	}
+	added, _ := arguments["torrent-added"].(map[string]interface{})
+	infoHashBytes := tor.InfoHashBytes()
+	infoHash := hex.EncodeToString(infoHashBytes[:])
+	if added["id"] != float64(1) || added["hashString"] != infoHash || added["name"] != tor.Name {
+		t.Errorf("torrent-added = %v", added)
+	}
+	if result, _ := c.call("torrent-add", map[string]interface{}{"metainfo": "not base64!"}); !strings.Contains(result, "invalid metainfo") {
+		t.Errorf("corrupt metainfo: result %q", result)
+	}
+
+	// Only the fields asked for, and known, come back
+	_, arguments = c.call("torrent-get", map[string]interface{}{"ids": []interface{}{1}, "fields": []string{"id", "name", "status", "totalSize", "downloadDir", "noSuchField"}})
+	want := []interface{}{map[string]interface{}{
+		"id":          float64(1),
+		"name":        tor.Name,
+		"status":      float64(transmissionStopped),
+		"totalSize":   float64(len(tor.Data)),
+		"downloadDir": downloadDir,
+	}}
+	if !reflect.DeepEqual(arguments["torrents"], want) {
+		t.Errorf("torrent-get = %v, want %v", arguments["torrents"], want)
+	}
+	_, arguments = c.call("torrent-get", map[string]interface{}{"ids": infoHash, "fields": []string{"id", "hashString"}, "format": "table"})
+	wantTable := []interface{}{
+		[]interface{}{"id", "hashString"},
+		[]interface{}{float64(1), infoHash},
+	}
+	if !reflect.DeepEqual(arguments["torrents"], wantTable) {
+		t.Errorf("torrent-get as table = %v, want %v", arguments["torrents"], wantTable)
+	}
+	_, arguments = c.call("torrent-get", map[string]interface{}{"ids": []interface{}{2}, "fields": []string{"id"}})
+	if torrents, _ := arguments["torrents"].([]interface{}); len(torrents) != 0 {
+		t.Errorf("torrent-get of an unknown id = %v", torrents)
+	}
+	if result, _ := c.call("torrent-get", map[string]interface{}{}); result != "no fields specified" {
+		t.Errorf("torrent-get without fields: result %q", result)
+	}
+
+	if result, _ := c.call("torrent-remove", map[string]interface{}{"ids": []interface{}{1}, "delete-local-data": true}); result != "success" {
+		t.Fatalf("torrent-remove: %s", result)
+	}
+	if len(s.Session.Torrents()) != 0 {
+		t.Error("torrent still in the session after torrent-remove")
+	}
+	if _, err := os.Stat(filepath.Join(downloadDir, tor.Name)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("data left behind after delete-local-data: %v", err)
+	}
+	_, arguments = c.call("torrent-get", map[string]interface{}{"fields": []string{"id"}})
+	if torrents, _ := arguments["torrents"].([]interface{}); len(torrents) != 0 {
+		t.Errorf("torrents after remove = %v", torrents)
+	}
+
+	// A torrent added again gets a new id
+	c.call("torrent-add", map[string]interface{}{"metainfo": base64.StdEncoding.EncodeToString(metainfo), "paused": true})
+	_, arguments = c.call("torrent-get", map[string]interface{}{"fields": []string{"id"}})
+	if want := []interface{}{map[string]interface{}{"id": float64(2)}}; !reflect.DeepEqual(arguments["torrents"], want) {
+		t.Errorf("torrents after adding again = %v, want %v", arguments["torrents"], want)
+	}
+}
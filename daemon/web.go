@@ -0,0 +1,99 @@
+package daemon
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/client"
+)
+
+//go:embed web
+var webFiles embed.FS
+
+// How often the web UI is sent a fresh snapshot
+var EventInterval = time.Second
+
+// Everything the web UI shows about one torrent
+type TorrentDetail struct {
+	client.TorrentStatus
+	PieceMap    []byte                 `json:"piece_map"` // verified pieces as a bitfield
+	Files       []client.FileStatus    `json:"files"`
+	PeerList    []client.PeerStatus    `json:"peer_list"`
+	TrackerList []client.TrackerStatus `json:"tracker_list"`
+	Limits      Limits                 `json:"limits"`
+}
+
+type Snapshot struct {
+	Session  SessionInfo     `json:"session"`
+	Torrents []TorrentDetail `json:"torrents"`
+}
+
+func (s *Server) snapshot() Snapshot {
+	snapshot := Snapshot{Session: s.sessionInfo(), Torrents: []TorrentDetail{}}
+	for _, t := range s.Session.Torrents() {
+		snapshot.Torrents = append(snapshot.Torrents, TorrentDetail{
+			TorrentStatus: t.Status(),
+			PieceMap:      t.Pieces(),
+			Files:         t.Files(),
+			PeerList:      t.Peers(),
+			TrackerList:   t.Trackers(),
+			Limits:        torrentLimits(t.Limits),
+		})
+	}
+	return snapshot
+}
+
+// Browsers only know basic authentication, so ask for the token as a password
+func (s *Server) challenge(w http.ResponseWriter, r *http.Request) bool {
+	if s.authorized(r) {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="mybittorrent", charset="UTF-8"`)
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+func (s *Server) serveWeb(w http.ResponseWriter, r *http.Request) {
+	if !s.challenge(w, r) {
+		return
+	}
+	root, _ := fs.Sub(webFiles, "web")
+	http.FileServerFS(root).ServeHTTP(w, r)
+}
+
+// Stream snapshots as server-sent events until the client goes away
+func (s *Server) serveEvents(w http.ResponseWriter, r *http.Request) {
+	if !s.challenge(w, r) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	ticker := time.NewTicker(EventInterval)
+	defer ticker.Stop()
+	for {
+		data, err := json.Marshal(s.snapshot())
+		if err != nil {
+			return
+		}
+		if _, err := fmt.Fprintf(w, "event: snapshot\ndata: %s\n\n", data); err != nil {
+			return
+		}
+		flusher.Flush()
+		select {
+		case <-ticker.C:
+		case <-r.Context().Done():
+			return
+		case <-s.closing:
+			return
+		}
+	}
+}
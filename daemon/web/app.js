@@ -0,0 +1,257 @@
+"use strict";
+
+// Web UI for the daemon. State arrives as snapshots over server-sent events;
+// actions go through the JSON-RPC API at /rpc. The browser sends the basic
+// credentials it was challenged for with both.
+
+const KiB = 1024;
+const priorities = ["skip", "low", "normal", "high"];
+
+let snapshot = null;
+let selected = null; // info hash of the torrent shown in detail
+
+function $(selector) {
+  return document.querySelector(selector);
+}
+
+function element(tag, properties, ...children) {
+  const node = document.createElement(tag);
+  Object.assign(node, properties);
+  node.append(...children);
+  return node;
+}
+
+function formatBytes(bytes) {
+  const units = ["B", "KiB", "MiB", "GiB", "TiB"];
+  let unit = 0;
+  while (bytes >= KiB && unit < units.length - 1) {
+    bytes /= KiB;
+    unit++;
+  }
+  return (unit === 0 ? bytes : bytes.toFixed(1)) + " " + units[unit];
+}
+
+function formatRate(rate) {
+  return rate > 0 ? formatBytes(rate) + "/s" : "–";
+}
+
+function progressBar(done, total) {
+  const value = total > 0 ? done / total : 1;
+  return element("span", {}, element("progress", { max: 1, value }), " " + (value * 100).toFixed(1) + "%");
+}
+
+function showMessage(text, isError) {
+  const message = $("#message");
+  message.textContent = text;
+  message.className = isError ? "error" : "";
+}
+
+async function rpc(method, params) {
+  const response = await fetch("rpc", {
+    method: "POST",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify({ jsonrpc: "2.0", id: 1, method, params }),
+  });
+  if (!response.ok) {
+    throw new Error(response.status + " " + response.statusText);
+  }
+  const reply = await response.json();
+  if (reply.error) {
+    throw new Error(reply.error.message);
+  }
+  return reply.result;
+}
+
+async function act(method, params, done) {
+  try {
+    await rpc(method, params);
+    showMessage(done || "", false);
+  } catch (err) {
+    showMessage(method + ": " + err.message, true);
+  }
+}
+
+function renderTorrents() {
+  const body = $("#torrents tbody");
+  body.replaceChildren();
+  for (const t of snapshot.torrents) {
+    const paused = t.state === "paused";
+    const toggle = element("button", { textContent: paused ? "Resume" : "Pause" });
+    toggle.onclick = (event) => {
+      event.stopPropagation();
+      act(paused ? "torrent.resume" : "torrent.pause", { hash: t.info_hash });
+    };
+    const remove = element("button", { textContent: "Remove" });
+    remove.onclick = (event) => {
+      event.stopPropagation();
+      if (confirm("Remove " + t.name + "? Downloaded data is kept.")) {
+        act("torrent.remove", { hash: t.info_hash });
+      }
+    };
+    const row = element("tr", { className: t.info_hash === selected ? "selected" : "" },
+      element("td", { className: "path", textContent: t.name }),
+      element("td", { textContent: t.state, className: t.error ? "error" : "" }),
+      element("td", {}, progressBar(t.size - t.left, t.size)),
+      element("td", { textContent: formatBytes(t.size) }),
+      element("td", { textContent: formatRate(t.download_rate) }),
+      element("td", { textContent: formatRate(t.upload_rate) }),
+      element("td", { textContent: t.peers }),
+      element("td", {}, toggle, " ", remove));
+    row.onclick = () => {
+      selected = t.info_hash;
+      fillLimits($("#torrent-limits"), t.limits);
+      render();
+    };
+    body.append(row);
+  }
+}
+
+function drawPieces(t) {
+  const canvas = $("#pieces");
+  canvas.width = canvas.clientWidth;
+  const context = canvas.getContext("2d");
+  const bits = Uint8Array.from(atob(t.piece_map || ""), (c) => c.charCodeAt(0));
+  const width = canvas.width / t.pieces;
+  context.clearRect(0, 0, canvas.width, canvas.height);
+  context.fillStyle = "#3b82f6";
+  for (let piece = 0; piece < t.pieces; piece++) {
+    if (bits[piece >> 3] & (0x80 >> (piece & 7))) {
+      // Neighbouring pieces overlap by a pixel so there are no gaps
+      context.fillRect(Math.floor(piece * width), 0, Math.ceil(width) + 1, canvas.height);
+    }
+  }
+}
+
+function renderFiles(t) {
+  const body = $("#files tbody");
+  body.replaceChildren();
+  t.files.forEach((file, index) => {
+    const select = element("select", {}, ...priorities.map((p) => element("option", { value: p, textContent: p })));
+    select.value = file.priority;
+    select.onchange = () => act("torrent.set_priority", { hash: t.info_hash, files: [index], priority: select.value });
+    body.append(element("tr", {},
+      element("td", { className: "path", textContent: file.path }),
+      element("td", { textContent: formatBytes(file.length) }),
+      element("td", {}, progressBar(file.completed, file.length)),
+      element("td", {}, select)));
+  });
+}
+
+function renderPeers(t) {
+  const body = $("#peers tbody");
+  body.replaceChildren();
+  for (const peer of t.peer_list) {
+    body.append(element("tr", {},
+      element("td", { textContent: peer.address }),
+      element("td", { textContent: peer.client }),
+      element("td", { textContent: formatRate(peer.download_rate) }),
+      element("td", { textContent: formatRate(peer.upload_rate) }),
+      element("td", { textContent: peer.choked ? "yes" : "no" })));
+  }
+}
+
+function renderTrackers(t) {
+  const body = $("#trackers tbody");
+  body.replaceChildren();
+  for (const tracker of t.tracker_list) {
+    const announced = new Date(tracker.last_announce);
+    body.append(element("tr", {},
+      element("td", { className: "path", textContent: tracker.url }),
+      element("td", { textContent: announced.getFullYear() > 1 ? announced.toLocaleTimeString() : "never" }),
+      element("td", { textContent: tracker.peers }),
+      element("td", { textContent: tracker.error || "ok", className: tracker.error ? "error" : "" })));
+  }
+}
+
+function renderDetail() {
+  const t = snapshot.torrents.find((t) => t.info_hash === selected);
+  $("#detail").hidden = !t;
+  if (!t) {
+    return;
+  }
+  $("#detail-name").textContent = t.name;
+  $("#detail-error").textContent = t.error || "";
+  drawPieces(t);
+  // Keep a row's priority menu usable while it is open
+  if (!$("#files").contains(document.activeElement)) {
+    renderFiles(t);
+  }
+  renderPeers(t);
+  renderTrackers(t);
+}
+
+function render() {
+  const session = snapshot.session;
+  $("#session").textContent = "port " + session.port + " · " + session.torrents + " torrents · saving to " + session.download_dir;
+  renderTorrents();
+  renderDetail();
+}
+
+function fillLimits(form, limits) {
+  form.download.value = Math.round(limits.download / KiB);
+  form.upload.value = Math.round(limits.upload / KiB);
+}
+
+function readLimits(form) {
+  return { download: Number(form.download.value) * KiB, upload: Number(form.upload.value) * KiB };
+}
+
+function readFile(file) {
+  return new Promise((resolve, reject) => {
+    const reader = new FileReader();
+    // The data URL carries the base64 the API expects for byte fields
+    reader.onload = () => resolve(reader.result.slice(reader.result.indexOf(",") + 1));
+    reader.onerror = () => reject(reader.error);
+    reader.readAsDataURL(file);
+  });
+}
+
+$("#add-form").onsubmit = async (event) => {
+  event.preventDefault();
+  const file = $("#add-file").files[0];
+  const url = $("#add-url").value.trim();
+  const params = { paused: $("#add-paused").checked };
+  if (file) {
+    params.metainfo = await readFile(file);
+  } else if (url) {
+    params.url = url;
+  } else {
+    showMessage("Choose a .torrent file or enter a link", true);
+    return;
+  }
+  showMessage("Adding…", false);
+  await act("torrent.add", params, "Added");
+  event.target.reset();
+};
+
+$("#session-limits").onsubmit = (event) => {
+  event.preventDefault();
+  act("session.set_limits", readLimits(event.target), "Session limits set");
+};
+
+$("#torrent-limits").onsubmit = (event) => {
+  event.preventDefault();
+  act("torrent.set_limits", { hash: selected, ...readLimits(event.target) }, "Torrent limits set");
+};
+
+function connect() {
+  const events = new EventSource("events");
+  let first = true;
+  events.addEventListener("snapshot", (event) => {
+    snapshot = JSON.parse(event.data);
+    if (first) {
+      fillLimits($("#session-limits"), snapshot.session.limits);
+      first = false;
+    }
+    $("#connection").textContent = "connected";
+    $("#connection").className = "online";
+    render();
+  });
+  // EventSource reconnects by itself
+  events.onerror = () => {
+    $("#connection").textContent = "disconnected, retrying…";
+    $("#connection").className = "offline";
+  };
+}
+
+connect();
@@ -0,0 +1,124 @@
+package daemon
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/client"
+)
+
+// Read the next server-sent event, returning its name and data
+func readEvent(t *testing.T, events *bufio.Reader) (string, string) {
+	t.Helper()
+	var name, data string
+	for {
+		line, err := events.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading events: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && name != "":
+			return name, data
+		case strings.HasPrefix(line, "event: "):
+			name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestWebRequiresToken(t *testing.T) {
+	_, server := startDaemon(t)
+	for _, path := range []string{"/", "/events"} {
+		for name, password := range map[string]string{"no credentials": "", "wrong token": "wrong"} {
+			request, _ := http.NewRequest(http.MethodGet, server.URL+path, nil)
+			if password != "" {
+				request.SetBasicAuth("", password)
+			}
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+			if response.StatusCode != http.StatusUnauthorized {
+				t.Errorf("%s with %s: status %s, want %d", path, name, response.Status, http.StatusUnauthorized)
+			}
+			// Browsers only prompt for basic authentication
+			if !strings.HasPrefix(response.Header.Get("WWW-Authenticate"), "Basic ") {
+				t.Errorf("%s with %s: challenge %q", path, name, response.Header.Get("WWW-Authenticate"))
+			}
+		}
+	}
+
+	request, _ := http.NewRequest(http.MethodGet, server.URL+"/", nil)
+	request.SetBasicAuth("", testToken)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK || !strings.HasPrefix(response.Header.Get("Content-Type"), "text/html") {
+		t.Errorf("web UI: status %s, content type %q", response.Status, response.Header.Get("Content-Type"))
+	}
+}
+
+func TestEventsStreamSnapshots(t *testing.T) {
+	previous := EventInterval
+	EventInterval = 10 * time.Millisecond
+	t.Cleanup(func() { EventInterval = previous })
+	s, server := startDaemon(t)
+	_, metainfo := idleTorrent(t)
+	rpc := NewClient(server.URL+"/rpc", testToken)
+	if err := rpc.Call(context.Background(), "torrent.add", AddParams{Metainfo: metainfo, Paused: true}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	request, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/events", nil)
+	request.Header.Set("Authorization", "Bearer "+testToken)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status %s, content type %q", response.Status, response.Header.Get("Content-Type"))
+	}
+	events := bufio.NewReader(response.Body)
+	name, data := readEvent(t, events)
+	if name != "snapshot" {
+		t.Fatalf("event %q, want snapshot", name)
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal([]byte(data), &snapshot); err != nil {
+		t.Fatalf("decoding snapshot %q: %v", data, err)
+	}
+	torrents := s.Session.Torrents()
+	if len(snapshot.Torrents) != 1 || snapshot.Torrents[0].InfoHash != torrents[0].InfoHash() {
+		t.Fatalf("snapshot torrents %+v, want the added torrent", snapshot.Torrents)
+	}
+	if detail := snapshot.Torrents[0]; len(detail.PieceMap) != len(torrents[0].Pieces()) || len(detail.TrackerList) != 1 {
+		t.Errorf("snapshot detail %+v", detail)
+	}
+
+	// Later snapshots follow changes to the session
+	torrents[0].Resume()
+	for {
+		if name, data = readEvent(t, events); name != "snapshot" {
+			t.Fatalf("event %q, want snapshot", name)
+		}
+		if err := json.Unmarshal([]byte(data), &snapshot); err != nil {
+			t.Fatal(err)
+		}
+		if len(snapshot.Torrents) == 1 && snapshot.Torrents[0].State != client.TorrentPaused {
+			break
+		}
+	}
+}
@@ -0,0 +1,166 @@
+// Package logging provides structured loggers for each subsystem of the
+// client. Loggers can be taken at package initialisation; Configure may be
+// called later and applies to loggers already handed out.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Subsystems logging through For
+const (
+	Tracker = "tracker"
+	Peer    = "peer"
+	Picker  = "picker"
+	Storage = "storage"
+	Session = "session"
+	DHT     = "dht"
+)
+
+type Config struct {
+	// Minimum level, optionally followed by per-subsystem overrides:
+	// "warn,peer=debug,tracker=info"
+	Level string
+	// "text" or "json"
+	Format string
+	Output io.Writer
+}
+
+var (
+	base         atomic.Pointer[slog.Handler]
+	defaultLevel = new(slog.LevelVar)
+
+	mu     sync.Mutex
+	levels = map[string]*slog.LevelVar{}
+)
+
+func init() {
+	defaultLevel.Set(slog.LevelWarn)
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})
+	base.Store(&handler)
+}
+
+// Level of a subsystem, shared by all its loggers
+func level(subsystem string) *slog.LevelVar {
+	mu.Lock()
+	defer mu.Unlock()
+	level, ok := levels[subsystem]
+	if !ok {
+		level = new(slog.LevelVar)
+		level.Set(defaultLevel.Level())
+		levels[subsystem] = level
+	}
+	return level
+}
+
+// Logger for a subsystem; its records carry a "subsystem" attribute
+func For(subsystem string) *slog.Logger {
+	return slog.New(&handler{level: level(subsystem)}).With("subsystem", subsystem)
+}
+
+// Parse a level name: debug, info, warn or error
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return 0, fmt.Errorf("invalid log level: %s", name)
+	}
+	return level, nil
+}
+
+// Apply a configuration to every logger, past and future
+func Configure(config Config) error {
+	overrides := map[string]slog.Level{}
+	defaultValue := slog.LevelWarn
+	for _, part := range strings.Split(config.Level, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, found := strings.Cut(part, "=")
+		if !found {
+			name, value = "", name
+		}
+		level, err := ParseLevel(value)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			defaultValue = level
+		} else {
+			overrides[name] = level
+		}
+	}
+	output := config.Output
+	if output == nil {
+		output = os.Stderr
+	}
+	// Levels are filtered per subsystem, so the base handler lets everything through
+	options := &slog.HandlerOptions{Level: slog.LevelDebug}
+	var handler slog.Handler
+	switch config.Format {
+	case "", "text":
+		handler = slog.NewTextHandler(output, options)
+	case "json":
+		handler = slog.NewJSONHandler(output, options)
+	default:
+		return fmt.Errorf("unknown log format: %s", config.Format)
+	}
+	base.Store(&handler)
+
+	mu.Lock()
+	defer mu.Unlock()
+	defaultLevel.Set(defaultValue)
+	for name, level := range levels {
+		if override, ok := overrides[name]; ok {
+			level.Set(override)
+		} else {
+			level.Set(defaultValue)
+		}
+	}
+	for name, override := range overrides {
+		if _, ok := levels[name]; !ok {
+			levels[name] = new(slog.LevelVar)
+			levels[name].Set(override)
+		}
+	}
+	return nil
+}
+
+// handler filters records by the level of its subsystem and hands them to
+// whichever base handler is configured at the time. Attributes and groups
+// added to the logger are replayed onto the base handler for every record.
+type handler struct {
+	level *slog.LevelVar
+	wraps []func(slog.Handler) slog.Handler
+}
+
+func (h *handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *handler) Handle(ctx context.Context, record slog.Record) error {
+	target := *base.Load()
+	for _, wrap := range h.wraps {
+		target = wrap(target)
+	}
+	return target.Handle(ctx, record)
+}
+
+func (h *handler) with(wrap func(slog.Handler) slog.Handler) *handler {
+	return &handler{level: h.level, wraps: append(h.wraps[:len(h.wraps):len(h.wraps)], wrap)}
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(target slog.Handler) slog.Handler { return target.WithAttrs(attrs) })
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return h.with(func(target slog.Handler) slog.Handler { return target.WithGroup(name) })
+}
@@ -0,0 +1,78 @@
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRotatingFileRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "client.log")
+	f, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := readFile(t, path); got != "fourth\n" {
+		t.Errorf("current file = %q", got)
+	}
+	if got := readFile(t, path+".1"); got != "third\n" {
+		t.Errorf("first backup = %q", got)
+	}
+	if got := readFile(t, path+".2"); got != "second\n" {
+		t.Errorf("second backup = %q", got)
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("backup beyond the limit kept: %v", err)
+	}
+}
+
+func TestRotatingFileKeepsWritingWhenRenameFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "client.log")
+	// A non-empty directory in the way of the backup makes the rename fail
+	if err := os.MkdirAll(filepath.Join(path+".1", "blocker"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := OpenRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, line := range []string{"first\n", "second\n", "third\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("write %q: %v", line, err)
+		}
+	}
+	if got := readFile(t, path); got != "first\nsecond\nthird\n" {
+		t.Errorf("current file = %q", got)
+	}
+
+	// Once the way is clear, rotation resumes
+	if err := os.RemoveAll(path + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("fourth\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, path); got != "fourth\n" {
+		t.Errorf("current file after rotation = %q", got)
+	}
+	if got := readFile(t, path+".1"); !strings.HasPrefix(got, "first\n") {
+		t.Errorf("backup = %q", got)
+	}
+}
@@ -0,0 +1,60 @@
+package metainfo
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Magnet is a parsed magnet link. It names a torrent by info hash only; the
+// info dictionary has to be fetched from peers (see peer.FetchMetadata).
+type Magnet struct {
+	InfoHash string // hex
+	Name     string
+	Trackers []string
+}
+
+func ParseMagnet(uri string) (*Magnet, error) {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid magnet link: %v", err)
+	}
+	if parsed.Scheme != "magnet" {
+		return nil, errors.New("not a magnet link")
+	}
+	query := parsed.Query()
+	magnet := &Magnet{Name: query.Get("dn"), Trackers: query["tr"]}
+	for _, topic := range query["xt"] {
+		hash, ok := strings.CutPrefix(topic, "urn:btih:")
+		if !ok {
+			continue
+		}
+		switch len(hash) {
+		case 40:
+			if _, err := hex.DecodeString(hash); err != nil {
+				return nil, fmt.Errorf("invalid info hash: %s", hash)
+			}
+			magnet.InfoHash = strings.ToLower(hash)
+		case 32:
+			decoded, err := base32.StdEncoding.DecodeString(strings.ToUpper(hash))
+			if err != nil {
+				return nil, fmt.Errorf("invalid info hash: %s", hash)
+			}
+			magnet.InfoHash = hex.EncodeToString(decoded)
+		default:
+			return nil, fmt.Errorf("invalid info hash: %s", hash)
+		}
+	}
+	if magnet.InfoHash == "" {
+		return nil, errors.New("magnet link has no btih info hash")
+	}
+	return magnet, nil
+}
+
+// Build the metainfo of a torrent from an info dictionary fetched from peers
+func FromInfo(announce string, info map[string]interface{}) (*Metainfo, error) {
+	return Parse(map[string]interface{}{"announce": announce, "info": info})
+}
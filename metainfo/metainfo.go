@@ -0,0 +1,245 @@
+// Package metainfo parses .torrent files.
+package metainfo
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/bencode"
+)
+
+type FileEntry struct {
+	Path   string // relative path using the OS separator
+	Length int
+	Offset int // offset of the file within the torrent's data
+}
+
+type Metainfo struct {
+	Announce    string
+	InfoHash    string
+	Info        map[string]interface{}
+	Name        string
+	PieceLength int
+	Pieces      string
+	Length      int
+	Files       []FileEntry
+	WebSeeds    []string // HTTP servers holding the torrent's files (BEP 19)
+}
+
+// Parse the file list of an info dictionary. Single-file torrents yield one entry named after the torrent.
+func ParseFileEntries(info map[string]interface{}) ([]FileEntry, error) {
+	name, _ := info["name"].(string)
+	if length, ok := info["length"].(int); ok {
+		if length < 0 {
+			return nil, errors.New("invalid 'length' field")
+		}
+		if name == "" {
+			name = "download"
+		}
+		if err := validatePathComponent(name); err != nil {
+			return nil, err
+		}
+		return []FileEntry{{Path: name, Length: length}}, nil
+	}
+	list, ok := info["files"].([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, errors.New("missing or invalid 'files' field")
+	}
+	files := make([]FileEntry, 0, len(list))
+	offset := 0
+	for _, item := range list {
+		file, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("invalid entry in 'files' field")
+		}
+		length, ok := file["length"].(int)
+		if !ok || length < 0 || length > math.MaxInt-offset {
+			return nil, errors.New("missing or invalid file 'length' field")
+		}
+		components, ok := file["path"].([]interface{})
+		if !ok || len(components) == 0 {
+			return nil, errors.New("missing or invalid file 'path' field")
+		}
+		parts := make([]string, 0, len(components))
+		for _, component := range components {
+			part, ok := component.(string)
+			if !ok {
+				return nil, errors.New("invalid file path component")
+			}
+			if err := validatePathComponent(part); err != nil {
+				return nil, err
+			}
+			parts = append(parts, part)
+		}
+		files = append(files, FileEntry{Path: filepath.Join(parts...), Length: length, Offset: offset})
+		offset += length
+	}
+	return files, nil
+}
+
+// Reject path components that would escape the download directory
+func validatePathComponent(part string) error {
+	if part == "" || part == "." || part == ".." || filepath.Base(part) != part {
+		return fmt.Errorf("unsafe file path component: %q", part)
+	}
+	return nil
+}
+
+func TotalLength(files []FileEntry) int {
+	total := 0
+	for _, file := range files {
+		total += file.Length
+	}
+	return total
+}
+
+func ExtractMetadata(bencodedData map[string]interface{}) (string, int, map[string]interface{}, int, string, error) {
+	// Torrents served only by web seeds may have no tracker
+	announce, ok := bencodedData["announce"].(string)
+	if !ok && len(ParseURLList(bencodedData["url-list"])) == 0 {
+		return "", 0, nil, 0, "", errors.New("missing or invalid 'announce' field")
+	}
+	info, ok := bencodedData["info"].(map[string]interface{})
+	if !ok {
+		return "", 0, nil, 0, "", errors.New("missing or invalid 'info' field")
+	}
+	length, ok := info["length"].(int)
+	if !ok {
+		// Multi-file torrents list their files instead of a single length
+		files, err := ParseFileEntries(info)
+		if err != nil {
+			return "", 0, nil, 0, "", errors.New("missing or invalid 'length' field")
+		}
+		length = TotalLength(files)
+	}
+	pieceLength, ok := info["piece length"].(int)
+	if !ok {
+		return "", 0, nil, 0, "", errors.New("missing or invalid 'piece length' field")
+	}
+	pieces, ok := info["pieces"].(string)
+	if !ok {
+		return "", 0, nil, 0, "", errors.New("missing or invalid 'pieces' field")
+	}
+	return announce, length, info, pieceLength, pieces, nil
+}
+
+// Parse a url-list field, which holds either one URL or a list of them.
+// Entries that are not HTTP URLs are dropped.
+func ParseURLList(value interface{}) []string {
+	var candidates []interface{}
+	switch v := value.(type) {
+	case string:
+		candidates = []interface{}{v}
+	case []interface{}:
+		candidates = v
+	}
+	var urls []string
+	for _, candidate := range candidates {
+		if u, ok := candidate.(string); ok && (strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://")) {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+func ComputeInfoHash(infoDict map[string]interface{}) (string, error) {
+	// Sort the keys of the info dictionary
+	sortedKeys := make([]string, 0, len(infoDict))
+	for key := range infoDict {
+		sortedKeys = append(sortedKeys, key)
+	}
+	sort.Strings(sortedKeys)
+	// Create a new map with the sorted keys
+	sortedInfoDict := make(map[string]interface{})
+	for _, key := range sortedKeys {
+		sortedInfoDict[key] = infoDict[key]
+	}
+	// Bencode the sorted info dictionary
+	bencodedInfo, _, err := bencode.Encode(sortedInfoDict)
+	if err != nil {
+		return "", err
+	}
+	// Compute the SHA-1 hash of the bencoded info dictionary
+	hash := sha1.New()
+	hash.Write([]byte(bencodedInfo))
+	infoHash := hash.Sum(nil)
+	// Convert the hash to a hexadecimal string
+	return hex.EncodeToString(infoHash), nil
+}
+
+func Parse(bencodedData map[string]interface{}) (*Metainfo, error) {
+	announce, length, info, pieceLength, pieces, err := ExtractMetadata(bencodedData)
+	if err != nil {
+		return nil, err
+	}
+	if pieceLength <= 0 || len(pieces)%20 != 0 || length < 0 || length > math.MaxInt-pieceLength {
+		return nil, errors.New("invalid piece layout")
+	}
+	files, err := ParseFileEntries(info)
+	if err != nil {
+		return nil, err
+	}
+	infoHash, err := ComputeInfoHash(info)
+	if err != nil {
+		return nil, err
+	}
+	m := &Metainfo{
+		Announce:    announce,
+		InfoHash:    infoHash,
+		Info:        info,
+		PieceLength: pieceLength,
+		Pieces:      pieces,
+		Length:      length,
+		Files:       files,
+	}
+	m.Name, _ = info["name"].(string)
+	m.WebSeeds = ParseURLList(bencodedData["url-list"])
+	if (length+pieceLength-1)/pieceLength != m.PieceCount() {
+		return nil, fmt.Errorf("piece count %d does not match length %d", m.PieceCount(), length)
+	}
+	return m, nil
+}
+
+func (m *Metainfo) PieceCount() int {
+	return len(m.Pieces) / 20
+}
+
+func (m *Metainfo) PieceSize(index int) int {
+	if index == m.PieceCount()-1 {
+		return m.Length - index*m.PieceLength
+	}
+	return m.PieceLength
+}
+
+func (m *Metainfo) PieceHash(index int) []byte {
+	return []byte(m.Pieces[index*20 : (index+1)*20])
+}
+
+// Decode a torrent file and parse its metainfo
+func Load(path string) (*Metainfo, error) {
+	fileData, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Unmarshal(fileData)
+}
+
+// Parse the contents of a torrent file
+func Unmarshal(fileData []byte) (*Metainfo, error) {
+	decoded, _, err := bencode.Decode(string(fileData))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding file: %v", err)
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("decoded data is not a dictionary")
+	}
+	return Parse(dict)
+}
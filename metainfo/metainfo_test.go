@@ -0,0 +1,81 @@
+package metainfo
+
+import (
+	"strings"
+	"testing"
+)
+
+const singleFile = "d8:announce31:http://tracker.example/announce4:infod6:lengthi40000e4:name10:sample.txt12:piece lengthi32768e6:pieces40:" +
+	"aaaaaaaaaaaaaaaaaaaabbbbbbbbbbbbbbbbbbbbee"
+
+const multiFile = "d4:infod5:filesld6:lengthi10e4:pathl3:dir5:a.txteed6:lengthi20e4:pathl5:b.txteee4:name5:files12:piece lengthi16e6:pieces40:" +
+	"aaaaaaaaaaaaaaaaaaaabbbbbbbbbbbbbbbbbbbbe8:url-listl20:http://seed.example/ee"
+
+func TestUnmarshal(t *testing.T) {
+	m, err := Unmarshal([]byte(singleFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Announce != "http://tracker.example/announce" || m.Name != "sample.txt" || m.Length != 40000 || m.PieceCount() != 2 || m.PieceSize(1) != 40000-32768 {
+		t.Errorf("unexpected metainfo %+v", m)
+	}
+	if len(m.InfoHash) != 40 {
+		t.Errorf("info hash %q", m.InfoHash)
+	}
+
+	m, err = Unmarshal([]byte(multiFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Length != 30 || len(m.Files) != 2 || m.Files[1].Offset != 10 || len(m.WebSeeds) != 1 {
+		t.Errorf("unexpected metainfo %+v", m)
+	}
+}
+
+func TestUnmarshalRejects(t *testing.T) {
+	for name, input := range map[string]string{
+		"not a dictionary": "i1e",
+		"no info":          "d8:announce3:urle",
+		"bad piece length": strings.Replace(singleFile, "lengthi32768e", "lengthi0e", 1),
+		"piece count":      strings.Replace(singleFile, "lengthi40000e", "lengthi70000e", 1),
+		"escaping path":    strings.Replace(multiFile, "3:dir", "3:../", 1),
+	} {
+		if _, err := Unmarshal([]byte(input)); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+// Whatever parses must describe a consistent piece layout
+func FuzzUnmarshal(f *testing.F) {
+	f.Add([]byte(singleFile))
+	f.Add([]byte(multiFile))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := Unmarshal(data)
+		if err != nil {
+			return
+		}
+		if len(m.InfoHash) != 40 || m.PieceLength <= 0 {
+			t.Fatalf("invalid metainfo %+v", m)
+		}
+		total := 0
+		for _, file := range m.Files {
+			if file.Length < 0 || file.Offset != total {
+				t.Fatalf("file %+v out of place", file)
+			}
+			total += file.Length
+		}
+		if total != m.Length {
+			t.Fatalf("files add up to %d bytes, length is %d", total, m.Length)
+		}
+		if m.PieceCount() > 0 {
+			last := m.PieceCount() - 1
+			if size := m.PieceSize(last); size <= 0 || size > m.PieceLength {
+				t.Fatalf("last piece is %d bytes", size)
+			}
+			if len(m.PieceHash(last)) != 20 {
+				t.Fatal("short piece hash")
+			}
+		}
+	})
+}
@@ -0,0 +1,141 @@
+// Package metrics exports the statistics of a client.Session in the
+// Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/client"
+)
+
+// A metric family and its samples, written together as the format requires
+type family struct {
+	name    string
+	kind    string // counter or gauge
+	help    string
+	samples []sample
+}
+
+type sample struct {
+	labels []string // name, value pairs
+	value  float64
+}
+
+func (f *family) add(value float64, labels ...string) {
+	f.samples = append(f.samples, sample{labels: labels, value: value})
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (f *family) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+	for _, s := range f.samples {
+		w.WriteString(f.name)
+		if len(s.labels) > 0 {
+			w.WriteByte('{')
+			for i := 0; i < len(s.labels); i += 2 {
+				if i > 0 {
+					w.WriteByte(',')
+				}
+				fmt.Fprintf(w, `%s="%s"`, s.labels[i], labelEscaper.Replace(s.labels[i+1]))
+			}
+			w.WriteByte('}')
+		}
+		w.WriteByte(' ')
+		w.WriteString(strconv.FormatFloat(s.value, 'g', -1, 64))
+		w.WriteByte('\n')
+	}
+}
+
+// Write the current statistics of every torrent in the session. Torrent
+// metrics carry info_hash and name labels. The client has no DHT, so there
+// are no DHT metrics.
+func Write(out io.Writer, session *client.Session) error {
+	downloaded := &family{name: "mybittorrent_downloaded_bytes_total", kind: "counter", help: "Bytes of verified pieces downloaded."}
+	uploaded := &family{name: "mybittorrent_uploaded_bytes_total", kind: "counter", help: "Bytes of blocks uploaded to peers."}
+	wasted := &family{name: "mybittorrent_wasted_bytes_total", kind: "counter", help: "Bytes of downloaded pieces that failed the hash check."}
+	hashFailures := &family{name: "mybittorrent_hash_failures_total", kind: "counter", help: "Pieces that failed the hash check."}
+	downloadRate := &family{name: "mybittorrent_download_rate_bytes", kind: "gauge", help: "Download rate over the last few seconds, in bytes per second."}
+	uploadRate := &family{name: "mybittorrent_upload_rate_bytes", kind: "gauge", help: "Upload rate over the last few seconds, in bytes per second."}
+	pieces := &family{name: "mybittorrent_pieces", kind: "gauge", help: "Pieces in the torrent."}
+	piecesComplete := &family{name: "mybittorrent_pieces_complete", kind: "gauge", help: "Verified pieces."}
+	left := &family{name: "mybittorrent_left_bytes", kind: "gauge", help: "Bytes of wanted pieces still missing."}
+	state := &family{name: "mybittorrent_torrent_state", kind: "gauge", help: "1 for the state the torrent is in."}
+	peers := &family{name: "mybittorrent_peers_connected", kind: "gauge", help: "Peers with a completed handshake."}
+	halfOpen := &family{name: "mybittorrent_peers_half_open", kind: "gauge", help: "Outbound peer connections still handshaking."}
+	choke := &family{name: "mybittorrent_peers_choke_state", kind: "gauge", help: "Connected peers by whether they are choking us."}
+	announces := &family{name: "mybittorrent_tracker_announces_total", kind: "counter", help: "Announces sent to the tracker."}
+	announceErrors := &family{name: "mybittorrent_tracker_announce_errors_total", kind: "counter", help: "Announces that failed."}
+	latency := &family{name: "mybittorrent_tracker_announce_duration_seconds", kind: "gauge", help: "Duration of the latest announce."}
+	lastAnnounce := &family{name: "mybittorrent_tracker_last_announce_timestamp_seconds", kind: "gauge", help: "Unix time of the latest announce."}
+
+	for _, t := range session.Torrents() {
+		status := t.Status()
+		labels := []string{"info_hash", status.InfoHash, "name", status.Name}
+		downloaded.add(float64(status.Downloaded), labels...)
+		uploaded.add(float64(status.Uploaded), labels...)
+		wasted.add(float64(status.Wasted), labels...)
+		hashFailures.add(float64(status.HashFailures), labels...)
+		downloadRate.add(float64(status.DownloadRate), labels...)
+		uploadRate.add(float64(status.UploadRate), labels...)
+		pieces.add(float64(status.Pieces), labels...)
+		piecesComplete.add(float64(status.Have), labels...)
+		left.add(float64(status.Left), labels...)
+		for s := client.TorrentQueued; s <= client.TorrentFailed; s++ {
+			value := 0.0
+			if s == status.State {
+				value = 1
+			}
+			state.add(value, append(labels, "state", s.String())...)
+		}
+		peers.add(float64(status.Peers), labels...)
+		halfOpen.add(float64(status.HalfOpen), labels...)
+		var choked, unchoked int
+		for _, p := range t.Peers() {
+			if p.Choked {
+				choked++
+			} else {
+				unchoked++
+			}
+		}
+		choke.add(float64(choked), append(labels, "state", "choked")...)
+		choke.add(float64(unchoked), append(labels, "state", "unchoked")...)
+		for _, tracker := range t.Trackers() {
+			trackerLabels := append(labels, "tracker", tracker.URL)
+			announces.add(float64(tracker.Announces), trackerLabels...)
+			announceErrors.add(float64(tracker.Failures), trackerLabels...)
+			latency.add(tracker.Latency.Seconds(), trackerLabels...)
+			if !tracker.LastAnnounce.IsZero() {
+				lastAnnounce.add(float64(tracker.LastAnnounce.Unix()), trackerLabels...)
+			}
+		}
+	}
+
+	inbound := &family{name: "mybittorrent_inbound_half_open", kind: "gauge", help: "Inbound peer connections still handshaking."}
+	inbound.add(float64(session.HalfOpen()))
+	torrents := &family{name: "mybittorrent_torrents", kind: "gauge", help: "Torrents in the session."}
+	torrents.add(float64(len(session.Torrents())))
+
+	w := bufio.NewWriter(out)
+	for _, f := range []*family{
+		torrents, inbound, state, downloaded, uploaded, wasted, hashFailures, downloadRate, uploadRate,
+		pieces, piecesComplete, left, peers, halfOpen, choke,
+		announces, announceErrors, latency, lastAnnounce,
+	} {
+		f.write(w)
+	}
+	return w.Flush()
+}
+
+// Handler serving the metrics of session, for mounting at /metrics
+func Handler(session *client.Session) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Write(w, session)
+	})
+}
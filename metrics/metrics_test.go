@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/client"
+	"github.com/codecrafters-io/bittorrent-starter-go/testutil"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// A session holding one paused torrent, so none of its statistics move while
+// the test looks at them. The name needs escaping in label values.
+func pausedSession(t *testing.T) *client.Session {
+	t.Helper()
+	session, err := client.NewSession(client.SessionConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { session.Close() })
+	tor := testutil.NewTorrent("say \"hi\"\nback\\slash", 32<<10, 100<<10)
+	info, err := tor.Metainfo("http://tracker.invalid/announce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Add(info, filepath.Join(t.TempDir(), "data"), &client.TorrentOptions{Paused: true}); err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+func TestHandlerMatchesGoldenExposition(t *testing.T) {
+	server := httptest.NewServer(Handler(pausedSession(t)))
+	defer server.Close()
+	response, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if contentType := response.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("content type %q", contentType)
+	}
+	got, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	golden := filepath.Join("testdata", "paused_torrent.prom")
+	if *update {
+		if err := os.WriteFile(golden, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("exposition differs from %s (rerun with -update to accept it):\n%s", golden, got)
+	}
+}
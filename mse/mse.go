@@ -0,0 +1,355 @@
+// Package mse implements Message Stream Encryption (MSE/PE), used by most
+// BitTorrent clients to obfuscate the peer wire protocol.
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+)
+
+type EncryptionPolicy int
+
+const (
+	EncryptionDisabled EncryptionPolicy = iota
+	EncryptionPreferred
+	EncryptionRequired
+)
+
+const (
+	cryptoPlaintext uint32 = 0x01
+	cryptoRC4       uint32 = 0x02
+	mseKeyLength           = 96
+	mseMaxPadding          = 512
+)
+
+var (
+	msePrime, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	mseGenerator = big.NewInt(2)
+	mseVC        = make([]byte, 8)
+
+	ErrPlaintextRejected = errors.New("plaintext connection rejected by encryption policy")
+	ErrEncryptedRejected = errors.New("encrypted connection rejected by encryption policy")
+)
+
+func ParseEncryptionPolicy(policy string) (EncryptionPolicy, error) {
+	switch strings.ToLower(policy) {
+	case "disabled", "off", "plaintext":
+		return EncryptionDisabled, nil
+	case "preferred", "prefer", "enabled":
+		return EncryptionPreferred, nil
+	case "required", "require", "forced":
+		return EncryptionRequired, nil
+	}
+	return EncryptionDisabled, fmt.Errorf("unknown encryption policy: %s", policy)
+}
+
+func (p EncryptionPolicy) String() string {
+	switch p {
+	case EncryptionPreferred:
+		return "preferred"
+	case EncryptionRequired:
+		return "required"
+	}
+	return "disabled"
+}
+
+// mseConn wraps a connection after the MSE handshake. A nil cipher means the
+// payload stream is plaintext.
+type mseConn struct {
+	net.Conn
+	reader  io.Reader
+	encrypt *rc4.Cipher
+	decrypt *rc4.Cipher
+}
+
+func (c *mseConn) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	if c.decrypt != nil && n > 0 {
+		c.decrypt.XORKeyStream(p[:n], p[:n])
+	}
+	return n, err
+}
+
+func (c *mseConn) Write(p []byte) (int, error) {
+	if c.encrypt == nil {
+		return c.Conn.Write(p)
+	}
+	buf := make([]byte, len(p))
+	c.encrypt.XORKeyStream(buf, p)
+	return c.Conn.Write(buf)
+}
+
+func mseHash(parts ...[]byte) []byte {
+	hash := sha1.New()
+	for _, part := range parts {
+		hash.Write(part)
+	}
+	return hash.Sum(nil)
+}
+
+// Create an RC4 cipher keyed as HASH(name, S, SKEY) with the first 1024 bytes discarded
+func mseCipher(name string, secret []byte, infoHash []byte) *rc4.Cipher {
+	cipher, _ := rc4.NewCipher(mseHash([]byte(name), secret, infoHash))
+	discard := make([]byte, 1024)
+	cipher.XORKeyStream(discard, discard)
+	return cipher
+}
+
+func mseKeyPair() (*big.Int, []byte, error) {
+	private := make([]byte, 20)
+	if _, err := rand.Read(private); err != nil {
+		return nil, nil, err
+	}
+	x := new(big.Int).SetBytes(private)
+	y := new(big.Int).Exp(mseGenerator, x, msePrime)
+	return x, y.FillBytes(make([]byte, mseKeyLength)), nil
+}
+
+func mseSecret(private *big.Int, remotePublic []byte) []byte {
+	y := new(big.Int).SetBytes(remotePublic)
+	return new(big.Int).Exp(y, private, msePrime).FillBytes(make([]byte, mseKeyLength))
+}
+
+func msePadding() ([]byte, error) {
+	var n [2]byte
+	if _, err := rand.Read(n[:]); err != nil {
+		return nil, err
+	}
+	padding := make([]byte, int(binary.BigEndian.Uint16(n[:]))%(mseMaxPadding+1))
+	_, err := rand.Read(padding)
+	return padding, err
+}
+
+// Read from r until marker has been consumed, giving up after limit bytes
+func mseSync(r *bufio.Reader, marker []byte, limit int) error {
+	window := make([]byte, 0, limit)
+	for len(window) < limit {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		window = append(window, b)
+		if bytes.HasSuffix(window, marker) {
+			return nil
+		}
+	}
+	return errors.New("mse: synchronisation marker not found")
+}
+
+// Perform the initiating side of the MSE handshake. With EncryptionRequired only
+// RC4 is offered, otherwise the peer may also select plaintext.
+func EncryptOutbound(conn net.Conn, infoHash []byte, policy EncryptionPolicy) (net.Conn, error) {
+	provide := cryptoRC4
+	if policy != EncryptionRequired {
+		provide |= cryptoPlaintext
+	}
+	return encryptOutbound(conn, infoHash, policy, provide)
+}
+
+func encryptOutbound(conn net.Conn, infoHash []byte, policy EncryptionPolicy, provide uint32) (net.Conn, error) {
+	private, public, err := mseKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	padA, err := msePadding()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(public, padA...)); err != nil {
+		return nil, fmt.Errorf("mse: failed to send public key: %v", err)
+	}
+	reader := bufio.NewReader(conn)
+	remotePublic := make([]byte, mseKeyLength)
+	if _, err := io.ReadFull(reader, remotePublic); err != nil {
+		return nil, fmt.Errorf("mse: failed to read public key: %v", err)
+	}
+	secret := mseSecret(private, remotePublic)
+	encrypt := mseCipher("keyA", secret, infoHash)
+	decrypt := mseCipher("keyB", secret, infoHash)
+
+	padC, err := msePadding()
+	if err != nil {
+		return nil, err
+	}
+	var message bytes.Buffer
+	message.Write(mseHash([]byte("req1"), secret))
+	req2 := mseHash([]byte("req2"), infoHash)
+	req3 := mseHash([]byte("req3"), secret)
+	for i := range req2 {
+		req2[i] ^= req3[i]
+	}
+	message.Write(req2)
+	var payload bytes.Buffer
+	payload.Write(mseVC)
+	binary.Write(&payload, binary.BigEndian, provide)
+	binary.Write(&payload, binary.BigEndian, uint16(len(padC)))
+	payload.Write(padC)
+	binary.Write(&payload, binary.BigEndian, uint16(0)) // no initial payload
+	encrypted := make([]byte, payload.Len())
+	encrypt.XORKeyStream(encrypted, payload.Bytes())
+	message.Write(encrypted)
+	if _, err := conn.Write(message.Bytes()); err != nil {
+		return nil, fmt.Errorf("mse: failed to send crypto offer: %v", err)
+	}
+
+	// The encrypted VC marks the end of the responder's padding
+	encryptedVC := make([]byte, len(mseVC))
+	decrypt.XORKeyStream(encryptedVC, mseVC)
+	if err := mseSync(reader, encryptedVC, mseMaxPadding+len(mseVC)); err != nil {
+		return nil, err
+	}
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, fmt.Errorf("mse: failed to read crypto select: %v", err)
+	}
+	decrypt.XORKeyStream(header, header)
+	selected := binary.BigEndian.Uint32(header[:4])
+	padD := make([]byte, binary.BigEndian.Uint16(header[4:]))
+	if len(padD) > mseMaxPadding {
+		return nil, errors.New("mse: invalid padding length")
+	}
+	if _, err := io.ReadFull(reader, padD); err != nil {
+		return nil, fmt.Errorf("mse: failed to read padding: %v", err)
+	}
+	decrypt.XORKeyStream(padD, padD)
+
+	switch {
+	case selected&provide == 0:
+	case selected == cryptoRC4:
+		return &mseConn{Conn: conn, reader: reader, encrypt: encrypt, decrypt: decrypt}, nil
+	case selected == cryptoPlaintext && policy != EncryptionRequired:
+		return &mseConn{Conn: conn, reader: reader}, nil
+	}
+	return nil, fmt.Errorf("mse: peer selected unsupported crypto method %d", selected)
+}
+
+// Accept an inbound connection that may either start with a plaintext BitTorrent
+// handshake or an MSE handshake for one of the given info hashes. The info hash
+// matched by the MSE handshake is returned; it is nil for plaintext connections.
+func AcceptInbound(conn net.Conn, infoHashes [][]byte, policy EncryptionPolicy) (net.Conn, []byte, error) {
+	reader := bufio.NewReader(conn)
+	first, err := reader.Peek(20)
+	if err != nil {
+		return nil, nil, fmt.Errorf("mse: failed to read connection header: %v", err)
+	}
+	if first[0] == 19 && string(first[1:20]) == "BitTorrent protocol" {
+		if policy == EncryptionRequired {
+			return nil, nil, ErrPlaintextRejected
+		}
+		return &mseConn{Conn: conn, reader: reader}, nil, nil
+	}
+	if policy == EncryptionDisabled {
+		return nil, nil, ErrEncryptedRejected
+	}
+
+	remotePublic := make([]byte, mseKeyLength)
+	if _, err := io.ReadFull(reader, remotePublic); err != nil {
+		return nil, nil, fmt.Errorf("mse: failed to read public key: %v", err)
+	}
+	private, public, err := mseKeyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+	padB, err := msePadding()
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := conn.Write(append(public, padB...)); err != nil {
+		return nil, nil, fmt.Errorf("mse: failed to send public key: %v", err)
+	}
+	secret := mseSecret(private, remotePublic)
+	if err := mseSync(reader, mseHash([]byte("req1"), secret), mseMaxPadding+20); err != nil {
+		return nil, nil, err
+	}
+
+	// Find the torrent whose obfuscated hash the initiator sent
+	obfuscated := make([]byte, 20)
+	if _, err := io.ReadFull(reader, obfuscated); err != nil {
+		return nil, nil, fmt.Errorf("mse: failed to read torrent hash: %v", err)
+	}
+	req3 := mseHash([]byte("req3"), secret)
+	var infoHash []byte
+	for _, candidate := range infoHashes {
+		req2 := mseHash([]byte("req2"), candidate)
+		for i := range req2 {
+			req2[i] ^= req3[i]
+		}
+		if bytes.Equal(req2, obfuscated) {
+			infoHash = candidate
+			break
+		}
+	}
+	if infoHash == nil {
+		return nil, nil, errors.New("mse: unknown torrent")
+	}
+	encrypt := mseCipher("keyB", secret, infoHash)
+	decrypt := mseCipher("keyA", secret, infoHash)
+
+	header := make([]byte, 14)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, nil, fmt.Errorf("mse: failed to read crypto offer: %v", err)
+	}
+	decrypt.XORKeyStream(header, header)
+	if !bytes.Equal(header[:8], mseVC) {
+		return nil, nil, errors.New("mse: invalid verification constant")
+	}
+	provide := binary.BigEndian.Uint32(header[8:12])
+	padC := make([]byte, binary.BigEndian.Uint16(header[12:14]))
+	if len(padC) > mseMaxPadding {
+		return nil, nil, errors.New("mse: invalid padding length")
+	}
+	if _, err := io.ReadFull(reader, padC); err != nil {
+		return nil, nil, fmt.Errorf("mse: failed to read padding: %v", err)
+	}
+	decrypt.XORKeyStream(padC, padC)
+	lengthIA := make([]byte, 2)
+	if _, err := io.ReadFull(reader, lengthIA); err != nil {
+		return nil, nil, fmt.Errorf("mse: failed to read initial payload: %v", err)
+	}
+	decrypt.XORKeyStream(lengthIA, lengthIA)
+	// The initial payload stays encrypted; it is decrypted below or by mseConn
+	initialPayload := make([]byte, binary.BigEndian.Uint16(lengthIA))
+	if _, err := io.ReadFull(reader, initialPayload); err != nil {
+		return nil, nil, fmt.Errorf("mse: failed to read initial payload: %v", err)
+	}
+
+	var selected uint32
+	switch {
+	case provide&cryptoRC4 != 0:
+		selected = cryptoRC4
+	case provide&cryptoPlaintext != 0 && policy != EncryptionRequired:
+		selected = cryptoPlaintext
+	default:
+		return nil, nil, fmt.Errorf("mse: no acceptable crypto method offered (%d)", provide)
+	}
+	padD, err := msePadding()
+	if err != nil {
+		return nil, nil, err
+	}
+	var response bytes.Buffer
+	response.Write(mseVC)
+	binary.Write(&response, binary.BigEndian, selected)
+	binary.Write(&response, binary.BigEndian, uint16(len(padD)))
+	response.Write(padD)
+	encrypted := make([]byte, response.Len())
+	encrypt.XORKeyStream(encrypted, response.Bytes())
+	if _, err := conn.Write(encrypted); err != nil {
+		return nil, nil, fmt.Errorf("mse: failed to send crypto select: %v", err)
+	}
+
+	if selected == cryptoRC4 {
+		return &mseConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(initialPayload), reader), encrypt: encrypt, decrypt: decrypt}, infoHash, nil
+	}
+	decrypt.XORKeyStream(initialPayload, initialPayload)
+	return &mseConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(initialPayload), reader)}, infoHash, nil
+}
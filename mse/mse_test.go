@@ -0,0 +1,246 @@
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tapConn records the raw bytes read through it
+type tapConn struct {
+	net.Conn
+	mu   sync.Mutex
+	read bytes.Buffer
+}
+
+func (c *tapConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.mu.Lock()
+	c.read.Write(p[:n])
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *tapConn) Raw() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.read.Bytes()...)
+}
+
+type handshakeResult struct {
+	conn     net.Conn
+	infoHash []byte
+	err      error
+}
+
+var (
+	infoHash = bytes.Repeat([]byte{0xab}, 20)
+	other    = bytes.Repeat([]byte{0xcd}, 20)
+)
+
+// Run the initiating side in the background against AcceptInbound over a
+// pipe. Both ends are closed once either side fails, so the other gives up.
+func handshake(t *testing.T, initiate func(net.Conn) (net.Conn, error), known [][]byte, inbound EncryptionPolicy) (outbound handshakeResult, accepted handshakeResult, tap *tapConn) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() { a.Close(); b.Close() })
+	deadline := time.Now().Add(5 * time.Second)
+	a.SetDeadline(deadline)
+	b.SetDeadline(deadline)
+	tap = &tapConn{Conn: b}
+	done := make(chan handshakeResult, 1)
+	go func() {
+		conn, err := initiate(a)
+		if err != nil {
+			a.Close()
+		}
+		done <- handshakeResult{conn: conn, err: err}
+	}()
+	conn, matched, err := AcceptInbound(tap, known, inbound)
+	if err != nil {
+		b.Close()
+	}
+	accepted = handshakeResult{conn, matched, err}
+	return <-done, accepted, tap
+}
+
+func offer(policy EncryptionPolicy) func(net.Conn) (net.Conn, error) {
+	return func(conn net.Conn) (net.Conn, error) {
+		return EncryptOutbound(conn, infoHash, policy)
+	}
+}
+
+// Send a message each way and check it arrives intact
+func exchange(t *testing.T, outbound, accepted net.Conn) {
+	t.Helper()
+	for _, pair := range [][2]net.Conn{{outbound, accepted}, {accepted, outbound}} {
+		message := []byte("\x13BitTorrent protocol and then some")
+		go pair[0].Write(message)
+		received := make([]byte, len(message))
+		if _, err := io.ReadFull(pair[1], received); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(received, message) {
+			t.Fatalf("received %q, want %q", received, message)
+		}
+	}
+}
+
+func TestHandshakeSelectsRC4(t *testing.T) {
+	for _, policies := range [][2]EncryptionPolicy{
+		{EncryptionPreferred, EncryptionPreferred},
+		{EncryptionPreferred, EncryptionRequired},
+		{EncryptionRequired, EncryptionPreferred},
+		{EncryptionRequired, EncryptionRequired},
+	} {
+		t.Run(policies[0].String()+"-"+policies[1].String(), func(t *testing.T) {
+			outbound, accepted, tap := handshake(t, offer(policies[0]), [][]byte{other, infoHash}, policies[1])
+			if outbound.err != nil || accepted.err != nil {
+				t.Fatalf("outbound: %v, inbound: %v", outbound.err, accepted.err)
+			}
+			if !bytes.Equal(accepted.infoHash, infoHash) {
+				t.Errorf("matched info hash %x, want %x", accepted.infoHash, infoHash)
+			}
+			if outbound.conn.(*mseConn).encrypt == nil || accepted.conn.(*mseConn).encrypt == nil {
+				t.Fatal("RC4 was not selected")
+			}
+			exchange(t, outbound.conn, accepted.conn)
+			if bytes.Contains(tap.Raw(), []byte("BitTorrent protocol")) {
+				t.Error("payload crossed the wire in plaintext")
+			}
+		})
+	}
+}
+
+func TestHandshakeSelectsPlaintext(t *testing.T) {
+	// An initiator that only offers plaintext gets it from the responder
+	plaintextOnly := func(conn net.Conn) (net.Conn, error) {
+		return encryptOutbound(conn, infoHash, EncryptionPreferred, cryptoPlaintext)
+	}
+	outbound, accepted, tap := handshake(t, plaintextOnly, [][]byte{infoHash}, EncryptionPreferred)
+	if outbound.err != nil || accepted.err != nil {
+		t.Fatalf("outbound: %v, inbound: %v", outbound.err, accepted.err)
+	}
+	if outbound.conn.(*mseConn).encrypt != nil || accepted.conn.(*mseConn).encrypt != nil {
+		t.Fatal("RC4 was selected")
+	}
+	exchange(t, outbound.conn, accepted.conn)
+	if !bytes.Contains(tap.Raw(), []byte("BitTorrent protocol and then some")) {
+		t.Error("payload was not sent in plaintext")
+	}
+
+	// A responder requiring encryption refuses the offer
+	outbound, accepted, _ = handshake(t, plaintextOnly, [][]byte{infoHash}, EncryptionRequired)
+	if accepted.err == nil || outbound.err == nil {
+		t.Errorf("plaintext offer accepted under a required policy: outbound %v, inbound %v", outbound.err, accepted.err)
+	}
+}
+
+func TestAcceptPlainBitTorrentHandshake(t *testing.T) {
+	plain := func(conn net.Conn) (net.Conn, error) {
+		_, err := conn.Write([]byte("\x13BitTorrent protocol" + strings.Repeat("\x00", 48)))
+		return conn, err
+	}
+	outbound, accepted, _ := handshake(t, plain, [][]byte{infoHash}, EncryptionPreferred)
+	if outbound.err != nil || accepted.err != nil {
+		t.Fatalf("outbound: %v, inbound: %v", outbound.err, accepted.err)
+	}
+	if accepted.infoHash != nil {
+		t.Errorf("plaintext connection matched info hash %x", accepted.infoHash)
+	}
+	// The peeked header is still there for the BitTorrent handshake
+	header := make([]byte, 20)
+	if _, err := io.ReadFull(accepted.conn, header); err != nil || string(header[1:]) != "BitTorrent protocol" {
+		t.Errorf("read %q, %v after accepting", header, err)
+	}
+
+	_, accepted, _ = handshake(t, plain, [][]byte{infoHash}, EncryptionRequired)
+	if !errors.Is(accepted.err, ErrPlaintextRejected) {
+		t.Errorf("inbound: %v, want %v", accepted.err, ErrPlaintextRejected)
+	}
+}
+
+func TestRequiredAgainstDisabledFails(t *testing.T) {
+	outbound, accepted, _ := handshake(t, offer(EncryptionRequired), [][]byte{infoHash}, EncryptionDisabled)
+	if !errors.Is(accepted.err, ErrEncryptedRejected) {
+		t.Errorf("inbound: %v, want %v", accepted.err, ErrEncryptedRejected)
+	}
+	if outbound.err == nil {
+		t.Error("outbound handshake succeeded against a peer that disabled encryption")
+	}
+}
+
+func TestUnknownInfoHashIsRejected(t *testing.T) {
+	outbound, accepted, _ := handshake(t, offer(EncryptionPreferred), [][]byte{other}, EncryptionPreferred)
+	if accepted.err == nil || !strings.Contains(accepted.err.Error(), "unknown torrent") {
+		t.Errorf("inbound: %v, want an unknown torrent error", accepted.err)
+	}
+	if outbound.err == nil {
+		t.Error("outbound handshake succeeded for a torrent the peer does not have")
+	}
+}
+
+func TestSyncGivesUpOnGarbage(t *testing.T) {
+	// A public key followed by more garbage than padding may hold, and no
+	// synchronisation marker anywhere
+	garbage := func(conn net.Conn) (net.Conn, error) {
+		junk := make([]byte, mseKeyLength+2*mseMaxPadding)
+		rand.Read(junk)
+		go io.Copy(io.Discard, conn)
+		_, err := conn.Write(junk)
+		return conn, err
+	}
+	_, accepted, _ := handshake(t, garbage, [][]byte{infoHash}, EncryptionPreferred)
+	if accepted.err == nil || !strings.Contains(accepted.err.Error(), "synchronisation marker not found") {
+		t.Errorf("inbound: %v, want the sync to give up", accepted.err)
+	}
+
+	// The same on the initiating side, scanning for the encrypted VC
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	go func() {
+		io.ReadFull(b, make([]byte, mseKeyLength))
+		garbage(b)
+	}()
+	a.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := EncryptOutbound(a, infoHash, EncryptionPreferred); err == nil || !strings.Contains(err.Error(), "synchronisation marker not found") {
+		t.Errorf("outbound: %v, want the sync to give up", err)
+	}
+}
+
+func TestSyncSkipsPadding(t *testing.T) {
+	marker := []byte("marker")
+	padding := bytes.Repeat([]byte("m"), mseMaxPadding) // a prefix of the marker, over and over
+	reader := bufio.NewReader(io.MultiReader(bytes.NewReader(padding), bytes.NewReader(marker), strings.NewReader("rest")))
+	if err := mseSync(reader, marker, mseMaxPadding+len(marker)); err != nil {
+		t.Fatal(err)
+	}
+	if rest, _ := io.ReadAll(reader); string(rest) != "rest" {
+		t.Errorf("read %q after the marker, want %q", rest, "rest")
+	}
+}
+
+func TestParseEncryptionPolicy(t *testing.T) {
+	for value, want := range map[string]EncryptionPolicy{
+		"disabled":  EncryptionDisabled,
+		"Preferred": EncryptionPreferred,
+		"required":  EncryptionRequired,
+		"forced":    EncryptionRequired,
+	} {
+		policy, err := ParseEncryptionPolicy(value)
+		if err != nil || policy != want {
+			t.Errorf("ParseEncryptionPolicy(%q) = %v, %v, want %v", value, policy, err, want)
+		}
+	}
+	if _, err := ParseEncryptionPolicy("sometimes"); err == nil {
+		t.Error("parsed an unknown policy")
+	}
+}
@@ -0,0 +1,38 @@
+package peer
+
+// Bitfield tracks one bit per piece (or block), most significant bit first as
+// in the peer wire bitfield message
+type Bitfield []byte
+
+func NewBitfield(length int) Bitfield {
+	return make(Bitfield, (length+7)/8)
+}
+
+func (b Bitfield) Has(index int) bool {
+	if index < 0 || index/8 >= len(b) {
+		return false
+	}
+	return b[index/8]&(1<<(7-index%8)) != 0
+}
+
+func (b Bitfield) Set(index int) {
+	if index >= 0 && index/8 < len(b) {
+		b[index/8] |= 1 << (7 - index%8)
+	}
+}
+
+func (b Bitfield) Clear(index int) {
+	if index >= 0 && index/8 < len(b) {
+		b[index/8] &^= 1 << (7 - index%8)
+	}
+}
+
+func (b Bitfield) Count() int {
+	count := 0
+	for _, x := range b {
+		for ; x != 0; x &= x - 1 {
+			count++
+		}
+	}
+	return count
+}
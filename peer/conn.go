@@ -0,0 +1,295 @@
+package peer
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/logging"
+	"github.com/codecrafters-io/bittorrent-starter-go/metainfo"
+	"github.com/codecrafters-io/bittorrent-starter-go/mse"
+	"github.com/codecrafters-io/bittorrent-starter-go/ratelimit"
+)
+
+var (
+	// How long to wait for a peer to unchoke us or to answer a block request
+	Timeout = 20 * time.Second
+	// Block requests kept outstanding with a peer at once
+	PipelineDepth = 5
+	// How long a connection may stay silent before it is dropped; peers send
+	// keep-alives every two minutes
+	IdleTimeout = 3 * time.Minute
+
+	ErrChoked       = errors.New("peer choked us")
+	ErrPieceMissing = errors.New("peer does not have the piece")
+
+	logger = logging.For(logging.Peer)
+)
+
+// Conn is a connection to a peer that has completed the handshake. It tracks
+// the pieces the peer announced, whether it is choking us and the traffic
+// exchanged with it.
+type Conn struct {
+	net.Conn
+	Address    string
+	Client     string
+	Bitfield   Bitfield
+	Choked     bool
+	Downloaded *ratelimit.Meter
+	Uploaded   *ratelimit.Meter
+	Log        *slog.Logger // carries the peer's address and client
+	pieceCount int
+	sendMu     sync.Mutex // keeps messages sent from several goroutines whole
+}
+
+// meteredConn counts the bytes read and written through it
+type meteredConn struct {
+	net.Conn
+	read    *ratelimit.Meter
+	written *ratelimit.Meter
+}
+
+func (c *meteredConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(n)
+	return n, err
+}
+
+func (c *meteredConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(n)
+	return n, err
+}
+
+// Dial a peer, handshake and declare interest, then wait until it unchokes us.
+// The peer's bitfield and have messages received meanwhile are recorded.
+// Traffic is throttled by limits, and encrypted according to the policy.
+func Connect(ctx context.Context, address string, info *metainfo.Metainfo, limits *ratelimit.TorrentLimits, encryption mse.EncryptionPolicy) (*Conn, error) {
+	return connectFor(ctx, address, info, limits, encryption, -1)
+}
+
+// Like Connect, for fetching a single piece: a peer whose bitfield lacks the
+// piece is given up on as soon as the bitfield arrives, with ErrPieceMissing,
+// instead of after waiting for an unchoke.
+func ConnectForPiece(ctx context.Context, address string, info *metainfo.Metainfo, limits *ratelimit.TorrentLimits, encryption mse.EncryptionPolicy, piece int) (*Conn, error) {
+	return connectFor(ctx, address, info, limits, encryption, piece)
+}
+
+func connectFor(ctx context.Context, address string, info *metainfo.Metainfo, limits *ratelimit.TorrentLimits, encryption mse.EncryptionPolicy, piece int) (*Conn, error) {
+	peer, err := connect(ctx, address, info, limits, encryption, piece)
+	if err != nil {
+		logger.Debug("connect failed", "peer", address, "error", err)
+		return nil, err
+	}
+	peer.Log.Debug("connected")
+	return peer, nil
+}
+
+func connect(ctx context.Context, address string, info *metainfo.Metainfo, limits *ratelimit.TorrentLimits, encryption mse.EncryptionPolicy, piece int) (*Conn, error) {
+	rawConn, err := Dial(ctx, address, info.InfoHash, encryption)
+	if err != nil {
+		return nil, err
+	}
+	conn := limits.Wrap(rawConn)
+	// Abort the handshake and unchoke wait when ctx is done
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	handshake, err := PerformHandshake(conn, info.InfoHash)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	peer := NewConn(address, conn, handshake, info.PieceCount())
+	if err := peer.Send(MsgInterested, nil); err != nil {
+		peer.Close()
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(Timeout))
+	for peer.Choked {
+		message, err := peer.ReadMessage()
+		if err != nil {
+			peer.Close()
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		if piece >= 0 && message != nil && message.ID == MsgBitfield && !peer.Has(piece) {
+			peer.Close()
+			return nil, ErrPieceMissing
+		}
+	}
+	// Block requests set their own deadlines, and a seeding connection may stay quiet
+	conn.SetReadDeadline(time.Time{})
+	if piece >= 0 && !peer.Has(piece) {
+		peer.Close()
+		return nil, ErrPieceMissing
+	}
+	return peer, nil
+}
+
+// Wrap a connection whose handshake is done
+func NewConn(address string, conn net.Conn, handshake *Handshake, pieceCount int) *Conn {
+	downloaded, uploaded := &ratelimit.Meter{}, &ratelimit.Meter{}
+	client := IdentifyClient(handshake.PeerID)
+	return &Conn{
+		Conn:       &meteredConn{Conn: conn, read: downloaded, written: uploaded},
+		Address:    address,
+		Client:     client,
+		Bitfield:   NewBitfield(pieceCount),
+		Choked:     true,
+		Downloaded: downloaded,
+		Uploaded:   uploaded,
+		Log:        logger.With("peer", address, "client", client),
+		pieceCount: pieceCount,
+	}
+}
+
+func (p *Conn) Has(piece int) bool {
+	return p.Bitfield.Has(piece)
+}
+
+// Send a message; safe to call from several goroutines at once
+func (p *Conn) Send(id byte, payload []byte) error {
+	p.sendMu.Lock()
+	defer p.sendMu.Unlock()
+	p.SetWriteDeadline(time.Now().Add(Timeout))
+	_, err := p.Write(EncodeMessage(id, payload))
+	return err
+}
+
+// Read the next message, applying any state change it carries. Keep-alives
+// are returned as a nil message.
+func (p *Conn) ReadMessage() (*Message, error) {
+	message, err := ReadMessage(p.Conn)
+	if err != nil || message == nil {
+		return message, err
+	}
+	switch message.ID {
+	case MsgChoke:
+		p.Choked = true
+		p.Log.Debug("choked us")
+	case MsgUnchoke:
+		p.Choked = false
+		p.Log.Debug("unchoked us")
+	case MsgHave:
+		if len(message.Payload) != 4 {
+			return nil, fmt.Errorf("malformed have message from %s", p.Address)
+		}
+		piece := int(binary.BigEndian.Uint32(message.Payload))
+		if piece >= p.pieceCount {
+			return nil, fmt.Errorf("peer %s announced piece %d out of range", p.Address, piece)
+		}
+		p.Bitfield.Set(piece)
+	case MsgBitfield:
+		if len(message.Payload) != len(p.Bitfield) {
+			return nil, fmt.Errorf("peer %s sent a bitfield of %d bytes, want %d", p.Address, len(message.Payload), len(p.Bitfield))
+		}
+		copy(p.Bitfield, message.Payload)
+	}
+	return message, nil
+}
+
+// Decode the piece, offset and length of a request or cancel message
+func ParseRequest(payload []byte) (int, int, int, error) {
+	if len(payload) != 12 {
+		return 0, 0, 0, errors.New("malformed request")
+	}
+	return int(binary.BigEndian.Uint32(payload[0:])), int(binary.BigEndian.Uint32(payload[4:])), int(binary.BigEndian.Uint32(payload[8:])), nil
+}
+
+// A block of a piece to request from a peer
+type BlockRequest struct {
+	Piece  int
+	Begin  int
+	Length int
+}
+
+func (r BlockRequest) payload() []byte {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:], uint32(r.Piece))
+	binary.BigEndian.PutUint32(payload[4:], uint32(r.Begin))
+	binary.BigEndian.PutUint32(payload[8:], uint32(r.Length))
+	return payload
+}
+
+// Request blocks while keeping up to PipelineDepth requests outstanding,
+// skipping unrelated messages in between. next is asked for another block
+// whenever the pipeline has room, with the number of requests outstanding; it
+// returns false when it has none to give right now, and the exchange ends once
+// nothing is outstanding either. Blocks are handed to received in the order
+// the peer sends them. On error, the requests still outstanding are returned
+// so the caller can fetch them elsewhere.
+func (p *Conn) RequestBlocks(next func(outstanding int) (BlockRequest, bool), received func(BlockRequest, []byte) error) ([]BlockRequest, error) {
+	var outstanding []BlockRequest
+	for {
+		for len(outstanding) < max(PipelineDepth, 1) {
+			request, ok := next(len(outstanding))
+			if !ok {
+				break
+			}
+			outstanding = append(outstanding, request)
+			if err := p.Send(MsgRequest, request.payload()); err != nil {
+				return outstanding, err
+			}
+			if len(outstanding) == 1 {
+				p.SetReadDeadline(time.Now().Add(Timeout))
+			}
+		}
+		if len(outstanding) == 0 {
+			return nil, nil
+		}
+		message, err := p.ReadMessage()
+		if err != nil {
+			return outstanding, err
+		}
+		if message == nil {
+			continue
+		}
+		if message.ID == MsgChoke {
+			// A choking peer discards the requests it has not answered
+			return outstanding, ErrChoked
+		}
+		if message.ID != MsgPiece || len(message.Payload) < 8 {
+			continue
+		}
+		piece, begin := int(binary.BigEndian.Uint32(message.Payload[0:])), int(binary.BigEndian.Uint32(message.Payload[4:]))
+		i := slices.IndexFunc(outstanding, func(r BlockRequest) bool { return r.Piece == piece && r.Begin == begin })
+		if i < 0 {
+			continue
+		}
+		request, block := outstanding[i], message.Payload[8:]
+		if len(block) != request.Length {
+			return outstanding, fmt.Errorf("peer %s sent %d bytes for a block of %d", p.Address, len(block), request.Length)
+		}
+		outstanding = slices.Delete(outstanding, i, i+1)
+		// Each block answered gives the rest another Timeout
+		p.SetReadDeadline(time.Now().Add(Timeout))
+		if err := received(request, block); err != nil {
+			return outstanding, err
+		}
+	}
+}
+
+// Request one block and wait for it
+func (p *Conn) RequestBlock(piece int, begin int, length int) ([]byte, error) {
+	var block []byte
+	requested := false
+	_, err := p.RequestBlocks(func(int) (BlockRequest, bool) {
+		if requested {
+			return BlockRequest{}, false
+		}
+		requested = true
+		return BlockRequest{Piece: piece, Begin: begin, Length: length}, true
+	}, func(_ BlockRequest, data []byte) error {
+		block = data
+		return nil
+	})
+	return block, err
+}
@@ -0,0 +1,194 @@
+package peer
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/metainfo"
+	"github.com/codecrafters-io/bittorrent-starter-go/mse"
+	"github.com/codecrafters-io/bittorrent-starter-go/ratelimit"
+)
+
+// A connection over a pipe, and the remote end for the test to play the peer
+func pipeConn(t *testing.T) (*Conn, net.Conn) {
+	t.Helper()
+	local, remote := net.Pipe()
+	t.Cleanup(func() { local.Close(); remote.Close() })
+	deadline := time.Now().Add(5 * time.Second)
+	remote.SetDeadline(deadline)
+	return NewConn("pipe", local, &Handshake{}, 4), remote
+}
+
+// Read n block requests as the remote peer
+func readRequests(t *testing.T, remote net.Conn, n int) []BlockRequest {
+	var requests []BlockRequest
+	for len(requests) < n {
+		message, err := ReadMessage(remote)
+		if err != nil {
+			t.Errorf("reading requests: %v", err)
+			return requests
+		}
+		piece, begin, length, err := ParseRequest(message.Payload)
+		if message.ID != MsgRequest || err != nil {
+			t.Errorf("got message %d, want a request", message.ID)
+			return requests
+		}
+		requests = append(requests, BlockRequest{piece, begin, length})
+	}
+	return requests
+}
+
+func sendBlock(remote net.Conn, request BlockRequest) error {
+	payload := binary.BigEndian.AppendUint32(nil, uint32(request.Piece))
+	payload = binary.BigEndian.AppendUint32(payload, uint32(request.Begin))
+	payload = append(payload, make([]byte, request.Length)...)
+	_, err := remote.Write(EncodeMessage(MsgPiece, payload))
+	return err
+}
+
+// Hand out count blocks of 16 bytes from piece 1
+func blockSource(count int) func(int) (BlockRequest, bool) {
+	next := 0
+	return func(int) (BlockRequest, bool) {
+		if next == count {
+			return BlockRequest{}, false
+		}
+		next++
+		return BlockRequest{Piece: 1, Begin: (next - 1) * 16, Length: 16}, true
+	}
+}
+
+func TestRequestBlocksKeepsPipelineFull(t *testing.T) {
+	previous := PipelineDepth
+	PipelineDepth = 3
+	defer func() { PipelineDepth = previous }()
+	conn, remote := pipeConn(t)
+
+	go func() {
+		// A full pipeline arrives before any block is answered; answer it
+		// backwards, with unrelated messages in between
+		requests := readRequests(t, remote, 3)
+		remote.Write(EncodeMessage(MsgHave, binary.BigEndian.AppendUint32(nil, 2)))
+		sendBlock(remote, BlockRequest{Piece: 0, Begin: 0, Length: 16}) // never requested
+		answered := make(chan bool)
+		go func() {
+			for i := len(requests) - 1; i >= 0; i-- {
+				sendBlock(remote, requests[i])
+			}
+			close(answered)
+		}()
+		// Each block answered makes room for one more request
+		more := readRequests(t, remote, 2)
+		<-answered
+		for _, request := range more {
+			sendBlock(remote, request)
+		}
+	}()
+
+	var received []int
+	outstanding, err := conn.RequestBlocks(blockSource(5), func(request BlockRequest, data []byte) error {
+		received = append(received, request.Begin/16)
+		return nil
+	})
+	if err != nil || outstanding != nil {
+		t.Fatalf("RequestBlocks = %v, %v", outstanding, err)
+	}
+	if want := []int{2, 1, 0, 3, 4}; !reflect.DeepEqual(received, want) {
+		t.Errorf("received blocks %v, want %v", received, want)
+	}
+	if !conn.Has(2) {
+		t.Error("have message in between blocks was not recorded")
+	}
+}
+
+func TestRequestBlocksReturnsOutstandingWhenChoked(t *testing.T) {
+	conn, remote := pipeConn(t)
+	go func() {
+		requests := readRequests(t, remote, PipelineDepth)
+		sendBlock(remote, requests[1])
+		remote.Write(EncodeMessage(MsgChoke, nil))
+	}()
+	outstanding, err := conn.RequestBlocks(blockSource(PipelineDepth), func(BlockRequest, []byte) error { return nil })
+	if !errors.Is(err, ErrChoked) {
+		t.Fatalf("error %v, want %v", err, ErrChoked)
+	}
+	if len(outstanding) != PipelineDepth-1 {
+		t.Errorf("%d requests outstanding, want %d", len(outstanding), PipelineDepth-1)
+	}
+	for _, request := range outstanding {
+		if request.Begin == 16 {
+			t.Error("the block that arrived is still outstanding")
+		}
+	}
+}
+
+func TestRequestBlocksRejectsShortBlock(t *testing.T) {
+	conn, remote := pipeConn(t)
+	go func() {
+		requests := readRequests(t, remote, 1)
+		requests[0].Length--
+		sendBlock(remote, requests[0])
+	}()
+	if _, err := conn.RequestBlock(1, 0, 16); err == nil || !strings.Contains(err.Error(), "15 bytes for a block of 16") {
+		t.Errorf("error %v, want a wrong length", err)
+	}
+}
+
+// Accept one connection and play a peer that unchokes at once, then sends a
+// have message after a pause
+func startUnchokingPeer(t *testing.T, infoHash [20]byte, pause time.Duration) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := ReadHandshake(conn); err != nil {
+			return
+		}
+		if err := WriteHandshake(conn, &Handshake{InfoHash: infoHash, PeerID: [20]byte{'r'}}); err != nil {
+			return
+		}
+		conn.Write(EncodeMessage(MsgUnchoke, nil))
+		time.Sleep(pause)
+		conn.Write(EncodeMessage(MsgHave, binary.BigEndian.AppendUint32(nil, 0)))
+		conn.Read(make([]byte, 1))
+	}()
+	return listener.Addr().String()
+}
+
+func TestConnectClearsReadDeadline(t *testing.T) {
+	previousTransports, previousTimeout := Transports, Timeout
+	Transports, Timeout = []string{"tcp"}, 50*time.Millisecond
+	t.Cleanup(func() { Transports, Timeout = previousTransports, previousTimeout })
+	infoHash := [20]byte{1, 2, 3}
+	info := &metainfo.Metainfo{InfoHash: hex.EncodeToString(infoHash[:]), PieceLength: 16, Length: 16, Pieces: strings.Repeat("x", 20)}
+	address := startUnchokingPeer(t, infoHash, 4*Timeout)
+
+	conn, err := Connect(context.Background(), address, info, ratelimit.NewTorrentLimits(), mse.EncryptionDisabled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// The peer stays quiet for longer than the unchoke wait allowed
+	message, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("read after a quiet spell: %v", err)
+	}
+	if message.ID != MsgHave || !conn.Has(0) {
+		t.Errorf("got message %d, want the have", message.ID)
+	}
+}
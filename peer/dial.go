@@ -0,0 +1,138 @@
+package peer
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/mse"
+	"github.com/codecrafters-io/bittorrent-starter-go/utp"
+)
+
+var (
+	// Transports raced when connecting to a peer, in order of preference.
+	// Each one starts TransportHeadStart after the one before it, or as soon
+	// as that one fails, and the first connection made wins.
+	Transports         = []string{"utp", "tcp"}
+	TransportHeadStart = 250 * time.Millisecond
+	UTPConnectTimeout  = 3 * time.Second
+	// How long to wait for a TCP connection to be established
+	DialTimeout = 10 * time.Second
+)
+
+func ParseTransports(value string) ([]string, error) {
+	var transports []string
+	for _, transport := range strings.Split(value, ",") {
+		transport = strings.ToLower(strings.TrimSpace(transport))
+		if transport != "utp" && transport != "tcp" {
+			return nil, fmt.Errorf("unknown transport: %s", transport)
+		}
+		transports = append(transports, transport)
+	}
+	return transports, nil
+}
+
+func dialTransport(ctx context.Context, transport string, peerAddress string) (net.Conn, error) {
+	if transport == "utp" {
+		ctx, cancel := context.WithTimeout(ctx, UTPConnectTimeout)
+		defer cancel()
+		return utp.Dial(ctx, peerAddress)
+	}
+	dialer := net.Dialer{Timeout: DialTimeout}
+	return dialer.DialContext(ctx, "tcp", peerAddress)
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// Connect to a peer over whichever transport in Transports connects first,
+// negotiating stream encryption according to the policy. A peer that only
+// speaks TCP costs TransportHeadStart rather than a uTP timeout.
+func Dial(ctx context.Context, peerAddress string, infoHash string, encryption mse.EncryptionPolicy) (net.Conn, error) {
+	if len(Transports) == 0 {
+		return nil, errors.New("no transports enabled")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult, len(Transports))
+	next, running := 0, 0
+	start := func() {
+		transport := Transports[next]
+		next++
+		running++
+		go func() {
+			conn, err := dialEncrypted(ctx, transport, peerAddress, infoHash, encryption)
+			results <- dialResult{conn, err}
+		}()
+	}
+	start()
+	headStart := time.NewTimer(TransportHeadStart)
+	defer headStart.Stop()
+	var lastErr error
+	for running > 0 {
+		select {
+		case <-headStart.C:
+			if next < len(Transports) {
+				start()
+				headStart.Reset(TransportHeadStart)
+			}
+		case result := <-results:
+			running--
+			if result.err == nil {
+				// Close the connections of transports that lost the race
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(running)
+				return Trace(result.conn, peerAddress), nil
+			}
+			lastErr = result.err
+			if next < len(Transports) && ctx.Err() == nil {
+				start()
+				headStart.Reset(TransportHeadStart)
+			}
+		}
+	}
+	return nil, lastErr
+}
+
+// With EncryptionPreferred a failed MSE handshake falls back to a plaintext connection
+func dialEncrypted(ctx context.Context, transport string, peerAddress string, infoHash string, encryption mse.EncryptionPolicy) (net.Conn, error) {
+	conn, err := dialTransport(ctx, transport, peerAddress)
+	if err != nil {
+		return nil, err
+	}
+	if encryption == mse.EncryptionDisabled {
+		return conn, nil
+	}
+	infoHashBytes, err := hex.DecodeString(infoHash)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("invalid info hash: %v", err)
+	}
+	// Abandon the MSE handshake when ctx is done or the peer stalls
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	encrypted, err := mse.EncryptOutbound(conn, infoHashBytes, encryption)
+	conn.SetDeadline(time.Time{})
+	if stop() && err == nil {
+		return encrypted, nil
+	}
+	conn.Close()
+	if err == nil {
+		err = ctx.Err()
+	}
+	if encryption == mse.EncryptionRequired || ctx.Err() != nil {
+		return nil, err
+	}
+	return dialTransport(ctx, transport, peerAddress)
+}
@@ -0,0 +1,94 @@
+package peer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/bencode"
+)
+
+// Extension protocol (BEP 10)
+
+const ExtendedHandshakeID = 0
+
+type ExtendedHandshake struct {
+	Client       string
+	Extensions   map[string]int
+	MetadataSize int // size of the info dictionary, for ut_metadata (BEP 9)
+}
+
+func SupportsExtensions(reserved [8]byte) bool {
+	return reserved[5]&0x10 != 0
+}
+
+// Send our extended handshake, advertising the given extension message IDs
+func SendExtendedHandshake(conn net.Conn, extensions map[string]int) error {
+	m := make(map[string]interface{}, len(extensions))
+	for name, id := range extensions {
+		m[name] = id
+	}
+	handshake := map[string]interface{}{
+		"m": m,
+		"v": ClientDescription(),
+	}
+	encoded, _, err := bencode.Encode(handshake)
+	if err != nil {
+		return err
+	}
+	payload := append([]byte{ExtendedHandshakeID}, encoded...)
+	_, err = conn.Write(EncodeMessage(MsgExtended, payload))
+	return err
+}
+
+func ParseExtendedHandshake(payload []byte) (*ExtendedHandshake, error) {
+	if len(payload) == 0 || payload[0] != ExtendedHandshakeID {
+		return nil, errors.New("not an extended handshake")
+	}
+	decoded, _, err := bencode.Decode(string(payload[1:]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid extended handshake: %v", err)
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("extended handshake is not a dictionary")
+	}
+	handshake := &ExtendedHandshake{Extensions: make(map[string]int)}
+	handshake.Client, _ = dict["v"].(string)
+	handshake.MetadataSize, _ = dict["metadata_size"].(int)
+	if m, ok := dict["m"].(map[string]interface{}); ok {
+		for name, id := range m {
+			if id, ok := id.(int); ok {
+				handshake.Extensions[name] = id
+			}
+		}
+	}
+	return handshake, nil
+}
+
+// Read messages until the peer's extended handshake arrives, discarding the rest
+func ReadExtendedHandshake(conn net.Conn) (*ExtendedHandshake, error) {
+	conn.SetReadDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		message, err := ReadMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		if message != nil && message.ID == MsgExtended && len(message.Payload) > 0 && message.Payload[0] == ExtendedHandshakeID {
+			return ParseExtendedHandshake(message.Payload)
+		}
+	}
+}
+
+// Name the client behind a connection, preferring the "v" key of its extended
+// handshake over the peer ID convention
+func IdentifyConnected(conn net.Conn, handshake *Handshake) string {
+	if SupportsExtensions(handshake.Reserved) && SendExtendedHandshake(conn, nil) == nil {
+		if extended, err := ReadExtendedHandshake(conn); err == nil && extended.Client != "" {
+			return extended.Client
+		}
+	}
+	return IdentifyClient(handshake.PeerID)
+}
@@ -0,0 +1,103 @@
+package peer
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const protocolString = "BitTorrent protocol"
+
+var (
+	HandshakeTimeout = 10 * time.Second
+
+	ErrInvalidProtocol  = errors.New("peer is not speaking the BitTorrent protocol")
+	ErrInfoHashMismatch = errors.New("peer answered with a different info hash")
+	ErrSelfConnection   = errors.New("connected to ourselves")
+
+	sessionPeerID     [20]byte
+	sessionPeerIDOnce sync.Once
+)
+
+// The peer ID this client presents to trackers and peers for the whole session
+func SessionPeerID() [20]byte {
+	sessionPeerIDOnce.Do(func() {
+		sessionPeerID = GeneratePeerID()
+	})
+	return sessionPeerID
+}
+
+type Handshake struct {
+	Reserved [8]byte
+	InfoHash [20]byte
+	PeerID   [20]byte
+}
+
+// Our side of a handshake for a torrent, advertising the extension protocol
+func NewHandshake(infoHash [20]byte, peerID [20]byte) *Handshake {
+	handshake := &Handshake{InfoHash: infoHash, PeerID: peerID}
+	handshake.Reserved[5] |= 0x10 // extension protocol
+	return handshake
+}
+
+func (h *Handshake) Marshal() []byte {
+	message := make([]byte, 0, 68)
+	message = append(message, byte(len(protocolString)))
+	message = append(message, protocolString...)
+	message = append(message, h.Reserved[:]...)
+	message = append(message, h.InfoHash[:]...)
+	return append(message, h.PeerID[:]...)
+}
+
+func WriteHandshake(conn net.Conn, handshake *Handshake) error {
+	conn.SetWriteDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetWriteDeadline(time.Time{})
+	if _, err := conn.Write(handshake.Marshal()); err != nil {
+		return fmt.Errorf("failed to send handshake message: %v", err)
+	}
+	return nil
+}
+
+func ReadHandshake(conn net.Conn) (*Handshake, error) {
+	conn.SetReadDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	response := make([]byte, 68)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, fmt.Errorf("failed to read handshake response: %v", err)
+	}
+	if response[0] != byte(len(protocolString)) || string(response[1:20]) != protocolString {
+		return nil, ErrInvalidProtocol
+	}
+	handshake := &Handshake{}
+	copy(handshake.Reserved[:], response[20:28])
+	copy(handshake.InfoHash[:], response[28:48])
+	copy(handshake.PeerID[:], response[48:68])
+	return handshake, nil
+}
+
+// Perform the handshake with the peer and return the peer's side of it
+func PerformHandshake(conn net.Conn, infoHash string) (*Handshake, error) {
+	infoHashBytes, err := hex.DecodeString(infoHash)
+	if err != nil || len(infoHashBytes) != 20 {
+		return nil, fmt.Errorf("invalid info hash: %s", infoHash)
+	}
+	local := NewHandshake([20]byte(infoHashBytes), SessionPeerID())
+	if err := WriteHandshake(conn, local); err != nil {
+		return nil, err
+	}
+	remote, err := ReadHandshake(conn)
+	if err != nil {
+		return nil, err
+	}
+	if remote.InfoHash != local.InfoHash {
+		return nil, ErrInfoHashMismatch
+	}
+	if remote.PeerID == local.PeerID {
+		return nil, ErrSelfConnection
+	}
+	return remote, nil
+}
@@ -0,0 +1,58 @@
+// Package peer speaks the BitTorrent peer wire protocol: handshakes, messages
+// and connections to peers.
+package peer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	MsgChoke         byte = 0
+	MsgUnchoke       byte = 1
+	MsgInterested    byte = 2
+	MsgNotInterested byte = 3
+	MsgHave          byte = 4
+	MsgBitfield      byte = 5
+	MsgRequest       byte = 6
+	MsgPiece         byte = 7
+	MsgCancel        byte = 8
+	MsgExtended      byte = 20
+
+	// Largest message accepted from a peer: a 16 KiB block plus headroom for
+	// the bitfields of very large torrents
+	maxMessageLength = 1 << 21
+)
+
+type Message struct {
+	ID      byte
+	Payload []byte
+}
+
+// Read one length-prefixed peer message. Keep-alives are returned as a nil message.
+func ReadMessage(r io.Reader) (*Message, error) {
+	var lengthBuf [4]byte
+	if _, err := io.ReadFull(r, lengthBuf[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(lengthBuf[:])
+	if length == 0 {
+		return nil, nil
+	}
+	if length > maxMessageLength {
+		return nil, fmt.Errorf("peer message too long: %d bytes", length)
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return &Message{ID: buf[0], Payload: buf[1:]}, nil
+}
+
+// Encode a length-prefixed peer message
+func EncodeMessage(messageID byte, payload []byte) []byte {
+	messageLength := make([]byte, 4)
+	binary.BigEndian.PutUint32(messageLength, uint32(len(payload)+1))
+	return append(append(messageLength, messageID), payload...)
+}
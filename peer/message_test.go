@@ -0,0 +1,102 @@
+package peer
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// readerConn feeds a Conn from a reader
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readerConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func TestReadMessage(t *testing.T) {
+	stream := append(append(EncodeMessage(MsgHave, []byte{0, 0, 0, 3}), 0, 0, 0, 0), EncodeMessage(MsgUnchoke, nil)...)
+	r := bytes.NewReader(stream)
+	message, err := ReadMessage(r)
+	if err != nil || message.ID != MsgHave || !bytes.Equal(message.Payload, []byte{0, 0, 0, 3}) {
+		t.Fatalf("first message = %+v, %v", message, err)
+	}
+	if message, err := ReadMessage(r); err != nil || message != nil {
+		t.Fatalf("keep-alive = %+v, %v", message, err)
+	}
+	if message, err := ReadMessage(r); err != nil || message.ID != MsgUnchoke || len(message.Payload) != 0 {
+		t.Fatalf("third message = %+v, %v", message, err)
+	}
+	if _, err := ReadMessage(r); err != io.EOF {
+		t.Fatalf("end of stream = %v", err)
+	}
+}
+
+func TestReadMessageRejectsOversizedLength(t *testing.T) {
+	if _, err := ReadMessage(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff, MsgPiece})); err == nil {
+		t.Error("accepted a 4 GiB message")
+	}
+}
+
+func TestConnValidatesStateMessages(t *testing.T) {
+	for name, message := range map[string][]byte{
+		"short have":     EncodeMessage(MsgHave, []byte{0, 0, 3}),
+		"have too large": EncodeMessage(MsgHave, []byte{0, 0, 0, 10}),
+		"short bitfield": EncodeMessage(MsgBitfield, []byte{0xff}),
+	} {
+		conn := NewConn("test", &readerConn{r: bytes.NewReader(message)}, &Handshake{}, 10)
+		if _, err := conn.ReadMessage(); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+	conn := NewConn("test", &readerConn{r: bytes.NewReader(EncodeMessage(MsgBitfield, []byte{0xa0, 0x40}))}, &Handshake{}, 10)
+	if _, err := conn.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	if !conn.Has(0) || conn.Has(1) || !conn.Has(2) || !conn.Has(9) || conn.Bitfield.Count() != 3 {
+		t.Errorf("bitfield = %08b", conn.Bitfield)
+	}
+}
+
+// Framing must be lossless, and a connection fed any stream must neither
+// panic nor resize its bitfield
+func FuzzReadMessage(f *testing.F) {
+	f.Add(EncodeMessage(MsgHave, []byte{0, 0, 0, 3}))
+	f.Add(EncodeMessage(MsgBitfield, []byte{0xff, 0xc0}))
+	f.Add(append(EncodeMessage(MsgUnchoke, nil), 0, 0, 0, 0))
+	f.Add(EncodeMessage(MsgPiece, append([]byte{0, 0, 0, 1, 0, 0, 0, 0}, "block"...)))
+	f.Fuzz(func(t *testing.T, stream []byte) {
+		r := bytes.NewReader(stream)
+		for {
+			offset := len(stream) - r.Len()
+			message, err := ReadMessage(r)
+			if err != nil {
+				break
+			}
+			consumed := stream[offset : len(stream)-r.Len()]
+			if message == nil {
+				if !bytes.Equal(consumed, []byte{0, 0, 0, 0}) {
+					t.Fatalf("keep-alive read from %x", consumed)
+				}
+				continue
+			}
+			if encoded := EncodeMessage(message.ID, message.Payload); !bytes.Equal(encoded, consumed) {
+				t.Fatalf("message %+v re-encodes to %x, read from %x", message, encoded, consumed)
+			}
+		}
+
+		const pieceCount = 10
+		conn := NewConn("fuzz", &readerConn{r: bytes.NewReader(stream)}, &Handshake{}, pieceCount)
+		for {
+			if _, err := conn.ReadMessage(); err != nil {
+				break
+			}
+		}
+		if len(conn.Bitfield) != 2 {
+			t.Fatalf("bitfield resized to %d bytes", len(conn.Bitfield))
+		}
+	})
+}
@@ -0,0 +1,128 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/mse"
+)
+
+// Metadata exchange (BEP 9), used to turn a magnet link into a torrent
+
+const (
+	MetadataPieceSize = 16 * 1024
+
+	// ID we ask peers to use for ut_metadata messages sent to us
+	utMetadataID = 1
+
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+// Largest info dictionary we are willing to fetch
+var MaxMetadataSize = 16 << 20
+
+// Download the info dictionary of a torrent from a peer and check it against
+// the info hash
+func FetchMetadata(ctx context.Context, address string, infoHash string, encryption mse.EncryptionPolicy) (map[string]interface{}, error) {
+	conn, err := Dial(ctx, address, infoHash, encryption)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	handshake, err := PerformHandshake(conn, infoHash)
+	if err != nil {
+		return nil, err
+	}
+	if !SupportsExtensions(handshake.Reserved) {
+		return nil, errors.New("peer does not support the extension protocol")
+	}
+	if err := SendExtendedHandshake(conn, map[string]int{"ut_metadata": utMetadataID}); err != nil {
+		return nil, err
+	}
+	extended, err := ReadExtendedHandshake(conn)
+	if err != nil {
+		return nil, err
+	}
+	remoteID := extended.Extensions["ut_metadata"]
+	if remoteID == 0 {
+		return nil, errors.New("peer does not support ut_metadata")
+	}
+	size := extended.MetadataSize
+	if size <= 0 || size > MaxMetadataSize {
+		return nil, fmt.Errorf("peer announced invalid metadata size %d", size)
+	}
+
+	data := make([]byte, size)
+	for piece := 0; piece*MetadataPieceSize < size; piece++ {
+		request, _, err := bencode.Encode(map[string]interface{}{"msg_type": metadataRequest, "piece": piece})
+		if err != nil {
+			return nil, err
+		}
+		conn.SetWriteDeadline(time.Now().Add(Timeout))
+		if _, err := conn.Write(EncodeMessage(MsgExtended, append([]byte{byte(remoteID)}, request...))); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(Timeout))
+		block, err := readMetadataPiece(conn, piece)
+		if err != nil {
+			return nil, err
+		}
+		start := piece * MetadataPieceSize
+		if len(block) != min(MetadataPieceSize, size-start) {
+			return nil, fmt.Errorf("metadata piece %d has %d bytes", piece, len(block))
+		}
+		copy(data[start:], block)
+	}
+
+	hash := sha1.Sum(data)
+	if hex.EncodeToString(hash[:]) != infoHash {
+		return nil, errors.New("metadata does not match the info hash")
+	}
+	decoded, _, err := bencode.Decode(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata: %v", err)
+	}
+	info, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("metadata is not a dictionary")
+	}
+	return info, nil
+}
+
+// Read messages until the answer to a metadata request arrives
+func readMetadataPiece(conn io.Reader, piece int) ([]byte, error) {
+	for {
+		message, err := ReadMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		if message == nil || message.ID != MsgExtended || len(message.Payload) < 2 || message.Payload[0] != utMetadataID {
+			continue
+		}
+		decoded, n, err := bencode.Decode(string(message.Payload[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid metadata message: %v", err)
+		}
+		dict, ok := decoded.(map[string]interface{})
+		if !ok || dict["piece"] != piece {
+			continue
+		}
+		switch dict["msg_type"] {
+		case metadataData:
+			return bytes.Clone(message.Payload[1+n:]), nil
+		case metadataReject:
+			return nil, fmt.Errorf("peer rejected metadata piece %d", piece)
+		}
+	}
+}
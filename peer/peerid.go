@@ -0,0 +1,157 @@
+package peer
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Identity advertised in Azureus-style peer IDs (-MB0100-xxxxxxxxxxxx) and in
+// the "v" key of extended handshakes
+var (
+	ClientName    = "mybittorrent"
+	ClientCode    = "MB"
+	ClientVersion = "0100"
+)
+
+const peerIDAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+var azureusClients = map[string]string{
+	"AG": "Ares", "AR": "Arctic", "AT": "Artemis", "AV": "Avicora", "AX": "BitPump",
+	"AZ": "Vuze", "BB": "BitBuddy", "BC": "BitComet", "BE": "BitTorrent SDK", "BF": "Bitflu",
+	"BI": "BiglyBT", "BL": "BitCometLite", "BR": "BitRocket", "BT": "Mainline", "BW": "BitWombat",
+	"CD": "Enhanced CTorrent", "CT": "CTorrent", "DE": "Deluge", "EB": "EBit", "ES": "Electric Sheep",
+	"FD": "Free Download Manager", "FG": "FlashGet", "FT": "FoxTorrent", "GS": "GSTorrent", "HL": "Halite",
+	"KG": "KGet", "KT": "KTorrent", "LH": "LH-ABC", "LK": "Linkage", "LP": "Lphant",
+	"LT": "libtorrent (rakshasa)", "LW": "LimeWire", "MB": "mybittorrent", "MO": "MonoTorrent", "MP": "MooPolice",
+	"MT": "MoonlightTorrent", "PD": "Pando", "PI": "PicoTorrent", "QD": "QQDownload", "RT": "Retriever",
+	"SB": "Swiftbit", "SD": "Thunder", "SS": "SwarmScope", "ST": "SymTorrent", "TN": "TorrentDotNET",
+	"TR": "Transmission", "TS": "Torrentstorm", "TT": "TuoTu", "UL": "uLeecher!", "UM": "µTorrent Mac",
+	"UT": "µTorrent", "UW": "µTorrent Web", "VG": "Vagaa", "WD": "WebTorrent Desktop", "WT": "BitLet",
+	"WW": "WebTorrent", "WY": "FireTorrent", "XL": "Xunlei", "XT": "XanTorrent", "XX": "Xtorrent",
+	"ZT": "ZipTorrent", "lt": "libtorrent (Rasterbar)", "qB": "qBittorrent", "st": "sharktorrent",
+}
+
+var shadowClients = map[byte]string{
+	'A': "ABC", 'O': "Osprey Permaseed", 'Q': "BTQueue", 'R': "Tribler",
+	'S': "Shadow", 'T': "BitTornado", 'U': "UPnP NAT Bit Torrent",
+}
+
+func isAlphanumeric(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !strings.ContainsRune(peerIDAlphabet, rune(s[i])) {
+			return false
+		}
+	}
+	return true
+}
+
+func SetClientIdentity(code string, version string) error {
+	if len(code) != 2 || !isAlphanumeric(code) {
+		return fmt.Errorf("client code must be two letters or digits: %q", code)
+	}
+	if len(version) != 4 || !isAlphanumeric(version) {
+		return fmt.Errorf("client version must be four letters or digits: %q", version)
+	}
+	ClientCode = code
+	ClientVersion = version
+	return nil
+}
+
+// Generate an Azureus-style peer ID: -<code><version>- followed by 12 random characters
+func GeneratePeerID() [20]byte {
+	var peerID [20]byte
+	copy(peerID[:], "-"+ClientCode+ClientVersion+"-")
+	// Bytes past the last whole multiple of the alphabet are thrown away, so
+	// that every character is equally likely
+	limit := 256 - 256%len(peerIDAlphabet)
+	random := make([]byte, 16)
+	for i := 8; i < len(peerID); {
+		if _, err := rand.Read(random); err != nil {
+			panic(err)
+		}
+		for _, b := range random {
+			if int(b) >= limit || i == len(peerID) {
+				continue
+			}
+			peerID[i] = peerIDAlphabet[int(b)%len(peerIDAlphabet)]
+			i++
+		}
+	}
+	return peerID
+}
+
+// Version string sent in the "v" key of our extended handshake
+func ClientDescription() string {
+	return ClientName + " " + formatVersion(ClientVersion, peerIDVersionDigit)
+}
+
+func peerIDVersionDigit(c byte) (int, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0'), true
+	case c >= 'A' && c <= 'Z':
+		return int(c-'A') + 10, true
+	case c >= 'a' && c <= 'z':
+		return int(c-'a') + 36, true
+	}
+	return 0, false
+}
+
+// Shadow-style versions also allow '.' and '-' digits
+func shadowVersionDigit(c byte) (int, bool) {
+	switch c {
+	case '.':
+		return 62, true
+	case '-':
+		return 63, true
+	}
+	return peerIDVersionDigit(c)
+}
+
+// Join version digits with dots, dropping trailing zero components
+func formatVersion(version string, digit func(byte) (int, bool)) string {
+	parts := make([]string, 0, len(version))
+	for i := 0; i < len(version); i++ {
+		value, ok := digit(version[i])
+		if !ok {
+			break
+		}
+		parts = append(parts, strconv.Itoa(value))
+	}
+	for len(parts) > 2 && parts[len(parts)-1] == "0" {
+		parts = parts[:len(parts)-1]
+	}
+	return strings.Join(parts, ".")
+}
+
+// Identify the client software of a remote peer from its peer ID
+func IdentifyClient(peerID [20]byte) string {
+	id := string(peerID[:])
+
+	// Azureus style: -XX1234-
+	if id[0] == '-' && id[7] == '-' && isAlphanumeric(id[1:7]) {
+		code := id[1:3]
+		name, ok := azureusClients[code]
+		if !ok {
+			name = fmt.Sprintf("Unknown (%s)", code)
+		}
+		return name + " " + formatVersion(id[3:7], peerIDVersionDigit)
+	}
+
+	// Mainline style: M4-3-6--
+	if id[0] == 'M' && id[2] == '-' {
+		if end := strings.Index(id[1:], "--"); end > 0 {
+			return "Mainline " + strings.ReplaceAll(id[1:1+end], "-", ".")
+		}
+	}
+
+	// Shadow style: S58B----- with up to five version characters
+	if name, ok := shadowClients[id[0]]; ok {
+		if end := strings.Index(id[1:8], "--"); end >= 0 {
+			return strings.TrimSpace(name + " " + formatVersion(id[1:1+end], shadowVersionDigit))
+		}
+	}
+	return "Unknown"
+}
@@ -0,0 +1,33 @@
+package peer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGeneratePeerIDIsUniform(t *testing.T) {
+	const ids = 10000
+	counts := make(map[byte]int)
+	for i := 0; i < ids; i++ {
+		peerID := GeneratePeerID()
+		if prefix := "-" + ClientCode + ClientVersion + "-"; !strings.HasPrefix(string(peerID[:]), prefix) {
+			t.Fatalf("peer ID %q does not start with %q", peerID, prefix)
+		}
+		for _, c := range peerID[8:] {
+			counts[c]++
+		}
+	}
+	// A plain modulo of random bytes makes the first 8 characters a fifth
+	// more likely than the rest; allow a tenth either way
+	expected := float64(ids*12) / float64(len(peerIDAlphabet))
+	for i := 0; i < len(peerIDAlphabet); i++ {
+		c := peerIDAlphabet[i]
+		if got := float64(counts[c]); got < 0.9*expected || got > 1.1*expected {
+			t.Errorf("%q appeared %v times, want about %.0f", c, got, expected)
+		}
+		delete(counts, c)
+	}
+	if len(counts) != 0 {
+		t.Errorf("characters outside the alphabet: %v", counts)
+	}
+}
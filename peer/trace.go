@@ -0,0 +1,265 @@
+package peer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/trace"
+)
+
+var messageNames = map[byte]string{
+	MsgChoke:         "choke",
+	MsgUnchoke:       "unchoke",
+	MsgInterested:    "interested",
+	MsgNotInterested: "not_interested",
+	MsgHave:          "have",
+	MsgBitfield:      "bitfield",
+	MsgRequest:       "request",
+	MsgPiece:         "piece",
+	MsgCancel:        "cancel",
+	MsgExtended:      "extended",
+}
+
+func MessageName(id byte) string {
+	if name, ok := messageNames[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown_%d", id)
+}
+
+// Describe a message's payload for a trace
+func summarize(message *Message) string {
+	payload := message.Payload
+	switch message.ID {
+	case MsgHave:
+		if len(payload) == 4 {
+			return fmt.Sprintf("piece=%d", binary.BigEndian.Uint32(payload))
+		}
+	case MsgBitfield:
+		return fmt.Sprintf("pieces=%d", Bitfield(payload).Count())
+	case MsgRequest, MsgCancel:
+		if piece, begin, length, err := ParseRequest(payload); err == nil {
+			return fmt.Sprintf("piece=%d begin=%d length=%d", piece, begin, length)
+		}
+	case MsgPiece:
+		if len(payload) >= 8 {
+			return fmt.Sprintf("piece=%d begin=%d length=%d", binary.BigEndian.Uint32(payload), binary.BigEndian.Uint32(payload[4:]), len(payload)-8)
+		}
+	case MsgExtended:
+		if len(payload) == 0 {
+			break
+		}
+		summary := fmt.Sprintf("id=%d", payload[0])
+		if decoded, n, err := bencode.Decode(string(payload[1:])); err == nil {
+			summary += fmt.Sprintf(" %v", decoded)
+			if extra := len(payload) - 1 - n; extra > 0 {
+				summary += fmt.Sprintf(" +%d bytes", extra)
+			}
+		}
+		return summary
+	default:
+		return ""
+	}
+	return fmt.Sprintf("malformed, %d bytes", len(payload))
+}
+
+// Record the traffic of a connection when tracing is enabled. The connection
+// must carry plaintext, so it is wrapped after any stream encryption.
+func Trace(conn net.Conn, address string) net.Conn {
+	if !trace.Enabled() {
+		return conn
+	}
+	return &tracedConn{
+		Conn: conn,
+		in:   &wireRecorder{address: address, dir: trace.In},
+		out:  &wireRecorder{address: address, dir: trace.Out},
+	}
+}
+
+type tracedConn struct {
+	net.Conn
+	in, out *wireRecorder
+}
+
+func (c *tracedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.in.feed(p[:n])
+	return n, err
+}
+
+func (c *tracedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.out.feed(p[:n])
+	return n, err
+}
+
+// wireRecorder splits one direction of a connection into the handshake and
+// messages and records each as it completes
+type wireRecorder struct {
+	address string
+	dir     string
+
+	mu         sync.Mutex
+	buffer     []byte
+	handshaken bool
+	broken     bool
+}
+
+func (w *wireRecorder) feed(data []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.broken || len(data) == 0 {
+		return
+	}
+	w.buffer = append(w.buffer, data...)
+	consumed := 0
+	for {
+		rest := w.buffer[consumed:]
+		if !w.handshaken {
+			if len(rest) == 0 || len(rest) < 49+int(rest[0]) {
+				break
+			}
+			frame := rest[:49+int(rest[0])]
+			w.handshaken = true
+			consumed += len(frame)
+			w.record(trace.Event{Kind: trace.Handshake, Summary: summarizeHandshake(frame)}, frame, false)
+			continue
+		}
+		if len(rest) < 4 {
+			break
+		}
+		length := binary.BigEndian.Uint32(rest)
+		if length > maxMessageLength {
+			w.broken = true
+			trace.Record(trace.Event{Conn: w.address, Dir: w.dir, Kind: trace.Message, Error: fmt.Sprintf("peer message too long: %d bytes", length)})
+			break
+		}
+		if len(rest) < 4+int(length) {
+			break
+		}
+		frame := rest[:4+length]
+		consumed += len(frame)
+		if length == 0 {
+			w.record(trace.Event{Kind: trace.Message, Name: "keep_alive"}, frame, false)
+			continue
+		}
+		message := &Message{ID: frame[4], Payload: frame[5:]}
+		event := trace.Event{Kind: trace.Message, Name: MessageName(message.ID), Summary: summarize(message)}
+		w.record(event, frame, message.ID == MsgPiece && len(frame) > 13)
+	}
+	w.buffer = append(w.buffer[:0], w.buffer[consumed:]...)
+}
+
+// Record a frame, keeping only the header of piece messages
+func (w *wireRecorder) record(event trace.Event, frame []byte, truncate bool) {
+	event.Conn, event.Dir, event.Length = w.address, w.dir, len(frame)
+	if truncate {
+		frame, event.Truncated = frame[:13], true
+	}
+	event.Data = bytes.Clone(frame)
+	trace.Record(event)
+}
+
+func summarizeHandshake(frame []byte) string {
+	if len(frame) != 68 || string(frame[1:20]) != protocolString {
+		return fmt.Sprintf("unknown protocol %q", frame[1:1+int(frame[0])])
+	}
+	var reserved [8]byte
+	var peerID [20]byte
+	copy(reserved[:], frame[20:28])
+	copy(peerID[:], frame[48:68])
+	return fmt.Sprintf("info_hash=%s client=%q extensions=%t", hex.EncodeToString(frame[28:48]), IdentifyClient(peerID), SupportsExtensions(reserved))
+}
+
+// State a connection was left in by replaying a trace
+type ReplayResult struct {
+	Conn     string
+	Client   string
+	Messages int
+	Choked   bool
+	Pieces   int // pieces the peer announced
+	Err      error
+}
+
+// Feed the handshake and messages each peer sent, as recorded in a trace,
+// through a Conn as if they came from the network, and report the state each
+// connection ended in. Outgoing traffic is not replayed. A peer that
+// reconnected shows up once per connection. pieceCount sizes the bitfields;
+// with 0 it is taken from each connection's bitfield message.
+func Replay(events []trace.Event, pieceCount int) []ReplayResult {
+	type stream struct {
+		address    string
+		data       bytes.Buffer
+		pieceCount int
+	}
+	var streams []*stream
+	current := make(map[string]*stream)
+	for _, event := range events {
+		if event.Dir != trace.In || len(event.Data) == 0 || (event.Kind != trace.Handshake && event.Kind != trace.Message) {
+			continue
+		}
+		s := current[event.Conn]
+		if event.Kind == trace.Handshake || s == nil {
+			s = &stream{address: event.Conn, pieceCount: pieceCount}
+			streams = append(streams, s)
+			current[event.Conn] = s
+		}
+		s.data.Write(event.Data)
+		if event.Truncated && event.Length > len(event.Data) {
+			s.data.Write(make([]byte, event.Length-len(event.Data)))
+		}
+		if s.pieceCount == 0 && event.Name == MessageName(MsgBitfield) && len(event.Data) > 5 {
+			s.pieceCount = (len(event.Data) - 5) * 8
+		}
+	}
+
+	results := make([]ReplayResult, 0, len(streams))
+	for _, s := range streams {
+		result := ReplayResult{Conn: s.address, Choked: true}
+		conn := &replayConn{Reader: bytes.NewReader(s.data.Bytes())}
+		handshake, err := ReadHandshake(conn)
+		if err != nil {
+			result.Err = err
+			results = append(results, result)
+			continue
+		}
+		peer := NewConn(s.address, conn, handshake, s.pieceCount)
+		result.Client = peer.Client
+		for {
+			message, err := peer.ReadMessage()
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					result.Err = fmt.Errorf("message %d: %v", result.Messages+1, err)
+				}
+				break
+			}
+			if message != nil {
+				result.Messages++
+			}
+		}
+		result.Choked, result.Pieces = peer.Choked, peer.Bitfield.Count()
+		results = append(results, result)
+	}
+	return results
+}
+
+// replayConn reads recorded traffic and discards whatever is written to it
+type replayConn struct {
+	*bytes.Reader
+}
+
+func (c *replayConn) Write(p []byte) (int, error)        { return len(p), nil }
+func (c *replayConn) Close() error                       { return nil }
+func (c *replayConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (c *replayConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (c *replayConn) SetDeadline(t time.Time) error      { return nil }
+func (c *replayConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *replayConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,76 @@
+package peer
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/trace"
+)
+
+// testdata/fetch_piece.jsonl records piece 0 of a three-piece torrent being
+// fetched: the first peer's bitfield lacks the piece, the second serves it,
+// and a third connection, added by hand, announces a piece out of range.
+func loadFixture(t *testing.T) []trace.Event {
+	t.Helper()
+	events, err := trace.LoadFile("testdata/fetch_piece.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+func TestReplayFixture(t *testing.T) {
+	results := Replay(loadFixture(t), 3)
+	if len(results) != 3 {
+		t.Fatalf("replayed %d connections, want 3: %+v", len(results), results)
+	}
+	want := []ReplayResult{
+		{Conn: "127.0.0.1:36079", Client: "Unknown (TU) 0.0.0.1", Messages: 1, Choked: true, Pieces: 1},
+		{Conn: "127.0.0.1:33771", Client: "Unknown (TU) 0.0.0.1", Messages: 4, Choked: false, Pieces: 3},
+	}
+	for i, w := range want {
+		if results[i] != w {
+			t.Errorf("connection %d = %+v, want %+v", i, results[i], w)
+		}
+	}
+	bad := results[2]
+	if bad.Conn != "127.0.0.1:51413" || bad.Err == nil || !strings.Contains(bad.Err.Error(), "out of range") {
+		t.Errorf("malformed connection = %+v, want an out of range error", bad)
+	}
+}
+
+func TestReplayFixtureSizesBitfieldsFromTrace(t *testing.T) {
+	results := Replay(loadFixture(t), 0)
+	// A bitfield message of one byte covers eight pieces
+	if results[1].Pieces != 3 || results[1].Err != nil {
+		t.Errorf("seeder = %+v", results[1])
+	}
+}
+
+func TestFixtureMessagesDecode(t *testing.T) {
+	var names []string
+	for _, event := range loadFixture(t) {
+		if event.Kind != trace.Message || event.Dir != trace.In || event.Conn != "127.0.0.1:33771" {
+			continue
+		}
+		data := event.Data
+		if event.Truncated {
+			data = append(bytes.Clone(data), make([]byte, event.Length-len(data))...)
+		}
+		message, err := ReadMessage(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: %v", event.Name, err)
+		}
+		if MessageName(message.ID) != event.Name {
+			t.Errorf("message decodes as %s, recorded as %s", MessageName(message.ID), event.Name)
+		}
+		if summary := summarize(message); summary != event.Summary {
+			t.Errorf("%s summarized as %q, recorded as %q", event.Name, summary, event.Summary)
+		}
+		names = append(names, event.Name)
+	}
+	if got := strings.Join(names, ","); got != "bitfield,unchoke,piece,piece" {
+		t.Errorf("seeder sent %s", got)
+	}
+}
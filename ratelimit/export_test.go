@@ -0,0 +1,58 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// FakeClock is simulated time for limiters: it stands still until a limiter
+// sleeps or the test advances it
+type FakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	slept time.Duration
+}
+
+func NewFakeClock() *FakeClock {
+	return &FakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Total time limiters have waited, which resets it
+func (c *FakeClock) TakeSlept() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	slept := c.slept
+	c.slept = 0
+	return slept
+}
+
+func (c *FakeClock) clock() clock {
+	return clock{
+		now: func() time.Time {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return c.now
+		},
+		sleep: func(d time.Duration) {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.now = c.now.Add(d)
+			c.slept += d
+		},
+	}
+}
+
+func NewFakeLimiter(rate int, c *FakeClock) *Limiter {
+	return newLimiter(rate, c.clock())
+}
+
+// Torrent limits whose own and per-peer limiters run on c
+func NewFakeTorrentLimits(download *Limiter, upload *Limiter, c *FakeClock) *TorrentLimits {
+	return newTorrentLimits(download, upload, c.clock())
+}
@@ -0,0 +1,55 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Seconds of history a Meter averages its rate over
+const meterWindow = 5
+
+// Meter counts transferred bytes and reports the recent transfer rate
+type Meter struct {
+	mu      sync.Mutex
+	total   int64
+	buckets [meterWindow]int64 // bytes per second, indexed by unix time
+	last    int64              // second of the newest bucket
+}
+
+func (m *Meter) Add(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.advance(time.Now().Unix())
+	m.total += int64(n)
+	m.buckets[m.last%meterWindow] += int64(n)
+}
+
+// Clear buckets that fell out of the window. Callers hold m.mu.
+func (m *Meter) advance(now int64) {
+	if now <= m.last {
+		return
+	}
+	for second := max(m.last+1, now-meterWindow+1); second <= now; second++ {
+		m.buckets[second%meterWindow] = 0
+	}
+	m.last = now
+}
+
+func (m *Meter) Total() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.total
+}
+
+// Bytes per second over the last few whole seconds
+func (m *Meter) Rate() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now().Unix()
+	m.advance(now)
+	var sum int64
+	for second := now - meterWindow + 1; second < now; second++ {
+		sum += m.buckets[second%meterWindow]
+	}
+	return sum / (meterWindow - 1)
+}
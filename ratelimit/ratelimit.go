@@ -0,0 +1,379 @@
+// Package ratelimit throttles connections with token buckets.
+package ratelimit
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Limiter is a token bucket holding up to one second worth of bytes. A
+// rate of 0 means unlimited. Callers may take more tokens than the bucket
+// holds; the debt is paid off by waiting before the next transfer.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   int // bytes per second
+	tokens float64
+	last   time.Time
+	clock  clock
+}
+
+// clock is the time a limiter refills its bucket by and waits on; tests
+// replace it with a simulated one
+type clock struct {
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+var systemClock = clock{now: time.Now, sleep: time.Sleep}
+
+func NewLimiter(rate int) *Limiter {
+	return newLimiter(rate, systemClock)
+}
+
+func newLimiter(rate int, clock clock) *Limiter {
+	return &Limiter{rate: rate, tokens: float64(rate), last: clock.now(), clock: clock}
+}
+
+func (l *Limiter) Rate() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// Change the rate; takes effect for transfers starting after the call
+func (l *Limiter) SetRate(rate int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.setRate(rate)
+}
+
+func (l *Limiter) setRate(rate int) {
+	l.refill(l.clock.now())
+	l.rate = rate
+	l.tokens = min(l.tokens, float64(rate))
+}
+
+// Set the rate unless it is already current
+func (l *Limiter) follow(rate int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate != rate {
+		l.setRate(rate)
+	}
+}
+
+func (l *Limiter) refill(now time.Time) {
+	l.tokens = min(float64(l.rate), l.tokens+now.Sub(l.last).Seconds()*float64(l.rate))
+	l.last = now
+}
+
+// Take n bytes worth of tokens, returning how long to wait before using them
+func (l *Limiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	l.refill(l.clock.now())
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
+
+// Block until n bytes may be transferred
+func (l *Limiter) Wait(n int) {
+	if l == nil {
+		return
+	}
+	if delay := l.reserve(n); delay > 0 {
+		l.clock.sleep(delay)
+	}
+}
+
+// Limits shared by every connection that is not given others, such as those
+// of the single-torrent commands
+var (
+	GlobalDownloadLimit = NewLimiter(0)
+	GlobalUploadLimit   = NewLimiter(0)
+
+	// Initial rates of the limiters created for each torrent and each peer
+	TorrentDownloadRate = 0
+	TorrentUploadRate   = 0
+	PeerDownloadRate    = 0
+	PeerUploadRate      = 0
+)
+
+// TorrentLimits holds the download and upload limiters of one torrent, the
+// limiters it shares with other torrents, and the rates every one of its
+// connections is limited to on its own
+type TorrentLimits struct {
+	Download *Limiter
+	Upload   *Limiter
+
+	sharedDownload *Limiter
+	sharedUpload   *Limiter
+	peerDownload   atomic.Int64
+	peerUpload     atomic.Int64
+	clock          clock // of the per-peer limiters
+}
+
+// Limits of a torrent whose traffic also counts against the global limits
+func NewTorrentLimits() *TorrentLimits {
+	return NewSharedTorrentLimits(GlobalDownloadLimit, GlobalUploadLimit)
+}
+
+// Limits of a torrent whose traffic also counts against download and upload,
+// such as the limits of the session running it
+func NewSharedTorrentLimits(download *Limiter, upload *Limiter) *TorrentLimits {
+	return newTorrentLimits(download, upload, systemClock)
+}
+
+func newTorrentLimits(download *Limiter, upload *Limiter, clock clock) *TorrentLimits {
+	t := &TorrentLimits{
+		Download:       newLimiter(TorrentDownloadRate, clock),
+		Upload:         newLimiter(TorrentUploadRate, clock),
+		sharedDownload: download,
+		sharedUpload:   upload,
+		clock:          clock,
+	}
+	t.SetPeerRates(PeerDownloadRate, PeerUploadRate)
+	return t
+}
+
+// Change the per-peer rates; connections already open follow from their
+// next transfer on
+func (t *TorrentLimits) SetPeerRates(download int, upload int) {
+	t.peerDownload.Store(int64(download))
+	t.peerUpload.Store(int64(upload))
+}
+
+func (t *TorrentLimits) PeerRates() (int, int) {
+	return int(t.peerDownload.Load()), int(t.peerUpload.Load())
+}
+
+// Wrap a peer connection so its traffic counts against the shared limits,
+// the torrent's limits and a fresh pair of per-peer limits
+func (t *TorrentLimits) Wrap(conn net.Conn) *ThrottledConn {
+	download, upload := t.PeerRates()
+	return &ThrottledConn{
+		Conn:     conn,
+		Download: newLimiter(download, t.clock),
+		Upload:   newLimiter(upload, t.clock),
+		torrent:  t,
+	}
+}
+
+// ThrottledConn is a net.Conn whose reads and writes wait on rate limiters
+type ThrottledConn struct {
+	net.Conn
+	Download *Limiter
+	Upload   *Limiter
+	torrent  *TorrentLimits
+}
+
+// Largest transfer charged at once, so limited connections move data in
+// small steps rather than long bursts
+const throttleChunk = 16 * 1024
+
+// The limiters a transfer waits on, after bringing the per-peer limiter in
+// line with the torrent's current per-peer rate
+func (c *ThrottledConn) limiters(upload bool) []*Limiter {
+	download, uploadRate := c.torrent.PeerRates()
+	if upload {
+		c.Upload.follow(uploadRate)
+		return []*Limiter{c.torrent.sharedUpload, c.torrent.Upload, c.Upload}
+	}
+	c.Download.follow(download)
+	return []*Limiter{c.torrent.sharedDownload, c.torrent.Download, c.Download}
+}
+
+func (c *ThrottledConn) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := c.Conn.Read(p)
+	for _, limiter := range c.limiters(false) {
+		limiter.Wait(n)
+	}
+	return n, err
+}
+
+func (c *ThrottledConn) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		chunk := p[written:min(len(p), written+throttleChunk)]
+		for _, limiter := range c.limiters(true) {
+			limiter.Wait(len(chunk))
+		}
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Parse a rate in bytes per second, with an optional k, m or g suffix
+// (powers of 1024). "0", "" and "unlimited" mean no limit.
+func ParseRate(value string) (int, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "" || value == "unlimited" {
+		return 0, nil
+	}
+	multiplier := 1
+	switch value[len(value)-1] {
+	case 'k':
+		multiplier = 1 << 10
+	case 'm':
+		multiplier = 1 << 20
+	case 'g':
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		value = value[:len(value)-1]
+	}
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil || rate < 0 {
+		return 0, fmt.Errorf("invalid rate: %s", value)
+	}
+	return int(rate * float64(multiplier)), nil
+}
+
+// A recurring window of time, such as working hours
+type ScheduleWindow struct {
+	Days  [7]bool // indexed by time.Weekday
+	Start time.Duration
+	End   time.Duration // before Start when the window runs past midnight
+}
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func parseWeekday(name string) (int, error) {
+	for i, weekday := range weekdayNames {
+		if strings.HasPrefix(strings.ToLower(name), weekday) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown weekday: %s", name)
+}
+
+func parseClock(value string) (time.Duration, error) {
+	hours, minutes, found := strings.Cut(value, ":")
+	h, err := strconv.Atoi(hours)
+	if err != nil || h < 0 || h > 24 {
+		return 0, fmt.Errorf("invalid time of day: %s", value)
+	}
+	m := 0
+	if found {
+		if m, err = strconv.Atoi(minutes); err != nil || m < 0 || m > 59 {
+			return 0, fmt.Errorf("invalid time of day: %s", value)
+		}
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// Parse a window like "mon-fri@09:00-18:00", "sat,sun@10-22" or "22:00-06:00"
+// (every day)
+func ParseScheduleWindow(value string) (ScheduleWindow, error) {
+	var window ScheduleWindow
+	days, hours, found := strings.Cut(value, "@")
+	if !found {
+		days, hours = "sun-sat", value
+	}
+	for _, part := range strings.Split(days, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		from, err := parseWeekday(first)
+		if err != nil {
+			return window, err
+		}
+		to := from
+		if isRange {
+			if to, err = parseWeekday(last); err != nil {
+				return window, err
+			}
+		}
+		for day := from; ; day = (day + 1) % 7 {
+			window.Days[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+	start, end, found := strings.Cut(hours, "-")
+	if !found {
+		return window, fmt.Errorf("schedule window needs a time range: %s", value)
+	}
+	var err error
+	if window.Start, err = parseClock(start); err != nil {
+		return window, err
+	}
+	if window.End, err = parseClock(end); err != nil {
+		return window, err
+	}
+	return window, nil
+}
+
+func (w ScheduleWindow) Contains(t time.Time) bool {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	clock := t.Sub(midnight)
+	day := t.Weekday()
+	if w.Start <= w.End {
+		return w.Days[day] && clock >= w.Start && clock < w.End
+	}
+	// Past midnight the window still belongs to the day it started on
+	return (w.Days[day] && clock >= w.Start) || (w.Days[(day+6)%7] && clock < w.End)
+}
+
+// Schedule switches the global limits to alternative rates while the
+// current time falls into one of its windows
+type Schedule struct {
+	Windows                []ScheduleWindow
+	Download, Upload       int
+	AltDownload, AltUpload int
+}
+
+// How often the schedule is re-evaluated
+var ScheduleCheckInterval = time.Minute
+
+func (s *Schedule) Active(t time.Time) bool {
+	for _, window := range s.Windows {
+		if window.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply the rates for the current time to the global limiters, and again
+// whenever the schedule moves in or out of a window, until stop is closed.
+// Rates changed in between, by hand or over RPC, are left alone until then.
+func (s *Schedule) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(ScheduleCheckInterval)
+	defer ticker.Stop()
+	first, wasActive := true, false
+	for {
+		if active := s.Active(time.Now()); first || active != wasActive {
+			if active {
+				GlobalDownloadLimit.SetRate(s.AltDownload)
+				GlobalUploadLimit.SetRate(s.AltUpload)
+			} else {
+				GlobalDownloadLimit.SetRate(s.Download)
+				GlobalUploadLimit.SetRate(s.Upload)
+			}
+			first, wasActive = false, active
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package ratelimit_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/mse"
+	"github.com/codecrafters-io/bittorrent-starter-go/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/ratelimit"
+	"github.com/codecrafters-io/bittorrent-starter-go/testutil"
+)
+
+// Connect to a fake seeder through limits
+func connectSeeder(t *testing.T, limits *ratelimit.TorrentLimits) *peer.Conn {
+	t.Helper()
+	previous := peer.Transports
+	peer.Transports = []string{"tcp"}
+	t.Cleanup(func() { peer.Transports = previous })
+	tor := testutil.NewTorrent("sample.bin", 256<<10, 512<<10)
+	seeder, err := testutil.NewPeer(tor, testutil.Behavior{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { seeder.Close() })
+	info, err := tor.Metainfo("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := peer.Connect(context.Background(), seeder.Addr(), info, limits, mse.EncryptionDisabled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// Torrent limits on simulated time, under unlimited shared limits
+func fakeLimits() (*ratelimit.TorrentLimits, *ratelimit.FakeClock) {
+	clock := ratelimit.NewFakeClock()
+	return ratelimit.NewFakeTorrentLimits(ratelimit.NewFakeLimiter(0, clock), ratelimit.NewFakeLimiter(0, clock), clock), clock
+}
+
+const blockSize = 16 << 10
+
+// Fetch blocks of piece 0 in order, starting at block first
+func fetchBlocks(t *testing.T, conn *peer.Conn, first int, count int) {
+	t.Helper()
+	for block := first; block < first+count; block++ {
+		if _, err := conn.RequestBlock(0, block*blockSize, blockSize); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Check the time limiters waited, allowing for message framing on top of the
+// block data
+func assertWaited(t *testing.T, clock *ratelimit.FakeClock, want time.Duration) {
+	t.Helper()
+	if waited := clock.TakeSlept(); waited < want || waited > want+want/100 {
+		t.Errorf("limiters waited %v, want %v", waited, want)
+	}
+}
+
+func TestLimiterBucket(t *testing.T) {
+	clock := ratelimit.NewFakeClock()
+	limiter := ratelimit.NewFakeLimiter(1000, clock)
+
+	// A second's worth is available at once, more has to wait
+	limiter.Wait(1000)
+	assertWaited(t, clock, 0)
+	limiter.Wait(500)
+	assertWaited(t, clock, 500*time.Millisecond)
+
+	// The bucket refills at the rate, up to a second's worth
+	clock.Advance(200 * time.Millisecond)
+	limiter.Wait(200)
+	assertWaited(t, clock, 0)
+	clock.Advance(10 * time.Second)
+	limiter.Wait(1500)
+	assertWaited(t, clock, 500*time.Millisecond)
+
+	// Taking more than the bucket holds runs up a debt
+	limiter.Wait(3000)
+	assertWaited(t, clock, 3*time.Second)
+}
+
+func TestLimiterSetRate(t *testing.T) {
+	clock := ratelimit.NewFakeClock()
+	limiter := ratelimit.NewFakeLimiter(1000, clock)
+	// Lowering the rate shrinks the bucket
+	limiter.SetRate(100)
+	limiter.Wait(200)
+	assertWaited(t, clock, time.Second)
+
+	limiter.SetRate(0)
+	limiter.Wait(1 << 30)
+	assertWaited(t, clock, 0)
+
+	// A limit set on an unlimited limiter starts from an empty bucket
+	limiter.SetRate(100)
+	limiter.Wait(100)
+	assertWaited(t, clock, time.Second)
+}
+
+func TestPeerDownloadRateBoundsThroughput(t *testing.T) {
+	limits, clock := fakeLimits()
+	limits.SetPeerRates(128<<10, 0)
+	conn := connectSeeder(t, limits)
+	clock.TakeSlept()
+
+	// The first second's worth comes out of the full bucket, the rest at the rate
+	fetchBlocks(t, conn, 0, 16)
+	assertWaited(t, clock, time.Second)
+}
+
+func TestTorrentDownloadRateBoundsThroughput(t *testing.T) {
+	limits, clock := fakeLimits()
+	conn := connectSeeder(t, limits)
+	limits.Download.SetRate(128 << 10)
+
+	fetchBlocks(t, conn, 0, 16)
+	assertWaited(t, clock, 2*time.Second)
+}
+
+func TestSharedDownloadRateBoundsThroughput(t *testing.T) {
+	clock := ratelimit.NewFakeClock()
+	shared := ratelimit.NewFakeLimiter(64<<10, clock)
+	conn := connectSeeder(t, ratelimit.NewFakeTorrentLimits(shared, ratelimit.NewFakeLimiter(0, clock), clock))
+	clock.TakeSlept()
+
+	fetchBlocks(t, conn, 0, 8)
+	assertWaited(t, clock, time.Second)
+}
+
+func TestPeerRateChangeReachesOpenConnections(t *testing.T) {
+	limits, clock := fakeLimits()
+	conn := connectSeeder(t, limits)
+
+	fetchBlocks(t, conn, 0, 8)
+	assertWaited(t, clock, 0)
+
+	// The connection's limiter starts from an empty bucket at the new rate
+	limits.SetPeerRates(64<<10, 0)
+	fetchBlocks(t, conn, 8, 4)
+	assertWaited(t, clock, time.Second)
+
+	limits.SetPeerRates(0, 0)
+	fetchBlocks(t, conn, 12, 4)
+	assertWaited(t, clock, 0)
+}
+
+func TestPeerUploadRateBoundsThroughput(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	go io.Copy(io.Discard, remote)
+	limits, clock := fakeLimits()
+	limits.SetPeerRates(0, 64<<10)
+	conn := limits.Wrap(local)
+	defer conn.Close()
+
+	if _, err := conn.Write(make([]byte, 128<<10)); err != nil {
+		t.Fatal(err)
+	}
+	assertWaited(t, clock, time.Second)
+}
+
+func TestScheduleLeavesRuntimeRatesAlone(t *testing.T) {
+	previous := ratelimit.ScheduleCheckInterval
+	ratelimit.ScheduleCheckInterval = 5 * time.Millisecond
+	defer func() {
+		ratelimit.ScheduleCheckInterval = previous
+		ratelimit.GlobalDownloadLimit.SetRate(0)
+		ratelimit.GlobalUploadLimit.SetRate(0)
+	}()
+	schedule := &ratelimit.Schedule{Download: 1000, Upload: 2000, AltDownload: 10, AltUpload: 20}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		schedule.Run(stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for ratelimit.GlobalDownloadLimit.Rate() != 1000 {
+		if time.Now().After(deadline) {
+			t.Fatal("schedule never applied its rates")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	ratelimit.GlobalDownloadLimit.SetRate(5000)
+	time.Sleep(50 * time.Millisecond)
+	if rate := ratelimit.GlobalDownloadLimit.Rate(); rate != 5000 {
+		t.Errorf("download rate = %d after a runtime change, want 5000", rate)
+	}
+	if rate := ratelimit.GlobalUploadLimit.Rate(); rate != 2000 {
+		t.Errorf("upload rate = %d, want 2000", rate)
+	}
+}
+
+func TestScheduleWindow(t *testing.T) {
+	window, err := ratelimit.ParseScheduleWindow("mon-fri@22:00-06:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		time string
+		want bool
+	}{
+		{"2024-01-08T23:00:00Z", true},  // Monday night
+		{"2024-01-09T05:59:00Z", true},  // early Tuesday, still Monday's window
+		{"2024-01-09T06:00:00Z", false}, // window over
+		{"2024-01-06T23:00:00Z", false}, // Saturday
+		{"2024-01-08T05:00:00Z", false}, // early Monday belongs to Sunday
+	} {
+		at, _ := time.Parse(time.RFC3339, c.time)
+		if got := window.Contains(at); got != c.want {
+			t.Errorf("Contains(%s) = %v, want %v", c.time, got, c.want)
+		}
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	for value, want := range map[string]int{"": 0, "unlimited": 0, "512": 512, "1.5k": 1536, "2M": 2 << 20} {
+		if got, err := ratelimit.ParseRate(value); err != nil || got != want {
+			t.Errorf("ParseRate(%q) = %d, %v, want %d", value, got, err, want)
+		}
+	}
+	if _, err := ratelimit.ParseRate("-1"); err == nil {
+		t.Error("ParseRate accepted a negative rate")
+	}
+}
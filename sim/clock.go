@@ -0,0 +1,62 @@
+package sim
+
+import (
+	"container/heap"
+	"time"
+)
+
+// Clock is the virtual clock of a simulation. Events run one at a time in
+// time order; events due at the same instant run in the order they were
+// scheduled, which keeps runs deterministic.
+type Clock struct {
+	now    time.Duration
+	seq    int
+	events eventQueue
+}
+
+type event struct {
+	at  time.Duration
+	seq int
+	run func()
+}
+
+type eventQueue []*event
+
+func (q eventQueue) Len() int { return len(q) }
+func (q eventQueue) Less(i, j int) bool {
+	if q[i].at != q[j].at {
+		return q[i].at < q[j].at
+	}
+	return q[i].seq < q[j].seq
+}
+func (q eventQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *eventQueue) Push(x interface{}) { *q = append(*q, x.(*event)) }
+func (q *eventQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+// Time elapsed since the start of the simulation
+func (c *Clock) Now() time.Duration {
+	return c.now
+}
+
+// Run fn once delay has passed on the virtual clock
+func (c *Clock) After(delay time.Duration, fn func()) {
+	c.seq++
+	heap.Push(&c.events, &event{at: c.now + max(delay, 0), seq: c.seq, run: fn})
+}
+
+// Advance to the next event and run it. Returns false when no event is due
+// before limit.
+func (c *Clock) Step(limit time.Duration) bool {
+	if len(c.events) == 0 || c.events[0].at > limit {
+		return false
+	}
+	e := heap.Pop(&c.events).(*event)
+	c.now = e.at
+	e.run()
+	return true
+}
@@ -0,0 +1,68 @@
+package sim
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Network conditions shared by every node
+type NetworkConfig struct {
+	Latency      time.Duration // one way
+	UploadRate   int           // bytes per second per node, 0 for unlimited
+	DownloadRate int           // bytes per second per node, 0 for unlimited
+	Loss         float64       // probability that a packet is lost
+}
+
+// Bytes per packet when counting losses
+const packetSize = 1460
+
+// network carries messages between nodes. Each node's uplink and downlink
+// pass one message at a time at their rate. The peer wire protocol runs over
+// a reliable stream, so a lost packet is not dropped but delays its message,
+// and everything behind it on the connection, by a round trip.
+type network struct {
+	clock        *Clock
+	config       NetworkConfig
+	rand         *rand.Rand
+	uplinkFree   []time.Duration // when each node's uplink is next idle
+	downlinkFree []time.Duration
+	lastArrival  map[[2]int]time.Duration // keeps each connection in order
+}
+
+func newNetwork(clock *Clock, config NetworkConfig, nodes int, random *rand.Rand) *network {
+	return &network{
+		clock:        clock,
+		config:       config,
+		rand:         random,
+		uplinkFree:   make([]time.Duration, nodes),
+		downlinkFree: make([]time.Duration, nodes),
+		lastArrival:  make(map[[2]int]time.Duration),
+	}
+}
+
+func transferTime(bytes int, rate int) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+	return time.Duration(int64(bytes) * int64(time.Second) / int64(rate))
+}
+
+// Send data from one node to another, calling deliver when it has arrived
+func (n *network) send(from, to int, data []byte, deliver func([]byte)) {
+	start := max(n.clock.Now(), n.uplinkFree[from])
+	n.uplinkFree[from] = start + transferTime(len(data), n.config.UploadRate)
+	arrival := n.uplinkFree[from] + n.config.Latency
+	if n.config.Loss > 0 {
+		for packet := 0; packet < (len(data)+packetSize-1)/packetSize; packet++ {
+			for n.rand.Float64() < n.config.Loss {
+				arrival += 2 * n.config.Latency
+			}
+		}
+	}
+	arrival = max(arrival, n.downlinkFree[to]) + transferTime(len(data), n.config.DownloadRate)
+	n.downlinkFree[to] = arrival
+	key := [2]int{from, to}
+	arrival = max(arrival, n.lastArrival[key])
+	n.lastArrival[key] = arrival
+	n.clock.After(arrival-n.clock.Now(), func() { deliver(data) })
+}
@@ -0,0 +1,373 @@
+package sim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/client"
+	"github.com/codecrafters-io/bittorrent-starter-go/metainfo"
+	"github.com/codecrafters-io/bittorrent-starter-go/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/storage"
+)
+
+// A simulated client. It keeps its data in memory storage, tracks progress
+// and picks pieces with the same code as a real torrent, and exchanges real
+// peer wire messages over the simulated network. Its choker and request
+// scheduling are simulator models, not client code.
+type node struct {
+	sim     *simulation
+	id      int
+	name    string
+	seed    bool
+	corrupt bool // serve blocks with a flipped byte
+
+	store    *storage.MemoryStorage
+	progress *client.Progress
+	picker   *client.PiecePicker
+	links    []*link       // by remote node id, nil for itself
+	inFlight map[int]*link // piece -> link fetching it
+
+	completed    time.Duration
+	done         bool
+	downloaded   int64
+	uploaded     int64
+	wasted       int64
+	hashFailures int
+	rechokes     int
+	optimistic   *link
+}
+
+// One side of a connection between two nodes
+type link struct {
+	remote         int
+	open           bool
+	bitfield       peer.Bitfield
+	amChoking      bool
+	amInterested   bool
+	peerChoking    bool
+	peerInterested bool
+	banned         bool
+
+	piece       int // piece being fetched from the peer, or -1
+	nextBlock   int
+	outstanding int
+
+	received int64 // bytes received since the last rechoke
+	sent     int64 // bytes sent since the last rechoke
+}
+
+func newNode(s *simulation, id int, name string, seed bool) *node {
+	info := s.info
+	n := &node{
+		sim:      s,
+		id:       id,
+		name:     name,
+		seed:     seed,
+		store:    storage.NewMemoryStorage(info),
+		progress: client.NewProgress(info),
+		inFlight: make(map[int]*link),
+	}
+	n.picker = client.NewPiecePicker(info, client.NewFilePriorities(info), n.progress)
+	if seed {
+		for piece := 0; piece < info.PieceCount(); piece++ {
+			offset := piece * info.PieceLength
+			n.store.WriteAt(s.data[offset:offset+info.PieceSize(piece)], piece, 0)
+			n.progress.SetPiece(piece)
+		}
+		n.done = true
+	}
+	return n
+}
+
+func (n *node) info() *metainfo.Metainfo {
+	return n.sim.info
+}
+
+func (n *node) send(l *link, data []byte) {
+	remote := n.sim.nodes[l.remote]
+	n.sim.network.send(n.id, l.remote, data, func(data []byte) {
+		remote.receive(remote.links[n.id], data)
+	})
+}
+
+func (n *node) sendMessage(l *link, id byte, payload []byte) {
+	n.send(l, peer.EncodeMessage(id, payload))
+}
+
+// Open a connection by sending the handshake, as both ends do
+func (n *node) connect(l *link) {
+	handshake := peer.Handshake{PeerID: n.sim.peerIDs[n.id]}
+	copy(handshake.InfoHash[:], n.sim.infoHash)
+	n.send(l, handshake.Marshal())
+}
+
+func (n *node) receive(l *link, data []byte) {
+	if !l.open {
+		if len(data) != 68 || !bytes.Equal(data[28:48], n.sim.infoHash) {
+			return
+		}
+		l.open = true
+		l.bitfield = peer.NewBitfield(n.info().PieceCount())
+		l.amChoking, l.peerChoking, l.piece = true, true, -1
+		n.sendMessage(l, peer.MsgBitfield, n.progress.Snapshot())
+		return
+	}
+	message, err := peer.ReadMessage(bytes.NewReader(data))
+	if err != nil || message == nil {
+		return
+	}
+	switch message.ID {
+	case peer.MsgBitfield:
+		copy(l.bitfield, message.Payload)
+		n.updateInterest(l)
+	case peer.MsgHave:
+		if len(message.Payload) == 4 {
+			l.bitfield.Set(int(binary.BigEndian.Uint32(message.Payload)))
+			n.updateInterest(l)
+		}
+	case peer.MsgInterested:
+		l.peerInterested = true
+		if n.sim.config.UploadSlots == 0 || n.unchoked() < n.sim.config.UploadSlots {
+			n.setChoking(l, false)
+		}
+	case peer.MsgNotInterested:
+		l.peerInterested = false
+		n.setChoking(l, true)
+	case peer.MsgChoke:
+		// Requests are dropped by a choking peer; blocks already written
+		// are kept and the piece is free for another peer to finish
+		l.peerChoking = true
+		n.release(l)
+	case peer.MsgUnchoke:
+		l.peerChoking = false
+		n.request(l)
+	case peer.MsgRequest:
+		n.serve(l, message.Payload)
+	case peer.MsgPiece:
+		n.block(l, message.Payload)
+	}
+}
+
+func (n *node) unchoked() int {
+	count := 0
+	for _, l := range n.links {
+		if l != nil && l.open && !l.amChoking {
+			count++
+		}
+	}
+	return count
+}
+
+func (n *node) setChoking(l *link, choking bool) {
+	if l.amChoking == choking {
+		return
+	}
+	l.amChoking = choking
+	if choking {
+		n.sendMessage(l, peer.MsgChoke, nil)
+	} else {
+		n.sendMessage(l, peer.MsgUnchoke, nil)
+	}
+}
+
+// Whether the peer has a piece this node still needs
+func (n *node) interesting(l *link) bool {
+	if n.done || l.banned {
+		return false
+	}
+	for piece := 0; piece < n.info().PieceCount(); piece++ {
+		if l.bitfield.Has(piece) && !n.progress.HasPiece(piece) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *node) updateInterest(l *link) {
+	interested := n.interesting(l)
+	if interested != l.amInterested {
+		l.amInterested = interested
+		if interested {
+			n.sendMessage(l, peer.MsgInterested, nil)
+		} else {
+			n.sendMessage(l, peer.MsgNotInterested, nil)
+		}
+	}
+	if interested {
+		n.request(l)
+	}
+}
+
+// Give up the piece assigned to a peer
+func (n *node) release(l *link) {
+	if l.piece >= 0 {
+		delete(n.inFlight, l.piece)
+	}
+	l.piece, l.outstanding = -1, 0
+}
+
+// Pick a piece the same way a torrent does: the most important missing
+// piece the peer has that nobody else is fetching
+func (n *node) pick(l *link) int {
+	mask := n.progress.Snapshot()
+	for piece := 0; piece < n.info().PieceCount(); piece++ {
+		if !l.bitfield.Has(piece) || n.inFlight[piece] != nil {
+			mask.Set(piece)
+		}
+	}
+	return n.picker.Next(mask)
+}
+
+// Keep up to Pipeline block requests outstanding with an unchoked peer
+func (n *node) request(l *link) {
+	if l.peerChoking || l.banned || n.done {
+		return
+	}
+	for l.outstanding < n.sim.config.Pipeline && !l.banned && !n.done {
+		if l.piece < 0 {
+			piece := n.pick(l)
+			if piece < 0 {
+				return
+			}
+			l.piece, l.nextBlock = piece, 0
+			n.inFlight[piece] = l
+		}
+		pieceSize := n.info().PieceSize(l.piece)
+		for l.nextBlock < client.BlockCount(pieceSize) && n.progress.HasBlock(l.piece, l.nextBlock) {
+			l.nextBlock++
+		}
+		if l.nextBlock >= client.BlockCount(pieceSize) {
+			if l.outstanding == 0 {
+				n.finishPiece(l)
+				continue
+			}
+			return
+		}
+		begin := l.nextBlock * client.BlockSize
+		payload := make([]byte, 12)
+		binary.BigEndian.PutUint32(payload[0:4], uint32(l.piece))
+		binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+		binary.BigEndian.PutUint32(payload[8:12], uint32(min(client.BlockSize, pieceSize-begin)))
+		n.sendMessage(l, peer.MsgRequest, payload)
+		l.nextBlock++
+		l.outstanding++
+	}
+}
+
+func (n *node) serve(l *link, payload []byte) {
+	if l.amChoking || len(payload) != 12 {
+		return
+	}
+	index := int(binary.BigEndian.Uint32(payload[0:4]))
+	begin := int(binary.BigEndian.Uint32(payload[4:8]))
+	length := int(binary.BigEndian.Uint32(payload[8:12]))
+	if index >= n.info().PieceCount() || !n.progress.HasPiece(index) || length > client.BlockSize {
+		return
+	}
+	block := make([]byte, 8+length)
+	copy(block, payload[:8])
+	if _, err := n.store.ReadAt(block[8:], index, begin); err != nil {
+		return
+	}
+	if n.corrupt {
+		block[8] ^= 0xff
+	}
+	n.uploaded += int64(length)
+	l.sent += int64(length)
+	n.sendMessage(l, peer.MsgPiece, block)
+}
+
+func (n *node) block(l *link, payload []byte) {
+	if len(payload) < 8 {
+		return
+	}
+	index := int(binary.BigEndian.Uint32(payload[0:4]))
+	begin := int(binary.BigEndian.Uint32(payload[4:8]))
+	data := payload[8:]
+	n.downloaded += int64(len(data))
+	l.received += int64(len(data))
+	if index != l.piece || n.progress.HasBlock(index, begin/client.BlockSize) {
+		// Arrived after a choke, or already fetched
+		n.wasted += int64(len(data))
+		return
+	}
+	if _, err := n.store.WriteAt(data, index, begin); err != nil {
+		n.wasted += int64(len(data))
+		return
+	}
+	n.progress.SetBlock(n.info(), index, begin/client.BlockSize)
+	l.outstanding = max(l.outstanding-1, 0)
+	n.request(l)
+}
+
+// Verify a piece once all its blocks are in, as FetchPiece does
+func (n *node) finishPiece(l *link) {
+	index := l.piece
+	n.release(l)
+	ok, err := client.VerifyPiece(n.store, n.info(), index)
+	if err != nil || !ok {
+		n.progress.ResetPiece(index)
+		n.wasted += int64(n.info().PieceSize(index))
+		n.hashFailures++
+		l.banned = true
+		n.updateInterest(l)
+		return
+	}
+	n.progress.SetPiece(index)
+	have := binary.BigEndian.AppendUint32(nil, uint32(index))
+	for _, other := range n.links {
+		if other != nil && other.open {
+			n.sendMessage(other, peer.MsgHave, have)
+		}
+	}
+	if n.progress.Complete(n.info()) {
+		n.done, n.completed = true, n.sim.clock.Now()
+		n.sim.finished()
+	}
+	for _, other := range n.links {
+		if other != nil && other.open && other != l {
+			n.updateInterest(other)
+		}
+	}
+}
+
+// Choke all but the UploadSlots peers that gave this node the most data in
+// the last interval, or that took the most from a seed, and rotate one
+// optimistic unchoke every third round
+func (n *node) rechoke(random *rand.Rand) {
+	slots := n.sim.config.UploadSlots
+	var candidates []*link
+	for _, l := range n.links {
+		if l != nil && l.open && l.peerInterested {
+			candidates = append(candidates, l)
+		}
+	}
+	rate := func(l *link) int64 {
+		if n.done {
+			return l.sent
+		}
+		return l.received
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return rate(candidates[i]) > rate(candidates[j]) })
+	unchoke := make(map[*link]bool)
+	for _, l := range candidates[:min(max(slots-1, 0), len(candidates))] {
+		unchoke[l] = true
+	}
+	if n.optimistic != nil && !n.optimistic.peerInterested {
+		n.optimistic = nil
+	}
+	if rest := candidates[min(max(slots-1, 0), len(candidates)):]; len(rest) > 0 && (n.rechokes%3 == 0 || n.optimistic == nil) {
+		n.optimistic = rest[random.Intn(len(rest))]
+	}
+	n.rechokes++
+	for _, l := range n.links {
+		if l == nil || !l.open {
+			continue
+		}
+		n.setChoking(l, !unchoke[l] && l != n.optimistic)
+		l.received, l.sent = 0, 0
+	}
+}
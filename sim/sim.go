@@ -0,0 +1,200 @@
+// Package sim simulates a swarm of clients and seeds exchanging one torrent
+// over an in-memory network with configurable latency, bandwidth and loss.
+// Time is virtual, so a swarm that would take hours runs in seconds, and a
+// run is fully determined by its configuration and random seed.
+//
+// The nodes speak the real peer wire protocol and reuse the storage, progress
+// and piece picking code of the client, so changes to those show up in the
+// reported completion times, fairness and wasted bytes. Nothing else of the
+// client runs here: choking and the scheduling of block requests are models
+// of the simulator's own, a tit-for-tat choker with UploadSlots and a fixed
+// Pipeline of requests per peer, so results say nothing about how the
+// client's connection handling behaves.
+package sim
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/metainfo"
+)
+
+type Config struct {
+	Info *metainfo.Metainfo
+	Data []byte // the torrent's content, given to the seeds
+
+	Seeds    int
+	Leechers int
+	Corrupt  int // additional seeds that serve corrupt blocks
+
+	Network NetworkConfig
+
+	Pipeline    int           // block requests outstanding per peer
+	UploadSlots int           // peers unchoked at once, 0 to unchoke everyone
+	Rechoke     time.Duration // interval between choking decisions
+
+	Seed    int64         // seeds the simulation's random numbers
+	MaxTime time.Duration // virtual time after which the run is abandoned
+}
+
+// Defaults for the fields of a Config left at zero
+var (
+	DefaultPipeline = 5
+	DefaultRechoke  = 10 * time.Second
+	DefaultMaxTime  = 24 * time.Hour
+)
+
+// Outcome of a simulation for one node
+type NodeReport struct {
+	Name         string
+	Seed         bool
+	Done         bool
+	Completed    time.Duration // when a leecher had every piece
+	Downloaded   int64
+	Uploaded     int64
+	Wasted       int64
+	HashFailures int
+}
+
+type Report struct {
+	Duration time.Duration // until the last leecher completed, or MaxTime
+	Complete bool          // whether every leecher completed
+	Events   int
+	Nodes    []NodeReport
+	// Jain's fairness index of the leechers' upload/download ratios, from
+	// 1/n when one leecher did all the uploading to 1 when all shared alike
+	Fairness float64
+	Wasted   int64
+}
+
+type simulation struct {
+	config   Config
+	info     *metainfo.Metainfo
+	data     []byte
+	infoHash []byte
+	peerIDs  [][20]byte
+	clock    *Clock
+	network  *network
+	nodes    []*node
+	pending  int // leechers yet to complete
+}
+
+func (s *simulation) finished() {
+	s.pending--
+}
+
+// Run a simulation to completion on the virtual clock
+func Run(config Config) (*Report, error) {
+	if config.Info == nil || len(config.Data) != config.Info.Length {
+		return nil, errors.New("simulation needs a torrent and its data")
+	}
+	if config.Seeds+config.Corrupt < 1 || config.Leechers < 1 {
+		return nil, errors.New("simulation needs at least one seed and one leecher")
+	}
+	if config.Pipeline <= 0 {
+		config.Pipeline = DefaultPipeline
+	}
+	if config.Rechoke <= 0 {
+		config.Rechoke = DefaultRechoke
+	}
+	if config.MaxTime <= 0 {
+		config.MaxTime = DefaultMaxTime
+	}
+	infoHash, err := hex.DecodeString(config.Info.InfoHash)
+	if err != nil || len(infoHash) != 20 {
+		return nil, fmt.Errorf("invalid info hash %q", config.Info.InfoHash)
+	}
+
+	random := rand.New(rand.NewSource(config.Seed))
+	total := config.Seeds + config.Corrupt + config.Leechers
+	s := &simulation{
+		config:   config,
+		info:     config.Info,
+		data:     config.Data,
+		infoHash: infoHash,
+		clock:    &Clock{},
+		pending:  config.Leechers,
+	}
+	s.network = newNetwork(s.clock, config.Network, total, random)
+	for i := 0; i < total; i++ {
+		var n *node
+		switch {
+		case i < config.Seeds:
+			n = newNode(s, i, fmt.Sprintf("seed%d", i+1), true)
+		case i < config.Seeds+config.Corrupt:
+			n = newNode(s, i, fmt.Sprintf("corrupt%d", i-config.Seeds+1), true)
+			n.corrupt = true
+		default:
+			n = newNode(s, i, fmt.Sprintf("leecher%d", i-config.Seeds-config.Corrupt+1), false)
+		}
+		var peerID [20]byte
+		copy(peerID[:], fmt.Sprintf("-SM0001-%012d", i))
+		s.peerIDs = append(s.peerIDs, peerID)
+		s.nodes = append(s.nodes, n)
+	}
+	for _, n := range s.nodes {
+		n.links = make([]*link, total)
+		for j := range s.nodes {
+			if j != n.id {
+				n.links[j] = &link{remote: j, piece: -1}
+			}
+		}
+	}
+	// Every node connects to every other one, each pair once
+	for _, n := range s.nodes {
+		for j := n.id + 1; j < total; j++ {
+			n.connect(n.links[j])
+			s.nodes[j].connect(s.nodes[j].links[n.id])
+		}
+	}
+	if config.UploadSlots > 0 {
+		for _, n := range s.nodes {
+			n := n
+			var tick func()
+			tick = func() {
+				n.rechoke(random)
+				s.clock.After(config.Rechoke, tick)
+			}
+			// Spread the nodes' rounds over the interval
+			s.clock.After(time.Duration(random.Int63n(int64(config.Rechoke))), tick)
+		}
+	}
+
+	report := &Report{}
+	for s.pending > 0 && s.clock.Step(config.MaxTime) {
+		report.Events++
+	}
+	report.Complete = s.pending == 0
+	report.Duration = s.clock.Now()
+	if !report.Complete {
+		report.Duration = config.MaxTime
+	}
+	var sum, squares float64
+	leechers := 0
+	for _, n := range s.nodes {
+		report.Nodes = append(report.Nodes, NodeReport{
+			Name:         n.name,
+			Seed:         n.seed,
+			Done:         n.done,
+			Completed:    n.completed,
+			Downloaded:   n.downloaded,
+			Uploaded:     n.uploaded,
+			Wasted:       n.wasted,
+			HashFailures: n.hashFailures,
+		})
+		report.Wasted += n.wasted
+		if !n.seed && n.downloaded > 0 {
+			ratio := float64(n.uploaded) / float64(n.downloaded)
+			sum += ratio
+			squares += ratio * ratio
+			leechers++
+		}
+	}
+	if squares > 0 {
+		report.Fairness = sum * sum / (float64(leechers) * squares)
+	}
+	return report, nil
+}
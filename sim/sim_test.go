@@ -0,0 +1,105 @@
+package sim
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/testutil"
+)
+
+// A small swarm on a lossy network, with a corrupt seed and choking enabled
+// so that every random choice of the simulator is exercised
+func smallSwarm(t *testing.T, seed int64) Config {
+	t.Helper()
+	tor := testutil.NewTorrent("swarm.bin", 32<<10, 1<<20)
+	info, err := tor.Metainfo("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Config{
+		Info:     info,
+		Data:     tor.Data,
+		Seeds:    2,
+		Corrupt:  1,
+		Leechers: 6,
+		Network: NetworkConfig{
+			Latency:      20 * time.Millisecond,
+			UploadRate:   256 << 10,
+			DownloadRate: 1 << 20,
+			Loss:         0.01,
+		},
+		UploadSlots: 3,
+		Rechoke:     2 * time.Second,
+		Seed:        seed,
+		MaxTime:     time.Hour,
+	}
+}
+
+func TestSmallSwarmCompletes(t *testing.T) {
+	config := smallSwarm(t, 1)
+	report, err := Run(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Complete {
+		t.Fatalf("swarm did not complete within %v", config.MaxTime)
+	}
+	size := int64(len(config.Data))
+	var uploadedByLeechers int64
+	for _, node := range report.Nodes {
+		if node.Seed {
+			continue
+		}
+		if !node.Done || node.Completed <= 0 || node.Completed > report.Duration {
+			t.Errorf("%s: done %v at %v, swarm finished at %v", node.Name, node.Done, node.Completed, report.Duration)
+		}
+		if node.Downloaded < size {
+			t.Errorf("%s downloaded %d bytes of %d", node.Name, node.Downloaded, size)
+		}
+		uploadedByLeechers += node.Uploaded
+	}
+	if uploadedByLeechers == 0 {
+		t.Error("leechers never traded pieces among themselves")
+	}
+	if report.Wasted == 0 {
+		t.Error("the corrupt seed's blocks were never counted as wasted")
+	}
+	if report.Fairness <= 0 || report.Fairness > 1 {
+		t.Errorf("fairness %v out of range", report.Fairness)
+	}
+}
+
+func TestSameSeedGivesSameReport(t *testing.T) {
+	first, err := Run(smallSwarm(t, 7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := Run(smallSwarm(t, 7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("runs with the same seed differ:\n%+v\n%+v", first, second)
+	}
+	other, err := Run(smallSwarm(t, 8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(first, other) {
+		t.Error("a different seed gave an identical run")
+	}
+}
+
+func TestRunRejectsIncompleteConfig(t *testing.T) {
+	config := smallSwarm(t, 1)
+	config.Data = config.Data[1:]
+	if _, err := Run(config); err == nil {
+		t.Error("ran with data that does not match the torrent")
+	}
+	config = smallSwarm(t, 1)
+	config.Seeds, config.Corrupt = 0, 0
+	if _, err := Run(config); err == nil {
+		t.Error("ran without a seed")
+	}
+}
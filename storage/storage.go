@@ -0,0 +1,451 @@
+// Package storage persists torrent data addressed by piece.
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/logging"
+	"github.com/codecrafters-io/bittorrent-starter-go/metainfo"
+)
+
+var logger = logging.For(logging.Storage)
+
+// Storage persists torrent data addressed by piece index and offset within the piece
+type Storage interface {
+	ReadAt(p []byte, piece int, begin int) (int, error)
+	WriteAt(p []byte, piece int, begin int) (int, error)
+	Sync() error
+	Close() error
+}
+
+// SelectiveStorage is implemented by storage that keeps the data of skipped
+// files out of those files, so they are not created until they are wanted
+type SelectiveStorage interface {
+	Storage
+	SetSkipped(file int, skipped bool) error
+	CreateWantedFiles() error
+	PartsPath() string
+}
+
+// Backend opens the storage of a torrent whose data lives at outputPath
+type Backend func(info *metainfo.Metainfo, outputPath string) (Storage, error)
+
+// Backends by the name users choose them with; "mmap" is only available on
+// systems that support it
+var Backends = map[string]Backend{
+	"file":   OpenFile,
+	"memory": OpenMemory,
+}
+
+func OpenFile(info *metainfo.Metainfo, outputPath string) (Storage, error) {
+	return NewFileStorage(info, outputPath), nil
+}
+
+// Keep the data in memory, ignoring outputPath
+func OpenMemory(info *metainfo.Metainfo, outputPath string) (Storage, error) {
+	return NewMemoryStorage(info), nil
+}
+
+// A region of a single file covered by a span of torrent data
+type Span struct {
+	File   int
+	Offset int64 // offset within the file
+	Start  int   // offset within the caller's buffer
+	Length int
+}
+
+// Map a span of torrent data onto the files it covers
+func MapSpan(files []metainfo.FileEntry, offset int64, length int) []Span {
+	var spans []Span
+	end := offset + int64(length)
+	for i, file := range files {
+		fileStart := int64(file.Offset)
+		fileEnd := fileStart + int64(file.Length)
+		if fileEnd <= offset || fileStart >= end || file.Length == 0 {
+			continue
+		}
+		from := max(offset, fileStart)
+		to := min(end, fileEnd)
+		spans = append(spans, Span{
+			File:   i,
+			Offset: from - fileStart,
+			Start:  int(from - offset),
+			Length: int(to - from),
+		})
+	}
+	return spans
+}
+
+func checkBounds(info *metainfo.Metainfo, piece int, begin int, length int) (int64, error) {
+	if piece < 0 || piece >= info.PieceCount() || begin < 0 || begin+length > info.PieceSize(piece) {
+		return 0, fmt.Errorf("block out of range: piece %d offset %d length %d", piece, begin, length)
+	}
+	return int64(piece)*int64(info.PieceLength) + int64(begin), nil
+}
+
+// FileStorage writes torrent data straight into the torrent's files. A
+// single-file torrent is stored at the output path itself; multi-file torrents
+// are laid out below the output path as a directory. Data of skipped files that
+// shares a piece with wanted files goes to a parts file instead, so skipped
+// files that do not exist yet are never created.
+type FileStorage struct {
+	info      *metainfo.Metainfo
+	paths     []string
+	partsPath string
+	mu        sync.Mutex
+	handles   []*os.File
+	skipped   []bool
+	parts     *os.File
+	slots     []uint32 // parts file slot+1 of each piece, 0 when it has none
+	nextSlot  uint32
+}
+
+func Paths(info *metainfo.Metainfo, outputPath string) []string {
+	paths := make([]string, len(info.Files))
+	if _, multiFile := info.Info["files"]; !multiFile {
+		paths[0] = outputPath
+		return paths
+	}
+	for i, file := range info.Files {
+		paths[i] = filepath.Join(outputPath, file.Path)
+	}
+	return paths
+}
+
+func NewFileStorage(info *metainfo.Metainfo, outputPath string) *FileStorage {
+	return &FileStorage{
+		info:      info,
+		paths:     Paths(info, outputPath),
+		partsPath: outputPath + ".parts",
+		handles:   make([]*os.File, len(info.Files)),
+		skipped:   make([]bool, len(info.Files)),
+	}
+}
+
+// Path of the file holding data of skipped files
+func (s *FileStorage) PartsPath() string {
+	return s.partsPath
+}
+
+// Open the parts file and load its slot table. The file starts with one
+// big-endian uint32 per piece naming its slot, followed by piece-sized slots.
+func (s *FileStorage) openParts(create bool) error {
+	if s.parts != nil {
+		return nil
+	}
+	flags := os.O_RDWR
+	if create {
+		flags |= os.O_CREATE
+	}
+	file, err := os.OpenFile(s.partsPath, flags, 0o644)
+	if err != nil {
+		return err
+	}
+	logger.Debug("opened parts file", "path", s.partsPath)
+	table := make([]byte, 4*s.info.PieceCount())
+	if _, err := file.ReadAt(table, 0); err != nil && err != io.EOF {
+		file.Close()
+		return err
+	}
+	s.slots = make([]uint32, s.info.PieceCount())
+	for i := range s.slots {
+		s.slots[i] = binary.BigEndian.Uint32(table[4*i:])
+		s.nextSlot = max(s.nextSlot, s.slots[i])
+	}
+	s.parts = file
+	return nil
+}
+
+// Offset of a piece's slot in the parts file, allocating one if asked to
+func (s *FileStorage) partsSlot(piece int, create bool) (int64, bool, error) {
+	if err := s.openParts(create); err != nil {
+		if errors.Is(err, os.ErrNotExist) && !create {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	if s.slots[piece] == 0 {
+		if !create {
+			return 0, false, nil
+		}
+		s.nextSlot++
+		s.slots[piece] = s.nextSlot
+		var entry [4]byte
+		binary.BigEndian.PutUint32(entry[:], s.slots[piece])
+		if _, err := s.parts.WriteAt(entry[:], int64(4*piece)); err != nil {
+			return 0, false, err
+		}
+	}
+	header := int64(4 * s.info.PieceCount())
+	return header + int64(s.slots[piece]-1)*int64(s.info.PieceLength), true, nil
+}
+
+// Mark a file as skipped or wanted. When a skipped file becomes wanted, the
+// data already kept for it in the parts file is moved into the file.
+func (s *FileStorage) SetSkipped(index int, skipped bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.skipped[index] == skipped {
+		return nil
+	}
+	s.skipped[index] = skipped
+	if skipped {
+		return nil
+	}
+	// Creating the file pulls in its data from the parts file
+	_, err := s.open(index, true)
+	return err
+}
+
+// Create every wanted file, pulling in data left in the parts file by earlier
+// runs in which the file was skipped
+func (s *FileStorage) CreateWantedFiles() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.info.Files {
+		if s.skipped[i] {
+			continue
+		}
+		if _, err := s.open(i, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copy the parts file data belonging to a file into the file itself
+func (s *FileStorage) migrateParts(index int) error {
+	if err := s.openParts(false); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	for piece, slot := range s.slots {
+		if slot == 0 {
+			continue
+		}
+		slotOffset, _, err := s.partsSlot(piece, false)
+		if err != nil {
+			return err
+		}
+		pieceOffset := int64(piece) * int64(s.info.PieceLength)
+		for _, span := range MapSpan(s.info.Files, pieceOffset, s.info.PieceSize(piece)) {
+			if span.File != index {
+				continue
+			}
+			data := make([]byte, span.Length)
+			if _, err := s.parts.ReadAt(data, slotOffset+int64(span.Start)); err != nil && err != io.EOF {
+				return err
+			}
+			if _, err := s.handles[index].WriteAt(data, span.Offset); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Read a span from the parts file, yielding zeroes when the piece has no slot
+func (s *FileStorage) readParts(p []byte, piece int, begin int) error {
+	slotOffset, ok, err := s.partsSlot(piece, false)
+	if err != nil {
+		return err
+	}
+	clear(p)
+	if !ok {
+		return nil
+	}
+	if _, err := s.parts.ReadAt(p, slotOffset+int64(begin)); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// Open (creating if needed) the file at index, sized to its final length
+func (s *FileStorage) open(index int, create bool) (*os.File, error) {
+	if s.handles[index] != nil {
+		return s.handles[index], nil
+	}
+	path := s.paths[index]
+	flags := os.O_RDWR
+	if create {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return nil, err
+		}
+		flags |= os.O_CREATE
+	}
+	_, statErr := os.Stat(path)
+	file, err := os.OpenFile(path, flags, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if stat, err := file.Stat(); err == nil && stat.Size() != int64(s.info.Files[index].Length) {
+		if err := file.Truncate(int64(s.info.Files[index].Length)); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	s.handles[index] = file
+	// A file skipped in an earlier run may have boundary data in the parts file
+	if errors.Is(statErr, os.ErrNotExist) {
+		logger.Debug("created file", "path", path, "length", s.info.Files[index].Length)
+		if err := s.migrateParts(index); err != nil {
+			return nil, err
+		}
+	}
+	return file, nil
+}
+
+func (s *FileStorage) ReadAt(p []byte, piece int, begin int) (int, error) {
+	offset, err := checkBounds(s.info, piece, begin, len(p))
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	read := 0
+	for _, span := range MapSpan(s.info.Files, offset, len(p)) {
+		file, err := s.open(span.File, false)
+		if errors.Is(err, os.ErrNotExist) {
+			// Data that was never written to a file reads from the parts file or as zeroes
+			if err := s.readParts(p[span.Start:span.Start+span.Length], piece, begin+span.Start); err != nil {
+				return read, err
+			}
+			read += span.Length
+			continue
+		}
+		if err != nil {
+			return read, err
+		}
+		n, err := file.ReadAt(p[span.Start:span.Start+span.Length], span.Offset)
+		read += n
+		if err != nil && err != io.EOF {
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+func (s *FileStorage) WriteAt(p []byte, piece int, begin int) (int, error) {
+	offset, err := checkBounds(s.info, piece, begin, len(p))
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	written := 0
+	for _, span := range MapSpan(s.info.Files, offset, len(p)) {
+		file, err := s.open(span.File, false)
+		if errors.Is(err, os.ErrNotExist) && s.skipped[span.File] {
+			slotOffset, _, err := s.partsSlot(piece, true)
+			if err != nil {
+				return written, err
+			}
+			n, err := s.parts.WriteAt(p[span.Start:span.Start+span.Length], slotOffset+int64(begin+span.Start))
+			written += n
+			if err != nil {
+				return written, err
+			}
+			continue
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			file, err = s.open(span.File, true)
+		}
+		if err != nil {
+			return written, err
+		}
+		n, err := file.WriteAt(p[span.Start:span.Start+span.Length], span.Offset)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (s *FileStorage) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, file := range append(s.handles, s.parts) {
+		if file == nil {
+			continue
+		}
+		if err := file.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FileStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var firstErr error
+	for i, file := range s.handles {
+		if file == nil {
+			continue
+		}
+		if err := file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		s.handles[i] = nil
+	}
+	if s.parts != nil {
+		if err := s.parts.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		s.parts = nil
+	}
+	return firstErr
+}
+
+// MemoryStorage keeps all torrent data in memory, mainly for tests
+type MemoryStorage struct {
+	info *metainfo.Metainfo
+	mu   sync.RWMutex
+	data []byte
+}
+
+func NewMemoryStorage(info *metainfo.Metainfo) *MemoryStorage {
+	return &MemoryStorage{info: info, data: make([]byte, info.Length)}
+}
+
+func (s *MemoryStorage) ReadAt(p []byte, piece int, begin int) (int, error) {
+	offset, err := checkBounds(s.info, piece, begin, len(p))
+	if err != nil {
+		return 0, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return copy(p, s.data[offset:]), nil
+}
+
+func (s *MemoryStorage) WriteAt(p []byte, piece int, begin int) (int, error) {
+	offset, err := checkBounds(s.info, piece, begin, len(p))
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return copy(s.data[offset:], p), nil
+}
+
+// Bytes returns the stored torrent data
+func (s *MemoryStorage) Bytes() []byte {
+	return s.data
+}
+
+func (s *MemoryStorage) Sync() error {
+	return nil
+}
+
+func (s *MemoryStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,144 @@
+//go:build linux || darwin
+
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/metainfo"
+)
+
+// MmapStorage maps every file of the torrent into memory, letting the kernel
+// page data in and out instead of going through read and write calls
+type MmapStorage struct {
+	info     *metainfo.Metainfo
+	mu       sync.RWMutex
+	mappings [][]byte
+	closed   bool
+}
+
+func init() {
+	Backends["mmap"] = OpenMmap
+}
+
+func OpenMmap(info *metainfo.Metainfo, outputPath string) (Storage, error) {
+	s, err := NewMmapStorage(info, outputPath)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func NewMmapStorage(info *metainfo.Metainfo, outputPath string) (*MmapStorage, error) {
+	s := &MmapStorage{info: info, mappings: make([][]byte, len(info.Files))}
+	for i, path := range Paths(info, outputPath) {
+		length := info.Files[i].Length
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			s.Close()
+			return nil, err
+		}
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		if err := file.Truncate(int64(length)); err != nil {
+			file.Close()
+			s.Close()
+			return nil, err
+		}
+		if length == 0 {
+			// Empty files cannot be mapped, but are still created
+			file.Close()
+			continue
+		}
+		mapping, err := syscall.Mmap(int(file.Fd()), 0, length, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+		file.Close()
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.mappings[i] = mapping
+	}
+	return s, nil
+}
+
+func (s *MmapStorage) ReadAt(p []byte, piece int, begin int) (int, error) {
+	offset, err := checkBounds(s.info, piece, begin, len(p))
+	if err != nil {
+		return 0, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return 0, os.ErrClosed
+	}
+	read := 0
+	for _, span := range MapSpan(s.info.Files, offset, len(p)) {
+		read += copy(p[span.Start:span.Start+span.Length], s.mappings[span.File][span.Offset:])
+	}
+	return read, nil
+}
+
+func (s *MmapStorage) WriteAt(p []byte, piece int, begin int) (int, error) {
+	offset, err := checkBounds(s.info, piece, begin, len(p))
+	if err != nil {
+		return 0, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return 0, os.ErrClosed
+	}
+	written := 0
+	for _, span := range MapSpan(s.info.Files, offset, len(p)) {
+		written += copy(s.mappings[span.File][span.Offset:span.Offset+int64(span.Length)], p[span.Start:span.Start+span.Length])
+	}
+	return written, nil
+}
+
+func (s *MmapStorage) Sync() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return os.ErrClosed
+	}
+	for _, mapping := range s.mappings {
+		if mapping == nil {
+			continue
+		}
+		if err := msync(mapping); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MmapStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	var firstErr error
+	for i, mapping := range s.mappings {
+		if mapping == nil {
+			continue
+		}
+		if err := syscall.Munmap(mapping); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		s.mappings[i] = nil
+	}
+	return firstErr
+}
+
+func msync(mapping []byte) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&mapping[0])), uintptr(len(mapping)), syscall.MS_SYNC)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
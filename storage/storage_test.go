@@ -0,0 +1,261 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/metainfo"
+	"github.com/codecrafters-io/bittorrent-starter-go/testutil"
+)
+
+func TestMapSpan(t *testing.T) {
+	// Files at [0,100), [100,100) (empty), [100,250) and [250,260)
+	files := []metainfo.FileEntry{
+		{Path: "a", Length: 100, Offset: 0},
+		{Path: "empty", Length: 0, Offset: 100},
+		{Path: "b", Length: 150, Offset: 100},
+		{Path: "c", Length: 10, Offset: 250},
+	}
+	tests := []struct {
+		name   string
+		offset int64
+		length int
+		want   []Span
+	}{
+		{"inside one file", 10, 20, []Span{{File: 0, Offset: 10, Start: 0, Length: 20}}},
+		{"ends at a file end", 50, 50, []Span{{File: 0, Offset: 50, Start: 0, Length: 50}}},
+		{"starts at a file start", 100, 10, []Span{{File: 2, Offset: 0, Start: 0, Length: 10}}},
+		{"across the empty file", 90, 20, []Span{
+			{File: 0, Offset: 90, Start: 0, Length: 10},
+			{File: 2, Offset: 0, Start: 10, Length: 10},
+		}},
+		{"every file", 0, 260, []Span{
+			{File: 0, Offset: 0, Start: 0, Length: 100},
+			{File: 2, Offset: 0, Start: 100, Length: 150},
+			{File: 3, Offset: 0, Start: 250, Length: 10},
+		}},
+		{"last byte", 259, 1, []Span{{File: 3, Offset: 9, Start: 0, Length: 1}}},
+		{"empty span", 100, 0, nil},
+		{"past the end", 260, 10, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := MapSpan(files, test.offset, test.length); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("MapSpan(%d, %d) = %+v, want %+v", test.offset, test.length, got, test.want)
+			}
+		})
+	}
+}
+
+// A torrent whose pieces straddle its files, including an empty one
+func newTestTorrent(t *testing.T) (*testutil.Torrent, *metainfo.Metainfo) {
+	t.Helper()
+	tor := testutil.NewTorrent("sample", 16<<10, 10000, 0, 30000, 9000)
+	info, err := tor.Metainfo("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tor, info
+}
+
+func TestBackendsReadAndWriteAcrossFiles(t *testing.T) {
+	tor, info := newTestTorrent(t)
+	for name, backend := range Backends {
+		t.Run(name, func(t *testing.T) {
+			output := filepath.Join(t.TempDir(), tor.Name)
+			store, err := backend(info, output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if selective, ok := store.(SelectiveStorage); ok {
+				if err := selective.CreateWantedFiles(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Write in blocks that do not line up with the file boundaries
+			const block = 3000
+			for piece := 0; piece < info.PieceCount(); piece++ {
+				data := tor.Piece(piece)
+				for begin := 0; begin < len(data); begin += block {
+					end := min(begin+block, len(data))
+					if n, err := store.WriteAt(data[begin:end], piece, begin); err != nil || n != end-begin {
+						t.Fatalf("WriteAt(piece %d, %d) = %d, %v", piece, begin, n, err)
+					}
+				}
+			}
+			for piece := 0; piece < info.PieceCount(); piece++ {
+				data := make([]byte, info.PieceSize(piece))
+				if n, err := store.ReadAt(data, piece, 0); err != nil || n != len(data) {
+					t.Fatalf("ReadAt(piece %d) = %d, %v", piece, n, err)
+				}
+				if !bytes.Equal(data, tor.Piece(piece)) {
+					t.Errorf("piece %d reads back differently", piece)
+				}
+			}
+			if _, err := store.ReadAt(make([]byte, 2), info.PieceCount()-1, info.PieceSize(info.PieceCount()-1)-1); err == nil {
+				t.Error("read past the end of the last piece succeeded")
+			}
+			if _, err := store.WriteAt(make([]byte, 1), info.PieceCount(), 0); err == nil {
+				t.Error("write to a piece out of range succeeded")
+			}
+			if err := store.Sync(); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if name == "memory" {
+				if !bytes.Equal(store.(*MemoryStorage).Bytes(), tor.Data) {
+					t.Error("memory storage holds different data")
+				}
+				return
+			}
+			if err := tor.Check(output); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestMmapStorageFailsAfterClose(t *testing.T) {
+	backend, ok := Backends["mmap"]
+	if !ok {
+		t.Skip("mmap storage is not available on this system")
+	}
+	_, info := newTestTorrent(t)
+	store, err := backend(info, filepath.Join(t.TempDir(), "sample"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.ReadAt(make([]byte, 10), 0, 0); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("ReadAt after Close: %v, want %v", err, os.ErrClosed)
+	}
+	if _, err := store.WriteAt(make([]byte, 10), 0, 0); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("WriteAt after Close: %v, want %v", err, os.ErrClosed)
+	}
+	if err := store.Sync(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Sync after Close: %v, want %v", err, os.ErrClosed)
+	}
+	if err := store.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
+
+func TestFileStorageReopensAfterClose(t *testing.T) {
+	tor, info := newTestTorrent(t)
+	output := filepath.Join(t.TempDir(), tor.Name)
+	store := NewFileStorage(info, output)
+	if _, err := store.WriteAt(tor.Piece(1), 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, info.PieceSize(1))
+	if _, err := store.ReadAt(data, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, tor.Piece(1)) {
+		t.Error("piece reads back differently after reopening")
+	}
+	store.Close()
+}
+
+func TestSkippedFileDataGoesToPartsFile(t *testing.T) {
+	tor, info := newTestTorrent(t)
+	output := filepath.Join(t.TempDir(), tor.Name)
+	paths := Paths(info, output)
+	store := NewFileStorage(info, output)
+	defer store.Close()
+	// Piece 0 spans the skipped first file and the wanted third; piece 2
+	// spans the third and the skipped last file
+	for _, file := range []int{0, 3} {
+		if err := store.SetSkipped(file, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for piece := 0; piece < info.PieceCount(); piece++ {
+		if _, err := store.WriteAt(tor.Piece(piece), piece, 0); err != nil {
+			t.Fatalf("WriteAt(piece %d): %v", piece, err)
+		}
+	}
+	for _, file := range []int{0, 3} {
+		if _, err := os.Stat(paths[file]); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("skipped file %s was created: %v", info.Files[file].Path, err)
+		}
+	}
+	if _, err := os.Stat(store.PartsPath()); err != nil {
+		t.Fatalf("no parts file: %v", err)
+	}
+	wanted := tor.Data[info.Files[2].Offset : info.Files[2].Offset+info.Files[2].Length]
+	if data, err := os.ReadFile(paths[2]); err != nil || !bytes.Equal(data, wanted) {
+		t.Errorf("wanted file holds %d bytes (%v), want its data", len(data), err)
+	}
+	for piece := 0; piece < info.PieceCount(); piece++ {
+		data := make([]byte, info.PieceSize(piece))
+		if _, err := store.ReadAt(data, piece, 0); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, tor.Piece(piece)) {
+			t.Errorf("piece %d reads back differently from the parts file", piece)
+		}
+	}
+
+	// Wanting the first file again moves its data out of the parts file
+	if err := store.SetSkipped(0, false); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(paths[0]); err != nil || !bytes.Equal(data, tor.Data[:info.Files[0].Length]) {
+		t.Errorf("unskipped file holds %d bytes (%v), want its data", len(data), err)
+	}
+	if _, err := os.Stat(paths[3]); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("file still skipped was created: %v", err)
+	}
+	data := make([]byte, info.PieceSize(0))
+	if _, err := store.ReadAt(data, 0, 0); err != nil || !bytes.Equal(data, tor.Piece(0)) {
+		t.Errorf("piece 0 reads back differently after unskipping (%v)", err)
+	}
+}
+
+func TestCreateWantedFilesMigratesPartsFromEarlierRun(t *testing.T) {
+	tor, info := newTestTorrent(t)
+	output := filepath.Join(t.TempDir(), tor.Name)
+	store := NewFileStorage(info, output)
+	if err := store.SetSkipped(0, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.WriteAt(tor.Piece(0), 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next run wants every file
+	store = NewFileStorage(info, output)
+	defer store.Close()
+	if err := store.CreateWantedFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(Paths(info, output)[0]); err != nil || !bytes.Equal(data, tor.Data[:info.Files[0].Length]) {
+		t.Errorf("file holds %d bytes (%v), want the data kept in the parts file", len(data), err)
+	}
+	for piece := 1; piece < info.PieceCount(); piece++ {
+		if _, err := store.WriteAt(tor.Piece(piece), piece, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tor.Check(output); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,244 @@
+package testutil
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/peer"
+)
+
+// Behavior scripts a fake peer. The zero value is a well-behaved seeder.
+// Block counts are per connection.
+type Behavior struct {
+	Missing         []int         // pieces left out of the bitfield
+	CorruptPieces   []int         // pieces served with a flipped byte
+	NoUnchoke       bool          // never unchoke
+	ChokeAfter      int           // choke after serving this many blocks
+	StallAfter      int           // stop answering after this many blocks
+	DisconnectAfter int           // drop the connection after this many blocks
+	Delay           time.Duration // wait before answering each request
+	ServeMetadata   bool          // answer ut_metadata requests (BEP 9)
+	CorruptMetadata bool          // serve the last metadata piece with a flipped byte
+}
+
+// Peer is a fake peer seeding a Torrent on loopback
+type Peer struct {
+	Torrent  *Torrent
+	Behavior Behavior
+	PeerID   [20]byte
+
+	listener net.Listener
+	mu       sync.Mutex
+	conns    map[net.Conn]bool
+	served   int
+}
+
+// ID the peer asks us to use for ut_metadata messages
+const fakeMetadataID = 3
+
+// Start a peer listening on a loopback port
+func NewPeer(torrent *Torrent, behavior Behavior) (*Peer, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	p := &Peer{Torrent: torrent, Behavior: behavior, listener: listener, conns: make(map[net.Conn]bool)}
+	copy(p.PeerID[:], "-TU0001-fakepeer0000")
+	go p.acceptLoop()
+	return p, nil
+}
+
+func (p *Peer) Addr() string {
+	return p.listener.Addr().String()
+}
+
+// Blocks served over all connections
+func (p *Peer) BlocksServed() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.served
+}
+
+// Stop listening and drop every connection
+func (p *Peer) Close() error {
+	err := p.listener.Close()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for conn := range p.conns {
+		conn.Close()
+	}
+	return err
+}
+
+func (p *Peer) acceptLoop() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		p.mu.Lock()
+		p.conns[conn] = true
+		p.mu.Unlock()
+		go func() {
+			p.serve(conn)
+			p.mu.Lock()
+			delete(p.conns, conn)
+			p.mu.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+var errStalled = errors.New("stalled")
+
+func (p *Peer) serve(conn net.Conn) error {
+	remote, err := peer.ReadHandshake(conn)
+	if err != nil {
+		return err
+	}
+	if remote.InfoHash != p.Torrent.InfoHashBytes() {
+		return peer.ErrInfoHashMismatch
+	}
+	local := &peer.Handshake{InfoHash: remote.InfoHash, PeerID: p.PeerID}
+	if p.Behavior.ServeMetadata {
+		local.Reserved[5] |= 0x10
+	}
+	if err := peer.WriteHandshake(conn, local); err != nil {
+		return err
+	}
+	bitfield := peer.NewBitfield(p.Torrent.PieceCount())
+	for piece := 0; piece < p.Torrent.PieceCount(); piece++ {
+		if !slices.Contains(p.Behavior.Missing, piece) {
+			bitfield.Set(piece)
+		}
+	}
+	if _, err := conn.Write(peer.EncodeMessage(peer.MsgBitfield, bitfield)); err != nil {
+		return err
+	}
+	blocks := 0
+	metadataID := 0 // the ID the other side wants ut_metadata messages sent with
+	for {
+		message, err := peer.ReadMessage(conn)
+		if err != nil {
+			return err
+		}
+		if message == nil {
+			continue
+		}
+		switch message.ID {
+		case peer.MsgInterested:
+			if !p.Behavior.NoUnchoke {
+				if _, err := conn.Write(peer.EncodeMessage(peer.MsgUnchoke, nil)); err != nil {
+					return err
+				}
+			}
+		case peer.MsgRequest:
+			if err := p.answerRequest(conn, message.Payload, blocks); err != nil {
+				return err
+			}
+			blocks++
+		case peer.MsgExtended:
+			if err := p.answerExtended(conn, message.Payload, &metadataID); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Serve one block request, applying the scripted misbehaviour. blocks is the
+// number of requests answered on the connection so far.
+func (p *Peer) answerRequest(conn net.Conn, payload []byte, blocks int) error {
+	b := p.Behavior
+	switch {
+	case b.DisconnectAfter > 0 && blocks >= b.DisconnectAfter:
+		return net.ErrClosed
+	case b.StallAfter > 0 && blocks >= b.StallAfter:
+		// Keep the connection open but never answer
+		io.Copy(io.Discard, conn)
+		return errStalled
+	case b.ChokeAfter > 0 && blocks >= b.ChokeAfter:
+		// Choke once, then ignore requests as a choking peer may
+		if blocks > b.ChokeAfter {
+			return nil
+		}
+		_, err := conn.Write(peer.EncodeMessage(peer.MsgChoke, nil))
+		return err
+	}
+	index, begin, length, err := peer.ParseRequest(payload)
+	if err != nil {
+		return err
+	}
+	if index >= p.Torrent.PieceCount() || slices.Contains(b.Missing, index) {
+		return errors.New("request for a piece we do not have")
+	}
+	data := p.Torrent.Piece(index)
+	if begin+length > len(data) {
+		return errors.New("request beyond the end of the piece")
+	}
+	time.Sleep(b.Delay)
+	block := append(append([]byte(nil), payload[:8]...), data[begin:begin+length]...)
+	if slices.Contains(b.CorruptPieces, index) {
+		block[8] ^= 0xff
+	}
+	if _, err := conn.Write(peer.EncodeMessage(peer.MsgPiece, block)); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.served++
+	p.mu.Unlock()
+	return nil
+}
+
+// Answer the extended handshake and ut_metadata requests
+func (p *Peer) answerExtended(conn net.Conn, payload []byte, metadataID *int) error {
+	if !p.Behavior.ServeMetadata || len(payload) == 0 {
+		return nil
+	}
+	metadata := p.Torrent.Metadata()
+	if payload[0] == peer.ExtendedHandshakeID {
+		remote, err := peer.ParseExtendedHandshake(payload)
+		if err != nil {
+			return err
+		}
+		*metadataID = remote.Extensions["ut_metadata"]
+		handshake, _, err := bencode.Encode(map[string]interface{}{
+			"m":             map[string]interface{}{"ut_metadata": fakeMetadataID},
+			"metadata_size": len(metadata),
+		})
+		if err != nil {
+			return err
+		}
+		_, err = conn.Write(peer.EncodeMessage(peer.MsgExtended, append([]byte{peer.ExtendedHandshakeID}, handshake...)))
+		return err
+	}
+	if payload[0] != fakeMetadataID || *metadataID == 0 {
+		return nil
+	}
+	request, _, err := bencode.Decode(string(payload[1:]))
+	if err != nil {
+		return err
+	}
+	dict, _ := request.(map[string]interface{})
+	piece, _ := dict["piece"].(int)
+	if piece < 0 || piece*peer.MetadataPieceSize >= len(metadata) {
+		return errors.New("metadata request out of range")
+	}
+	header, _, err := bencode.Encode(map[string]interface{}{"msg_type": 1, "piece": piece, "total_size": len(metadata)})
+	if err != nil {
+		return err
+	}
+	chunk := metadata[piece*peer.MetadataPieceSize : min((piece+1)*peer.MetadataPieceSize, len(metadata))]
+	if p.Behavior.CorruptMetadata && (piece+1)*peer.MetadataPieceSize >= len(metadata) {
+		chunk = bytes.Clone(chunk)
+		chunk[len(chunk)-1] ^= 0xff
+	}
+	response := append(append([]byte{byte(*metadataID)}, header...), chunk...)
+	_, err = conn.Write(peer.EncodeMessage(peer.MsgExtended, response))
+	return err
+}
@@ -0,0 +1,150 @@
+// Package testutil provides in-process stand-ins for the network side of a
+// download, all on loopback: a generated torrent, a tracker stub and peers
+// that can be scripted to misbehave. The peers speak plain TCP, so callers
+// should set peer.Transports to []string{"tcp"} to skip the uTP attempt.
+package testutil
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/metainfo"
+)
+
+// Torrent is a generated torrent with pseudo-random content. Single-file
+// torrents store their file at the output path; multi-file torrents store
+// file i at <output>/data/file<i>.
+type Torrent struct {
+	Name        string
+	PieceLength int
+	Files       []int // file lengths
+	Data        []byte
+	Info        map[string]interface{}
+	InfoHash    string   // hex
+	WebSeeds    []string // url-list written by Marshal
+}
+
+// Generate a torrent of files with the given lengths. The content depends only
+// on the arguments, so fixtures are the same from run to run.
+func NewTorrent(name string, pieceLength int, fileLengths ...int) *Torrent {
+	total := 0
+	for _, length := range fileLengths {
+		total += length
+	}
+	data := make([]byte, total)
+	rand.New(rand.NewSource(int64(total)*31 + int64(pieceLength))).Read(data)
+	var pieces []byte
+	for offset := 0; offset < total; offset += pieceLength {
+		hash := sha1.Sum(data[offset:min(offset+pieceLength, total)])
+		pieces = append(pieces, hash[:]...)
+	}
+	info := map[string]interface{}{"name": name, "piece length": pieceLength, "pieces": string(pieces)}
+	if len(fileLengths) == 1 {
+		info["length"] = total
+	} else {
+		files := make([]interface{}, len(fileLengths))
+		for i, length := range fileLengths {
+			files[i] = map[string]interface{}{"length": length, "path": []interface{}{"data", "file" + strconv.Itoa(i)}}
+		}
+		info["files"] = files
+	}
+	infoHash, err := metainfo.ComputeInfoHash(info)
+	if err != nil {
+		panic(err)
+	}
+	return &Torrent{Name: name, PieceLength: pieceLength, Files: fileLengths, Data: data, Info: info, InfoHash: infoHash}
+}
+
+func (t *Torrent) PieceCount() int {
+	return (len(t.Data) + t.PieceLength - 1) / t.PieceLength
+}
+
+func (t *Torrent) Piece(index int) []byte {
+	return t.Data[index*t.PieceLength : min((index+1)*t.PieceLength, len(t.Data))]
+}
+
+func (t *Torrent) InfoHashBytes() [20]byte {
+	var infoHash [20]byte
+	decoded, _ := hex.DecodeString(t.InfoHash)
+	copy(infoHash[:], decoded)
+	return infoHash
+}
+
+// The bencoded info dictionary, as exchanged by ut_metadata
+func (t *Torrent) Metadata() []byte {
+	encoded, _, err := bencode.Encode(t.Info)
+	if err != nil {
+		panic(err)
+	}
+	return []byte(encoded)
+}
+
+// Contents of a .torrent file announcing to the given URL, or to no tracker
+// when announce is empty
+func (t *Torrent) Marshal(announce string) []byte {
+	torrent := map[string]interface{}{"info": t.Info}
+	if announce != "" {
+		torrent["announce"] = announce
+	}
+	if len(t.WebSeeds) > 0 {
+		urlList := make([]interface{}, len(t.WebSeeds))
+		for i, seedURL := range t.WebSeeds {
+			urlList[i] = seedURL
+		}
+		torrent["url-list"] = urlList
+	}
+	encoded, _, err := bencode.Encode(torrent)
+	if err != nil {
+		panic(err)
+	}
+	return []byte(encoded)
+}
+
+func (t *Torrent) WriteFile(path string, announce string) error {
+	return os.WriteFile(path, t.Marshal(announce), 0o644)
+}
+
+func (t *Torrent) Metainfo(announce string) (*metainfo.Metainfo, error) {
+	return metainfo.FromInfo(announce, t.Info)
+}
+
+// A magnet link for the torrent, naming the tracker if one is given
+func (t *Torrent) Magnet(announce string) string {
+	query := url.Values{"dn": {t.Name}}
+	if announce != "" {
+		query.Set("tr", announce)
+	}
+	return "magnet:?xt=urn:btih:" + t.InfoHash + "&" + query.Encode()
+}
+
+// Compare a downloaded torrent at outputPath with the generated content
+func (t *Torrent) Check(outputPath string) error {
+	var data []byte
+	if len(t.Files) == 1 {
+		content, err := os.ReadFile(outputPath)
+		if err != nil {
+			return err
+		}
+		data = content
+	} else {
+		for i := range t.Files {
+			content, err := os.ReadFile(filepath.Join(outputPath, "data", "file"+strconv.Itoa(i)))
+			if err != nil {
+				return err
+			}
+			data = append(data, content...)
+		}
+	}
+	if !bytes.Equal(data, t.Data) {
+		return fmt.Errorf("downloaded data differs from the torrent (%d bytes, want %d)", len(data), len(t.Data))
+	}
+	return nil
+}
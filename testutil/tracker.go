@@ -0,0 +1,98 @@
+package testutil
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/bencode"
+)
+
+// Tracker is an HTTP tracker stub answering every announce with a fixed list
+// of peers, or with a failure reason once one is set. It records the
+// announces it receives.
+type Tracker struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	peers    []string
+	failure  string
+	requests []url.Values
+}
+
+// Start a tracker handing out the given host:port addresses
+func NewTracker(peers ...string) *Tracker {
+	t := &Tracker{peers: peers}
+	t.Server = httptest.NewServer(http.HandlerFunc(t.serve))
+	return t
+}
+
+func (t *Tracker) AnnounceURL() string {
+	return t.URL + "/announce"
+}
+
+func (t *Tracker) SetPeers(peers ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.peers = peers
+}
+
+// Answer announces with a failure reason; empty to answer normally again
+func (t *Tracker) SetFailure(reason string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.failure = reason
+}
+
+// Query parameters of every announce so far
+func (t *Tracker) Requests() []url.Values {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]url.Values(nil), t.requests...)
+}
+
+// Events of the announces so far, "" for regular announces
+func (t *Tracker) Events() []string {
+	var events []string
+	for _, request := range t.Requests() {
+		events = append(events, request.Get("event"))
+	}
+	return events
+}
+
+func (t *Tracker) serve(w http.ResponseWriter, r *http.Request) {
+	t.mu.Lock()
+	t.requests = append(t.requests, r.URL.Query())
+	peers, failure := t.peers, t.failure
+	t.mu.Unlock()
+	response := map[string]interface{}{"interval": 60}
+	if failure != "" {
+		response = map[string]interface{}{"failure reason": failure}
+	} else {
+		var compact []byte
+		for _, address := range peers {
+			host, port, err := net.SplitHostPort(address)
+			if err != nil {
+				continue
+			}
+			portNumber, _ := strconv.Atoi(port)
+			ip := net.ParseIP(host).To4()
+			if ip == nil {
+				continue
+			}
+			compact = binary.BigEndian.AppendUint16(append(compact, ip...), uint16(portNumber))
+		}
+		response["peers"] = string(compact)
+	}
+	encoded, _, err := bencode.Encode(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, encoded)
+}
@@ -0,0 +1,108 @@
+package testutil
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// WebSeed is an HTTP server holding a torrent's files, for BEP 19 web seed
+// downloads. It answers range requests, and can be told to fail requests,
+// serve corrupt data or ignore ranges.
+type WebSeed struct {
+	*httptest.Server
+	torrent *Torrent
+
+	mu          sync.Mutex
+	failNext    int
+	corrupt     bool
+	ignoreRange bool
+	requests    int
+}
+
+func NewWebSeed(torrent *Torrent) *WebSeed {
+	w := &WebSeed{torrent: torrent}
+	w.Server = httptest.NewServer(http.HandlerFunc(w.serve))
+	return w
+}
+
+// The url-list entry for the seed: the directory holding the torrent's file,
+// or holding the directory of a multi-file torrent
+func (w *WebSeed) SeedURL() string {
+	return w.URL + "/"
+}
+
+// Answer the next n requests with 503 Service Unavailable
+func (w *WebSeed) FailNext(n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.failNext = n
+}
+
+// Flip the first byte of every file served
+func (w *WebSeed) SetCorrupt(corrupt bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.corrupt = corrupt
+}
+
+// Send whole files with 200 OK instead of the ranges asked for
+func (w *WebSeed) SetIgnoreRange(ignore bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.ignoreRange = ignore
+}
+
+// Number of requests received
+func (w *WebSeed) Requests() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.requests
+}
+
+// Content of the file at a URL path, if the torrent has one there
+func (w *WebSeed) file(path string) ([]byte, bool) {
+	t := w.torrent
+	if len(t.Files) == 1 {
+		return t.Data, path == "/"+t.Name
+	}
+	offset := 0
+	for i, length := range t.Files {
+		if path == "/"+t.Name+"/data/file"+strconv.Itoa(i) {
+			return t.Data[offset : offset+length], true
+		}
+		offset += length
+	}
+	return nil, false
+}
+
+func (w *WebSeed) serve(rw http.ResponseWriter, r *http.Request) {
+	w.mu.Lock()
+	w.requests++
+	fail := w.failNext > 0
+	if fail {
+		w.failNext--
+	}
+	corrupt, ignoreRange := w.corrupt, w.ignoreRange
+	w.mu.Unlock()
+	if fail {
+		http.Error(rw, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	data, ok := w.file(r.URL.Path)
+	if !ok {
+		http.NotFound(rw, r)
+		return
+	}
+	if corrupt && len(data) > 0 {
+		data = bytes.Clone(data)
+		data[0] ^= 0xff
+	}
+	if ignoreRange {
+		r.Header.Del("Range")
+	}
+	http.ServeContent(rw, r, "", time.Time{}, bytes.NewReader(data))
+}
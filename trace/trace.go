@@ -0,0 +1,141 @@
+// Package trace records what goes over the wire: handshakes and messages on
+// each peer connection and requests to trackers, one JSON object per line.
+// Recording is off until Enable is called; a recorded trace can be loaded
+// back with Load and replayed through the peer wire code.
+package trace
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Kinds of events
+const (
+	Handshake       = "handshake"
+	Message         = "message"
+	TrackerRequest  = "tracker_request"
+	TrackerResponse = "tracker_response"
+)
+
+// Directions of an event, seen from this client
+const (
+	In  = "in"
+	Out = "out"
+)
+
+// One recorded event. Data holds the bytes as they went over the wire, with
+// the block data of piece messages left out: Length keeps the full size and
+// Truncated is set.
+type Event struct {
+	Time      time.Time `json:"time"`
+	Conn      string    `json:"conn"` // peer address or tracker URL
+	Dir       string    `json:"dir"`
+	Kind      string    `json:"kind"`
+	Name      string    `json:"name,omitempty"`    // message name
+	Summary   string    `json:"summary,omitempty"` // decoded payload, for reading
+	Length    int       `json:"length,omitempty"`
+	Data      []byte    `json:"data,omitempty"`
+	Truncated bool      `json:"truncated,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Recorder writes events to a JSONL stream. It is safe for concurrent use.
+type Recorder struct {
+	mu     sync.Mutex
+	writer io.Writer
+	closer io.Closer
+	err    error
+}
+
+func NewRecorder(w io.Writer) *Recorder {
+	r := &Recorder{writer: w}
+	if closer, ok := w.(io.Closer); ok {
+		r.closer = closer
+	}
+	return r
+}
+
+// Create a recorder appending to the file at path
+func Create(path string) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open trace file: %v", err)
+	}
+	return NewRecorder(file), nil
+}
+
+// Write one event. After a write error further events are dropped.
+func (r *Recorder) Record(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+	_, r.err = r.writer.Write(append(line, '\n'))
+}
+
+func (r *Recorder) Close() error {
+	if r.closer == nil {
+		return nil
+	}
+	return r.closer.Close()
+}
+
+var active atomic.Pointer[Recorder]
+
+// Send events recorded from now on to r, or stop recording when r is nil
+func Enable(r *Recorder) {
+	active.Store(r)
+}
+
+func Enabled() bool {
+	return active.Load() != nil
+}
+
+// Record an event with the active recorder, if any
+func Record(event Event) {
+	if r := active.Load(); r != nil {
+		r.Record(event)
+	}
+}
+
+// Read the events of a trace
+func Load(r io.Reader) ([]Event, error) {
+	var events []Event
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, fmt.Errorf("trace line %d: %v", line, err)
+		}
+		events = append(events, event)
+	}
+	return events, scanner.Err()
+}
+
+// Read the events of a trace file
+func LoadFile(path string) ([]Event, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return Load(file)
+}
@@ -0,0 +1,391 @@
+package tracker
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/metainfo"
+)
+
+var (
+	ErrNotAllowed = errors.New("torrent not allowed on this tracker")
+
+	// Peers returned when the announce does not ask for a number, and the most
+	// that will be returned
+	DefaultNumWant = 50
+	MaxNumWant     = 200
+)
+
+// An announce as received by the server, over HTTP or UDP
+type Announcement struct {
+	InfoHash   [20]byte
+	PeerID     [20]byte
+	IP         net.IP
+	Port       int
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      string
+	NumWant    int // 0 for DefaultNumWant
+}
+
+type SwarmPeer struct {
+	PeerID [20]byte
+	IP     net.IP
+	Port   int
+}
+
+type AnnounceResult struct {
+	Interval    time.Duration
+	MinInterval time.Duration
+	Complete    int // seeders
+	Incomplete  int // leechers
+	Peers       []SwarmPeer
+}
+
+type ScrapeResult struct {
+	Complete   int
+	Downloaded int // completed events seen
+	Incomplete int
+}
+
+type swarmPeer struct {
+	SwarmPeer
+	left     int64
+	lastSeen time.Time
+}
+
+type swarm struct {
+	peers      map[string]*swarmPeer // by ip:port
+	downloaded int
+}
+
+// Server is an in-memory tracker. Swarms are created on first announce and
+// peers that stop announcing are forgotten after PeerTTL. When an allowlist is
+// set, only listed info hashes are tracked.
+type Server struct {
+	Interval    time.Duration
+	MinInterval time.Duration
+	PeerTTL     time.Duration
+
+	mu      sync.Mutex
+	swarms  map[[20]byte]*swarm
+	allowed map[[20]byte]bool // nil for an open tracker
+	now     func() time.Time
+}
+
+func NewServer() *Server {
+	return &Server{
+		Interval:    15 * time.Minute,
+		MinInterval: 5 * time.Minute,
+		PeerTTL:     45 * time.Minute,
+		swarms:      make(map[[20]byte]*swarm),
+		now:         time.Now,
+	}
+}
+
+// Add an info hash to the allowlist, turning the tracker into a closed one
+func (s *Server) Allow(infoHash [20]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.allowed == nil {
+		s.allowed = make(map[[20]byte]bool)
+	}
+	s.allowed[infoHash] = true
+}
+
+// Allow the torrent in a .torrent file, or every .torrent file in a directory.
+// Returns the number of torrents allowed; a directory without any is an error,
+// since allowing nothing would leave the tracker open.
+func (s *Server) AllowTorrents(path string) (int, error) {
+	paths := []string{path}
+	if stat, err := os.Stat(path); err != nil {
+		return 0, err
+	} else if stat.IsDir() {
+		if paths, err = filepath.Glob(filepath.Join(path, "*.torrent")); err != nil {
+			return 0, err
+		}
+		if len(paths) == 0 {
+			return 0, fmt.Errorf("no .torrent files in %s", path)
+		}
+	}
+	for _, path := range paths {
+		info, err := metainfo.Load(path)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %v", path, err)
+		}
+		infoHash, err := decodeInfoHash(info.InfoHash)
+		if err != nil {
+			return 0, err
+		}
+		s.Allow(infoHash)
+	}
+	return len(paths), nil
+}
+
+func decodeInfoHash(hexHash string) ([20]byte, error) {
+	var infoHash [20]byte
+	decoded, err := hex.DecodeString(hexHash)
+	if err != nil || len(decoded) != len(infoHash) {
+		return infoHash, fmt.Errorf("invalid info hash: %s", hexHash)
+	}
+	copy(infoHash[:], decoded)
+	return infoHash, nil
+}
+
+func (s *Server) allowedLocked(infoHash [20]byte) bool {
+	return s.allowed == nil || s.allowed[infoHash]
+}
+
+// Drop peers of a swarm not seen within PeerTTL. Callers hold s.mu.
+func (s *Server) expireLocked(sw *swarm, now time.Time) {
+	for key, p := range sw.peers {
+		if now.Sub(p.lastSeen) > s.PeerTTL {
+			delete(sw.peers, key)
+		}
+	}
+}
+
+// Drop expired peers and empty swarms everywhere
+func (s *Server) Sweep() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	for infoHash, sw := range s.swarms {
+		s.expireLocked(sw, now)
+		if len(sw.peers) == 0 && sw.downloaded == 0 {
+			delete(s.swarms, infoHash)
+		}
+	}
+}
+
+func countPeers(sw *swarm) (int, int) {
+	var complete, incomplete int
+	for _, p := range sw.peers {
+		if p.left == 0 {
+			complete++
+		} else {
+			incomplete++
+		}
+	}
+	return complete, incomplete
+}
+
+// Record an announce and pick peers for the announcing peer
+func (s *Server) Announce(a Announcement) (*AnnounceResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.allowedLocked(a.InfoHash) {
+		return nil, ErrNotAllowed
+	}
+	if a.Port <= 0 || a.Port > 65535 {
+		return nil, errors.New("invalid port")
+	}
+	now := s.now()
+	sw := s.swarms[a.InfoHash]
+	if sw == nil {
+		sw = &swarm{peers: make(map[string]*swarmPeer)}
+		s.swarms[a.InfoHash] = sw
+	}
+	s.expireLocked(sw, now)
+	if ip4 := a.IP.To4(); ip4 != nil {
+		a.IP = ip4
+	}
+	key := net.JoinHostPort(a.IP.String(), strconv.Itoa(a.Port))
+	if a.Event == EventStopped {
+		delete(sw.peers, key)
+	} else {
+		if a.Event == EventCompleted {
+			sw.downloaded++
+		}
+		sw.peers[key] = &swarmPeer{SwarmPeer: SwarmPeer{PeerID: a.PeerID, IP: a.IP, Port: a.Port}, left: a.Left, lastSeen: now}
+	}
+	result := &AnnounceResult{Interval: s.Interval, MinInterval: s.MinInterval}
+	result.Complete, result.Incomplete = countPeers(sw)
+	if a.Event == EventStopped {
+		return result, nil
+	}
+	numWant := a.NumWant
+	if numWant <= 0 {
+		numWant = DefaultNumWant
+	}
+	numWant = min(numWant, MaxNumWant)
+	for k, p := range sw.peers {
+		if k == key || (a.Left == 0 && p.left == 0) {
+			// Seeders have no use for other seeders
+			continue
+		}
+		result.Peers = append(result.Peers, p.SwarmPeer)
+	}
+	rand.Shuffle(len(result.Peers), func(i, j int) {
+		result.Peers[i], result.Peers[j] = result.Peers[j], result.Peers[i]
+	})
+	if len(result.Peers) > numWant {
+		result.Peers = result.Peers[:numWant]
+	}
+	return result, nil
+}
+
+// Report swarm sizes; with no info hashes, every tracked swarm
+func (s *Server) Scrape(infoHashes [][20]byte) map[[20]byte]ScrapeResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if len(infoHashes) == 0 {
+		for infoHash := range s.swarms {
+			infoHashes = append(infoHashes, infoHash)
+		}
+	}
+	results := make(map[[20]byte]ScrapeResult, len(infoHashes))
+	for _, infoHash := range infoHashes {
+		if !s.allowedLocked(infoHash) {
+			continue
+		}
+		var result ScrapeResult
+		if sw := s.swarms[infoHash]; sw != nil {
+			s.expireLocked(sw, now)
+			result.Complete, result.Incomplete = countPeers(sw)
+			result.Downloaded = sw.downloaded
+		}
+		results[infoHash] = result
+	}
+	return results
+}
+
+// Handler serving /announce and /scrape
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/announce", s.serveAnnounce)
+	mux.HandleFunc("/scrape", s.serveScrape)
+	return mux
+}
+
+func writeBencoded(w http.ResponseWriter, response map[string]interface{}) {
+	encoded, _, err := bencode.Encode(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(encoded))
+}
+
+// Trackers report errors inside a successful response
+func writeFailure(w http.ResponseWriter, reason string) {
+	writeBencoded(w, map[string]interface{}{"failure reason": reason})
+}
+
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+func (s *Server) serveAnnounce(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	a := Announcement{IP: remoteIP(r), Event: query.Get("event")}
+	if len(query.Get("info_hash")) != 20 {
+		writeFailure(w, "invalid info_hash")
+		return
+	}
+	copy(a.InfoHash[:], query.Get("info_hash"))
+	if len(query.Get("peer_id")) != 20 {
+		writeFailure(w, "invalid peer_id")
+		return
+	}
+	copy(a.PeerID[:], query.Get("peer_id"))
+	var err error
+	if a.Port, err = strconv.Atoi(query.Get("port")); err != nil {
+		writeFailure(w, "invalid port")
+		return
+	}
+	for name, target := range map[string]*int64{"uploaded": &a.Uploaded, "downloaded": &a.Downloaded, "left": &a.Left} {
+		if value := query.Get(name); value != "" {
+			if *target, err = strconv.ParseInt(value, 10, 64); err != nil {
+				writeFailure(w, "invalid "+name)
+				return
+			}
+		}
+	}
+	if value := query.Get("numwant"); value != "" {
+		a.NumWant, _ = strconv.Atoi(value)
+	}
+	if a.IP == nil {
+		writeFailure(w, "unknown peer address")
+		return
+	}
+	result, err := s.Announce(a)
+	log := logger.With("info_hash", fmt.Sprintf("%x", a.InfoHash), "peer", net.JoinHostPort(a.IP.String(), strconv.Itoa(a.Port)), "event", a.Event)
+	if err != nil {
+		log.Debug("announce refused", "error", err)
+		writeFailure(w, err.Error())
+		return
+	}
+	log.Debug("announce", "left", a.Left, "peers", len(result.Peers))
+	response := map[string]interface{}{
+		"interval":     int(result.Interval / time.Second),
+		"min interval": int(result.MinInterval / time.Second),
+		"complete":     result.Complete,
+		"incomplete":   result.Incomplete,
+	}
+	if query.Get("compact") == "1" {
+		var peers, peers6 []byte
+		for _, p := range result.Peers {
+			if ip4 := p.IP.To4(); ip4 != nil {
+				peers = binary.BigEndian.AppendUint16(append(peers, ip4...), uint16(p.Port))
+			} else {
+				peers6 = binary.BigEndian.AppendUint16(append(peers6, p.IP.To16()...), uint16(p.Port))
+			}
+		}
+		response["peers"] = string(peers)
+		if len(peers6) > 0 {
+			response["peers6"] = string(peers6)
+		}
+	} else {
+		peers := []interface{}{}
+		for _, p := range result.Peers {
+			peer := map[string]interface{}{"ip": p.IP.String(), "port": p.Port}
+			if query.Get("no_peer_id") != "1" {
+				peer["peer id"] = string(p.PeerID[:])
+			}
+			peers = append(peers, peer)
+		}
+		response["peers"] = peers
+	}
+	writeBencoded(w, response)
+}
+
+func (s *Server) serveScrape(w http.ResponseWriter, r *http.Request) {
+	var infoHashes [][20]byte
+	for _, value := range r.URL.Query()["info_hash"] {
+		if len(value) != 20 {
+			writeFailure(w, "invalid info_hash")
+			return
+		}
+		var infoHash [20]byte
+		copy(infoHash[:], value)
+		infoHashes = append(infoHashes, infoHash)
+	}
+	files := make(map[string]interface{})
+	for infoHash, result := range s.Scrape(infoHashes) {
+		files[string(infoHash[:])] = map[string]interface{}{
+			"complete":   result.Complete,
+			"downloaded": result.Downloaded,
+			"incomplete": result.Incomplete,
+		}
+	}
+	writeBencoded(w, map[string]interface{}{"files": files})
+}
@@ -0,0 +1,262 @@
+package tracker
+
+import (
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/testutil"
+)
+
+var (
+	testHash  = strings.Repeat("h", 20)
+	otherHash = strings.Repeat("o", 20)
+)
+
+// A tracker over HTTP whose clock only moves when the test advances it
+func startServer(t *testing.T) (*Server, *httptest.Server, *time.Time) {
+	t.Helper()
+	s := NewServer()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	server := httptest.NewServer(s.Handler())
+	t.Cleanup(server.Close)
+	return s, server, &now
+}
+
+// GET a tracker endpoint and decode the bencoded dictionary it answers with
+func get(t *testing.T, server *httptest.Server, path string, query url.Values) map[string]interface{} {
+	t.Helper()
+	resp, err := http.Get(server.URL + path + "?" + query.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, _, err := bencode.Decode(string(body))
+	if err != nil {
+		t.Fatalf("decoding %q: %v", body, err)
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		t.Fatalf("response %q is not a dictionary", body)
+	}
+	return dict
+}
+
+// Announce a peer on 127.0.0.1 at port, with extra query parameters
+func httpAnnounce(t *testing.T, server *httptest.Server, infoHash string, port int, left int, extra ...string) map[string]interface{} {
+	t.Helper()
+	query := url.Values{
+		"info_hash": {infoHash},
+		"peer_id":   {"-TS0001-" + strings.Repeat(strconv.Itoa(port%10), 12)},
+		"port":      {strconv.Itoa(port)},
+		"left":      {strconv.Itoa(left)},
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		query.Set(extra[i], extra[i+1])
+	}
+	return get(t, server, "/announce", query)
+}
+
+func sortedPeers(peers []string) []string {
+	sort.Strings(peers)
+	return peers
+}
+
+func TestAnnounceCompactAndNonCompact(t *testing.T) {
+	_, server, _ := startServer(t)
+	httpAnnounce(t, server, testHash, 7001, 0)
+	httpAnnounce(t, server, testHash, 7002, 100)
+
+	response := httpAnnounce(t, server, testHash, 7003, 100, "compact", "1")
+	if response["complete"] != 1 || response["incomplete"] != 2 {
+		t.Errorf("complete %v, incomplete %v, want 1 and 2", response["complete"], response["incomplete"])
+	}
+	if response["interval"] != 900 || response["min interval"] != 300 {
+		t.Errorf("interval %v, min interval %v", response["interval"], response["min interval"])
+	}
+	compact, ok := response["peers"].(string)
+	if !ok {
+		t.Fatalf("compact peers are %T", response["peers"])
+	}
+	if got, want := sortedPeers(ParsePeers(compact)), []string{"127.0.0.1:7001", "127.0.0.1:7002"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("compact peers %v, want %v", got, want)
+	}
+
+	response = httpAnnounce(t, server, testHash, 7003, 100)
+	list, ok := response["peers"].([]interface{})
+	if !ok || len(list) != 2 {
+		t.Fatalf("non-compact peers %v", response["peers"])
+	}
+	var addresses []string
+	for _, entry := range list {
+		p := entry.(map[string]interface{})
+		addresses = append(addresses, p["ip"].(string)+":"+strconv.Itoa(p["port"].(int)))
+		if id, _ := p["peer id"].(string); len(id) != 20 || !strings.HasPrefix(id, "-TS0001-") {
+			t.Errorf("peer id %q", id)
+		}
+	}
+	if want := []string{"127.0.0.1:7001", "127.0.0.1:7002"}; !reflect.DeepEqual(sortedPeers(addresses), want) {
+		t.Errorf("non-compact peers %v, want %v", addresses, want)
+	}
+
+	response = httpAnnounce(t, server, testHash, 7003, 100, "no_peer_id", "1")
+	for _, entry := range response["peers"].([]interface{}) {
+		if _, ok := entry.(map[string]interface{})["peer id"]; ok {
+			t.Error("peer id sent despite no_peer_id")
+		}
+	}
+
+	// A seeder only hears about leechers
+	response = httpAnnounce(t, server, testHash, 7001, 0, "compact", "1")
+	if got := ParsePeers(response["peers"].(string)); len(got) != 2 {
+		t.Errorf("seeder got peers %v, want the two leechers", got)
+	}
+	response = httpAnnounce(t, server, testHash, 7004, 0, "compact", "1")
+	for _, address := range ParsePeers(response["peers"].(string)) {
+		if address == "127.0.0.1:7001" {
+			t.Error("seeder was sent another seeder")
+		}
+	}
+}
+
+func TestAnnounceNumWant(t *testing.T) {
+	_, server, _ := startServer(t)
+	for port := 7000; port < 7010; port++ {
+		httpAnnounce(t, server, testHash, port, 100)
+	}
+	for numWant, want := range map[string]int{"3": 3, "0": 9, "": 9, "100": 9} {
+		response := httpAnnounce(t, server, testHash, 7000, 100, "compact", "1", "numwant", numWant)
+		if got := len(ParsePeers(response["peers"].(string))); got != want {
+			t.Errorf("numwant %q returned %d peers, want %d", numWant, got, want)
+		}
+	}
+	previous := DefaultNumWant
+	DefaultNumWant = 4
+	defer func() { DefaultNumWant = previous }()
+	response := httpAnnounce(t, server, testHash, 7000, 100, "compact", "1")
+	if got := len(ParsePeers(response["peers"].(string))); got != 4 {
+		t.Errorf("announce without numwant returned %d peers, want %d", got, 4)
+	}
+}
+
+func TestAnnounceExpiresSilentPeers(t *testing.T) {
+	s, server, now := startServer(t)
+	httpAnnounce(t, server, testHash, 7001, 100)
+	*now = now.Add(s.PeerTTL / 2)
+	httpAnnounce(t, server, testHash, 7002, 100)
+	*now = now.Add(s.PeerTTL/2 + time.Second)
+	// 7001 has been silent for longer than PeerTTL, 7002 has not
+	response := httpAnnounce(t, server, testHash, 7003, 100, "compact", "1")
+	if got, want := ParsePeers(response["peers"].(string)), []string{"127.0.0.1:7002"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("peers %v, want %v", got, want)
+	}
+	if response["incomplete"] != 2 {
+		t.Errorf("incomplete %v, want 2", response["incomplete"])
+	}
+
+	// Stopping leaves the swarm at once, and Sweep drops swarms left empty
+	httpAnnounce(t, server, testHash, 7002, 100, "event", EventStopped)
+	httpAnnounce(t, server, testHash, 7003, 100, "event", EventStopped)
+	s.Sweep()
+	if len(s.swarms) != 0 {
+		t.Errorf("%d swarms left after every peer stopped", len(s.swarms))
+	}
+}
+
+func TestAnnounceRejectsBadRequests(t *testing.T) {
+	_, server, _ := startServer(t)
+	valid := url.Values{"info_hash": {testHash}, "peer_id": {strings.Repeat("p", 20)}, "port": {"7001"}}
+	for name, change := range map[string][2]string{
+		"info_hash": {"info_hash", "short"},
+		"peer_id":   {"peer_id", "short"},
+		"port":      {"port", "x"},
+		"range":     {"port", "70000"},
+		"left":      {"left", "-x"},
+	} {
+		query := url.Values{}
+		for k, v := range valid {
+			query[k] = v
+		}
+		query.Set(change[0], change[1])
+		if response := get(t, server, "/announce", query); response["failure reason"] == nil {
+			t.Errorf("%s: announce accepted: %v", name, response)
+		}
+	}
+}
+
+func TestScrape(t *testing.T) {
+	_, server, _ := startServer(t)
+	httpAnnounce(t, server, testHash, 7001, 0)
+	httpAnnounce(t, server, testHash, 7002, 100)
+	httpAnnounce(t, server, testHash, 7002, 0, "event", EventCompleted)
+	httpAnnounce(t, server, otherHash, 7003, 100)
+
+	files := get(t, server, "/scrape", url.Values{"info_hash": {testHash}})["files"].(map[string]interface{})
+	want := map[string]interface{}{"complete": 2, "downloaded": 1, "incomplete": 0}
+	if len(files) != 1 || !reflect.DeepEqual(files[testHash], want) {
+		t.Errorf("scrape of one torrent = %v, want %v", files, want)
+	}
+	files = get(t, server, "/scrape", nil)["files"].(map[string]interface{})
+	if len(files) != 2 || !reflect.DeepEqual(files[otherHash], map[string]interface{}{"complete": 0, "downloaded": 0, "incomplete": 1}) {
+		t.Errorf("scrape of every torrent = %v", files)
+	}
+	if response := get(t, server, "/scrape", url.Values{"info_hash": {"short"}}); response["failure reason"] == nil {
+		t.Errorf("scrape of an invalid info hash = %v", response)
+	}
+}
+
+func TestAllowlistRejectsOtherTorrents(t *testing.T) {
+	s, server, _ := startServer(t)
+	dir := t.TempDir()
+	tor := testutil.NewTorrent("allowed.bin", 16<<10, 20<<10)
+	if err := tor.WriteFile(filepath.Join(dir, "allowed.torrent"), server.URL+"/announce"); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := s.AllowTorrents(dir); err != nil || count != 1 {
+		t.Fatalf("AllowTorrents = %d, %v", count, err)
+	}
+	infoHash := tor.InfoHashBytes()
+	allowed := string(infoHash[:])
+
+	if response := httpAnnounce(t, server, allowed, 7001, 100); response["failure reason"] != nil {
+		t.Errorf("allowed torrent refused: %v", response["failure reason"])
+	}
+	if response := httpAnnounce(t, server, testHash, 7001, 100); response["failure reason"] != ErrNotAllowed.Error() {
+		t.Errorf("failure reason %v, want %q", response["failure reason"], ErrNotAllowed)
+	}
+	files := get(t, server, "/scrape", url.Values{"info_hash": {allowed, testHash}})["files"].(map[string]interface{})
+	if _, ok := files[testHash]; ok || len(files) != 1 {
+		t.Errorf("scrape reported torrents outside the allowlist: %v", files)
+	}
+}
+
+func TestAllowTorrentsRefusesEmptyDirectory(t *testing.T) {
+	s, server, _ := startServer(t)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte(hex.EncodeToString([]byte(testHash))), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := s.AllowTorrents(dir); err == nil {
+		t.Fatalf("allowed %d torrents from a directory without any", count)
+	}
+	// The tracker is still open, and the caller knows it
+	if response := httpAnnounce(t, server, testHash, 7001, 100); response["failure reason"] != nil {
+		t.Errorf("announce refused: %v", response["failure reason"])
+	}
+}
@@ -0,0 +1,163 @@
+// Package tracker announces torrents to HTTP trackers and runs an in-memory
+// tracker serving HTTP and UDP announces.
+package tracker
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/logging"
+	"github.com/codecrafters-io/bittorrent-starter-go/trace"
+)
+
+// How long a single announce may take
+var Timeout = 15 * time.Second
+
+// Announce events; regular announces carry no event
+const (
+	EventStarted   = "started"
+	EventCompleted = "completed"
+	EventStopped   = "stopped"
+)
+
+// An announce for one torrent, given by its hex info hash
+type Request struct {
+	InfoHash   string
+	PeerID     [20]byte
+	Port       int
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      string
+}
+
+// Announce a torrent that has nothing yet and return the addresses of the
+// peers the tracker knows about
+func Query(ctx context.Context, trackerURL string, infoHash string, peerID [20]byte, port int, fileLength int) ([]string, error) {
+	return Announce(ctx, trackerURL, Request{InfoHash: infoHash, PeerID: peerID, Port: port, Left: int64(fileLength)})
+}
+
+var logger = logging.For(logging.Tracker)
+
+// Send an announce and return the addresses of the peers the tracker knows
+// about. The request is abandoned after Timeout or when ctx is done.
+func Announce(ctx context.Context, trackerURL string, request Request) ([]string, error) {
+	start := time.Now()
+	peers, err := announce(ctx, trackerURL, request)
+	log := logger.With("url", trackerURL, "info_hash", request.InfoHash, "event", request.Event, "duration", time.Since(start))
+	if err != nil {
+		log.Debug("announce failed", "error", err)
+	} else {
+		log.Debug("announced", "peers", len(peers))
+	}
+	return peers, err
+}
+
+func announce(ctx context.Context, trackerURL string, request Request) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, Timeout)
+	defer cancel()
+	encodedInfoHash, err := ConvertToPercentEncoded(request.InfoHash)
+	if err != nil {
+		return nil, err
+	}
+	// Construct query parameters
+	queryParams := url.Values{}
+	queryParams.Set("peer_id", string(request.PeerID[:]))
+	queryParams.Set("port", strconv.Itoa(request.Port))
+	queryParams.Set("uploaded", strconv.FormatInt(request.Uploaded, 10))
+	queryParams.Set("downloaded", strconv.FormatInt(request.Downloaded, 10))
+	queryParams.Set("left", strconv.FormatInt(request.Left, 10))
+	queryParams.Set("compact", "1")
+	if request.Event != "" {
+		queryParams.Set("event", request.Event)
+	}
+	// Construct the full URL with query parameters
+	fullURL := fmt.Sprintf("%s?%s&info_hash=%s", trackerURL, queryParams.Encode(), encodedInfoHash)
+	// Send GET request to the tracker
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fullURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tracker URL: %v", err)
+	}
+	trace.Record(trace.Event{
+		Conn:    trackerURL,
+		Dir:     trace.Out,
+		Kind:    trace.TrackerRequest,
+		Summary: fmt.Sprintf("event=%q uploaded=%d downloaded=%d left=%d port=%d", request.Event, request.Uploaded, request.Downloaded, request.Left, request.Port),
+		Data:    []byte(fullURL),
+	})
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		trace.Record(trace.Event{Conn: trackerURL, Dir: trace.In, Kind: trace.TrackerResponse, Error: err.Error()})
+		return nil, fmt.Errorf("failed to query tracker: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	event := trace.Event{Conn: trackerURL, Dir: trace.In, Kind: trace.TrackerResponse, Summary: resp.Status, Length: len(body), Data: body}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	trace.Record(event)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tracker response: %v", err)
+	}
+	return parseResponse(body, request.Event)
+}
+
+// Decode an announce response into its peer list. A stopped event needs no
+// peers back.
+func parseResponse(body []byte, event string) ([]string, error) {
+	// Decode the bencoded response
+	decodedResponse, err := bencode.DecodeResponse(bytes.NewReader(body)) // Pass body as Reader here
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode tracker response: %v", err)
+	}
+	// Check if failure reason exists
+	if failureReason, ok := decodedResponse["failure reason"].(string); ok {
+		return nil, fmt.Errorf("tracker returned failure reason: %s", failureReason)
+	}
+	// Extract peer list from the response
+	peers, ok := decodedResponse["peers"].(string)
+	if !ok && event == EventStopped {
+		return nil, nil
+	}
+	if !ok {
+		return nil, fmt.Errorf("peers not found in tracker response")
+	}
+	// Parse the peer list (compact format) and return peer addresses
+	return ParsePeers(peers), nil
+}
+
+// Parse a compact peer list of 6-byte IPv4 address and port entries
+func ParsePeers(peers string) []string {
+	var peerList []string
+	for i := 0; i+6 <= len(peers); i += 6 {
+		ip := fmt.Sprintf("%d.%d.%d.%d", peers[i], peers[i+1], peers[i+2], peers[i+3])
+		port := int(peers[i+4])<<8 | int(peers[i+5])
+		peerList = append(peerList, fmt.Sprintf("%s:%d", ip, port))
+	}
+	return peerList
+}
+
+// Percent-encode every byte of a hex info hash for use in a tracker URL
+func ConvertToPercentEncoded(input string) (string, error) {
+	// Decode the hex string into a byte slice
+	data, err := hex.DecodeString(input)
+	if err != nil {
+		return "", fmt.Errorf("invalid info hash: %v", err)
+	}
+	// Convert each byte to a percent-encoded string
+	var builder strings.Builder
+	for _, b := range data {
+		builder.WriteString(fmt.Sprintf("%%%02x", b))
+	}
+	return builder.String(), nil
+}
@@ -0,0 +1,92 @@
+package tracker
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePeers(t *testing.T) {
+	peers := ParsePeers("\x7f\x00\x00\x01\x1a\xe1\xc0\xa8\x01\x02\x00\x50\x01")
+	if want := []string{"127.0.0.1:6881", "192.168.1.2:80"}; !reflect.DeepEqual(peers, want) {
+		t.Errorf("ParsePeers = %v, want %v", peers, want)
+	}
+}
+
+func TestParseResponse(t *testing.T) {
+	peers, err := parseResponse([]byte("d8:intervali900e5:peers6:\x7f\x00\x00\x01\x1a\xe1e"), "")
+	if err != nil || !reflect.DeepEqual(peers, []string{"127.0.0.1:6881"}) {
+		t.Errorf("parseResponse = %v, %v", peers, err)
+	}
+	if _, err := parseResponse([]byte("d14:failure reason9:forbiddene"), ""); err == nil || !strings.Contains(err.Error(), "forbidden") {
+		t.Errorf("failure reason not reported: %v", err)
+	}
+	if _, err := parseResponse([]byte("d8:intervali900ee"), ""); err == nil {
+		t.Error("response without peers accepted")
+	}
+	if peers, err := parseResponse([]byte("d8:intervali900ee"), EventStopped); err != nil || peers != nil {
+		t.Errorf("stopped announce = %v, %v", peers, err)
+	}
+	if _, err := parseResponse([]byte("li1ee"), ""); err == nil {
+		t.Error("non-dictionary response accepted")
+	}
+}
+
+// Every complete 6-byte entry yields one address; a trailing partial entry is dropped
+func FuzzParsePeers(f *testing.F) {
+	f.Add("\x7f\x00\x00\x01\x1a\xe1")
+	f.Add("\x7f\x00\x00\x01\x1a\xe1\xc0\xa8\x01\x02\x00")
+	f.Fuzz(func(t *testing.T, peers string) {
+		addresses := ParsePeers(peers)
+		if len(addresses) != len(peers)/6 {
+			t.Fatalf("%d addresses from %d bytes", len(addresses), len(peers))
+		}
+		for _, address := range addresses {
+			if _, _, err := net.SplitHostPort(address); err != nil {
+				t.Fatalf("malformed address %q", address)
+			}
+		}
+	})
+}
+
+func FuzzParseResponse(f *testing.F) {
+	f.Add([]byte("d8:intervali900e5:peers6:\x7f\x00\x00\x01\x1a\xe1e"), "")
+	f.Add([]byte("d14:failure reason9:forbiddene"), "")
+	f.Add([]byte("d8:intervali900ee"), EventStopped)
+	f.Fuzz(func(t *testing.T, body []byte, event string) {
+		peers, err := parseResponse(body, event)
+		if err != nil && peers != nil {
+			t.Fatalf("peers %v returned with error %v", peers, err)
+		}
+	})
+}
+
+// Packets carrying any action get a valid connection ID patched in, so the
+// fuzzer reaches the announce and scrape parsers
+func FuzzHandleUDP(f *testing.F) {
+	connect := binary.BigEndian.AppendUint64(nil, udpProtocolID)
+	connect = binary.BigEndian.AppendUint32(connect, udpActionConnect)
+	connect = binary.BigEndian.AppendUint32(connect, 7)
+	f.Add(connect)
+	announce := make([]byte, 98)
+	binary.BigEndian.PutUint32(announce[8:], udpActionAnnounce)
+	f.Add(announce)
+	scrape := make([]byte, 36)
+	binary.BigEndian.PutUint32(scrape[8:], udpActionScrape)
+	f.Add(scrape)
+	s := NewServer()
+	secret := make([]byte, 32)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881}
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		if len(packet) >= 16 && binary.BigEndian.Uint32(packet[8:]) != udpActionConnect {
+			epoch := time.Now().Unix() / int64(udpConnectionLifetime/time.Second)
+			binary.BigEndian.PutUint64(packet, udpConnectionID(secret, addr, epoch))
+		}
+		if response := s.handleUDP(packet, addr, secret); response != nil && len(response) < 8 {
+			t.Fatalf("response of %d bytes", len(response))
+		}
+	})
+}
@@ -0,0 +1,172 @@
+package tracker
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// BEP 15 UDP tracker protocol
+const (
+	udpProtocolID = 0x41727101980
+
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+
+	// Connection IDs stay valid for at least this long
+	udpConnectionLifetime = 2 * time.Minute
+	// Info hashes a single scrape may ask about
+	udpMaxScrape = 74
+)
+
+var udpEvents = []string{"", EventCompleted, EventStarted, EventStopped}
+
+// Answer UDP tracker requests on conn until it is closed. Connection IDs are
+// derived from the client address and the time, so no per-client state is
+// kept before an announce.
+func (s *Server) ServeUDP(conn net.PacketConn) error {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	buffer := make([]byte, 2048)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		if response := s.handleUDP(buffer[:n], udpAddr, secret); response != nil {
+			conn.WriteTo(response, addr)
+		}
+	}
+}
+
+func udpConnectionID(secret []byte, addr *net.UDPAddr, epoch int64) uint64 {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(addr.IP.To16())
+	binary.Write(mac, binary.BigEndian, uint16(addr.Port))
+	binary.Write(mac, binary.BigEndian, epoch)
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+func validConnectionID(secret []byte, addr *net.UDPAddr, id uint64) bool {
+	epoch := time.Now().Unix() / int64(udpConnectionLifetime/time.Second)
+	return id == udpConnectionID(secret, addr, epoch) || id == udpConnectionID(secret, addr, epoch-1)
+}
+
+func udpHeader(action uint32, transactionID uint32) []byte {
+	header := binary.BigEndian.AppendUint32(nil, action)
+	return binary.BigEndian.AppendUint32(header, transactionID)
+}
+
+func udpError(transactionID uint32, message string) []byte {
+	return append(udpHeader(udpActionError, transactionID), message...)
+}
+
+// Build the response to one packet, or nil to ignore it
+func (s *Server) handleUDP(packet []byte, addr *net.UDPAddr, secret []byte) []byte {
+	if len(packet) < 16 {
+		return nil
+	}
+	connectionID := binary.BigEndian.Uint64(packet[0:])
+	action := binary.BigEndian.Uint32(packet[8:])
+	transactionID := binary.BigEndian.Uint32(packet[12:])
+	if action == udpActionConnect {
+		if connectionID != udpProtocolID {
+			return nil
+		}
+		epoch := time.Now().Unix() / int64(udpConnectionLifetime/time.Second)
+		return binary.BigEndian.AppendUint64(udpHeader(udpActionConnect, transactionID), udpConnectionID(secret, addr, epoch))
+	}
+	if !validConnectionID(secret, addr, connectionID) {
+		return udpError(transactionID, "invalid connection id")
+	}
+	switch action {
+	case udpActionAnnounce:
+		return s.handleUDPAnnounce(packet, addr, transactionID)
+	case udpActionScrape:
+		return s.handleUDPScrape(packet, transactionID)
+	}
+	return udpError(transactionID, "unknown action")
+}
+
+func (s *Server) handleUDPAnnounce(packet []byte, addr *net.UDPAddr, transactionID uint32) []byte {
+	if len(packet) < 98 {
+		return udpError(transactionID, "malformed announce")
+	}
+	a := Announcement{
+		IP:         addr.IP,
+		Downloaded: int64(binary.BigEndian.Uint64(packet[56:])),
+		Left:       int64(binary.BigEndian.Uint64(packet[64:])),
+		Uploaded:   int64(binary.BigEndian.Uint64(packet[72:])),
+		NumWant:    int(int32(binary.BigEndian.Uint32(packet[92:]))),
+		Port:       int(binary.BigEndian.Uint16(packet[96:])),
+	}
+	copy(a.InfoHash[:], packet[16:36])
+	copy(a.PeerID[:], packet[36:56])
+	event := binary.BigEndian.Uint32(packet[80:])
+	if event >= uint32(len(udpEvents)) {
+		return udpError(transactionID, "invalid event")
+	}
+	a.Event = udpEvents[event]
+	// The IP field is ignored; peers are reached at the address they sent from
+	result, err := s.Announce(a)
+	log := logger.With("info_hash", fmt.Sprintf("%x", a.InfoHash), "peer", net.JoinHostPort(a.IP.String(), strconv.Itoa(a.Port)), "event", a.Event, "udp", true)
+	if err != nil {
+		log.Debug("announce refused", "error", err)
+		return udpError(transactionID, err.Error())
+	}
+	log.Debug("announce", "left", a.Left, "peers", len(result.Peers))
+	response := udpHeader(udpActionAnnounce, transactionID)
+	response = binary.BigEndian.AppendUint32(response, uint32(result.Interval/time.Second))
+	response = binary.BigEndian.AppendUint32(response, uint32(result.Incomplete))
+	response = binary.BigEndian.AppendUint32(response, uint32(result.Complete))
+	// The address family of the request decides the peer format
+	ipv4 := addr.IP.To4() != nil
+	for _, p := range result.Peers {
+		ip := p.IP.To4()
+		if !ipv4 {
+			ip = p.IP.To16()
+		} else if ip == nil {
+			continue
+		}
+		response = binary.BigEndian.AppendUint16(append(response, ip...), uint16(p.Port))
+	}
+	return response
+}
+
+func (s *Server) handleUDPScrape(packet []byte, transactionID uint32) []byte {
+	hashes := packet[16:]
+	if len(hashes) == 0 || len(hashes)%20 != 0 || len(hashes)/20 > udpMaxScrape {
+		return udpError(transactionID, "malformed scrape")
+	}
+	infoHashes := make([][20]byte, len(hashes)/20)
+	for i := range infoHashes {
+		copy(infoHashes[i][:], hashes[i*20:])
+	}
+	results := s.Scrape(infoHashes)
+	response := udpHeader(udpActionScrape, transactionID)
+	for _, infoHash := range infoHashes {
+		// Torrents outside the allowlist are reported as empty
+		result := results[infoHash]
+		response = binary.BigEndian.AppendUint32(response, uint32(result.Complete))
+		response = binary.BigEndian.AppendUint32(response, uint32(result.Downloaded))
+		response = binary.BigEndian.AppendUint32(response, uint32(result.Incomplete))
+	}
+	return response
+}
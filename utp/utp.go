@@ -0,0 +1,828 @@
+// Package utp implements the Micro Transport Protocol (BEP 29): reliable,
+// ordered streams over UDP with LEDBAT congestion control so bulk transfers
+// yield to interactive traffic.
+package utp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	utpData  = 0
+	utpFin   = 1
+	utpState = 2
+	utpReset = 3
+	utpSyn   = 4
+
+	utpVersion         = 1
+	utpHeaderSize      = 20
+	utpExtSelectiveAck = 1
+	utpMaxPayload      = 1380
+
+	utpTargetDelay     = 100 * time.Millisecond
+	utpMaxCwndIncrease = 3000
+	utpMinRTO          = 500 * time.Millisecond
+	utpMaxRTO          = 30 * time.Second
+	utpRecvWindow      = 1 << 20
+	utpMaxRetransmits  = 8
+	utpSynRetries      = 3
+	utpTickInterval    = 50 * time.Millisecond
+	utpBaseDelayWindow = 2 * time.Minute
+)
+
+const (
+	utpStateSynSent = iota
+	utpStateConnected
+	utpStateFinSent
+	utpStateClosed
+)
+
+var ErrReset = errors.New("utp: connection reset by peer")
+
+type header struct {
+	Type          uint8
+	ConnID        uint16
+	Timestamp     uint32
+	TimestampDiff uint32
+	WindowSize    uint32
+	SeqNr         uint16
+	AckNr         uint16
+	SelectiveAck  []byte
+}
+
+func (h *header) Marshal(payload []byte) []byte {
+	buf := make([]byte, utpHeaderSize, utpHeaderSize+len(h.SelectiveAck)+2+len(payload))
+	buf[0] = h.Type<<4 | utpVersion
+	if len(h.SelectiveAck) > 0 {
+		buf[1] = utpExtSelectiveAck
+	}
+	binary.BigEndian.PutUint16(buf[2:], h.ConnID)
+	binary.BigEndian.PutUint32(buf[4:], h.Timestamp)
+	binary.BigEndian.PutUint32(buf[8:], h.TimestampDiff)
+	binary.BigEndian.PutUint32(buf[12:], h.WindowSize)
+	binary.BigEndian.PutUint16(buf[16:], h.SeqNr)
+	binary.BigEndian.PutUint16(buf[18:], h.AckNr)
+	if len(h.SelectiveAck) > 0 {
+		buf = append(buf, 0, byte(len(h.SelectiveAck)))
+		buf = append(buf, h.SelectiveAck...)
+	}
+	return append(buf, payload...)
+}
+
+func parsePacket(packet []byte) (*header, []byte, error) {
+	if len(packet) < utpHeaderSize {
+		return nil, nil, errors.New("utp: packet too short")
+	}
+	if packet[0]&0x0f != utpVersion || packet[0]>>4 > utpSyn {
+		return nil, nil, errors.New("utp: invalid packet type or version")
+	}
+	h := &header{
+		Type:          packet[0] >> 4,
+		ConnID:        binary.BigEndian.Uint16(packet[2:]),
+		Timestamp:     binary.BigEndian.Uint32(packet[4:]),
+		TimestampDiff: binary.BigEndian.Uint32(packet[8:]),
+		WindowSize:    binary.BigEndian.Uint32(packet[12:]),
+		SeqNr:         binary.BigEndian.Uint16(packet[16:]),
+		AckNr:         binary.BigEndian.Uint16(packet[18:]),
+	}
+	// Walk the extension chain
+	extension := packet[1]
+	rest := packet[utpHeaderSize:]
+	for extension != 0 {
+		if len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+			return nil, nil, errors.New("utp: truncated extension")
+		}
+		if extension == utpExtSelectiveAck {
+			h.SelectiveAck = rest[2 : 2+int(rest[1])]
+		}
+		extension = rest[0]
+		rest = rest[2+int(rest[1]):]
+	}
+	return h, rest, nil
+}
+
+// Report whether sequence number a comes before b, accounting for wrap-around
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+func utpNow() uint32 {
+	return uint32(time.Now().UnixMicro())
+}
+
+type connKey struct {
+	addr string
+	id   uint16
+}
+
+// Socket multiplexes uTP connections over a single UDP socket and can both
+// dial and accept connections.
+type Socket struct {
+	conn    net.PacketConn
+	mu      sync.Mutex
+	conns   map[connKey]*conn
+	backlog chan *conn
+	done    chan struct{}
+	once    sync.Once
+}
+
+func Listen(address string) (*Socket, error) {
+	packetConn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return newSocket(packetConn), nil
+}
+
+// Run uTP over an already bound packet connection
+func newSocket(packetConn net.PacketConn) *Socket {
+	s := &Socket{
+		conn:    packetConn,
+		conns:   make(map[connKey]*conn),
+		backlog: make(chan *conn, 32),
+		done:    make(chan struct{}),
+	}
+	go s.readLoop()
+	go s.tickLoop()
+	return s
+}
+
+var (
+	defaultSocket     *Socket
+	defaultSocketErr  error
+	defaultSocketOnce sync.Once
+)
+
+// Dial a uTP connection from a shared socket bound to an ephemeral port
+func Dial(ctx context.Context, address string) (net.Conn, error) {
+	defaultSocketOnce.Do(func() {
+		defaultSocket, defaultSocketErr = Listen(":0")
+	})
+	if defaultSocketErr != nil {
+		return nil, defaultSocketErr
+	}
+	return defaultSocket.DialContext(ctx, address)
+}
+
+func (s *Socket) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.backlog:
+		return c, nil
+	case <-s.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *Socket) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+		s.mu.Lock()
+		conns := make([]*conn, 0, len(s.conns))
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.mu.Unlock()
+		for _, c := range conns {
+			c.fail(net.ErrClosed)
+		}
+		s.conn.Close()
+	})
+	return nil
+}
+
+// Connect to address, giving up when ctx is done
+func (s *Socket) DialContext(ctx context.Context, address string) (net.Conn, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	var recvID uint16
+	for {
+		var id [2]byte
+		rand.Read(id[:])
+		recvID = binary.BigEndian.Uint16(id[:])
+		if _, taken := s.conns[connKey{addr.String(), recvID}]; !taken {
+			break
+		}
+	}
+	c := newConn(s, addr, recvID, recvID+1)
+	s.conns[connKey{addr.String(), recvID}] = c
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	c.state = utpStateSynSent
+	c.seqNr = 2
+	c.sendSyn()
+	c.mu.Unlock()
+
+	select {
+	case <-c.connected:
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			c.fail(os.ErrDeadlineExceeded)
+		} else {
+			c.fail(ctx.Err())
+		}
+	case <-s.done:
+		c.fail(net.ErrClosed)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != utpStateConnected {
+		if c.err == nil {
+			c.err = os.ErrDeadlineExceeded
+		}
+		return nil, fmt.Errorf("utp: failed to connect to %s: %w", address, c.err)
+	}
+	return c, nil
+}
+
+func (s *Socket) send(addr net.Addr, packet []byte) {
+	s.conn.WriteTo(packet, addr)
+}
+
+func (s *Socket) remove(c *conn) {
+	s.mu.Lock()
+	key := connKey{c.remote.String(), c.recvID}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+	s.mu.Unlock()
+}
+
+func (s *Socket) readLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				s.Close()
+				return
+			}
+			continue
+		}
+		h, payload, err := parsePacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		s.mu.Lock()
+		c, ok := s.conns[connKey{addr.String(), h.ConnID}]
+		if !ok && h.Type == utpSyn {
+			c, ok = s.conns[connKey{addr.String(), h.ConnID + 1}]
+		}
+		s.mu.Unlock()
+		if ok {
+			c.handlePacket(h, append([]byte(nil), payload...))
+			continue
+		}
+		switch h.Type {
+		case utpSyn:
+			s.accept(addr, h)
+		case utpReset:
+		default:
+			reset := &header{Type: utpReset, ConnID: h.ConnID, Timestamp: utpNow(), AckNr: h.SeqNr}
+			s.send(addr, reset.Marshal(nil))
+		}
+	}
+}
+
+func (s *Socket) accept(addr net.Addr, syn *header) {
+	var seq [2]byte
+	rand.Read(seq[:])
+	c := newConn(s, addr, syn.ConnID+1, syn.ConnID)
+	c.state = utpStateConnected
+	c.seqNr = binary.BigEndian.Uint16(seq[:])
+	c.ackNr = syn.SeqNr
+	c.replyMicro = utpNow() - syn.Timestamp
+	c.peerWindow = syn.WindowSize
+	close(c.connected)
+	s.mu.Lock()
+	s.conns[connKey{addr.String(), c.recvID}] = c
+	s.mu.Unlock()
+	c.mu.Lock()
+	c.sendState()
+	c.mu.Unlock()
+	select {
+	case s.backlog <- c:
+	default:
+		// Nobody is accepting; refuse the connection
+		s.remove(c)
+		reset := &header{Type: utpReset, ConnID: syn.ConnID, Timestamp: utpNow(), AckNr: syn.SeqNr}
+		s.send(addr, reset.Marshal(nil))
+	}
+}
+
+func (s *Socket) tickLoop() {
+	ticker := time.NewTicker(utpTickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			conns := make([]*conn, 0, len(s.conns))
+			for _, c := range s.conns {
+				conns = append(conns, c)
+			}
+			s.mu.Unlock()
+			for _, c := range conns {
+				c.tick(now)
+			}
+		}
+	}
+}
+
+type packet struct {
+	header        header
+	payload       []byte
+	sentAt        time.Time
+	transmissions int
+}
+
+type conn struct {
+	socket         *Socket
+	remote         net.Addr
+	recvID, sendID uint16
+	connected      chan struct{}
+
+	mu         sync.Mutex
+	cond       *sync.Cond
+	state      int
+	closed     bool
+	err        error
+	seqNr      uint16
+	ackNr      uint16
+	replyMicro uint32
+
+	// Sending side
+	outbound    []*packet
+	inflight    int
+	cwnd        float64
+	peerWindow  uint32
+	rtt, rttVar time.Duration
+	rto         time.Duration
+	lastAckNr   uint16
+	dupAcks     int
+	synSentAt   time.Time
+	synTries    int
+	baseDelays  []time.Duration
+	baseStarted time.Time
+
+	// Receiving side
+	recvBuf       bytes.Buffer
+	reorder       map[uint16][]byte
+	reorderBytes  int
+	finSeq        uint16
+	finReceived   bool
+	eof           bool
+	advertised    uint32
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readTimer     *time.Timer
+	writeTimer    *time.Timer
+}
+
+func newConn(s *Socket, remote net.Addr, recvID, sendID uint16) *conn {
+	c := &conn{
+		socket:     s,
+		remote:     remote,
+		recvID:     recvID,
+		sendID:     sendID,
+		connected:  make(chan struct{}),
+		cwnd:       utpMaxPayload * 2,
+		peerWindow: utpMaxPayload,
+		rto:        time.Second,
+		reorder:    make(map[uint16][]byte),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *conn) recvWindow() uint32 {
+	used := c.recvBuf.Len() + c.reorderBytes
+	if used >= utpRecvWindow {
+		return 0
+	}
+	return uint32(utpRecvWindow - used)
+}
+
+func (c *conn) makeHeader(packetType uint8, seqNr uint16) header {
+	c.advertised = c.recvWindow()
+	return header{
+		Type:          packetType,
+		ConnID:        c.sendID,
+		TimestampDiff: c.replyMicro,
+		WindowSize:    c.advertised,
+		SeqNr:         seqNr,
+		AckNr:         c.ackNr,
+	}
+}
+
+func (c *conn) transmit(h header, payload []byte) {
+	h.Timestamp = utpNow()
+	c.socket.send(c.remote, h.Marshal(payload))
+}
+
+func (c *conn) sendSyn() {
+	h := c.makeHeader(utpSyn, 1)
+	h.ConnID = c.recvID
+	c.synSentAt = time.Now()
+	c.synTries++
+	c.transmit(h, nil)
+}
+
+// Acknowledge received data, describing out-of-order packets with a selective ack
+func (c *conn) sendState() {
+	h := c.makeHeader(utpState, c.seqNr)
+	if len(c.reorder) > 0 {
+		mask := make([]byte, 4)
+		for seq := range c.reorder {
+			bit := int(seq - c.ackNr - 2)
+			if bit < 0 || bit >= 32*8 {
+				continue
+			}
+			for bit/8 >= len(mask) {
+				mask = append(mask, 0, 0, 0, 0)
+			}
+			mask[bit/8] |= 1 << (bit % 8)
+		}
+		h.SelectiveAck = mask
+	}
+	c.transmit(h, nil)
+}
+
+// Queue a sequenced packet and transmit it; it is kept until acknowledged
+func (c *conn) sendPacket(packetType uint8, payload []byte) {
+	p := &packet{header: c.makeHeader(packetType, c.seqNr), payload: payload}
+	c.seqNr++
+	c.outbound = append(c.outbound, p)
+	c.inflight += len(payload)
+	c.resend(p)
+}
+
+func (c *conn) resend(p *packet) {
+	p.header.AckNr = c.ackNr
+	p.header.TimestampDiff = c.replyMicro
+	p.header.WindowSize = c.recvWindow()
+	p.sentAt = time.Now()
+	p.transmissions++
+	c.transmit(p.header, p.payload)
+}
+
+func (c *conn) handlePacket(h *header, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.cond.Broadcast()
+
+	c.replyMicro = utpNow() - h.Timestamp
+	c.peerWindow = h.WindowSize
+	switch h.Type {
+	case utpReset:
+		c.failLocked(ErrReset)
+		return
+	case utpSyn:
+		// Our state packet was lost; repeat it
+		c.sendState()
+		return
+	}
+	if c.state == utpStateSynSent {
+		if h.Type != utpState {
+			return
+		}
+		c.state = utpStateConnected
+		c.ackNr = h.SeqNr - 1
+		close(c.connected)
+	}
+	c.processAck(h)
+	if h.Type == utpData || h.Type == utpFin {
+		c.receive(h, payload)
+	}
+}
+
+func (c *conn) receive(h *header, payload []byte) {
+	if h.Type == utpFin && !c.finReceived {
+		c.finReceived = true
+		c.finSeq = h.SeqNr
+	}
+	switch {
+	case h.SeqNr == c.ackNr+1:
+		c.recvBuf.Write(payload)
+		c.ackNr++
+		for {
+			next, ok := c.reorder[c.ackNr+1]
+			if !ok {
+				break
+			}
+			delete(c.reorder, c.ackNr+1)
+			c.reorderBytes -= len(next)
+			c.recvBuf.Write(next)
+			c.ackNr++
+		}
+	case seqLess(c.ackNr, h.SeqNr) && h.SeqNr-c.ackNr < 1024:
+		if _, ok := c.reorder[h.SeqNr]; !ok {
+			c.reorder[h.SeqNr] = payload
+			c.reorderBytes += len(payload)
+		}
+	}
+	if c.finReceived && !seqLess(c.ackNr, c.finSeq) {
+		c.eof = true
+	}
+	c.sendState()
+}
+
+func (c *conn) processAck(h *header) {
+	now := time.Now()
+	ackedBytes := 0
+	remaining := c.outbound[:0]
+	for _, p := range c.outbound {
+		seq := p.header.SeqNr
+		acked := !seqLess(h.AckNr, seq)
+		if !acked && len(h.SelectiveAck) > 0 {
+			bit := int(seq - h.AckNr - 2)
+			acked = bit >= 0 && bit/8 < len(h.SelectiveAck) && h.SelectiveAck[bit/8]&(1<<(bit%8)) != 0
+		}
+		if !acked {
+			remaining = append(remaining, p)
+			continue
+		}
+		ackedBytes += len(p.payload)
+		c.inflight -= len(p.payload)
+		if p.transmissions == 1 {
+			c.updateRTT(now.Sub(p.sentAt))
+		}
+	}
+	c.outbound = remaining
+	if ackedBytes > 0 && c.rtt > 0 {
+		// Acks are flowing again; forget the backoff of earlier timeouts
+		c.rto = c.baseRTO()
+	}
+
+	// Three duplicate acks mean the oldest outstanding packet was lost, and
+	// three selectively acked packets past any packet mean that one was
+	var lost []*packet
+	if ackedBytes == 0 && h.Type == utpState && len(c.outbound) > 0 && h.AckNr == c.lastAckNr {
+		c.dupAcks++
+		if c.dupAcks == 3 {
+			lost = append(lost, c.outbound[0])
+		}
+	} else {
+		c.dupAcks = 0
+	}
+	var sacked []uint16
+	for bit := 0; bit < 8*len(h.SelectiveAck); bit++ {
+		if h.SelectiveAck[bit/8]&(1<<(bit%8)) != 0 {
+			sacked = append(sacked, h.AckNr+2+uint16(bit))
+		}
+	}
+	for _, p := range c.outbound {
+		if p.transmissions > 1 || len(lost) > 0 && lost[0] == p {
+			continue
+		}
+		after := 0
+		for _, seq := range sacked {
+			if seqLess(p.header.SeqNr, seq) {
+				after++
+			}
+		}
+		if after >= 3 {
+			lost = append(lost, p)
+		}
+	}
+	c.lastAckNr = h.AckNr
+	if len(lost) > 0 {
+		c.cwnd = max(c.cwnd/2, utpMaxPayload)
+		for _, p := range lost {
+			c.resend(p)
+		}
+	}
+	if ackedBytes > 0 && h.TimestampDiff != 0 {
+		c.updateCwnd(time.Duration(h.TimestampDiff)*time.Microsecond, ackedBytes)
+	}
+	if c.state == utpStateFinSent && len(c.outbound) == 0 {
+		c.state = utpStateClosed
+		c.socket.remove(c)
+	}
+}
+
+func (c *conn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.rto = c.baseRTO()
+}
+
+// Retransmission timeout from the smoothed round trip time, without backoff
+func (c *conn) baseRTO() time.Duration {
+	return min(max(c.rtt+4*c.rttVar, utpMinRTO), utpMaxRTO)
+}
+
+// LEDBAT: grow the window while the measured queuing delay is below target and
+// shrink it when it is above, keeping the link free for other traffic
+func (c *conn) updateCwnd(delay time.Duration, ackedBytes int) {
+	now := time.Now()
+	if c.baseStarted.IsZero() || now.Sub(c.baseStarted) > utpBaseDelayWindow/2 {
+		c.baseStarted = now
+		c.baseDelays = append(c.baseDelays, delay)
+		if len(c.baseDelays) > 2 {
+			c.baseDelays = c.baseDelays[1:]
+		}
+	}
+	last := len(c.baseDelays) - 1
+	c.baseDelays[last] = min(c.baseDelays[last], delay)
+	baseDelay := c.baseDelays[0]
+	for _, d := range c.baseDelays {
+		baseDelay = min(baseDelay, d)
+	}
+	ourDelay := delay - baseDelay
+	offTarget := float64(utpTargetDelay-ourDelay) / float64(utpTargetDelay)
+	windowFactor := float64(ackedBytes) / max(c.cwnd, float64(ackedBytes))
+	c.cwnd += utpMaxCwndIncrease * offTarget * windowFactor
+	c.cwnd = min(max(c.cwnd, utpMaxPayload), utpRecvWindow)
+}
+
+func (c *conn) tick(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.state {
+	case utpStateSynSent:
+		if now.Sub(c.synSentAt) < c.rto {
+			return
+		}
+		if c.synTries >= utpSynRetries {
+			c.failLocked(os.ErrDeadlineExceeded)
+			return
+		}
+		c.sendSyn()
+	case utpStateConnected, utpStateFinSent:
+		if len(c.outbound) == 0 || now.Sub(c.outbound[0].sentAt) < c.rto {
+			return
+		}
+		if c.outbound[0].transmissions >= utpMaxRetransmits {
+			c.failLocked(os.ErrDeadlineExceeded)
+			return
+		}
+		// Timeout: collapse the window and back off
+		c.cwnd = utpMaxPayload
+		c.rto = min(c.rto*2, utpMaxRTO)
+		c.resend(c.outbound[0])
+	}
+	// Tell the peer our window has reopened after the reader drained it
+	if c.advertised < utpMaxPayload && c.recvWindow() >= utpMaxPayload {
+		c.sendState()
+	}
+}
+
+func (c *conn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failLocked(err)
+}
+
+func (c *conn) failLocked(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.state = utpStateClosed
+	c.cond.Broadcast()
+	c.socket.remove(c)
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		if c.closed {
+			return 0, net.ErrClosed
+		}
+		if c.recvBuf.Len() > 0 {
+			n, _ := c.recvBuf.Read(p)
+			if c.advertised < utpMaxPayload && c.recvWindow() >= utpMaxPayload {
+				c.sendState()
+			}
+			return n, nil
+		}
+		if c.eof {
+			return 0, io.EOF
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+		if !c.readDeadline.IsZero() && !time.Now().Before(c.readDeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.cond.Wait()
+	}
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	written := 0
+	for written < len(p) {
+		if c.closed {
+			return written, net.ErrClosed
+		}
+		if c.err != nil {
+			return written, c.err
+		}
+		if !c.writeDeadline.IsZero() && !time.Now().Before(c.writeDeadline) {
+			return written, os.ErrDeadlineExceeded
+		}
+		chunk := min(len(p)-written, utpMaxPayload)
+		window := min(int(c.cwnd), int(c.peerWindow))
+		if c.inflight > 0 && c.inflight+chunk > window {
+			c.cond.Wait()
+			continue
+		}
+		payload := append([]byte(nil), p[written:written+chunk]...)
+		c.sendPacket(utpData, payload)
+		written += chunk
+	}
+	return written, nil
+}
+
+func (c *conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if c.state == utpStateConnected {
+		c.sendPacket(utpFin, nil)
+		c.state = utpStateFinSent
+	} else if c.state != utpStateFinSent {
+		c.state = utpStateClosed
+		c.socket.remove(c)
+	}
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *conn) LocalAddr() net.Addr {
+	return c.socket.Addr()
+}
+
+func (c *conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.readTimer = c.armDeadline(c.readTimer, t)
+	return nil
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.writeTimer = c.armDeadline(c.writeTimer, t)
+	return nil
+}
+
+// Wake blocked readers and writers once the deadline passes
+func (c *conn) armDeadline(timer *time.Timer, t time.Time) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+	}
+	if t.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(t), func() {
+		c.mu.Lock()
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	})
+}
@@ -0,0 +1,275 @@
+package utp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// lossyConn drops every nth packet written through it
+type lossyConn struct {
+	net.PacketConn
+	n       int64
+	written atomic.Int64
+	dropped atomic.Int64
+}
+
+func (c *lossyConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if c.n > 0 && c.written.Add(1)%c.n == 0 {
+		c.dropped.Add(1)
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+// Start a uTP socket on loopback that drops every nth packet it sends, or
+// none when n is 0
+func startSocket(t *testing.T, n int64) (*Socket, *lossyConn) {
+	t.Helper()
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lossy := &lossyConn{PacketConn: packetConn, n: n}
+	s := newSocket(lossy)
+	t.Cleanup(func() { s.Close() })
+	return s, lossy
+}
+
+// Dial from one socket to the other, returning both ends of the connection
+func connectPair(t *testing.T, dialer, listener *Socket) (net.Conn, net.Conn) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := listener.Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+	dialed, err := dialer.DialContext(ctx, listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dialed.Close() })
+	select {
+	case c := <-accepted:
+		t.Cleanup(func() { c.Close() })
+		return dialed, c
+	case <-ctx.Done():
+		t.Fatal("connection was never accepted")
+	}
+	return nil, nil
+}
+
+func TestParsePacketRoundTrip(t *testing.T) {
+	h := header{
+		Type:          utpState,
+		ConnID:        0xbeef,
+		Timestamp:     123456,
+		TimestampDiff: 789,
+		WindowSize:    utpRecvWindow,
+		SeqNr:         65535,
+		AckNr:         42,
+		SelectiveAck:  []byte{0x05, 0, 0, 0x80},
+	}
+	parsed, payload, err := parsePacket(h.Marshal([]byte("payload")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*parsed, h) {
+		t.Errorf("parsed %+v, want %+v", *parsed, h)
+	}
+	if string(payload) != "payload" {
+		t.Errorf("payload %q, want %q", payload, "payload")
+	}
+	for _, packet := range [][]byte{
+		make([]byte, utpHeaderSize-1),
+		append([]byte{utpData<<4 | 2}, make([]byte, utpHeaderSize-1)...), // version 2
+		append([]byte{7<<4 | utpVersion}, make([]byte, utpHeaderSize-1)...),
+		append([]byte{utpState<<4 | utpVersion, utpExtSelectiveAck}, make([]byte, utpHeaderSize-2+3)...)[:utpHeaderSize+1],
+	} {
+		if _, _, err := parsePacket(packet); err == nil {
+			t.Errorf("parsed invalid packet %x", packet)
+		}
+	}
+}
+
+func TestSeqLessWrapsAround(t *testing.T) {
+	for _, test := range []struct {
+		a, b uint16
+		want bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{5, 5, false},
+		{65535, 0, true},
+		{0, 65535, false},
+		{65000, 100, true},
+	} {
+		if got := seqLess(test.a, test.b); got != test.want {
+			t.Errorf("seqLess(%d, %d) = %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestDialAndAccept(t *testing.T) {
+	a, _ := startSocket(t, 0)
+	b, _ := startSocket(t, 0)
+	dialed, accepted := connectPair(t, a, b)
+	if got, want := accepted.RemoteAddr().String(), a.Addr().String(); got != want {
+		t.Errorf("accepted connection from %s, want %s", got, want)
+	}
+	if _, err := dialed.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	accepted.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(accepted, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+	if _, err := accepted.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	dialed.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(dialed, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+}
+
+func TestDialTimesOutWithoutAnswer(t *testing.T) {
+	a, _ := startSocket(t, 0)
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := a.DialContext(ctx, silent.LocalAddr().String()); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("dial: %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	a, _ := startSocket(t, 0)
+	b, _ := startSocket(t, 0)
+	_, accepted := connectPair(t, a, b)
+	accepted.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := accepted.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("read: %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+}
+
+// Send size bytes from one end to the other and check they arrive intact
+func transfer(t *testing.T, from, to net.Conn, size int) {
+	t.Helper()
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	written := make(chan error, 1)
+	go func() {
+		_, err := from.Write(data)
+		written <- err
+	}()
+	received := make([]byte, size)
+	to.SetReadDeadline(time.Now().Add(20 * time.Second))
+	if _, err := io.ReadFull(to, received); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatal("received data differs from what was sent")
+	}
+}
+
+func TestTransferLargerThanWindow(t *testing.T) {
+	a, _ := startSocket(t, 0)
+	b, _ := startSocket(t, 0)
+	dialed, accepted := connectPair(t, a, b)
+	// Three times the receive window, so the sender has to wait for the
+	// reader to drain it and reopen the window
+	transfer(t, dialed, accepted, 3*utpRecvWindow)
+	transfer(t, accepted, dialed, 64<<10)
+}
+
+func TestTransferWithPacketLoss(t *testing.T) {
+	// Data packets and acks both get lost
+	a, aLoss := startSocket(t, 7)
+	b, bLoss := startSocket(t, 11)
+	dialed, accepted := connectPair(t, a, b)
+	transfer(t, dialed, accepted, 512<<10)
+	if aLoss.dropped.Load() == 0 || bLoss.dropped.Load() == 0 {
+		t.Fatalf("dropped %d and %d packets, want losses in both directions", aLoss.dropped.Load(), bLoss.dropped.Load())
+	}
+}
+
+func TestCloseSendsFin(t *testing.T) {
+	a, _ := startSocket(t, 0)
+	b, _ := startSocket(t, 0)
+	dialed, accepted := connectPair(t, a, b)
+	if _, err := dialed.Write([]byte("last words")); err != nil {
+		t.Fatal(err)
+	}
+	if err := dialed.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dialed.Write([]byte("more")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("write after close: %v, want %v", err, net.ErrClosed)
+	}
+	accepted.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := io.ReadAll(accepted)
+	if err != nil {
+		t.Fatalf("read until FIN: %v", err)
+	}
+	if string(data) != "last words" {
+		t.Errorf("read %q before EOF, want %q", data, "last words")
+	}
+	// Once the FIN is acknowledged the closing side forgets the connection
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		a.mu.Lock()
+		open := len(a.conns)
+		a.mu.Unlock()
+		if open == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections still registered after the FIN was acknowledged", open)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSocketCloseFailsConnections(t *testing.T) {
+	a, _ := startSocket(t, 0)
+	b, _ := startSocket(t, 0)
+	dialed, _ := connectPair(t, a, b)
+	done := make(chan error, 1)
+	go func() {
+		_, err := dialed.Read(make([]byte, 1))
+		done <- err
+	}()
+	a.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("read: %v, want %v", err, net.ErrClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read still blocked after the socket closed")
+	}
+	if _, err := a.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("accept: %v, want %v", err, net.ErrClosed)
+	}
+}